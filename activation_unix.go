@@ -0,0 +1,53 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const sdListenFDsStart = 3
+
+// activatedListeners returns the sockets passed in by systemd socket
+// activation, or nil when the process wasn't socket-activated. The LISTEN_*
+// variables are cleared so child processes don't mistake them for their own.
+func activatedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listenersFromFDs(sdListenFDsStart, n)
+}
+
+// listenersFromFDs wraps n consecutive inherited file descriptors starting at
+// start as listeners.
+func listenersFromFDs(start, n int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, n)
+	for fd := start; fd < start+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestActivatedListeners(t *testing.T) {
+	Convey("Given socket activation environment variables", t, func() {
+		Convey("They are ignored when LISTEN_PID names another process", func() {
+			t.Setenv("LISTEN_PID", "1")
+			t.Setenv("LISTEN_FDS", "1")
+			ls, err := activatedListeners()
+			So(err, ShouldBeNil)
+			So(ls, ShouldBeNil)
+		})
+
+		Convey("They are ignored when unset", func() {
+			t.Setenv("LISTEN_PID", "")
+			os.Unsetenv("LISTEN_PID")
+			ls, err := activatedListeners()
+			So(err, ShouldBeNil)
+			So(ls, ShouldBeNil)
+		})
+
+		Convey("They are ignored when LISTEN_FDS is malformed", func() {
+			t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+			t.Setenv("LISTEN_FDS", "x")
+			ls, err := activatedListeners()
+			So(err, ShouldBeNil)
+			So(ls, ShouldBeNil)
+		})
+	})
+
+	Convey("Given an inherited TCP socket", t, func() {
+		orig, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer orig.Close()
+		f, err := orig.(*net.TCPListener).File()
+		So(err, ShouldBeNil)
+
+		Convey("listenersFromFDs wraps it as a listener on the same address", func() {
+			ls, err := listenersFromFDs(int(f.Fd()), 1)
+			So(err, ShouldBeNil)
+			So(ls, ShouldHaveLength, 1)
+			defer ls[0].Close()
+			So(ls[0].Addr().String(), ShouldEqual, orig.Addr().String())
+
+			Convey("openListeners serves the API on it", func() {
+				tcp, sock, url, err := openListeners(ls)
+				So(err, ShouldBeNil)
+				So(tcp, ShouldEqual, ls[0])
+				So(sock, ShouldBeNil)
+				So(url, ShouldEqual, "http://"+orig.Addr().String())
+			})
+		})
+	})
+}
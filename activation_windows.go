@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// activatedListeners always returns nil; socket activation is a systemd
+// feature.
+func activatedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// activityTracker records who is using the editor: open SSE streams (browser
+// tabs, app windows and scripts such as mermaid-cli watch), MCP sessions,
+// and the time of the last API request.
+type activityTracker struct {
+	mu       sync.Mutex
+	streams  int
+	browsers int // the streams of browser tabs and app windows
+	last     time.Time
+	mcp      *mcp.Server
+}
+
+// activity tracks this process's clients for idle shutdown and /api/status.
+var activity = &activityTracker{last: time.Now()}
+
+// touch records API traffic.
+func (a *activityTracker) touch() {
+	a.mu.Lock()
+	a.last = time.Now()
+	a.mu.Unlock()
+}
+
+// streamOpened and streamClosed bracket an SSE subscription by a client of
+// kind. Closing the last stream starts the idle clock rather than inheriting
+// its age.
+func (a *activityTracker) streamOpened(kind string) {
+	a.mu.Lock()
+	a.streams++
+	if kind == clientBrowser {
+		a.browsers++
+	}
+	a.last = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *activityTracker) streamClosed(kind string) {
+	a.mu.Lock()
+	a.streams--
+	if kind == clientBrowser {
+		a.browsers--
+	}
+	a.last = time.Now()
+	a.mu.Unlock()
+}
+
+// setMCPServer makes the tracker count the sessions of s.
+func (a *activityTracker) setMCPServer(s *mcp.Server) {
+	a.mu.Lock()
+	a.mcp = s
+	a.mu.Unlock()
+}
+
+// clients returns the number of open SSE streams, the browsers among them,
+// and MCP sessions.
+func (a *activityTracker) clients() (streams, browsers, sessions int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.mcp != nil {
+		for range a.mcp.Sessions() {
+			sessions++
+		}
+	}
+	return a.streams, a.browsers, sessions
+}
+
+// idleFor returns how long nobody has been connected or made a request.
+func (a *activityTracker) idleFor() time.Duration {
+	streams, _, sessions := a.clients()
+	if streams > 0 || sessions > 0 {
+		a.touch()
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Since(a.last)
+}
+
+// watchIdle calls quit once the editor has been idle for timeout. It checks
+// often enough to overshoot the timeout by at most a quarter.
+func watchIdle(timeout time.Duration, quit func()) {
+	interval := min(max(timeout/4, 10*time.Millisecond), 30*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if activity.idleFor() >= timeout {
+			log.Printf("No clients for %s, shutting down", timeout)
+			quit()
+			return
+		}
+	}
+}
+
+// startIdleWatch enables idle shutdown if --idle-timeout is set.
+func startIdleWatch() {
+	if cfg.IdleTimeout > 0 {
+		go watchIdle(time.Duration(cfg.IdleTimeout), requestQuit)
+	}
+}
+
+// trackActivity counts every request except status polls as API traffic, so
+// a tool checking on the editor doesn't keep it alive.
+func trackActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" {
+			activity.touch()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// currentStatus describes this instance and who is connected to it, for
+// GET /api/status and the SSE status event.
+func currentStatus() map[string]any {
+	streams, browsers, sessions := activity.clients()
+	return map[string]any{
+		"version":   version,
+		"pid":       os.Getpid(),
+		"url":       serverURL,
+		"workspace": workspaceRoot(),
+		"clients": map[string]int{
+			"browsers": browsers,
+			"agents":   sessions,
+			"streams":  streams,
+		},
+		"idle_seconds":         int(activity.idleFor().Seconds()),
+		"idle_timeout_seconds": int(time.Duration(cfg.IdleTimeout).Seconds()),
+	}
+}
+
+// handleStatus reports this instance and who is connected to it.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentStatus())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// useTestActivity gives the enclosing Convey scope a fresh activity tracker.
+func useTestActivity() {
+	orig := activity
+	activity = &activityTracker{last: time.Now()}
+	Reset(func() { activity = orig })
+}
+
+func TestActivityTracker(t *testing.T) {
+	Convey("Given a fresh activity tracker", t, func() {
+		useTestActivity()
+
+		Convey("An open SSE stream keeps the editor from going idle", func() {
+			activity.last = time.Now().Add(-time.Hour)
+			activity.streamOpened(clientBrowser)
+			activity.last = time.Now().Add(-time.Hour)
+			So(activity.idleFor(), ShouldEqual, 0)
+
+			activity.streamClosed(clientBrowser)
+			So(activity.idleFor(), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("The idle clock counts from the last request", func() {
+			activity.last = time.Now().Add(-time.Hour)
+			So(activity.idleFor(), ShouldBeGreaterThanOrEqualTo, time.Hour)
+			activity.touch()
+			So(activity.idleFor(), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("MCP sessions count as connected agents", func() {
+			s := mcp.NewServer(&mcp.Implementation{Name: "test"}, nil)
+			activity.setMCPServer(s)
+
+			st, ct := mcp.NewInMemoryTransports()
+			ss, err := s.Connect(context.Background(), st, nil)
+			So(err, ShouldBeNil)
+			cs, err := mcp.NewClient(&mcp.Implementation{Name: "agent"}, nil).Connect(context.Background(), ct, nil)
+			So(err, ShouldBeNil)
+
+			_, _, sessions := activity.clients()
+			So(sessions, ShouldEqual, 1)
+
+			cs.Close()
+			ss.Wait()
+			_, _, sessions = activity.clients()
+			So(sessions, ShouldEqual, 0)
+		})
+
+		Convey("Status polls don't count as traffic", func() {
+			activity.last = time.Now().Add(-time.Hour)
+			handler := trackActivity(http.HandlerFunc(handleStatus))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/status", nil))
+			So(activity.idleFor(), ShouldBeGreaterThanOrEqualTo, time.Hour)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/diagram", nil))
+			So(activity.idleFor(), ShouldBeLessThan, time.Second)
+		})
+	})
+}
+
+func TestWatchIdle(t *testing.T) {
+	Convey("Given an idle watcher", t, func() {
+		useTestActivity()
+		quit := make(chan struct{})
+		requestQuit := func() { close(quit) }
+
+		Convey("It quits once nobody has been connected for the timeout", func() {
+			go watchIdle(50*time.Millisecond, requestQuit)
+			select {
+			case <-quit:
+			case <-time.After(2 * time.Second):
+				So("watchIdle did not quit", ShouldBeEmpty)
+			}
+		})
+
+		Convey("It doesn't quit while a browser is connected", func() {
+			activity.streamOpened(clientBrowser)
+			go watchIdle(50*time.Millisecond, requestQuit)
+			select {
+			case <-quit:
+				So("watchIdle quit with a stream open", ShouldBeEmpty)
+			case <-time.After(200 * time.Millisecond):
+			}
+			activity.streamClosed(clientBrowser)
+			<-quit
+		})
+	})
+}
+
+func TestHandleStatus(t *testing.T) {
+	Convey("Given an instance with one browser and one watcher connected", t, func() {
+		useTestActivity()
+		activity.streamOpened(clientBrowser)
+		activity.streamOpened("cli")
+
+		w := httptest.NewRecorder()
+		handleStatus(w, httptest.NewRequest("GET", "/api/status", nil))
+
+		Convey("GET /api/status reports the connected clients", func() {
+			var out struct {
+				PID     int            `json:"pid"`
+				Clients map[string]int `json:"clients"`
+				Idle    int            `json:"idle_seconds"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.PID, ShouldBeGreaterThan, 0)
+			So(out.Clients, ShouldResemble, map[string]int{"browsers": 1, "agents": 0, "streams": 2})
+			So(out.Idle, ShouldEqual, 0)
+		})
+	})
+}
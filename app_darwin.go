@@ -45,17 +45,36 @@ func maybeFocusApp() {
 
 func handleQuit(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
+	requestQuit()
+}
+
+// requestQuit shuts the editor down. With a window open it terminates the
+// app, whose run loop calls back into shutdown.
+func requestQuit() {
+	if cfg.NoBrowser || cfg.MCP {
+		// Headless: there is no app run loop to terminate.
+		signalQuit()
+		return
+	}
 	C.terminateApp()
 }
 
 func main() {
-	if isMCPMode() {
+	setupConfig()
+	if runSubcommand() {
+		return
+	}
+	if cfg.MCP {
 		runMCP()
 		return
 	}
 	if !startServer() {
 		return
 	}
+	if cfg.NoBrowser {
+		waitForSignal()
+		return
+	}
 	curl := C.CString(serverURL)
 	defer C.free(unsafe.Pointer(curl))
 	C.runApp(curl)
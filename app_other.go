@@ -3,11 +3,7 @@
 package main
 
 import (
-	"context"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
 )
 
 func handleFocus(w http.ResponseWriter, r *http.Request) {
@@ -18,25 +14,30 @@ func maybeFocusApp() {}
 
 func handleQuit(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
-	go func() {
-		shutdown()
-		os.Exit(0)
-	}()
+	requestQuit()
+}
+
+// requestQuit asks the main goroutine to shut the editor down. It returns at
+// once so an HTTP handler can finish its response first.
+func requestQuit() {
+	signalQuit()
 }
 
 func main() {
-	if isMCPMode() {
+	setupConfig()
+	if runSubcommand() {
+		return
+	}
+	if cfg.MCP {
 		runMCP()
 		return
 	}
 	if !startServer() {
 		return
 	}
-	go openBrowser(serverURL)
-
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
-	defer stop()
-	<-ctx.Done()
+	if !cfg.NoBrowser {
+		go openBrowser(serverURL)
+	}
 
-	shutdown()
+	waitForSignal()
 }
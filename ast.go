@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Diagram kinds the parser understands statement by statement. Other diagram
+// types are recognized by their header and kept as plain statements.
+const (
+	kindFlowchart = "flowchart"
+	kindSequence  = "sequence"
+	kindClass     = "class"
+	kindState     = "state"
+	kindER        = "er"
+)
+
+// Kinds of Statement.
+const (
+	stmtBlank       = "blank"
+	stmtComment     = "comment"
+	stmtDirective   = "directive" // %%{init: …}%% or front matter
+	stmtHeader      = "header"
+	stmtOpen        = "open"    // subgraph, loop, state X {, …
+	stmtSection     = "section" // else, and, option, or -- in a state
+	stmtClose       = "close"   // end, }, end note
+	stmtNode        = "node"
+	stmtEdge        = "edge"
+	stmtParticipant = "participant"
+	stmtMessage     = "message"
+	stmtNote        = "note"
+	stmtMember      = "member" // a class member, entity attribute or note line
+	stmtStyle       = "style"  // classDef, class, style, linkStyle, cssClass
+	stmtDirection   = "direction"
+	stmtOther       = "other"
+)
+
+// Pos is a position in the diagram text.
+type Pos struct {
+	Offset int `json:"offset"` // in bytes from the start
+	Line   int `json:"line"`   // from 1
+	Col    int `json:"col"`    // in characters, from 1
+}
+
+// Span is a range of the diagram text.
+type Span struct {
+	Start Pos `json:"start"`
+	End   Pos `json:"end"`
+}
+
+// ParseError is a problem the parser found, and where.
+type ParseError struct {
+	Span    Span   `json:"span"`
+	Message string `json:"message"`
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Span.Start.Line, e.Span.Start.Col, e.Message)
+}
+
+// Statement is one statement of the diagram, usually a line.
+type Statement struct {
+	Kind  string `json:"kind"`
+	Text  string `json:"text"` // without indentation or a trailing semicolon
+	Span  Span   `json:"span"`
+	Depth int    `json:"depth"` // how many blocks it is nested in
+}
+
+// Node is a flowchart node, a state, a class or an entity.
+type Node struct {
+	ID       string   `json:"id"`
+	Label    string   `json:"label"`
+	Shape    string   `json:"shape"`
+	Classes  []string `json:"classes,omitempty"`
+	Subgraph string   `json:"subgraph,omitempty"` // the innermost subgraph, composite state or namespace
+	Members  []string `json:"members,omitempty"`  // class members or entity attributes
+	// Span is where the node is defined: its first mention with a label or
+	// shape, or else its first mention.
+	Span Span      `json:"span"`
+	Refs []NodeRef `json:"-"`
+}
+
+// NodeRef is one mention of a node in the text.
+type NodeRef struct {
+	ID        Span   // the id
+	Span      Span   // the id with its shape, label and classes
+	Label     string // the label given here, if any
+	Shape     string // the shape given here, if any
+	LabelSpan Span   // the label as written, with any quotes
+	Quoted    bool
+	Stmt      int // index into Diagram.Statements
+}
+
+// Edge is a flowchart link, a state transition or a class or entity
+// relationship.
+type Edge struct {
+	ID        string `json:"id,omitempty"` // a flowchart edge's own id, as in A e1@--> B
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Arrow     string `json:"arrow"` // without its text, e.g. -->, -.->, <|--, ||--o{
+	Label     string `json:"label,omitempty"`
+	FromLabel string `json:"from_label,omitempty"` // cardinality at From, in class diagrams
+	ToLabel   string `json:"to_label,omitempty"`
+	Index     int    `json:"index"` // counting from 0 in source order, as linkStyle does
+	Span      Span   `json:"span"`  // from the start of From to the end of To
+	ArrowSpan Span   `json:"-"`     // the arrow with its id and text
+	Stmt      int    `json:"-"`
+}
+
+// Subgraph is a flowchart subgraph, a composite state or a class namespace.
+type Subgraph struct {
+	ID        string   `json:"id"`
+	Title     string   `json:"title"`
+	Parent    string   `json:"parent,omitempty"`
+	Direction string   `json:"direction,omitempty"`
+	Nodes     []string `json:"nodes"`
+	Span      Span     `json:"span"` // from the opening line to its end
+	Header    Span     `json:"-"`
+	Stmt      int      `json:"-"`
+}
+
+// Participant is a sequence diagram participant or actor.
+type Participant struct {
+	ID       string `json:"id"`
+	Label    string `json:"label"`
+	Kind     string `json:"kind"` // participant or actor
+	Declared bool   `json:"declared"`
+	Box      string `json:"box,omitempty"`
+	Span     Span   `json:"span"` // the declaration, or else the first mention
+	Refs     []Span `json:"-"`
+	Stmt     int    `json:"-"`
+}
+
+// Message is a sequence diagram message.
+type Message struct {
+	Index      int    `json:"index"` // from 1, in source order
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Arrow      string `json:"arrow"`
+	Text       string `json:"text"`
+	Activate   bool   `json:"activate,omitempty"`
+	Deactivate bool   `json:"deactivate,omitempty"`
+	Block      int    `json:"block"` // index into Diagram.Blocks of the innermost block, or -1
+	Span       Span   `json:"span"`
+	Stmt       int    `json:"-"`
+}
+
+// Note is a note in a sequence or state diagram.
+type Note struct {
+	Position string   `json:"position"` // left of, right of or over
+	Actors   []string `json:"actors"`
+	Text     string   `json:"text"`
+	Span     Span     `json:"span"`
+	Stmt     int      `json:"-"`
+}
+
+// Block is a sequence diagram block: loop, alt, opt, par, critical, break,
+// rect or box.
+type Block struct {
+	Kind     string    `json:"kind"`
+	Label    string    `json:"label"`
+	Parent   int       `json:"parent"` // index into Diagram.Blocks, or -1
+	Sections []Section `json:"sections,omitempty"`
+	Span     Span      `json:"span"`
+	Stmt     int       `json:"-"`
+}
+
+// Section is an else, and or option branch of a Block.
+type Section struct {
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+	Span  Span   `json:"span"`
+}
+
+// ClassDef is a classDef statement: styles nodes take on with class or :::.
+type ClassDef struct {
+	Name   string `json:"name"`
+	Styles string `json:"styles"`
+	Span   Span   `json:"span"`
+}
+
+// Style is a style or linkStyle statement.
+type Style struct {
+	Target string `json:"target"` // the node id, or for linkStyle the link index or default
+	Link   bool   `json:"link,omitempty"`
+	Styles string `json:"styles"`
+	Span   Span   `json:"span"`
+}
+
+// Diagram is a parsed Mermaid diagram.
+type Diagram struct {
+	Kind       string      `json:"kind"`
+	Header     string      `json:"header"` // the diagram keyword as written, e.g. graph or stateDiagram-v2
+	Direction  string      `json:"direction,omitempty"`
+	Statements []Statement `json:"statements"`
+
+	Nodes     []*Node     `json:"nodes,omitempty"`
+	Edges     []*Edge     `json:"edges,omitempty"`
+	Subgraphs []*Subgraph `json:"subgraphs,omitempty"`
+
+	Participants []*Participant `json:"participants,omitempty"`
+	Messages     []*Message     `json:"messages,omitempty"`
+	Notes        []*Note        `json:"notes,omitempty"`
+	Blocks       []*Block       `json:"blocks,omitempty"`
+
+	ClassDefs []*ClassDef `json:"class_defs,omitempty"`
+	Styles    []*Style    `json:"styles,omitempty"`
+
+	Errors []ParseError `json:"errors,omitempty"`
+
+	nodes        map[string]*Node
+	participants map[string]*Participant
+}
+
+// Node returns the node with id, or nil.
+func (d *Diagram) Node(id string) *Node {
+	return d.nodes[id]
+}
+
+// Participant returns the participant with id, or nil.
+func (d *Diagram) Participant(id string) *Participant {
+	return d.participants[id]
+}
+
+// Subgraph returns the subgraph with id, or nil.
+func (d *Diagram) Subgraph(id string) *Subgraph {
+	for _, sg := range d.Subgraphs {
+		if sg.ID == id {
+			return sg
+		}
+	}
+	return nil
+}
+
+// Mentions returns every place id is named, in order: the mentions of the
+// node or participant, and the style, class and click statements naming it.
+func (d *Diagram) Mentions(id string) []Span {
+	var spans []Span
+	if n := d.Node(id); n != nil {
+		for _, r := range n.Refs {
+			spans = append(spans, r.ID)
+		}
+	}
+	if p := d.Participant(id); p != nil {
+		spans = append(spans, p.Refs...)
+	}
+	for _, st := range d.Statements {
+		word, rest := firstWord(st.Text)
+		if !(st.Kind == stmtStyle && (word == "style" || word == "class") || d.Kind == kindFlowchart && word == "click") {
+			continue
+		}
+		ids, _ := firstWord(rest)
+		i := len(st.Text) - len(rest)
+		for _, name := range strings.Split(ids, ",") {
+			if strings.TrimSpace(name) == id {
+				at := i + strings.Index(name, id)
+				start := Pos{Offset: st.Span.Start.Offset + at, Line: st.Span.Start.Line, Col: st.Span.Start.Col + utf8.RuneCountInString(st.Text[:at])}
+				end := Pos{Offset: start.Offset + len(id), Line: start.Line, Col: start.Col + utf8.RuneCountInString(id)}
+				spans = append(spans, Span{Start: start, End: end})
+			}
+			i += len(name) + 1
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Offset < spans[j].Start.Offset })
+	return spans
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// lineAuthor is the revision that last changed a line.
+type lineAuthor struct {
+	Source  string
+	Client  string
+	Version int64
+}
+
+// BlameRange attributes lines From to To of the diagram, counting from 1, to
+// the revision that last changed them.
+type BlameRange struct {
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+	Source  string `json:"source"`
+	Client  string `json:"client,omitempty"`
+	Version int64  `json:"version"`
+}
+
+// reblame returns the authors of the lines of next, given the authors of the
+// lines of prev: lines kept from prev keep their author, and the rest are
+// attributed to author.
+func reblame(authors []lineAuthor, prev, next string, author lineAuthor) []lineAuthor {
+	o, n := splitLines(prev), splitLines(next)
+	out := make([]lineAuthor, len(n))
+	for i := range out {
+		out[i] = author
+	}
+	if len(authors) != len(o) {
+		return out
+	}
+
+	// Most edits touch a few lines; only match up the ones in between.
+	pre := 0
+	for pre < len(o) && pre < len(n) && o[pre] == n[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(o)-pre && suf < len(n)-pre && o[len(o)-1-suf] == n[len(n)-1-suf] {
+		suf++
+	}
+	copy(out, authors[:pre])
+	copy(out[len(n)-suf:], authors[len(o)-suf:])
+	for i, j := range matchLines(o[pre:len(o)-suf], n[pre:len(n)-suf]) {
+		if j >= 0 {
+			out[pre+j] = authors[pre+i]
+		}
+	}
+	return out
+}
+
+// Blame attributes each line of the current diagram to the revision that
+// last changed it, as runs of lines with the same author. Lines from before
+// the editor started are attributed to version 1 and source "initial".
+func (d *DiagramState) Blame() ([]BlameRange, int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ranges := []BlameRange{}
+	for i, a := range d.authors {
+		if n := len(ranges); n > 0 && ranges[n-1].To == i && ranges[n-1].Version == a.Version {
+			ranges[n-1].To++
+			continue
+		}
+		ranges = append(ranges, BlameRange{From: i + 1, To: i + 1, Source: a.Source, Client: a.Client, Version: a.Version})
+	}
+	return ranges, d.version
+}
+
+// handleGetBlame returns the line attribution of the current diagram.
+func (d *DiagramState) handleGetBlame(w http.ResponseWriter, r *http.Request) {
+	ranges, version := d.Blame()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version": version,
+		"lines":   ranges,
+	})
+}
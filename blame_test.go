@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBlame(t *testing.T) {
+	Convey("Given a DiagramState", t, func() {
+		ds := NewDiagramState("graph TD\n  A-->B")
+
+		Convey("The initial lines are attributed to version 1", func() {
+			lines, version := ds.Blame()
+			So(version, ShouldEqual, 1)
+			So(lines, ShouldResemble, []BlameRange{{From: 1, To: 2, Source: "initial", Version: 1}})
+		})
+
+		Convey("Changed and added lines are attributed to their writer", func() {
+			ds.SetBy("graph TD\n  A-->B\n  B-->C\n  C-->D", "mcp", "mcp-1")
+			ds.SetBy("graph TD\n  A-->X\n  B-->C\n  C-->D", "browser", "tab-1")
+
+			lines, version := ds.Blame()
+			So(version, ShouldEqual, 3)
+			So(lines, ShouldResemble, []BlameRange{
+				{From: 1, To: 1, Source: "initial", Version: 1},
+				{From: 2, To: 2, Source: "browser", Client: "tab-1", Version: 3},
+				{From: 3, To: 4, Source: "mcp", Client: "mcp-1", Version: 2},
+			})
+		})
+
+		Convey("Removed lines don't shift the attribution of the rest", func() {
+			ds.SetBy("graph TD\n  A-->B\n  B-->C", "mcp", "mcp-1")
+			ds.SetBy("graph TD\n  B-->C", "browser", "tab-1")
+
+			lines, _ := ds.Blame()
+			So(lines, ShouldResemble, []BlameRange{
+				{From: 1, To: 1, Source: "initial", Version: 1},
+				{From: 2, To: 2, Source: "mcp", Client: "mcp-1", Version: 2},
+			})
+		})
+
+		Convey("Typing into a line attributes it to the typist", func() {
+			_, err := ds.Apply(1, []TextChange{{From: 15, To: 16, Insert: "Bee"}}, "browser", "tab-1", "")
+			So(err, ShouldBeNil)
+
+			lines, _ := ds.Blame()
+			So(lines, ShouldHaveLength, 2)
+			So(lines[1], ShouldResemble, BlameRange{From: 2, To: 2, Source: "browser", Client: "tab-1", Version: 2})
+		})
+
+		Convey("Attribution outlives the revision history", func() {
+			ds.SetBy("graph TD\n  A-->B\n  B-->C", "mcp", "mcp-1")
+			for i := 0; i < historySize+1; i++ {
+				content, _ := ds.Get()
+				ds.SetBy(content+"\n  %% note", "browser", "tab-1")
+			}
+
+			lines, _ := ds.Blame()
+			So(lines[1], ShouldResemble, BlameRange{From: 3, To: 3, Source: "mcp", Client: "mcp-1", Version: 2})
+		})
+
+		Convey("GET /api/diagram/blame returns the attribution", func() {
+			ds.SetBy("graph TD\n  A-->B\n  B-->C", "mcp", "mcp-1")
+			rec := httptest.NewRecorder()
+			ds.handleGetBlame(rec, httptest.NewRequest("GET", "/api/diagram/blame", nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+
+			var resp struct {
+				Version int64        `json:"version"`
+				Lines   []BlameRange `json:"lines"`
+			}
+			So(json.Unmarshal(rec.Body.Bytes(), &resp), ShouldBeNil)
+			So(resp.Version, ShouldEqual, 2)
+			So(resp.Lines, ShouldHaveLength, 2)
+			So(resp.Lines[1].Source, ShouldEqual, "mcp")
+		})
+	})
+}
+
+func TestReblame(t *testing.T) {
+	Convey("reblame", t, func() {
+		a := lineAuthor{Source: "mcp", Version: 2}
+		b := lineAuthor{Source: "browser", Version: 3}
+
+		Convey("Appending to a last line without a newline keeps its author", func() {
+			authors := reblame(nil, "", "graph TD", a)
+			So(reblame(authors, "graph TD", "graph TD\n  A-->B", b), ShouldResemble, []lineAuthor{a, b})
+		})
+
+		Convey("Emptying the diagram leaves no lines", func() {
+			authors := reblame(nil, "", "graph TD", a)
+			So(reblame(authors, "graph TD", "", b), ShouldBeEmpty)
+		})
+
+		Convey("Lines moved around keep their author where they can", func() {
+			authors := reblame(nil, "", "x\ny\nz", a)
+			So(reblame(authors, "x\ny\nz", "y\nz\nx", b), ShouldResemble, []lineAuthor{a, a, b})
+		})
+	})
+}
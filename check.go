@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// markdownExtensions are the extensions of the markdown files check looks
+// for mermaid blocks in.
+var markdownExtensions = map[string]bool{".md": true, ".markdown": true}
+
+// checkExtensions are the extensions of the files check looks at when given
+// a directory.
+var checkExtensions = map[string]bool{".mmd": true, ".mermaid": true, ".md": true, ".markdown": true}
+
+// markdownFenceRe matches the line opening a markdown code block, giving its
+// fence and info string.
+var markdownFenceRe = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})(.*)$")
+
+// embeddedDiagram is a mermaid block in a markdown file.
+type embeddedDiagram struct {
+	Text   string
+	Line   int // of the first line of the diagram, from 1
+	Offset int // in bytes from the start of the file
+}
+
+// markdownDiagrams returns the mermaid blocks in markdown text, fenced with
+// ```mermaid or ~~~mermaid.
+func markdownDiagrams(src string) []embeddedDiagram {
+	var diagrams []embeddedDiagram
+	var fence string // of the block we are in, if any
+	var cur *embeddedDiagram
+	offset := 0
+	for i, line := range strings.SplitAfter(src, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch m := markdownFenceRe.FindStringSubmatch(trimmed); {
+		case fence == "" && m != nil:
+			fence = m[1]
+			if info, _ := firstWord(strings.TrimSpace(m[2])); info == "mermaid" {
+				cur = &embeddedDiagram{Line: i + 2, Offset: offset + len(line)}
+			}
+		case fence != "" && m != nil && m[1][0] == fence[0] && len(m[1]) >= len(fence) && strings.TrimSpace(m[2]) == "":
+			if cur != nil {
+				cur.Text = src[cur.Offset:offset]
+				diagrams = append(diagrams, *cur)
+			}
+			fence, cur = "", nil
+		}
+		offset += len(line)
+	}
+	// A block left open runs to the end of the file.
+	if cur != nil && cur.Offset <= len(src) {
+		cur.Text = src[cur.Offset:]
+		diagrams = append(diagrams, *cur)
+	}
+	return diagrams
+}
+
+// checkSource lints a diagram file, or each mermaid block of a markdown
+// file, with positions in the file.
+func checkSource(name, src string, c LintConfig) []LintIssue {
+	if !markdownExtensions[filepath.Ext(name)] {
+		return LintDiagram(src, c)
+	}
+	issues := []LintIssue{}
+	for _, d := range markdownDiagrams(src) {
+		shift := func(p Pos) Pos {
+			return Pos{Offset: p.Offset + d.Offset, Line: p.Line + d.Line - 1, Col: p.Col}
+		}
+		for _, i := range LintDiagram(d.Text, c) {
+			i.Span = Span{Start: shift(i.Span.Start), End: shift(i.Span.End)}
+			issues = append(issues, i)
+		}
+	}
+	return issues
+}
+
+// checkResult is the issues found in one file.
+type checkResult struct {
+	File   string      `json:"file"`
+	Issues []LintIssue `json:"issues"`
+}
+
+// runCheck implements `mermaid-editor check [-format text|json|sarif]
+// [-strict] [path ...]`. It lints the diagram files and the mermaid blocks
+// of the markdown files under each path, or the current directory, using
+// the lint config of each file's project. It exits with 1 if any issue is
+// an error, or with -strict a warning, and with 2 if a file or config
+// couldn't be read. It needs no browser and no running editor.
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text, json or sarif")
+	strict := fs.Bool("strict", false, "fail on warnings as well as errors")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mermaid-editor check [-format text|json|sarif] [-strict] [path ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *format != "text" && *format != "json" && *format != "sarif" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	results, failed := checkPaths(paths, os.Stderr)
+	var errors, warnings int
+	for _, r := range results {
+		e, w := lintCounts(r.Issues)
+		errors += e
+		warnings += w
+	}
+
+	switch *format {
+	case "json":
+		writeJSON(os.Stdout, results)
+	case "sarif":
+		writeJSON(os.Stdout, sarifReport(results))
+	default:
+		for _, r := range results {
+			for _, i := range r.Issues {
+				fmt.Printf("%s:%s\n", r.File, i)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%d files checked: %d errors, %d warnings\n", len(results), errors, warnings)
+	}
+	switch {
+	case failed:
+		os.Exit(2)
+	case errors > 0 || *strict && warnings > 0:
+		os.Exit(1)
+	}
+}
+
+// checkPaths checks the files under paths, writing the problems reading
+// them to errs and reporting whether there were any.
+func checkPaths(paths []string, errs io.Writer) ([]checkResult, bool) {
+	results := []checkResult{}
+	failed := false
+	configs := map[string]LintConfig{}
+	for _, path := range paths {
+		files, err := filesUnder(path, checkExtensions)
+		if err != nil {
+			fmt.Fprintln(errs, err)
+			failed = true
+		}
+		for _, file := range files {
+			dir := filepath.Dir(file)
+			c, ok := configs[dir]
+			if !ok {
+				if c, err = loadLintConfig(dir); err != nil {
+					fmt.Fprintln(errs, err)
+					failed = true
+					continue
+				}
+				configs[dir] = c
+			}
+			src, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Fprintln(errs, err)
+				failed = true
+				continue
+			}
+			results = append(results, checkResult{File: file, Issues: checkSource(file, string(src), c)})
+		}
+	}
+	return results, failed
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(w io.Writer, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// SARIF 2.1.0, as read by code scanning services, trimmed to what check
+// reports.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string       `json:"id"`
+	ShortDescription     sarifMessage `json:"shortDescription"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region struct {
+			StartLine   int `json:"startLine"`
+			StartColumn int `json:"startColumn"`
+			EndLine     int `json:"endLine"`
+			EndColumn   int `json:"endColumn"`
+		} `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+// sarifLevel maps a severity to a SARIF level.
+func sarifLevel(severity string) string {
+	if severity == severityInfo {
+		return "note"
+	}
+	return severity
+}
+
+// sarifReport converts check results to a SARIF log.
+func sarifReport(results []checkResult) sarifLog {
+	driver := sarifDriver{
+		Name:           "mermaid-editor",
+		Version:        version,
+		InformationURI: "https://github.com/kmatthias/mermaid-editor",
+		Rules:          []sarifRule{},
+	}
+	for _, r := range lintRules {
+		rule := sarifRule{ID: r.id, ShortDescription: sarifMessage{r.summary}}
+		rule.DefaultConfiguration.Level = sarifLevel(r.severity)
+		driver.Rules = append(driver.Rules, rule)
+	}
+	run := sarifRun{Tool: sarifTool{Driver: driver}, Results: []sarifResult{}}
+	for _, r := range results {
+		uri := filepath.ToSlash(r.File)
+		if filepath.IsAbs(r.File) {
+			uri = "file://" + uri
+		}
+		for _, i := range r.Issues {
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = uri
+			region := &loc.PhysicalLocation.Region
+			region.StartLine, region.StartColumn = i.Span.Start.Line, i.Span.Start.Col
+			region.EndLine, region.EndColumn = i.Span.End.Line, i.Span.End.Col
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    i.Rule,
+				Level:     sarifLevel(i.Severity),
+				Message:   sarifMessage{i.Message},
+				Locations: []sarifLocation{loc},
+			})
+		}
+	}
+	return sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMarkdownDiagrams(t *testing.T) {
+	Convey("markdownDiagrams", t, func() {
+		Convey("Finds mermaid blocks fenced with backticks or tildes", func() {
+			src := "# Title\n\n```mermaid\ngraph TD\n  A --> B\n```\n\ntext\n\n~~~ mermaid\nsequenceDiagram\n~~~\n"
+			diagrams := markdownDiagrams(src)
+			So(diagrams, ShouldHaveLength, 2)
+			So(diagrams[0].Text, ShouldEqual, "graph TD\n  A --> B\n")
+			So(diagrams[0].Line, ShouldEqual, 4)
+			So(src[diagrams[0].Offset:], ShouldStartWith, "graph TD")
+			So(diagrams[1].Text, ShouldEqual, "sequenceDiagram\n")
+			So(diagrams[1].Line, ShouldEqual, 11)
+		})
+
+		Convey("Skips other code blocks, and fences inside them", func() {
+			src := "````markdown\n```mermaid\ngraph TD\n```\n````\n```js\nx\n```\n"
+			So(markdownDiagrams(src), ShouldBeEmpty)
+		})
+
+		Convey("Takes a block left open to the end of the file", func() {
+			diagrams := markdownDiagrams("```mermaid\ngraph TD")
+			So(diagrams, ShouldHaveLength, 1)
+			So(diagrams[0].Text, ShouldEqual, "graph TD")
+		})
+	})
+}
+
+func TestCheck(t *testing.T) {
+	Convey("Given a repository with diagrams", t, func() {
+		root := t.TempDir()
+		os.MkdirAll(filepath.Join(root, "docs"), 0755)
+		os.MkdirAll(filepath.Join(root, "node_modules", "dep"), 0755)
+		good := filepath.Join(root, "good.mmd")
+		doc := filepath.Join(root, "docs", "design.md")
+		os.WriteFile(good, []byte("graph TD\n  A --> B\n"), 0644)
+		os.WriteFile(doc, []byte("# Design\n\n```mermaid\ngraph TD\n  A --> end\n```\n"), 0644)
+		os.WriteFile(filepath.Join(root, "node_modules", "dep", "README.md"), []byte("```mermaid\nnot a diagram\n```\n"), 0644)
+
+		Convey("Issues in markdown are placed in the file", func() {
+			results, failed := checkPaths([]string{root}, &bytes.Buffer{})
+			So(failed, ShouldBeFalse)
+			So(results, ShouldHaveLength, 2)
+			So(results[0].File, ShouldEqual, doc)
+			So(rules(results[0].Issues), ShouldResemble, []string{"reserved-id"})
+			So(results[0].Issues[0].String(), ShouldStartWith, "5:9: error: ")
+			So(results[1].File, ShouldEqual, good)
+			So(results[1].Issues, ShouldBeEmpty)
+		})
+
+		Convey("The project lint config applies", func() {
+			os.WriteFile(filepath.Join(root, lintConfigFile), []byte(`{"rules": {"reserved-id": "warning"}}`), 0644)
+			results, _ := checkPaths([]string{doc}, &bytes.Buffer{})
+			So(results[0].Issues[0].Severity, ShouldEqual, severityWarning)
+		})
+
+		Convey("Missing paths are reported as failures", func() {
+			var errs bytes.Buffer
+			_, failed := checkPaths([]string{filepath.Join(root, "missing")}, &errs)
+			So(failed, ShouldBeTrue)
+			So(errs.String(), ShouldContainSubstring, "missing")
+		})
+
+		Convey("SARIF output gives each issue's rule, level and region", func() {
+			results, _ := checkPaths([]string{doc}, &bytes.Buffer{})
+			report := sarifReport(results)
+			So(report.Version, ShouldEqual, "2.1.0")
+			run := report.Runs[0]
+			So(run.Tool.Driver.Rules, ShouldHaveLength, len(lintRules))
+			So(run.Results, ShouldHaveLength, 1)
+			So(run.Results[0].RuleID, ShouldEqual, "reserved-id")
+			So(run.Results[0].Level, ShouldEqual, "error")
+			loc := run.Results[0].Locations[0].PhysicalLocation
+			So(loc.ArtifactLocation.URI, ShouldEqual, "file://"+filepath.ToSlash(doc))
+			So(loc.Region.StartLine, ShouldEqual, 5)
+			So(loc.Region.StartColumn, ShouldEqual, 9)
+			So(sarifLevel(severityInfo), ShouldEqual, "note")
+		})
+	})
+}
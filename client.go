@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// socketHost is the placeholder host used in request URLs sent over the Unix
+// socket; the transport ignores it and dials the socket instead.
+const socketHost = "http://unix"
+
+// Client talks to a running editor instance over its HTTP API. It prefers
+// the instance's Unix socket, which only the current user can reach, and
+// falls back to TCP where there is no socket.
+type Client struct {
+	// URL is the instance's browser-facing address.
+	URL string
+
+	base string
+	http *http.Client
+}
+
+// newHTTPClient returns a Client that talks to baseURL over TCP,
+// authenticating with token.
+func newHTTPClient(baseURL, token string) *Client {
+	transport := &tokenTransport{base: http.DefaultTransport, token: token}
+	return &Client{URL: baseURL, base: baseURL, http: &http.Client{Transport: transport}}
+}
+
+// newSocketClient returns a Client that sends every request over the Unix
+// socket at path, authenticating with token. url is kept for opening the UI
+// in a browser.
+func newSocketClient(path, url, token string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{
+		URL:  url,
+		base: socketHost,
+		http: &http.Client{Transport: &tokenTransport{base: transport, token: token}},
+	}
+}
+
+// existingClient returns a Client for the instance running in the current
+// scope, or nil if there is none.
+func existingClient() *Client {
+	return existingClientIn(stateDir())
+}
+
+// existingClientIn returns a Client for the instance whose state lives in
+// dir, or nil if it isn't running.
+func existingClientIn(dir string) *Client {
+	url := checkExistingIn(dir)
+	if url == "" {
+		return nil
+	}
+	token := readToken(dir)
+	sock := filepath.Join(dir, "sock")
+	if info, err := os.Stat(sock); err == nil && info.Mode()&os.ModeSocket != 0 {
+		c := newSocketClient(sock, url, token)
+		if c.ping() {
+			return c
+		}
+	}
+	return newHTTPClient(url, token)
+}
+
+// ping reports whether the instance answers on this client's transport.
+func (c *Client) ping() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := c.do(ctx, "GET", "/api/diagram", nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.http.Do(req)
+}
+
+// GetDiagram returns the instance's current diagram and version.
+func (c *Client) GetDiagram() (string, int64, error) {
+	resp, err := c.do(context.Background(), "GET", "/api/diagram", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("GET /api/diagram returned %s", resp.Status)
+	}
+	var out struct {
+		Content string `json:"content"`
+		Version int64  `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", 0, err
+	}
+	return out.Content, out.Version, nil
+}
+
+// SetDiagram replaces the instance's diagram and returns the new version.
+func (c *Client) SetDiagram(content, source string) (int64, error) {
+	resp, err := c.do(context.Background(), "PUT", "/api/diagram", map[string]string{
+		"content": content,
+		"source":  source,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("PUT /api/diagram returned %s", resp.Status)
+	}
+	var out struct {
+		Version int64 `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return out.Version, nil
+}
+
+// Focus asks the instance to bring its window to the front. It reports
+// whether the instance handled it.
+func (c *Client) Focus() bool {
+	resp, err := c.do(context.Background(), "POST", "/api/focus", nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent
+}
@@ -0,0 +1,66 @@
+//go:build !windows
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSocketClient(t *testing.T) {
+	Convey("Given an instance serving its API on a Unix socket", t, func() {
+		tmp := useTestStateDir(t)
+		ds := NewDiagramState("graph TD")
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /api/diagram", ds.handleGetDiagram)
+		mux.HandleFunc("PUT /api/diagram", ds.handleSetDiagram)
+
+		sock, err := listenSocket(filepath.Join(tmp, "sock"))
+		So(err, ShouldBeNil)
+		srv := &http.Server{Handler: mux}
+		go srv.Serve(sock)
+		Reset(func() { srv.Close() })
+
+		os.WriteFile(filepath.Join(tmp, "pid"), []byte(strconv.Itoa(os.Getpid())), 0644)
+		os.WriteFile(filepath.Join(tmp, "port"), []byte("1"), 0644)
+
+		Convey("The socket is only accessible to the current user", func() {
+			info, err := os.Stat(filepath.Join(tmp, "sock"))
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+			entries, _ := os.ReadDir(tmp)
+			for _, e := range entries {
+				So(e.IsDir(), ShouldBeFalse) // the directory it was made in is gone
+			}
+		})
+
+		Convey("existingClient prefers the socket over the TCP port", func() {
+			c := existingClient()
+			So(c, ShouldNotBeNil)
+			So(c.base, ShouldEqual, socketHost)
+			So(c.URL, ShouldEqual, "http://127.0.0.1:1")
+
+			v, err := c.SetDiagram("graph LR; A-->B", "cli")
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, 2)
+
+			content, version, err := c.GetDiagram()
+			So(err, ShouldBeNil)
+			So(content, ShouldEqual, "graph LR; A-->B")
+			So(version, ShouldEqual, 2)
+		})
+
+		Convey("A dead socket falls back to TCP", func() {
+			srv.Close()
+			c := existingClient()
+			So(c, ShouldNotBeNil)
+			So(c.base, ShouldEqual, "http://127.0.0.1:1")
+		})
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// eventClients is the SSE event listing the connected clients.
+const eventClients = "clients"
+
+// Kinds of client the server tells apart. Scripts following the event
+// stream name their own, e.g. "cli".
+const (
+	clientBrowser = "browser"
+	clientMCP     = "mcp"
+)
+
+// ClientInfo describes one connected client: a browser tab, an MCP session,
+// or a script following the event stream.
+type ClientInfo struct {
+	ID          string     `json:"id"`
+	Kind        string     `json:"kind"`
+	Name        string     `json:"name"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	LastActive  time.Time  `json:"last_active"`
+	Selection   *Selection `json:"selection,omitempty"`
+
+	conns int // open streams or sessions; a client is gone when it has none
+}
+
+// clientRegistry tracks the connected clients. The zero value is ready to use.
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[string]*ClientInfo
+	seq     map[string]int // clients seen so far per kind, for default names
+}
+
+// newClientID returns a random id for a client that didn't bring its own.
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// connect records a connection by client id and reports whether the client
+// is new. A client without a name is called after its kind, e.g.
+// "browser 2".
+func (c *clientRegistry) connect(id, kind, name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients == nil {
+		c.clients = make(map[string]*ClientInfo)
+		c.seq = make(map[string]int)
+	}
+	if info, ok := c.clients[id]; ok {
+		info.conns++
+		return false
+	}
+	if name == "" {
+		c.seq[kind]++
+		name = fmt.Sprintf("%s %d", kind, c.seq[kind])
+	}
+	now := time.Now()
+	c.clients[id] = &ClientInfo{ID: id, Kind: kind, Name: name, ConnectedAt: now, LastActive: now, conns: 1}
+	return true
+}
+
+// disconnect records a connection by client id closing and reports whether
+// that was its last, so the client is gone.
+func (c *clientRegistry) disconnect(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, ok := c.clients[id]
+	if !ok {
+		return false
+	}
+	if info.conns--; info.conns > 0 {
+		return false
+	}
+	delete(c.clients, id)
+	return true
+}
+
+// touch records activity by client id, if it is connected.
+func (c *clientRegistry) touch(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, ok := c.clients[id]; ok {
+		info.LastActive = time.Now()
+	}
+}
+
+// kind returns the kind client id connected as, or "" if it isn't connected.
+func (c *clientRegistry) kind(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, ok := c.clients[id]; ok {
+		return info.Kind
+	}
+	return ""
+}
+
+// setSelection records the selection of a connected client.
+func (c *clientRegistry) setSelection(sel Selection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, ok := c.clients[sel.Client]; ok {
+		info.Selection = &sel
+		info.LastActive = time.Now()
+	}
+}
+
+// list returns the connected clients, longest connected first.
+func (c *clientRegistry) list() []ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]ClientInfo, 0, len(c.clients))
+	for _, info := range c.clients {
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].ConnectedAt.Equal(list[j].ConnectedAt) {
+			return list[i].ConnectedAt.Before(list[j].ConnectedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Connect lists a client as connected, announcing it to the other clients
+// if it is new. Every Connect must be matched by a Disconnect.
+func (d *DiagramState) Connect(id, kind, name string) {
+	if d.clients.connect(id, kind, name) {
+		d.Publish(eventClients, d.Clients())
+	}
+}
+
+// Disconnect undoes a Connect, announcing the client's departure once its
+// last connection closes.
+func (d *DiagramState) Disconnect(id string) {
+	if d.clients.disconnect(id) {
+		d.Publish(eventClients, d.Clients())
+	}
+}
+
+// Clients returns the connected clients.
+func (d *DiagramState) Clients() []ClientInfo {
+	return d.clients.list()
+}
+
+// handleGetClients lists the connected clients.
+func (d *DiagramState) handleGetClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"clients": d.Clients(),
+	})
+}
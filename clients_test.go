@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClientRegistry(t *testing.T) {
+	Convey("Given an empty client registry", t, func() {
+		var c clientRegistry
+
+		Convey("Connected clients are listed in the order they came", func() {
+			c.connect("b", "browser", "")
+			c.connect("a", "mcp", "claude")
+			list := c.list()
+			So(list, ShouldHaveLength, 2)
+			So(list[0].ID, ShouldEqual, "b")
+			So(list[0].Name, ShouldEqual, "browser 1")
+			So(list[1].Name, ShouldEqual, "claude")
+		})
+
+		Convey("A client stays until its last connection closes", func() {
+			So(c.connect("a", "browser", ""), ShouldBeTrue)
+			So(c.connect("a", "browser", ""), ShouldBeFalse)
+			So(c.disconnect("a"), ShouldBeFalse)
+			So(c.list(), ShouldHaveLength, 1)
+			So(c.disconnect("a"), ShouldBeTrue)
+			So(c.list(), ShouldBeEmpty)
+		})
+
+		Convey("Activity by a client is recorded", func() {
+			c.connect("a", "cli", "")
+			before := c.list()[0].LastActive
+			time.Sleep(time.Millisecond)
+			c.touch("a")
+			So(c.list()[0].LastActive, ShouldHappenAfter, before)
+			So(c.list()[0].ConnectedAt, ShouldEqual, before)
+		})
+
+		Convey("A selection is recorded for its client", func() {
+			c.connect("a", "browser", "")
+			c.setSelection(Selection{From: 1, To: 3, Source: "browser", Client: "a"})
+			c.setSelection(Selection{From: 4, To: 5, Source: "browser", Client: "unknown"})
+			So(c.list()[0].Selection, ShouldResemble, &Selection{From: 1, To: 3, Source: "browser", Client: "a"})
+		})
+
+		Convey("Disconnecting an unknown client is harmless", func() {
+			So(func() { c.disconnect("nobody") }, ShouldNotPanic)
+		})
+	})
+}
+
+func TestHandleGetClients(t *testing.T) {
+	Convey("Given a DiagramState with a connected browser", t, func() {
+		ds := NewDiagramState("graph TD")
+		ds.Connect("tab-1", clientBrowser, "")
+		events := ds.Listen()
+		defer ds.Unlisten(events)
+
+		Convey("GET /api/clients lists it", func() {
+			w := httptest.NewRecorder()
+			ds.handleGetClients(w, httptest.NewRequest("GET", "/api/clients", nil))
+
+			var out struct {
+				Clients []ClientInfo `json:"clients"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Clients, ShouldHaveLength, 1)
+			So(out.Clients[0].ID, ShouldEqual, "tab-1")
+			So(out.Clients[0].Kind, ShouldEqual, "browser")
+			So(out.Clients[0].Name, ShouldEqual, "browser 1")
+		})
+
+		Convey("Its departure is announced in a clients event", func() {
+			ds.Disconnect("tab-1")
+			event := <-events
+			So(event.Type, ShouldEqual, eventClients)
+			So(event.Data, ShouldBeEmpty)
+		})
+	})
+}
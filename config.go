@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the editor's startup options. Values come from, in increasing
+// order of precedence: the global config file, MERMAID_EDITOR_* environment
+// variables, and command-line flags.
+type Config struct {
+	Addr      string `json:"addr"`
+	Port      int    `json:"port"`
+	NoBrowser bool   `json:"no_browser"`
+	StateDir  string `json:"state_dir"`
+	LogLevel  string `json:"log_level"`
+	Workspace string `json:"workspace"`
+
+	// IdleTimeout shuts the editor down after this long without a browser,
+	// agent or API request. Zero keeps it running.
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	// Set only from the command line.
+	MCP  bool     `json:"-"`
+	File string   `json:"-"`
+	Args []string `json:"-"` // subcommand name and its arguments
+}
+
+// Duration is a time.Duration written as a string such as "30m" in the config
+// file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// cfg is the configuration of the running process.
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{Addr: "127.0.0.1", LogLevel: "info"}
+}
+
+// subcommands don't start an editor; their arguments are left unparsed for
+// the subcommand itself.
+var subcommands = map[string]bool{
+	"check":   true,
+	"fmt":     true,
+	"lint":    true,
+	"list":    true,
+	"lsp":     true,
+	"service": true,
+	"url":     true,
+}
+
+// configFile returns the path of the optional global config file.
+func configFile() string {
+	if p := os.Getenv("MERMAID_EDITOR_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mermaid-editor", "config.json")
+}
+
+// loadConfig builds the configuration from the config file, the environment
+// and args (os.Args[1:]).
+func loadConfig(args []string) (Config, error) {
+	c := defaultConfig()
+	if path := configFile(); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			if err := json.Unmarshal(data, &c); err != nil {
+				return c, fmt.Errorf("%s: %w", path, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return c, err
+		}
+	}
+	if err := applyEnv(&c); err != nil {
+		return c, err
+	}
+	if err := parseFlags(&c, args); err != nil {
+		return c, err
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func applyEnv(c *Config) error {
+	if v, ok := os.LookupEnv("MERMAID_EDITOR_ADDR"); ok {
+		c.Addr = v
+	}
+	if v, ok := os.LookupEnv("MERMAID_EDITOR_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MERMAID_EDITOR_PORT: %w", err)
+		}
+		c.Port = port
+	}
+	if v, ok := os.LookupEnv("MERMAID_EDITOR_NO_BROWSER"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("MERMAID_EDITOR_NO_BROWSER: %w", err)
+		}
+		c.NoBrowser = b
+	}
+	if v, ok := os.LookupEnv("MERMAID_EDITOR_STATE_DIR"); ok {
+		c.StateDir = v
+	}
+	if v, ok := os.LookupEnv("MERMAID_EDITOR_LOG_LEVEL"); ok {
+		c.LogLevel = v
+	}
+	if v, ok := os.LookupEnv("MERMAID_EDITOR_WORKSPACE"); ok {
+		c.Workspace = v
+	}
+	if v, ok := os.LookupEnv("MERMAID_EDITOR_IDLE_TIMEOUT"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("MERMAID_EDITOR_IDLE_TIMEOUT: %w", err)
+		}
+		c.IdleTimeout = Duration(d)
+	}
+	return nil
+}
+
+// parseFlags applies command-line flags to c. Flags may appear before or
+// after the file argument; everything after a subcommand name belongs to the
+// subcommand.
+func parseFlags(c *Config, args []string) error {
+	fs := flag.NewFlagSet("mermaid-editor", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&c.MCP, "mcp", c.MCP, "run as an MCP server over stdio")
+	fs.StringVar(&c.Workspace, "workspace", c.Workspace, `scope the instance to a directory, "git" or "roots"`)
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	fs.IntVar(&c.Port, "port", c.Port, "port to listen on (0 picks a free port)")
+	fs.BoolVar(&c.NoBrowser, "no-browser", c.NoBrowser, "don't open a browser or app window")
+	fs.StringVar(&c.StateDir, "state-dir", c.StateDir, "directory for pid, port and other state files")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "debug, info, warn or error")
+	fs.DurationVar((*time.Duration)(&c.IdleTimeout), "idle-timeout", time.Duration(c.IdleTimeout), "shut down after this long with no clients (0 disables)")
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				fs.SetOutput(os.Stderr)
+				fs.Usage()
+			}
+			return err
+		}
+		if fs.NArg() == 0 {
+			return nil
+		}
+		arg := fs.Arg(0)
+		if c.File == "" && subcommands[arg] {
+			c.Args = fs.Args()
+			return nil
+		}
+		if c.File != "" {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		c.File = arg
+		args = fs.Args()[1:]
+	}
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// setupConfig loads the configuration for this process and applies the
+// settings that take effect globally.
+func setupConfig() {
+	c, err := loadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "mermaid-editor: %v\n", err)
+		os.Exit(2)
+	}
+	cfg = c
+
+	level, _ := parseLogLevel(cfg.LogLevel)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if cfg.StateDir != "" {
+		stateDirOverride = cfg.StateDir
+	}
+}
+
+// openListeners returns the API's TCP listener, its browser URL and, if
+// systemd passed one in, a Unix socket listener. Without inherited sockets it
+// listens on --addr and --port.
+func openListeners(inherited []net.Listener) (tcp, sock net.Listener, url string, err error) {
+	for _, l := range inherited {
+		switch l.Addr().(type) {
+		case *net.TCPAddr:
+			if tcp == nil {
+				tcp = l
+				continue
+			}
+		case *net.UnixAddr:
+			if sock == nil {
+				sock = l
+				continue
+			}
+		}
+		l.Close()
+	}
+	if tcp == nil {
+		tcp, url, err = listen()
+		return tcp, sock, url, err
+	}
+	port := tcp.Addr().(*net.TCPAddr).Port
+	return tcp, sock, fmt.Sprintf("http://127.0.0.1:%d", port), nil
+}
+
+// listen opens the TCP listener for the API and returns it with the URL the
+// browser should use.
+func listen() (net.Listener, string, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(cfg.Addr, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return nil, "", err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	host := cfg.Addr
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return listener, fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(port))), nil
+}
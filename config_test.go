@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// useTestConfigFile points the global config file at a temp path and clears
+// MERMAID_EDITOR_* variables for the duration of the test.
+func useTestConfigFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("MERMAID_EDITOR_CONFIG", path)
+	for _, v := range []string{"ADDR", "PORT", "NO_BROWSER", "STATE_DIR", "LOG_LEVEL", "WORKSPACE", "IDLE_TIMEOUT"} {
+		t.Setenv("MERMAID_EDITOR_"+v, "")
+		os.Unsetenv("MERMAID_EDITOR_" + v)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	Convey("Given loadConfig()", t, func() {
+		path := useTestConfigFile(t)
+
+		Convey("Defaults to loopback, a random port and the browser", func() {
+			c, err := loadConfig(nil)
+			So(err, ShouldBeNil)
+			So(c.Addr, ShouldEqual, "127.0.0.1")
+			So(c.Port, ShouldEqual, 0)
+			So(c.NoBrowser, ShouldBeFalse)
+			So(c.MCP, ShouldBeFalse)
+			So(c.File, ShouldEqual, "")
+		})
+
+		Convey("Returns the file argument", func() {
+			c, err := loadConfig([]string{"diagram.mmd"})
+			So(err, ShouldBeNil)
+			So(c.File, ShouldEqual, "diagram.mmd")
+		})
+
+		Convey("Parses flags before and after the file argument", func() {
+			c, err := loadConfig([]string{"--mcp", "diagram.mmd", "--port", "8080", "--no-browser"})
+			So(err, ShouldBeNil)
+			So(c.MCP, ShouldBeTrue)
+			So(c.File, ShouldEqual, "diagram.mmd")
+			So(c.Port, ShouldEqual, 8080)
+			So(c.NoBrowser, ShouldBeTrue)
+		})
+
+		Convey("Treats the --workspace value as the flag's, not a file", func() {
+			c, err := loadConfig([]string{"--workspace", "git", "--mcp"})
+			So(err, ShouldBeNil)
+			So(c.Workspace, ShouldEqual, "git")
+			So(c.File, ShouldEqual, "")
+		})
+
+		Convey("Leaves subcommand arguments unparsed", func() {
+			c, err := loadConfig([]string{"--state-dir", "/tmp/x", "list", "-v"})
+			So(err, ShouldBeNil)
+			So(c.StateDir, ShouldEqual, "/tmp/x")
+			So(c.Args, ShouldResemble, []string{"list", "-v"})
+		})
+
+		Convey("Takes url as a subcommand, with the scope flags before it", func() {
+			c, err := loadConfig([]string{"--workspace", "git", "url", "-json"})
+			So(err, ShouldBeNil)
+			So(c.Workspace, ShouldEqual, "git")
+			So(c.Args, ShouldResemble, []string{"url", "-json"})
+		})
+
+		Convey("Rejects unknown flags", func() {
+			_, err := loadConfig([]string{"--bogus"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Rejects an invalid log level", func() {
+			_, err := loadConfig([]string{"--log-level", "loud"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Rejects a second positional argument", func() {
+			_, err := loadConfig([]string{"a.mmd", "b.mmd"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Reads the config file", func() {
+			os.WriteFile(path, []byte(`{"port": 7000, "no_browser": true, "log_level": "debug"}`), 0644)
+			c, err := loadConfig(nil)
+			So(err, ShouldBeNil)
+			So(c.Port, ShouldEqual, 7000)
+			So(c.NoBrowser, ShouldBeTrue)
+			So(c.LogLevel, ShouldEqual, "debug")
+		})
+
+		Convey("Environment variables override the config file", func() {
+			os.WriteFile(path, []byte(`{"port": 7000, "addr": "127.0.0.1"}`), 0644)
+			t.Setenv("MERMAID_EDITOR_PORT", "7001")
+			t.Setenv("MERMAID_EDITOR_ADDR", "0.0.0.0")
+			c, err := loadConfig(nil)
+			So(err, ShouldBeNil)
+			So(c.Port, ShouldEqual, 7001)
+			So(c.Addr, ShouldEqual, "0.0.0.0")
+		})
+
+		Convey("Flags override environment variables", func() {
+			t.Setenv("MERMAID_EDITOR_PORT", "7001")
+			c, err := loadConfig([]string{"--port=7002"})
+			So(err, ShouldBeNil)
+			So(c.Port, ShouldEqual, 7002)
+		})
+
+		Convey("Reads the idle timeout as a duration from each source", func() {
+			os.WriteFile(path, []byte(`{"idle_timeout": "30m"}`), 0644)
+			c, err := loadConfig(nil)
+			So(err, ShouldBeNil)
+			So(time.Duration(c.IdleTimeout), ShouldEqual, 30*time.Minute)
+
+			t.Setenv("MERMAID_EDITOR_IDLE_TIMEOUT", "1h")
+			c, err = loadConfig(nil)
+			So(err, ShouldBeNil)
+			So(time.Duration(c.IdleTimeout), ShouldEqual, time.Hour)
+
+			c, err = loadConfig([]string{"--idle-timeout", "90s"})
+			So(err, ShouldBeNil)
+			So(time.Duration(c.IdleTimeout), ShouldEqual, 90*time.Second)
+		})
+
+		Convey("A numeric idle timeout in the config file is an error", func() {
+			os.WriteFile(path, []byte(`{"idle_timeout": 30}`), 0644)
+			_, err := loadConfig(nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A malformed config file is an error", func() {
+			os.WriteFile(path, []byte(`{`), 0644)
+			_, err := loadConfig(nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestListen(t *testing.T) {
+	Convey("Given listen()", t, func() {
+		orig := cfg
+		Reset(func() { cfg = orig })
+
+		Convey("A wildcard address is reported as a loopback URL", func() {
+			cfg = Config{Addr: "0.0.0.0"}
+			l, url, err := listen()
+			So(err, ShouldBeNil)
+			defer l.Close()
+			So(url, ShouldStartWith, "http://127.0.0.1:")
+		})
+	})
+}
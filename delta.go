@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// TextChange replaces the text between From and To with Insert. Offsets are
+// UTF-16 code units, the way the browser editor counts them.
+type TextChange struct {
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Insert string `json:"insert"`
+}
+
+// errVersionConflict is returned when edits are made against a version that
+// is no longer current.
+var errVersionConflict = errors.New("version conflict")
+
+// applyChanges applies changes to text. All offsets refer to the original
+// text, so the changes must be sorted and must not overlap.
+func applyChanges(text string, changes []TextChange) (string, error) {
+	offsets, err := byteOffsets(text, changes)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, 0, len(text))
+	pos := 0
+	for i, c := range changes {
+		out = append(out, text[pos:offsets[2*i]]...)
+		out = append(out, c.Insert...)
+		pos = offsets[2*i+1]
+	}
+	out = append(out, text[pos:]...)
+	return string(out), nil
+}
+
+// byteOffsets converts the UTF-16 offsets of changes into byte offsets in
+// text, returning from and to for each change in turn.
+func byteOffsets(text string, changes []TextChange) ([]int, error) {
+	want := make([]int, 0, 2*len(changes))
+	last := 0
+	for _, c := range changes {
+		if c.From < last || c.To < c.From {
+			return nil, fmt.Errorf("changes must be sorted and not overlap")
+		}
+		want = append(want, c.From, c.To)
+		last = c.To
+	}
+
+	offsets := make([]int, 0, len(want))
+	units := 0
+	for i, r := range text {
+		for len(offsets) < len(want) && want[len(offsets)] == units {
+			offsets = append(offsets, i)
+		}
+		if len(offsets) < len(want) && want[len(offsets)] < units {
+			return nil, fmt.Errorf("offset %d splits a character", want[len(offsets)])
+		}
+		units += utf16.RuneLen(r)
+	}
+	for len(offsets) < len(want) && want[len(offsets)] == units {
+		offsets = append(offsets, len(text))
+	}
+	if len(offsets) < len(want) {
+		return nil, fmt.Errorf("offset %d is past the end of the document", want[len(offsets)])
+	}
+	return offsets, nil
+}
+
+// diffChange returns the single change that turns old into new, found by
+// trimming their common prefix and suffix. There is no change if they are
+// equal.
+func diffChange(old, new string) []TextChange {
+	if old == new {
+		return []TextChange{}
+	}
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	// Don't split a multi-byte character.
+	for prefix > 0 && prefix < len(old) && !utf8.RuneStart(old[prefix]) {
+		prefix--
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix &&
+		old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(old[len(old)-suffix]) {
+		suffix--
+	}
+
+	from := utf16Len(old[:prefix])
+	return []TextChange{{
+		From:   from,
+		To:     from + utf16Len(old[prefix:len(old)-suffix]),
+		Insert: new[prefix : len(new)-suffix],
+	}}
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApplyChanges(t *testing.T) {
+	Convey("Given applyChanges()", t, func() {
+		Convey("It replaces, inserts and deletes relative to the original text", func() {
+			out, err := applyChanges("graph TD\n  A-->B", []TextChange{
+				{From: 6, To: 8, Insert: "LR"},
+				{From: 11, To: 11, Insert: "X & "},
+				{From: 15, To: 16},
+			})
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph LR\n  X & A-->")
+		})
+
+		Convey("Offsets count UTF-16 code units", func() {
+			// "é" is one unit, the emoji is a surrogate pair.
+			out, err := applyChanges("é😀x", []TextChange{{From: 3, To: 4, Insert: "y"}})
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "é😀y")
+		})
+
+		Convey("An offset inside a surrogate pair is rejected", func() {
+			_, err := applyChanges("😀", []TextChange{{From: 1, To: 1, Insert: "x"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("An offset past the end is rejected", func() {
+			_, err := applyChanges("abc", []TextChange{{From: 2, To: 4}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Overlapping or unsorted changes are rejected", func() {
+			_, err := applyChanges("abcdef", []TextChange{{From: 3, To: 5}, {From: 1, To: 2}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDiffChange(t *testing.T) {
+	Convey("Given diffChange()", t, func() {
+		Convey("Equal texts have no change", func() {
+			So(diffChange("same", "same"), ShouldBeEmpty)
+		})
+
+		Convey("A one-line edit in a long document is a small change", func() {
+			old := "graph TD\n  A-->B\n  B-->C\n  C-->D"
+			changes := diffChange(old, "graph TD\n  A-->B\n  B-->X\n  C-->D")
+			So(changes, ShouldResemble, []TextChange{{From: 23, To: 24, Insert: "X"}})
+		})
+
+		Convey("Its change turns the old text into the new one", func() {
+			pairs := [][2]string{
+				{"", "graph TD"},
+				{"graph TD", ""},
+				{"aaa", "aaaa"},
+				{"né😀 A-->B", "né😁 A-->B"},
+				{"😀😀", "😀"},
+				{"line1\nline2", "line1\nline1\nline2"},
+			}
+			for _, p := range pairs {
+				out, err := applyChanges(p[0], diffChange(p[0], p[1]))
+				So(err, ShouldBeNil)
+				So(out, ShouldEqual, p[1])
+			}
+		})
+	})
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // DiagramEvent is sent to SSE subscribers when the diagram changes.
@@ -12,16 +17,104 @@ type DiagramEvent struct {
 	Content string `json:"content"`
 	Source  string `json:"source"`
 	Version int64  `json:"version"`
+
+	// Client is the id of the editor that made the change, if it gave one.
+	// An editor recognises its own edits by it.
+	Client string `json:"client,omitempty"`
+
+	// Skipped is set when a slow subscriber missed versions: they were
+	// superseded by this one before it read them.
+	Skipped *VersionRange `json:"skipped,omitempty"`
+
+	// Base and Changes describe the edit from the previous version, so a
+	// client that has Base can apply it instead of reloading Content.
+	Base    int64        `json:"-"`
+	Changes []TextChange `json:"-"`
+
+	// Merged is set when the edit was merged with others made since the
+	// version it was based on. Its writer doesn't have the result, so the
+	// event carries the whole content.
+	Merged bool `json:"merged,omitempty"`
+}
+
+// deltaEvent is the compact form of a DiagramEvent sent over SSE.
+type deltaEvent struct {
+	Version int64        `json:"version"`
+	Base    int64        `json:"base"`
+	Source  string       `json:"source"`
+	Client  string       `json:"client,omitempty"`
+	Changes []TextChange `json:"changes"`
+}
+
+// ssePayload returns what an SSE client needs for e: just the changes when
+// it can have the base version, else, or when the edit was merged, the
+// whole content.
+func (e DiagramEvent) ssePayload() any {
+	if e.Changes == nil || e.Skipped != nil || e.Merged {
+		return e
+	}
+	return deltaEvent{Version: e.Version, Base: e.Base, Source: e.Source, Client: e.Client, Changes: e.Changes}
+}
+
+// VersionRange is an inclusive range of diagram versions.
+type VersionRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
 }
 
+// StreamEvent is any other SSE event: a named type and its JSON payload.
+type StreamEvent struct {
+	Type string
+	Data any
+}
+
+// SSE event types besides "diagram".
+const (
+	eventPreferences = "preferences"
+	eventSelection   = "selection"
+	eventStatus      = "status"
+	eventShutdown    = "shutdown"
+)
+
+// Selection is a range of the diagram text selected in an editor, as UTF-16
+// offsets the way the browser counts them.
+type Selection struct {
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Source string `json:"source"`
+	Client string `json:"client,omitempty"`
+}
+
+// historySize is how many recent revisions are kept for clients resuming an
+// SSE stream.
+const historySize = 64
+
+// wedgeTimeout is how long a subscriber may leave an event unread, or an SSE
+// write may block, before the subscriber is considered stuck and dropped.
+var wedgeTimeout = 30 * time.Second
+
+// keepaliveInterval is how often an idle SSE stream gets a comment line, so
+// proxies and sleeping laptops don't silently drop it.
+var keepaliveInterval = 15 * time.Second
+
 // DiagramState holds the current diagram text and broadcasts changes via SSE.
 type DiagramState struct {
-	mu      sync.RWMutex
-	content string
-	version int64
+	mu        sync.RWMutex
+	content   string
+	version   int64
+	history   []DiagramEvent // oldest first, ending with the current version
+	authors   []lineAuthor   // who last changed each line
+	selection Selection
+	lease     *Lease
+	clients   clientRegistry
+	epoch     string // tells this run's SSE event ids from another run's
 
 	subMu       sync.Mutex
-	subscribers map[chan DiagramEvent]struct{}
+	subscribers map[chan DiagramEvent]*subscriber
+	listeners   map[chan StreamEvent]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewDiagramState creates a DiagramState with initial content.
@@ -29,7 +122,12 @@ func NewDiagramState(initial string) *DiagramState {
 	return &DiagramState{
 		content:     initial,
 		version:     1,
-		subscribers: make(map[chan DiagramEvent]struct{}),
+		history:     []DiagramEvent{{Content: initial, Version: 1}},
+		epoch:       newClientID(),
+		authors:     reblame(nil, "", initial, lineAuthor{Source: "initial", Version: 1}),
+		subscribers: make(map[chan DiagramEvent]*subscriber),
+		listeners:   make(map[chan StreamEvent]struct{}),
+		done:        make(chan struct{}),
 	}
 }
 
@@ -40,34 +138,206 @@ func (d *DiagramState) Get() (string, int64) {
 	return d.content, d.version
 }
 
+// subscriber tracks one subscription channel. The channel holds at most
+// one event: the newest the subscriber hasn't read yet.
+type subscriber struct {
+	// unreadSince is when the unread event, or the oldest one it
+	// replaced, was queued.
+	unreadSince time.Time
+}
+
 // Set updates the diagram content, bumps the version, and broadcasts to SSE subscribers.
 func (d *DiagramState) Set(content, source string) int64 {
+	return d.SetBy(content, source, "")
+}
+
+// SetBy is Set for an edit made by a known client.
+func (d *DiagramState) SetBy(content, source, client string) int64 {
+	d.clients.touch(client)
+	d.mu.Lock()
+	return d.commit(content, source, client, diffChange(d.content, content), false)
+}
+
+// SetFrom is SetBy for content edited from version base, or for writes
+// that may be blocked by the edit lease. Edits made since base are merged in
+// line by line, and merged reports whether there were any; a base of 0
+// replaces the diagram outright. If the edits conflict with content it
+// returns a *ConflictError, if base is no longer in the history
+// errVersionConflict, and if the lease blocks the write a *LeaseError; in
+// each case it changes nothing. Only a write with the lease's key gets past
+// the lease.
+func (d *DiagramState) SetFrom(base int64, content, source, client, leaseKey string) (version int64, merged bool, err error) {
+	d.clients.touch(client)
+	d.mu.Lock()
+	if err := d.checkLease(leaseKey); err != nil {
+		d.mu.Unlock()
+		return 0, false, err
+	}
+	if base != 0 && base != d.version {
+		original, err := d.contentAt(base)
+		if err == nil {
+			content, err = merge3(original, d.content, content)
+		}
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			conflict.Version = d.version
+		}
+		if err != nil {
+			d.mu.Unlock()
+			return 0, false, err
+		}
+		merged = true
+	}
+	return d.commit(content, source, client, diffChange(d.content, content), merged), merged, nil
+}
+
+// At returns the diagram at version if it is still in the history.
+func (d *DiagramState) At(version int64) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.contentAt(version)
+}
+
+// contentAt returns the diagram at version if it is still in the history.
+// It is called with mu held.
+func (d *DiagramState) contentAt(version int64) (string, error) {
+	first := d.history[0].Version
+	if version > d.version || version < first {
+		return "", errVersionConflict
+	}
+	return d.history[version-first].Content, nil
+}
+
+// Apply applies changes made against version base and broadcasts them. If
+// other edits were committed since base, the changes are first transformed
+// past them so that both survive. It returns errVersionConflict if base is
+// no longer in the history, or a *LeaseError if the edit lease blocks it,
+// as it does unless leaseKey is the lease's key.
+func (d *DiagramState) Apply(base int64, changes []TextChange, source, client, leaseKey string) (int64, error) {
+	d.clients.touch(client)
 	d.mu.Lock()
+	if err := d.checkLease(leaseKey); err != nil {
+		d.mu.Unlock()
+		return 0, err
+	}
+	changes, err := d.rebase(base, changes)
+	var content string
+	if err == nil {
+		content, err = applyChanges(d.content, changes)
+	}
+	if err != nil {
+		d.mu.Unlock()
+		return 0, err
+	}
+	return d.commit(content, source, client, changes, false), nil
+}
+
+// rebase transforms changes made against version base into changes against
+// the current version. It is called with mu held.
+func (d *DiagramState) rebase(base int64, changes []TextChange) ([]TextChange, error) {
+	if base == d.version {
+		return changes, nil
+	}
+	original, err := d.contentAt(base)
+	if err != nil {
+		return nil, err
+	}
+	i := int(base - d.history[0].Version)
+	op, err := opFromChanges(changes, utf16Len(original))
+	if err != nil {
+		return nil, err
+	}
+	for ; i+1 < len(d.history); i++ {
+		committed, err := opFromChanges(d.history[i+1].Changes, utf16Len(d.history[i].Content))
+		if err != nil {
+			return nil, err
+		}
+		// Edits already committed go first where both insert at one place.
+		if _, op, err = transform(committed, op); err != nil {
+			return nil, err
+		}
+	}
+	return op.changes(), nil
+}
+
+// commit stores a new version made by changes and broadcasts it, marked
+// merged if it was merged with edits made since its base. It is called
+// with mu held and releases it.
+func (d *DiagramState) commit(content, source, client string, changes []TextChange, merged bool) int64 {
 	d.version++
-	d.content = content
 	v := d.version
+	d.authors = reblame(d.authors, d.content, content, lineAuthor{Source: source, Client: client, Version: v})
+	d.content = content
+	event := DiagramEvent{Content: content, Source: source, Version: v, Client: client, Base: v - 1, Changes: changes, Merged: merged}
+	d.history = append(d.history, event)
+	if len(d.history) > historySize {
+		d.history = d.history[len(d.history)-historySize:]
+	}
+	// Take subMu before releasing mu so concurrent Sets broadcast in version
+	// order.
+	d.subMu.Lock()
 	d.mu.Unlock()
+	defer d.subMu.Unlock()
 
-	event := DiagramEvent{Content: content, Source: source, Version: v}
+	now := time.Now()
+	for ch, sub := range d.subscribers {
+		d.deliver(ch, sub, event, now)
+	}
+	return v
+}
 
-	d.subMu.Lock()
-	for ch := range d.subscribers {
-		select {
-		case ch <- event:
-		default:
-			// Drop if subscriber is slow
+// deliver queues event for one subscriber, replacing any event it hasn't
+// read yet. A subscriber that has left events unread for longer than
+// wedgeTimeout is dropped and its channel closed. The caller holds subMu, so
+// deliver is the only sender on ch.
+func (d *DiagramState) deliver(ch chan DiagramEvent, sub *subscriber, event DiagramEvent, now time.Time) {
+	select {
+	case ch <- event:
+		sub.unreadSince = now
+		return
+	default:
+	}
+
+	select {
+	case old := <-ch:
+		if now.Sub(sub.unreadSince) > wedgeTimeout {
+			delete(d.subscribers, ch)
+			close(ch)
+			return
+		}
+		from := old.Version
+		if old.Skipped != nil {
+			from = old.Skipped.From
 		}
+		event.Skipped = &VersionRange{From: from, To: event.Version - 1}
+	default:
+		// The subscriber read the event in the meantime.
+		sub.unreadSince = now
 	}
-	d.subMu.Unlock()
+	ch <- event
+}
 
-	return v
+// Since returns the revisions after version, oldest first. It returns false
+// if they are no longer all retained, or version is newer than the current
+// one; the caller should then fall back to the current content.
+func (d *DiagramState) Since(version int64) ([]DiagramEvent, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if version > d.version || version < d.history[0].Version-1 {
+		return nil, false
+	}
+	start := len(d.history) - int(d.version-version)
+	return append([]DiagramEvent(nil), d.history[start:]...), true
 }
 
-// Subscribe returns a channel that receives diagram change events.
+// Subscribe returns a channel that receives diagram change events. A slow
+// subscriber misses intermediate versions but always gets the newest one;
+// the event it gets marks what it skipped. The channel is closed if the
+// subscriber stops reading altogether.
 func (d *DiagramState) Subscribe() chan DiagramEvent {
-	ch := make(chan DiagramEvent, 16)
+	ch := make(chan DiagramEvent, 1)
 	d.subMu.Lock()
-	d.subscribers[ch] = struct{}{}
+	d.subscribers[ch] = &subscriber{}
 	d.subMu.Unlock()
 	return ch
 }
@@ -79,6 +349,48 @@ func (d *DiagramState) Unsubscribe(ch chan DiagramEvent) {
 	d.subMu.Unlock()
 }
 
+// Publish sends a non-diagram event to every SSE stream. A listener whose
+// buffer is full loses its oldest event rather than this one.
+func (d *DiagramState) Publish(eventType string, data any) {
+	event := StreamEvent{Type: eventType, Data: data}
+	d.subMu.Lock()
+	defer d.subMu.Unlock()
+	for ch := range d.listeners {
+		select {
+		case ch <- event:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// Listen returns a channel that receives the events sent with Publish.
+func (d *DiagramState) Listen() chan StreamEvent {
+	ch := make(chan StreamEvent, 16)
+	d.subMu.Lock()
+	d.listeners[ch] = struct{}{}
+	d.subMu.Unlock()
+	return ch
+}
+
+// Unlisten removes a channel returned by Listen.
+func (d *DiagramState) Unlisten(ch chan StreamEvent) {
+	d.subMu.Lock()
+	delete(d.listeners, ch)
+	d.subMu.Unlock()
+}
+
+// Close ends every SSE stream with a final shutdown event. It is called when
+// the server stops.
+func (d *DiagramState) Close() {
+	d.closeOnce.Do(func() { close(d.done) })
+}
+
 // handleGetDiagram returns the current diagram as JSON.
 func (d *DiagramState) handleGetDiagram(w http.ResponseWriter, r *http.Request) {
 	content, version := d.Get()
@@ -89,11 +401,20 @@ func (d *DiagramState) handleGetDiagram(w http.ResponseWriter, r *http.Request)
 	})
 }
 
-// handleSetDiagram updates the diagram from a JSON body.
+// handleSetDiagram updates the diagram from a JSON body. With a base
+// version, edits made since are merged in; if they conflict it answers 409
+// with the conflicts and the merge with conflict markers, and changes
+// nothing. While the user holds the edit lease, writes without its key get
+// 423. Writes from agents and scripts are sanitized if sanitize
+// is true, or if it is unset and the user prefers it, and the fixes reported.
 func (d *DiagramState) handleSetDiagram(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Content string `json:"content"`
-		Source  string `json:"source"`
+		Content  string `json:"content"`
+		Source   string `json:"source"`
+		Client   string `json:"client"`
+		Base     int64  `json:"base"`
+		Lease    string `json:"lease"`
+		Sanitize *bool  `json:"sanitize"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
@@ -102,16 +423,158 @@ func (d *DiagramState) handleSetDiagram(w http.ResponseWriter, r *http.Request)
 	if req.Source == "" {
 		req.Source = "api"
 	}
+	var fixes []SanitizeFix
+	if req.Source != "browser" {
+		req.Content, fixes = sanitizeWrite(req.Content, req.Sanitize)
+	}
 
-	version := d.Set(req.Content, req.Source)
-	maybeFocusApp()
+	version, merged, err := d.SetFrom(req.Base, req.Content, req.Source, req.Client, req.Lease)
+	var locked *LeaseError
+	if errors.As(err, &locked) {
+		writeLeaseError(w, locked)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
+	if err != nil {
+		writeConflict(w, d, err)
+		return
+	}
+	maybeFocusApp()
+	resp := map[string]any{"version": version}
+	if merged {
+		resp["merged"] = true
+	}
+	if len(fixes) > 0 {
+		resp["fixes"] = fixes
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeConflict answers 409 for an edit that couldn't be merged, with the
+// current diagram and, for a *ConflictError, what conflicted.
+func writeConflict(w http.ResponseWriter, d *DiagramState, err error) {
+	content, version := d.Get()
+	resp := map[string]any{
+		"error":   err.Error(),
+		"content": content,
 		"version": version,
-	})
+	}
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		resp["conflicts"] = conflict.Conflicts
+		resp["merged_with_markers"] = conflict.Merged
+	}
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handlePatchDiagram applies text edits made against a base version,
+// merging them with any edits committed since. If the base version is too
+// old to merge with it answers 409 with the current content, and the client
+// falls back to sending its whole document.
+func (d *DiagramState) handlePatchDiagram(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Base    int64        `json:"base"`
+		Changes []TextChange `json:"changes"`
+		Source  string       `json:"source"`
+		Client  string       `json:"client"`
+		Lease   string       `json:"lease"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Source == "" {
+		req.Source = "api"
+	}
+
+	version, err := d.Apply(req.Base, req.Changes, req.Source, req.Client, req.Lease)
+	var locked *LeaseError
+	if errors.As(err, &locked) {
+		writeLeaseError(w, locked)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeConflict(w, d, err)
+	case err != nil:
+		w.Header().Del("Content-Type")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		json.NewEncoder(w).Encode(map[string]any{
+			"version": version,
+		})
+	}
+}
+
+// handleGetSelection returns the last selection reported by an editor.
+func (d *DiagramState) handleGetSelection(w http.ResponseWriter, r *http.Request) {
+	d.mu.RLock()
+	sel := d.selection
+	d.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sel)
+}
+
+// handleSetSelection records a selection and broadcasts it, so the browser
+// can share what the user selected and other tools can highlight a range.
+func (d *DiagramState) handleSetSelection(w http.ResponseWriter, r *http.Request) {
+	var sel Selection
+	if err := json.NewDecoder(r.Body).Decode(&sel); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if sel.From < 0 || sel.To < sel.From {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	if sel.Source == "" {
+		sel.Source = "api"
+	}
+	d.mu.Lock()
+	d.selection = sel
+	d.mu.Unlock()
+	d.clients.setSelection(sel)
+	d.Publish(eventSelection, sel)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventID returns the SSE id of a diagram version: the version prefixed by
+// the epoch of this run, so that versions of an earlier run, which start
+// again from 1, aren't mistaken for this run's.
+func (d *DiagramState) eventID(version int64) string {
+	return fmt.Sprintf("%s-%d", d.epoch, version)
+}
+
+// eventVersion returns the version of a Last-Event-ID, if it is one this
+// run sent.
+func (d *DiagramState) eventVersion(id string) (int64, bool) {
+	epoch, v, ok := strings.Cut(id, "-")
+	if !ok || epoch != d.epoch {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(v, 10, 64)
+	return version, err == nil
+}
+
+// writeEvent writes one SSE event. Only diagram events carry an id, so a
+// reconnecting browser's Last-Event-ID is always a diagram version.
+func writeEvent(w io.Writer, eventType, id string, data any) {
+	payload, _ := json.Marshal(data)
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, payload)
 }
 
-// handleDiagramSSE streams diagram change events to the client.
+// handleDiagramSSE streams diagram changes and other editor events to the
+// client. A client reconnecting with Last-Event-ID first gets the revisions
+// it missed, or the current diagram if they are no longer available or the
+// id is from another run of the editor.
+//
+// The query parameters client, kind and name identify the client in the
+// list of connected clients; a client without an id is given one.
 func (d *DiagramState) handleDiagramSSE(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -122,19 +585,103 @@ func (d *DiagramState) handleDiagramSSE(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	flusher.Flush() // Send headers immediately
+
+	query := r.URL.Query()
+	client, kind := query.Get("client"), query.Get("kind")
+	if client == "" {
+		client = newClientID()
+	}
+	if kind == "" {
+		kind = "api"
+	}
 
 	ch := d.Subscribe()
 	defer d.Unsubscribe(ch)
+	d.Connect(client, kind, query.Get("name"))
+	defer d.Disconnect(client)
+	events := d.Listen()
+	defer d.Unlisten(events)
+
+	// sent is the newest version written, once there is one. A coalesced
+	// event would make an editor with unsent edits start over from the
+	// whole content, so we send the revisions it stands for instead while
+	// they are retained.
+	var sent int64
+	writeDiagram := func(event DiagramEvent) {
+		missed := []DiagramEvent{event}
+		if event.Skipped != nil && sent > 0 {
+			if since, ok := d.Since(sent); ok {
+				missed = since
+			}
+		}
+		for _, e := range missed {
+			if e.Version > sent {
+				writeEvent(w, "diagram", d.eventID(e.Version), e.ssePayload())
+				sent = e.Version
+			}
+		}
+	}
+
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var missed []DiagramEvent
+		last, ok := d.eventVersion(id)
+		if ok {
+			missed, ok = d.Since(last)
+		}
+		if !ok {
+			content, version := d.Get()
+			missed = []DiagramEvent{{Content: content, Source: "resume", Version: version}}
+		}
+		for _, event := range missed {
+			writeDiagram(event)
+		}
+	}
+	writeEvent(w, eventClients, "", d.Clients())
+	flusher.Flush() // Send headers immediately
+
+	// A client that stops reading blocks our writes once the socket buffers
+	// fill; give up on it rather than hold the goroutine forever. Not every
+	// ResponseWriter supports deadlines, which is fine.
+	rc := http.NewResponseController(w)
+	send := func(write func()) bool {
+		rc.SetWriteDeadline(time.Now().Add(wedgeTimeout))
+		write()
+		return rc.Flush() == nil
+	}
+
+	activity.streamOpened(kind)
+	defer func() {
+		activity.streamClosed(kind)
+		d.Publish(eventStatus, currentStatus())
+	}()
+	d.Publish(eventStatus, currentStatus())
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
 
 	for {
+		var ok bool
 		select {
-		case event := <-ch:
-			data, _ := json.Marshal(event)
-			fmt.Fprintf(w, "data: %s\n\n", data)
+		case event, open := <-ch:
+			if !open {
+				// Dropped as wedged; the client will reconnect and resume.
+				return
+			}
+			ok = send(func() { writeDiagram(event) })
+		case event := <-events:
+			ok = send(func() { writeEvent(w, event.Type, "", event.Data) })
+		case <-keepalive.C:
+			ok = send(func() { fmt.Fprint(w, ": keepalive\n\n") })
+		case <-d.done:
+			// Tell the UI the editor stopped so it stops reconnecting.
+			writeEvent(w, eventShutdown, "", struct{}{})
 			flusher.Flush()
+			return
 		case <-r.Context().Done():
 			return
 		}
+		if !ok {
+			return
+		}
 	}
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -156,28 +159,56 @@ func TestDiagramStateBroadcasting(t *testing.T) {
 		})
 	})
 
-	Convey("Given a slow subscriber whose buffer fills up", t, func() {
+	Convey("Given a slow subscriber that reads nothing while the diagram changes", t, func() {
 		ds := NewDiagramState("initial")
 		ch := ds.Subscribe()
 		defer ds.Unsubscribe(ch)
 
-		Convey("Excess events are dropped without deadlocking", func() {
-			for i := 0; i < 20; i++ {
-				ds.Set(fmt.Sprintf("event-%d", i), "api")
-			}
+		for i := 0; i < 20; i++ {
+			ds.Set(fmt.Sprintf("event-%d", i), "api")
+		}
 
-			drained := 0
-			for {
-				select {
-				case <-ch:
-					drained++
-				default:
-					goto done
-				}
+		Convey("It gets only the newest version, marked with what it skipped", func() {
+			event := <-ch
+			So(event.Version, ShouldEqual, 21)
+			So(event.Content, ShouldEqual, "event-19")
+			So(event.Skipped, ShouldResemble, &VersionRange{From: 2, To: 20})
+
+			select {
+			case extra := <-ch:
+				So(extra.Version, ShouldEqual, "no further event")
+			default:
 			}
-		done:
-			So(drained, ShouldBeGreaterThan, 0)
-			So(drained, ShouldBeLessThanOrEqualTo, 16)
+		})
+
+		Convey("A subscriber that catches up gets later versions unmarked", func() {
+			<-ch
+			ds.Set("next", "api")
+			event := <-ch
+			So(event.Version, ShouldEqual, 22)
+			So(event.Skipped, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a subscriber that stopped reading", t, func() {
+		orig := wedgeTimeout
+		wedgeTimeout = 10 * time.Millisecond
+		Reset(func() { wedgeTimeout = orig })
+
+		ds := NewDiagramState("initial")
+		ch := ds.Subscribe()
+		defer ds.Unsubscribe(ch)
+
+		Convey("It is disconnected once an event sat unread past the timeout", func() {
+			ds.Set("first", "api")
+			time.Sleep(20 * time.Millisecond)
+			ds.Set("second", "api")
+
+			_, open := <-ch
+			So(open, ShouldBeFalse)
+
+			ds.Set("third", "api")
+			ds.Unsubscribe(ch)
 		})
 	})
 }
@@ -208,6 +239,77 @@ func TestDiagramStateConcurrency(t *testing.T) {
 		So(finalVersion, ShouldEqual, int64(goroutines+1))
 	})
 
+	Convey("Under concurrent Sets every subscriber ends on the newest version", t, func() {
+		ds := NewDiagramState("v1")
+		const (
+			subscribers = 200
+			writers     = 8
+			sets        = 250
+		)
+		final := int64(1 + writers*sets)
+
+		errs := make(chan error, subscribers)
+		var wg sync.WaitGroup
+		for i := 0; i < subscribers; i++ {
+			ch := ds.Subscribe()
+			wg.Add(1)
+			go func(slow bool) {
+				defer wg.Done()
+				defer ds.Unsubscribe(ch)
+				last := int64(1)
+				for event := range ch {
+					from := event.Version
+					if event.Skipped != nil {
+						from = event.Skipped.From
+						if event.Skipped.To != event.Version-1 {
+							errs <- fmt.Errorf("skipped range %+v doesn't end before %d", *event.Skipped, event.Version)
+							return
+						}
+					}
+					if from != last+1 {
+						errs <- fmt.Errorf("got version %d (from %d) after %d", event.Version, from, last)
+						return
+					}
+					last = event.Version
+					if last == final {
+						return
+					}
+					if slow {
+						time.Sleep(time.Millisecond)
+					}
+				}
+				errs <- fmt.Errorf("channel closed at version %d", last)
+			}(i%4 == 0)
+		}
+
+		var writersWG sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			writersWG.Add(1)
+			go func(w int) {
+				defer writersWG.Done()
+				for i := 0; i < sets; i++ {
+					ds.Set(fmt.Sprintf("writer-%d-%d", w, i), "api")
+				}
+			}(w)
+		}
+		writersWG.Wait()
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			So("subscribers stuck", ShouldEqual, "all caught up")
+		}
+		close(errs)
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+	})
+
 	Convey("Concurrent subscribe/unsubscribe during Set does not deadlock", t, func() {
 		ds := NewDiagramState("initial")
 		const goroutines = 50
@@ -243,6 +345,109 @@ func TestDiagramStateConcurrency(t *testing.T) {
 	})
 }
 
+func TestDiagramApply(t *testing.T) {
+	Convey("Given a DiagramState with a subscriber", t, func() {
+		ds := NewDiagramState("graph TD\n  A-->B")
+		ch := ds.Subscribe()
+		defer ds.Unsubscribe(ch)
+
+		Convey("Apply edits the current version and broadcasts the changes", func() {
+			changes := []TextChange{{From: 6, To: 8, Insert: "LR"}}
+			v, err := ds.Apply(1, changes, "browser", "tab-1", "")
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, 2)
+
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph LR\n  A-->B")
+
+			event := <-ch
+			So(event.Base, ShouldEqual, 1)
+			So(event.Changes, ShouldResemble, changes)
+			So(event.ssePayload(), ShouldResemble, deltaEvent{Version: 2, Base: 1, Source: "browser", Client: "tab-1", Changes: changes})
+		})
+
+		Convey("Apply against an older version merges with the edits made since", func() {
+			_, err := ds.Apply(1, []TextChange{{From: 6, To: 8, Insert: "LR"}}, "browser", "tab-1", "")
+			So(err, ShouldBeNil)
+			_, err = ds.Apply(2, []TextChange{{From: 16, To: 16, Insert: "-->C"}}, "mcp", "", "")
+			So(err, ShouldBeNil)
+			<-ch
+
+			v, err := ds.Apply(1, []TextChange{{From: 11, To: 12, Insert: "Start"}}, "browser", "tab-2", "")
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, 4)
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph LR\n  Start-->B-->C")
+
+			event := <-ch
+			So(event.Changes, ShouldResemble, []TextChange{{From: 11, To: 12, Insert: "Start"}})
+		})
+
+		Convey("Concurrent inserts at the same place keep the first committed first", func() {
+			_, err := ds.Apply(1, []TextChange{{From: 16, To: 16, Insert: "1"}}, "browser", "tab-1", "")
+			So(err, ShouldBeNil)
+			_, err = ds.Apply(1, []TextChange{{From: 16, To: 16, Insert: "2"}}, "browser", "tab-2", "")
+			So(err, ShouldBeNil)
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph TD\n  A-->B12")
+		})
+
+		Convey("Apply against a version no longer in the history is a conflict", func() {
+			for i := range historySize {
+				ds.Set(fmt.Sprintf("v%d", i+2), "mcp")
+			}
+			_, err := ds.Apply(1, []TextChange{{From: 0, To: 0, Insert: "x"}}, "browser", "", "")
+			So(err, ShouldEqual, errVersionConflict)
+		})
+
+		Convey("Apply against a version from the future is a conflict", func() {
+			_, err := ds.Apply(5, nil, "browser", "", "")
+			So(err, ShouldEqual, errVersionConflict)
+		})
+
+		Convey("SetFrom merges in the lines edited since its base version", func() {
+			ds.Set("graph TD\n  A-->B\n  B-->C", "browser")
+			<-ch
+			v, merged, err := ds.SetFrom(1, "graph LR\n  A-->B", "mcp", "", "")
+			So(err, ShouldBeNil)
+			So(merged, ShouldBeTrue)
+			So(v, ShouldEqual, 3)
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph LR\n  A-->B\n  B-->C")
+
+			Convey("and sends its writer the whole merged content", func() {
+				event := <-ch
+				So(event.Merged, ShouldBeTrue)
+				So(event.ssePayload(), ShouldResemble, event)
+			})
+		})
+
+		Convey("SetFrom with a conflict changes nothing", func() {
+			ds.Set("graph TD\n  A-->X", "browser")
+			_, _, err := ds.SetFrom(1, "graph TD\n  A-->Y", "mcp", "", "")
+			var conflict *ConflictError
+			So(errors.As(err, &conflict), ShouldBeTrue)
+			So(conflict.Version, ShouldEqual, 2)
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph TD\n  A-->X")
+		})
+
+		Convey("Set broadcasts the difference from the previous version", func() {
+			ds.Set("graph TD\n  A-->C", "mcp")
+			event := <-ch
+			So(event.Changes, ShouldResemble, []TextChange{{From: 15, To: 16, Insert: "C"}})
+		})
+
+		Convey("A coalesced event carries the whole content", func() {
+			ds.Set("one", "mcp")
+			ds.Set("two", "mcp")
+			event := <-ch
+			So(event.Skipped, ShouldNotBeNil)
+			So(event.ssePayload(), ShouldResemble, event)
+		})
+	})
+}
+
 func TestDiagramHTTPHandlers(t *testing.T) {
 	Convey("Given a DiagramState", t, func() {
 		ds := NewDiagramState("test diagram")
@@ -278,6 +483,100 @@ func TestDiagramHTTPHandlers(t *testing.T) {
 			So(content, ShouldEqual, "new diagram")
 		})
 
+		Convey("PATCH /api/diagram applies edits against the base version", func() {
+			body := `{"base": 1, "changes": [{"from": 0, "to": 0, "insert": "%% note\n"}], "source": "browser"}`
+			w := httptest.NewRecorder()
+			ds.handlePatchDiagram(w, httptest.NewRequest("PATCH", "/api/diagram", strings.NewReader(body)))
+
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"version":2`)
+			content, _ := ds.Get()
+			So(content, ShouldStartWith, "%% note\n")
+		})
+
+		Convey("PATCH /api/diagram against a version too old to merge returns 409 with the content", func() {
+			for range historySize {
+				ds.Set("graph LR", "mcp")
+			}
+			body := `{"base": 1, "changes": [], "source": "browser"}`
+			w := httptest.NewRecorder()
+			ds.handlePatchDiagram(w, httptest.NewRequest("PATCH", "/api/diagram", strings.NewReader(body)))
+
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			var out struct {
+				Content string `json:"content"`
+				Version int64  `json:"version"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Content, ShouldEqual, "graph LR")
+			So(out.Version, ShouldEqual, historySize+1)
+		})
+
+		Convey("PATCH /api/diagram with an out-of-range edit returns 400", func() {
+			body := `{"base": 1, "changes": [{"from": 0, "to": 9999, "insert": ""}]}`
+			w := httptest.NewRecorder()
+			ds.handlePatchDiagram(w, httptest.NewRequest("PATCH", "/api/diagram", strings.NewReader(body)))
+
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("PUT /api/diagram with a base version merges edits made since", func() {
+			ds.Set("graph TD\n  A-->B", "mcp")
+			ds.Set("graph TD\n  A-->B\n  B-->C", "browser")
+			body := `{"content": "graph LR\n  A-->B", "source": "mcp", "base": 2}`
+			w := httptest.NewRecorder()
+			ds.handleSetDiagram(w, httptest.NewRequest("PUT", "/api/diagram", strings.NewReader(body)))
+
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"merged":true`)
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph LR\n  A-->B\n  B-->C")
+		})
+
+		Convey("PUT /api/diagram with a conflicting edit returns 409 with a conflict report", func() {
+			ds.Set("user diagram", "browser")
+			body := `{"content": "agent diagram", "source": "mcp", "base": 1}`
+			w := httptest.NewRecorder()
+			ds.handleSetDiagram(w, httptest.NewRequest("PUT", "/api/diagram", strings.NewReader(body)))
+
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			var out struct {
+				Conflicts []MergeConflict `json:"conflicts"`
+				Marked    string          `json:"merged_with_markers"`
+				Version   int64           `json:"version"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Conflicts, ShouldHaveLength, 1)
+			So(out.Marked, ShouldContainSubstring, "<<<<<<< current\nuser diagram\n=======\nagent diagram\n")
+			So(out.Version, ShouldEqual, 2)
+		})
+
+		Convey("PUT /api/diagram with sanitize fixes the content and reports the fixes", func() {
+			body := `{"content": "graph TD\n  A --> end", "source": "mcp", "sanitize": true}`
+			w := httptest.NewRecorder()
+			ds.handleSetDiagram(w, httptest.NewRequest("PUT", "/api/diagram", strings.NewReader(body)))
+
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out struct {
+				Fixes []SanitizeFix `json:"fixes"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(fixRules(out.Fixes), ShouldResemble, []string{"reserved-id"})
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph TD\n  A --> End[end]")
+		})
+
+		Convey("PUT /api/diagram from the browser is never sanitized", func() {
+			body := `{"content": "graph TD\n  A --> end", "source": "browser", "sanitize": true}`
+			w := httptest.NewRecorder()
+			ds.handleSetDiagram(w, httptest.NewRequest("PUT", "/api/diagram", strings.NewReader(body)))
+
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldNotContainSubstring, "fixes")
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph TD\n  A --> end")
+		})
+
 		Convey("PUT /api/diagram with invalid JSON returns 400", func() {
 			req := httptest.NewRequest("PUT", "/api/diagram", strings.NewReader("not json"))
 			w := httptest.NewRecorder()
@@ -288,70 +587,238 @@ func TestDiagramHTTPHandlers(t *testing.T) {
 	})
 }
 
+// sseMessage is one event read from an SSE stream.
+type sseMessage struct {
+	ID, Type, Data string
+}
+
+// readEvent reads an SSE stream until an event of eventType arrives, skipping
+// others. It gives up after two seconds.
+func readEvent(r *bufio.Reader, eventType string) (sseMessage, error) {
+	result := make(chan sseMessage, 1)
+	errc := make(chan error, 1)
+	go func() {
+		var msg sseMessage
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				errc <- err
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				if msg.Type == eventType {
+					result <- msg
+					return
+				}
+				msg = sseMessage{}
+			case strings.HasPrefix(line, "id: "):
+				msg.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				msg.Type = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				msg.Data = strings.TrimPrefix(line, "data: ")
+			case strings.HasPrefix(line, ":"):
+				msg.Type = "comment"
+			}
+		}
+	}()
+	select {
+	case msg := <-result:
+		return msg, nil
+	case err := <-errc:
+		return sseMessage{}, err
+	case <-time.After(2 * time.Second):
+		return sseMessage{}, fmt.Errorf("timed out waiting for a %s event", eventType)
+	}
+}
+
 func TestDiagramSSE(t *testing.T) {
 	Convey("Given an SSE endpoint backed by a DiagramState", t, func() {
 		ds := NewDiagramState("initial")
 		mux := http.NewServeMux()
 		mux.HandleFunc("GET /api/events", ds.handleDiagramSSE)
+		mux.HandleFunc("PUT /api/selection", ds.handleSetSelection)
 		ts := httptest.NewServer(mux)
 		defer ts.Close()
 
-		Convey("It streams events with the correct content type", func() {
-			resp, err := http.Get(ts.URL + "/api/events")
+		connect := func(lastEventID string) (*http.Response, *bufio.Reader) {
+			req, _ := http.NewRequest("GET", ts.URL+"/api/events", nil)
+			if lastEventID != "" {
+				req.Header.Set("Last-Event-ID", lastEventID)
+			}
+			resp, err := http.DefaultClient.Do(req)
 			So(err, ShouldBeNil)
+			return resp, bufio.NewReader(resp.Body)
+		}
+
+		Convey("It streams named diagram events with the version as id", func() {
+			resp, r := connect("")
 			defer resp.Body.Close()
 
 			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
 
 			ds.Set("live update", "mcp")
 
-			type readResult struct {
-				data string
-				err  error
-			}
-			ch := make(chan readResult, 1)
-			go func() {
-				buf := make([]byte, 4096)
-				n, err := resp.Body.Read(buf)
-				ch <- readResult{string(buf[:n]), err}
-			}()
+			msg, err := readEvent(r, "diagram")
+			So(err, ShouldBeNil)
+			So(msg.ID, ShouldEqual, ds.eventID(2))
+			So(msg.Data, ShouldContainSubstring, "live update")
+			So(msg.Data, ShouldContainSubstring, `"source":"mcp"`)
+		})
 
-			select {
-			case r := <-ch:
-				So(r.err, ShouldBeNil)
-				So(r.data, ShouldContainSubstring, "live update")
-				So(r.data, ShouldContainSubstring, `"source":"mcp"`)
-			case <-time.After(2 * time.Second):
-				So("timeout", ShouldEqual, "event received")
-			}
+		Convey("An edit is sent as a compact delta against the previous version", func() {
+			resp, r := connect("")
+			defer resp.Body.Close()
+
+			ds.Set("initial\nmore", "mcp")
+
+			msg, err := readEvent(r, "diagram")
+			So(err, ShouldBeNil)
+			So(msg.Data, ShouldEqual, `{"version":2,"base":1,"source":"mcp","changes":[{"from":7,"to":7,"insert":"\nmore"}]}`)
 		})
 
 		Convey("Multiple clients each receive the event", func() {
-			resp1, err := http.Get(ts.URL + "/api/events")
-			So(err, ShouldBeNil)
+			resp1, r1 := connect("")
 			defer resp1.Body.Close()
-
-			resp2, err := http.Get(ts.URL + "/api/events")
-			So(err, ShouldBeNil)
+			resp2, r2 := connect("")
 			defer resp2.Body.Close()
 
 			ds.Set("multi-client update", "mcp")
 
-			for i, resp := range []*http.Response{resp1, resp2} {
-				ch := make(chan string, 1)
-				go func() {
-					buf := make([]byte, 4096)
-					n, _ := resp.Body.Read(buf)
-					ch <- string(buf[:n])
-				}()
+			for _, r := range []*bufio.Reader{r1, r2} {
+				msg, err := readEvent(r, "diagram")
+				So(err, ShouldBeNil)
+				So(msg.Data, ShouldContainSubstring, "multi-client update")
+			}
+		})
 
-				select {
-				case data := <-ch:
-					So(data, ShouldContainSubstring, "multi-client update")
-				case <-time.After(2 * time.Second):
-					So(fmt.Sprintf("client %d timeout", i+1), ShouldEqual, "event received")
-				}
+		Convey("A new stream is announced in a status event", func() {
+			resp, r := connect("")
+			defer resp.Body.Close()
+
+			msg, err := readEvent(r, eventStatus)
+			So(err, ShouldBeNil)
+			So(msg.ID, ShouldEqual, "")
+			So(msg.Data, ShouldContainSubstring, `"clients"`)
+		})
+
+		Convey("Connected clients are listed in a clients event", func() {
+			resp, err := http.Get(ts.URL + "/api/events?client=tab-1&kind=browser&name=Alice")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			msg, err := readEvent(bufio.NewReader(resp.Body), eventClients)
+			So(err, ShouldBeNil)
+			So(msg.Data, ShouldContainSubstring, `"id":"tab-1","kind":"browser","name":"Alice"`)
+			So(ds.Clients(), ShouldHaveLength, 1)
+		})
+
+		Convey("Diagram events name the client that made the edit", func() {
+			resp, r := connect("")
+			defer resp.Body.Close()
+
+			ds.Apply(1, []TextChange{{From: 0, To: 0, Insert: "x"}}, "browser", "tab-1", "")
+
+			msg, err := readEvent(r, "diagram")
+			So(err, ShouldBeNil)
+			So(msg.Data, ShouldContainSubstring, `"client":"tab-1"`)
+		})
+
+		Convey("Selections are broadcast as selection events", func() {
+			resp, r := connect("")
+			defer resp.Body.Close()
+
+			req, _ := http.NewRequest("PUT", ts.URL+"/api/selection", strings.NewReader(`{"from":2,"to":5,"source":"cli"}`))
+			put, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			put.Body.Close()
+			So(put.StatusCode, ShouldEqual, http.StatusNoContent)
+
+			msg, err := readEvent(r, eventSelection)
+			So(err, ShouldBeNil)
+			So(msg.Data, ShouldEqual, `{"from":2,"to":5,"source":"cli"}`)
+		})
+
+		Convey("Idle streams get keepalive comments", func() {
+			orig := keepaliveInterval
+			keepaliveInterval = 20 * time.Millisecond
+			Reset(func() { keepaliveInterval = orig })
+
+			resp, r := connect("")
+			defer resp.Body.Close()
+
+			_, err := readEvent(r, "comment")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A reconnecting client gets the revisions it missed", func() {
+			ds.Set("v2", "mcp")
+			ds.Set("v3", "mcp")
+			ds.Set("v4", "mcp")
+
+			resp, r := connect(ds.eventID(2))
+			defer resp.Body.Close()
+
+			for _, want := range []int64{3, 4} {
+				msg, err := readEvent(r, "diagram")
+				So(err, ShouldBeNil)
+				So(msg.ID, ShouldEqual, ds.eventID(want))
+			}
+		})
+
+		Convey("A client too far behind gets the current diagram", func() {
+			for i := range historySize + 5 {
+				ds.Set(fmt.Sprintf("v%d", i+2), "mcp")
 			}
+
+			resp, r := connect(ds.eventID(1))
+			defer resp.Body.Close()
+
+			msg, err := readEvent(r, "diagram")
+			So(err, ShouldBeNil)
+			So(msg.ID, ShouldEqual, ds.eventID(historySize+6))
+			So(msg.Data, ShouldContainSubstring, `"source":"resume"`)
+		})
+
+		Convey("A client from an earlier run of the editor gets the current diagram", func() {
+			// The earlier run got further than this one has: its version 2
+			// is not this run's.
+			earlier := NewDiagramState("initial")
+			earlier.Set("earlier v2", "mcp")
+			earlier.Set("earlier v3", "mcp")
+			ds.Set("v2", "mcp")
+			ds.Set("v3", "mcp")
+
+			resp, r := connect(earlier.eventID(2))
+			defer resp.Body.Close()
+
+			msg, err := readEvent(r, "diagram")
+			So(err, ShouldBeNil)
+			So(msg.ID, ShouldEqual, ds.eventID(3))
+			So(msg.Data, ShouldContainSubstring, `"content":"v3"`)
+			So(msg.Data, ShouldContainSubstring, `"source":"resume"`)
+		})
+
+		Convey("A malformed Last-Event-ID gets the current diagram", func() {
+			resp, r := connect("99")
+			defer resp.Body.Close()
+
+			msg, err := readEvent(r, "diagram")
+			So(err, ShouldBeNil)
+			So(msg.ID, ShouldEqual, ds.eventID(1))
+			So(msg.Data, ShouldContainSubstring, `"content":"initial"`)
+		})
+
+		Convey("Close ends the stream with a shutdown event", func() {
+			resp, _ := connect("")
+			defer resp.Body.Close()
+
+			ds.Close()
+			data, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEndWith, "event: shutdown\ndata: {}\n\n")
 		})
 
 		Convey("Client disconnect does not cause a panic on subsequent Set", func() {
@@ -367,3 +834,64 @@ func TestDiagramSSE(t *testing.T) {
 		})
 	})
 }
+
+func benchmarkSet(b *testing.B, subscribers int, read bool) {
+	ds := NewDiagramState("initial")
+	var wg sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		ch := ds.Subscribe()
+		if read {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range ch {
+				}
+			}()
+		}
+	}
+	content := strings.Repeat("A-->B\n", 2000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ds.Set(content, "api")
+	}
+	b.StopTimer()
+
+	closeSubscribers(ds)
+	wg.Wait()
+}
+
+// closeSubscribers ends the reader goroutines of a benchmark.
+func closeSubscribers(ds *DiagramState) {
+	ds.subMu.Lock()
+	defer ds.subMu.Unlock()
+	for ch := range ds.subscribers {
+		delete(ds.subscribers, ch)
+		close(ch)
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	for _, n := range []int{1, 100, 500} {
+		b.Run(fmt.Sprintf("readers=%d", n), func(b *testing.B) { benchmarkSet(b, n, true) })
+		b.Run(fmt.Sprintf("stalled=%d", n), func(b *testing.B) { benchmarkSet(b, n, false) })
+	}
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	ds := NewDiagramState("initial")
+	for i := 0; i < 500; i++ {
+		ch := ds.Subscribe()
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+	defer closeSubscribers(ds)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ds.Set("graph TD\n  A-->B", "api")
+		}
+	})
+}
@@ -0,0 +1,833 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Kinds of DiffChange.
+const (
+	diffAdded     = "added"
+	diffRemoved   = "removed"
+	diffRelabeled = "relabeled"
+	diffRestyled  = "restyled"
+	diffMoved     = "moved"
+)
+
+// Styles of the diff diagram.
+const (
+	diffAddedStyle   = "fill:#e6f4ea,stroke:#2e7d32,color:#1b5e20"
+	diffRemovedStyle = "fill:#fdecea,stroke:#c62828,color:#b71c1c,stroke-dasharray:4 3"
+	diffChangedStyle = "fill:#fff8e1,stroke:#f9a825"
+)
+
+// DiffChange is one semantic difference between two diagrams.
+type DiffChange struct {
+	Change  string `json:"change"`  // added, removed, relabeled, restyled or moved
+	Element string `json:"element"` // node, edge, subgraph, participant, message, note, classDef, …
+	ID      string `json:"id"`
+	From    string `json:"from,omitempty"` // the label, style or place before
+	To      string `json:"to,omitempty"`   // and after
+	Line    int    `json:"line,omitempty"` // in the newer diagram, or the older one for removals
+}
+
+// DiagramDiff is the semantic difference between two diagrams: what was
+// added, removed or changed, regardless of order and formatting.
+type DiagramDiff struct {
+	Kind    string       `json:"kind"`
+	Changes []DiffChange `json:"changes"`
+	// Diagram is the newer diagram with added elements styled green,
+	// removed ones put back and styled red, and changed ones amber.
+	Diagram string `json:"diagram,omitempty"`
+}
+
+// graphElements names the nodes and edges of each kind of diagram.
+var graphElements = map[string][2]string{
+	kindFlowchart: {"node", "edge"},
+	kindState:     {"state", "transition"},
+	kindClass:     {"class", "relationship"},
+	kindER:        {"entity", "relationship"},
+}
+
+// differ compares two diagrams, and remembers what to highlight.
+type differ struct {
+	a, b *Diagram
+	diff *DiagramDiff
+
+	added, removed, changed  []string // node ids
+	addedEdges, changedEdges []int    // into b.Edges
+	removedNodes             []*Node
+	removedEdges             []*Edge
+	messages                 map[int]string     // change by index into b.Messages
+	removedMessages          map[int][]*Message // by the index into b.Messages they went before
+}
+
+// diffDiagrams compares two diagram texts.
+func diffDiagrams(from, to string) (*DiagramDiff, error) {
+	a, b := ParseDiagram(from), ParseDiagram(to)
+	if a.Kind != "" && b.Kind != "" && a.Kind != b.Kind {
+		return nil, fmt.Errorf("can't compare a %s diagram with a %s diagram", a.Header, b.Header)
+	}
+	kind := b.Kind
+	if kind == "" {
+		kind = a.Kind
+	}
+	df := &differ{
+		a:               a,
+		b:               b,
+		diff:            &DiagramDiff{Kind: kind, Changes: []DiffChange{}},
+		messages:        make(map[int]string),
+		removedMessages: make(map[int][]*Message),
+	}
+	switch kind {
+	case kindSequence:
+		df.sequence()
+	case kindFlowchart, kindState, kindClass, kindER:
+		df.graph()
+	default:
+		df.statements()
+	}
+	df.styles()
+	if b.Kind != "" && len(df.diff.Changes) > 0 {
+		df.diff.Diagram = df.diagram(to)
+	}
+	return df.diff, nil
+}
+
+func (df *differ) add(change, element, id, from, to string, line int) {
+	df.diff.Changes = append(df.diff.Changes, DiffChange{
+		Change:  change,
+		Element: element,
+		ID:      id,
+		From:    from,
+		To:      to,
+		Line:    line,
+	})
+}
+
+// graph compares the nodes, edges and subgraphs of two graph diagrams.
+func (df *differ) graph() {
+	a, b := df.a, df.b
+	names := graphElements[df.diff.Kind]
+
+	for _, n := range b.Nodes {
+		if n.Shape == "terminal" {
+			continue
+		}
+		line := n.Span.Start.Line
+		old := a.Node(n.ID)
+		if old == nil {
+			df.add(diffAdded, names[0], n.ID, "", n.Label, line)
+			df.added = append(df.added, n.ID)
+			continue
+		}
+		changed := false
+		if old.Label != n.Label {
+			df.add(diffRelabeled, names[0], n.ID, old.Label, n.Label, line)
+			changed = true
+		}
+		if old.Shape != n.Shape {
+			df.add(diffRestyled, names[0], n.ID, "shape: "+old.Shape, "shape: "+n.Shape, line)
+			changed = true
+		}
+		if oc, nc := strings.Join(old.Classes, " "), strings.Join(n.Classes, " "); oc != nc {
+			df.add(diffRestyled, names[0], n.ID, "class: "+oc, "class: "+nc, line)
+			changed = true
+		}
+		if old.Subgraph != n.Subgraph {
+			df.add(diffMoved, names[0], n.ID, old.Subgraph, n.Subgraph, line)
+			changed = true
+		}
+		gone, come := multisetDiff(old.Members, n.Members)
+		for _, m := range come {
+			df.add(diffAdded, "member", n.ID, "", m, line)
+		}
+		for _, m := range gone {
+			df.add(diffRemoved, "member", n.ID, m, "", line)
+		}
+		if changed || len(gone)+len(come) > 0 {
+			df.changed = append(df.changed, n.ID)
+		}
+	}
+	for _, n := range a.Nodes {
+		if n.Shape != "terminal" && b.Node(n.ID) == nil {
+			df.add(diffRemoved, names[0], n.ID, n.Label, "", n.Span.Start.Line)
+			df.removed = append(df.removed, n.ID)
+			df.removedNodes = append(df.removedNodes, n)
+		}
+	}
+
+	pairs, gone, come := matchEdges(a.Edges, b.Edges)
+	for _, pair := range pairs {
+		ea, eb := a.Edges[pair[0]], b.Edges[pair[1]]
+		line := eb.Span.Start.Line
+		if ea.Label != eb.Label {
+			df.add(diffRelabeled, names[1], edgeID(eb), ea.Label, eb.Label, line)
+		}
+		if ea.Arrow != eb.Arrow {
+			df.add(diffRestyled, names[1], edgeID(eb), ea.Arrow, eb.Arrow, line)
+		}
+		if ea.Label != eb.Label || ea.Arrow != eb.Arrow {
+			df.changedEdges = append(df.changedEdges, pair[1])
+		}
+	}
+	for _, j := range come {
+		e := b.Edges[j]
+		df.add(diffAdded, names[1], edgeID(e), "", e.Label, e.Span.Start.Line)
+		df.addedEdges = append(df.addedEdges, j)
+	}
+	for _, i := range gone {
+		e := a.Edges[i]
+		df.add(diffRemoved, names[1], edgeID(e), e.Label, "", e.Span.Start.Line)
+		df.removedEdges = append(df.removedEdges, e)
+	}
+
+	// Composite states are compared as states.
+	if df.diff.Kind != kindState {
+		element := "subgraph"
+		if df.diff.Kind == kindClass {
+			element = "namespace"
+		}
+		for _, sg := range b.Subgraphs {
+			old := a.Subgraph(sg.ID)
+			switch {
+			case old == nil:
+				df.add(diffAdded, element, sg.ID, "", sg.Title, sg.Span.Start.Line)
+			case old.Title != sg.Title:
+				df.add(diffRelabeled, element, sg.ID, old.Title, sg.Title, sg.Span.Start.Line)
+			}
+		}
+		for _, sg := range a.Subgraphs {
+			if b.Subgraph(sg.ID) == nil {
+				df.add(diffRemoved, element, sg.ID, sg.Title, "", sg.Span.Start.Line)
+			}
+		}
+	}
+
+	if a.Header != "" && a.Direction != b.Direction {
+		df.add(diffRestyled, "diagram", "direction", a.Direction, b.Direction, 0)
+	}
+}
+
+// edgeID names an edge in a diff.
+func edgeID(e *Edge) string {
+	return e.From + " " + e.Arrow + " " + e.To
+}
+
+// matchEdges pairs the edges of a and b between the same nodes, preferring
+// ones that are alike, and returns the pairs and the indexes of the edges
+// left over in a and b.
+func matchEdges(a, b []*Edge) (pairs [][2]int, gone, come []int) {
+	key := func(e *Edge) string { return e.From + "\x00" + e.To }
+	byKey := make(map[string][]int)
+	for j, e := range b {
+		byKey[key(e)] = append(byKey[key(e)], j)
+	}
+	matchedA := make([]bool, len(a))
+	matchedB := make([]bool, len(b))
+	pair := func(alike bool) {
+		for i, ea := range a {
+			if matchedA[i] {
+				continue
+			}
+			for _, j := range byKey[key(ea)] {
+				eb := b[j]
+				if !matchedB[j] && (!alike || ea.Label == eb.Label && ea.Arrow == eb.Arrow) {
+					matchedA[i], matchedB[j] = true, true
+					pairs = append(pairs, [2]int{i, j})
+					break
+				}
+			}
+		}
+	}
+	pair(true)
+	pair(false)
+	for i := range a {
+		if !matchedA[i] {
+			gone = append(gone, i)
+		}
+	}
+	for j := range b {
+		if !matchedB[j] {
+			come = append(come, j)
+		}
+	}
+	return pairs, gone, come
+}
+
+// multisetDiff returns the strings only in a and only in b, counting
+// repeats.
+func multisetDiff(a, b []string) (gone, come []string) {
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		if count[s] > 0 {
+			count[s]--
+		} else {
+			come = append(come, s)
+		}
+	}
+	for _, s := range a {
+		if count[s] > 0 {
+			count[s]--
+			gone = append(gone, s)
+		}
+	}
+	return gone, come
+}
+
+// sequence compares the participants, messages and notes of two sequence
+// diagrams. Messages are compared in order, so moving one is a removal and
+// an addition.
+func (df *differ) sequence() {
+	a, b := df.a, df.b
+	for _, pt := range b.Participants {
+		line := pt.Span.Start.Line
+		old := a.Participant(pt.ID)
+		switch {
+		case old == nil:
+			df.add(diffAdded, "participant", pt.ID, "", pt.Label, line)
+			continue
+		case old.Label != pt.Label:
+			df.add(diffRelabeled, "participant", pt.ID, old.Label, pt.Label, line)
+		}
+		if old.Kind != pt.Kind {
+			df.add(diffRestyled, "participant", pt.ID, old.Kind, pt.Kind, line)
+		}
+	}
+	for _, pt := range a.Participants {
+		if b.Participant(pt.ID) == nil {
+			df.add(diffRemoved, "participant", pt.ID, pt.Label, "", pt.Span.Start.Line)
+		}
+	}
+
+	key := func(m *Message) string { return m.From + "\x00" + m.Arrow + "\x00" + m.To + "\x00" + m.Text }
+	keys := func(ms []*Message) []string {
+		out := make([]string, len(ms))
+		for i, m := range ms {
+			out[i] = key(m)
+		}
+		return out
+	}
+	match := matchLines(keys(a.Messages), keys(b.Messages))
+	matchedB := make([]bool, len(b.Messages))
+	for _, j := range match {
+		if j >= 0 {
+			matchedB[j] = true
+		}
+	}
+	// Between messages that match, pair up those between the same
+	// participants as changed ones.
+	i, j := 0, 0
+	for i < len(a.Messages) || j < len(b.Messages) {
+		if i < len(a.Messages) && j < len(b.Messages) && match[i] == j {
+			i, j = i+1, j+1
+			continue
+		}
+		gi, gj := i, j
+		for i < len(a.Messages) && match[i] < 0 {
+			i++
+		}
+		for j < len(b.Messages) && !matchedB[j] {
+			j++
+		}
+		df.messageGap(a.Messages[gi:i], b.Messages[gj:j], gj)
+	}
+
+	noteKey := func(n *Note) string { return n.Position + "\x00" + strings.Join(n.Actors, ",") }
+	for _, pair := range matchNotes(a.Notes, b.Notes, noteKey) {
+		na, nb := pair[0], pair[1]
+		switch {
+		case na == nil:
+			df.add(diffAdded, "note", noteID(nb), "", nb.Text, nb.Span.Start.Line)
+		case nb == nil:
+			df.add(diffRemoved, "note", noteID(na), na.Text, "", na.Span.Start.Line)
+		case na.Text != nb.Text:
+			df.add(diffRelabeled, "note", noteID(nb), na.Text, nb.Text, nb.Span.Start.Line)
+		}
+	}
+}
+
+// messageGap compares the messages between two that match, the new ones
+// starting at index start of b.Messages.
+func (df *differ) messageGap(old, new []*Message, start int) {
+	paired := make([]bool, len(new))
+	// Removed messages go before the next one that was kept.
+	var pending []*Message
+	flush := func(k int) {
+		df.removedMessages[start+k] = append(df.removedMessages[start+k], pending...)
+		pending = nil
+	}
+	for _, ma := range old {
+		found := -1
+		for k, mb := range new {
+			if !paired[k] && ma.From == mb.From && ma.To == mb.To {
+				found = k
+				break
+			}
+		}
+		if found < 0 {
+			df.add(diffRemoved, "message", messageID(ma), ma.Text, "", ma.Span.Start.Line)
+			pending = append(pending, ma)
+			continue
+		}
+		flush(found)
+		paired[found] = true
+		mb := new[found]
+		if ma.Text != mb.Text {
+			df.add(diffRelabeled, "message", messageID(mb), ma.Text, mb.Text, mb.Span.Start.Line)
+		}
+		if ma.Arrow != mb.Arrow {
+			df.add(diffRestyled, "message", messageID(mb), ma.Arrow, mb.Arrow, mb.Span.Start.Line)
+		}
+		df.messages[start+found] = diffRelabeled
+	}
+	if len(pending) > 0 {
+		flush(len(new))
+	}
+	for k, mb := range new {
+		if !paired[k] {
+			df.add(diffAdded, "message", messageID(mb), "", mb.Text, mb.Span.Start.Line)
+			df.messages[start+k] = diffAdded
+		}
+	}
+}
+
+// messageID names a message in a diff.
+func messageID(m *Message) string {
+	return m.From + m.Arrow + m.To
+}
+
+// noteID names a note in a diff.
+func noteID(n *Note) string {
+	return strings.TrimSpace(n.Position + " " + strings.Join(n.Actors, ","))
+}
+
+// matchNotes pairs the notes of a and b, first those alike and then those
+// with the same key. Unpaired notes come with nil.
+func matchNotes(a, b []*Note, key func(*Note) string) [][2]*Note {
+	var pairs [][2]*Note
+	usedA := make([]bool, len(a))
+	usedB := make([]bool, len(b))
+	for _, alike := range []bool{true, false} {
+		for i, na := range a {
+			for j, nb := range b {
+				if usedA[i] || usedB[j] || key(na) != key(nb) || alike && na.Text != nb.Text {
+					continue
+				}
+				usedA[i], usedB[j] = true, true
+				pairs = append(pairs, [2]*Note{na, nb})
+			}
+		}
+	}
+	for j, nb := range b {
+		if !usedB[j] {
+			pairs = append(pairs, [2]*Note{nil, nb})
+		}
+	}
+	for i, na := range a {
+		if !usedA[i] {
+			pairs = append(pairs, [2]*Note{na, nil})
+		}
+	}
+	return pairs
+}
+
+// statements compares diagrams the parser doesn't know in detail statement
+// by statement.
+func (df *differ) statements() {
+	texts := func(d *Diagram) ([]string, []Statement) {
+		var out []string
+		var stmts []Statement
+		for _, s := range d.Statements {
+			switch s.Kind {
+			case stmtBlank, stmtComment, stmtHeader, stmtDirective:
+				continue
+			}
+			out = append(out, s.Text)
+			stmts = append(stmts, s)
+		}
+		return out, stmts
+	}
+	ta, sa := texts(df.a)
+	tb, sb := texts(df.b)
+	match := matchLines(ta, tb)
+	matchedB := make([]bool, len(tb))
+	for i, j := range match {
+		if j >= 0 {
+			matchedB[j] = true
+		} else {
+			df.add(diffRemoved, "statement", ta[i], "", "", sa[i].Span.Start.Line)
+		}
+	}
+	for j, t := range tb {
+		if !matchedB[j] {
+			df.add(diffAdded, "statement", t, "", "", sb[j].Span.Start.Line)
+		}
+	}
+}
+
+// styles compares classDef, style and linkStyle statements.
+func (df *differ) styles() {
+	classDefs := func(d *Diagram) map[string]*ClassDef {
+		m := make(map[string]*ClassDef)
+		for _, c := range d.ClassDefs {
+			m[c.Name] = c
+		}
+		return m
+	}
+	ca, cb := classDefs(df.a), classDefs(df.b)
+	for _, c := range df.b.ClassDefs {
+		if cb[c.Name] != c {
+			continue // overridden by a later one
+		}
+		switch old := ca[c.Name]; {
+		case old == nil:
+			df.add(diffAdded, "classDef", c.Name, "", c.Styles, c.Span.Start.Line)
+		case old.Styles != c.Styles:
+			df.add(diffRestyled, "classDef", c.Name, old.Styles, c.Styles, c.Span.Start.Line)
+		}
+	}
+	for _, c := range df.a.ClassDefs {
+		if ca[c.Name] == c && cb[c.Name] == nil {
+			df.add(diffRemoved, "classDef", c.Name, c.Styles, "", c.Span.Start.Line)
+		}
+	}
+
+	element := func(s *Style) string {
+		if s.Link {
+			return "linkStyle"
+		}
+		return "style"
+	}
+	styles := func(d *Diagram) map[string]*Style {
+		m := make(map[string]*Style)
+		for _, s := range d.Styles {
+			m[element(s)+" "+s.Target] = s
+		}
+		return m
+	}
+	sa, sb := styles(df.a), styles(df.b)
+	for _, s := range df.b.Styles {
+		k := element(s) + " " + s.Target
+		if sb[k] != s {
+			continue
+		}
+		switch old := sa[k]; {
+		case old == nil:
+			df.add(diffAdded, element(s), s.Target, "", s.Styles, s.Span.Start.Line)
+		case old.Styles != s.Styles:
+			df.add(diffRestyled, element(s), s.Target, old.Styles, s.Styles, s.Span.Start.Line)
+		default:
+			continue
+		}
+		if !s.Link {
+			df.restyled(s.Target)
+		}
+	}
+	for _, s := range df.a.Styles {
+		k := element(s) + " " + s.Target
+		if sa[k] == s && sb[k] == nil {
+			df.add(diffRemoved, element(s), s.Target, s.Styles, "", s.Span.Start.Line)
+			if !s.Link {
+				df.restyled(s.Target)
+			}
+		}
+	}
+}
+
+// restyled highlights node id as changed, if it is in the newer diagram
+// and not already highlighted.
+func (df *differ) restyled(id string) {
+	if df.b.Node(id) == nil || slices.Contains(df.added, id) || slices.Contains(df.changed, id) {
+		return
+	}
+	df.changed = append(df.changed, id)
+}
+
+// diagram returns the diff diagram for to, or "" for kinds of diagram that
+// can't be styled.
+func (df *differ) diagram(to string) string {
+	switch df.diff.Kind {
+	case kindFlowchart, kindState, kindClass:
+		return df.graphDiagram(to)
+	case kindSequence:
+		return df.sequenceDiagram()
+	}
+	return ""
+}
+
+// graphDiagram puts the removed nodes and edges back into to, and styles
+// what changed.
+func (df *differ) graphDiagram(to string) string {
+	indent := formatIndent
+	var sb strings.Builder
+	sb.WriteString(strings.TrimRight(to, "\n") + "\n")
+	kind := df.diff.Kind
+
+	var removed []string
+	for _, n := range df.removedNodes {
+		if line := diffNodeText(kind, n); line != "" {
+			removed = append(removed, line)
+		}
+	}
+	removedLinks := 0
+	for _, e := range df.removedEdges {
+		if line := diffEdgeText(kind, e); line != "" {
+			removed = append(removed, line)
+			removedLinks++
+		}
+	}
+	if len(removed) > 0 {
+		sb.WriteString(indent + "%% removed\n")
+		for _, line := range removed {
+			sb.WriteString(indent + line + "\n")
+		}
+	}
+
+	styled := false
+	for _, class := range []struct {
+		name, style string
+		ids         []string
+	}{
+		{"diffAdded", diffAddedStyle, df.added},
+		{"diffRemoved", diffRemovedStyle, df.removed},
+		{"diffChanged", diffChangedStyle, df.changed},
+	} {
+		if len(class.ids) == 0 {
+			continue
+		}
+		if !styled {
+			sb.WriteString(indent + "%% diff styles\n")
+			styled = true
+		}
+		sb.WriteString(indent + "classDef " + class.name + " " + class.style + "\n")
+		if kind == kindClass {
+			sb.WriteString(fmt.Sprintf("%scssClass \"%s\" %s\n", indent, strings.Join(class.ids, ","), class.name))
+		} else {
+			sb.WriteString(indent + "class " + strings.Join(class.ids, ",") + " " + class.name + "\n")
+		}
+		// A node's own style statements win over any class; style it
+		// again after them.
+		if kind == kindFlowchart {
+			for _, id := range class.ids {
+				if df.hasStyle(id) {
+					sb.WriteString(indent + "style " + id + " " + class.style + "\n")
+				}
+			}
+		}
+	}
+
+	if kind != kindFlowchart {
+		return sb.String()
+	}
+	links := func(indexes []int, style string) {
+		if len(indexes) == 0 {
+			return
+		}
+		s := make([]string, len(indexes))
+		for k, i := range indexes {
+			s[k] = strconv.Itoa(i)
+		}
+		sb.WriteString(indent + "linkStyle " + strings.Join(s, ",") + " " + style + "\n")
+	}
+	links(df.addedEdges, "stroke:#2e7d32,stroke-width:2px")
+	links(df.changedEdges, "stroke:#f9a825,stroke-width:2px")
+	var gone []int
+	for k := range removedLinks {
+		gone = append(gone, len(df.b.Edges)+k)
+	}
+	links(gone, "stroke:#c62828,stroke-dasharray:4 3")
+	return sb.String()
+}
+
+// hasStyle reports whether the newer diagram has a style statement for
+// node id.
+func (df *differ) hasStyle(id string) bool {
+	for _, s := range df.b.Styles {
+		if !s.Link && s.Target == id {
+			return true
+		}
+	}
+	return false
+}
+
+// diffNodeText writes a removed node back, or returns "" if it can't be.
+func diffNodeText(kind string, n *Node) string {
+	switch kind {
+	case kindFlowchart:
+		return flowchartNodeText(n.ID, n.Label, n.Shape)
+	case kindState:
+		if label, _, _ := strings.Cut(n.Label, "\n"); label != n.ID {
+			return fmt.Sprintf("state %s as %s", quoteLabel(label), n.ID)
+		}
+		return n.ID
+	case kindClass:
+		return "class " + n.ID
+	}
+	return ""
+}
+
+// diffEdgeText writes a removed edge back, or returns "" if it can't be.
+func diffEdgeText(kind string, e *Edge) string {
+	switch kind {
+	case kindFlowchart:
+		if e.Label != "" && !strings.HasPrefix(e.Arrow, "~") {
+			return fmt.Sprintf("%s %s|%s| %s", e.From, e.Arrow, quoteLabel(e.Label), e.To)
+		}
+		return e.From + " " + e.Arrow + " " + e.To
+	case kindState:
+		if strings.Contains(e.From, "/") || strings.Contains(e.To, "/") {
+			return "" // a [*] inside a composite state
+		}
+		return fmt.Sprintf("%s --> %s : removed %s", e.From, e.To, e.Label)
+	case kindClass:
+		return fmt.Sprintf("%s %s %s : removed %s", e.From, e.Arrow, e.To, e.Label)
+	}
+	return ""
+}
+
+// flowchartNodeText writes a flowchart node with its label, in quotes, and
+// shape.
+func flowchartNodeText(id, label, shape string) string {
+	return nodeText(id, label, shape, quoteLabel)
+}
+
+// nodeText writes a flowchart node with its label, written by quote, and
+// shape.
+func nodeText(id, label, shape string, quote func(string) string) string {
+	if label == id && shape == "rect" {
+		return id
+	}
+	for _, s := range flowchartShapes {
+		for _, c := range s.closes {
+			if c.shape == shape {
+				return id + s.open + quote(label) + c.close
+			}
+		}
+	}
+	return fmt.Sprintf("%s@{ shape: %s, label: %s }", id, shape, quoteLabel(label))
+}
+
+// quoteLabel quotes a label, escaping any quotes in it.
+func quoteLabel(label string) string {
+	return `"` + strings.ReplaceAll(label, `"`, "#quot;") + `"`
+}
+
+// sequenceDiagram rewrites the newer sequence diagram with added and
+// changed messages highlighted and removed ones put back.
+func (df *differ) sequenceDiagram() string {
+	var sb strings.Builder
+	byStmt := make(map[int]int)
+	for k, m := range df.b.Messages {
+		byStmt[m.Stmt] = k
+	}
+	rect := func(indent, color string, lines ...string) {
+		sb.WriteString(indent + "rect " + color + "\n")
+		for _, l := range lines {
+			sb.WriteString(indent + formatIndent + l + "\n")
+		}
+		sb.WriteString(indent + "end\n")
+	}
+	removed := func(indent string, k int) {
+		for _, m := range df.removedMessages[k] {
+			rect(indent, "rgba(198, 40, 40, 0.15)", fmt.Sprintf("%s%s%s: (removed) %s", m.From, m.Arrow, m.To, m.Text))
+		}
+	}
+	for i, s := range df.b.Statements {
+		indent := strings.Repeat(formatIndent, s.Depth)
+		if s.Kind == stmtBlank {
+			sb.WriteString("\n")
+			continue
+		}
+		k, ok := byStmt[i]
+		if !ok {
+			sb.WriteString(indent + s.Text + "\n")
+			continue
+		}
+		removed(indent, k)
+		switch df.messages[k] {
+		case diffAdded:
+			rect(indent, "rgba(46, 125, 50, 0.15)", s.Text)
+		case diffRelabeled:
+			rect(indent, "rgba(249, 168, 37, 0.2)", s.Text)
+		default:
+			sb.WriteString(indent + s.Text + "\n")
+		}
+	}
+	removed(formatIndent, len(df.b.Messages))
+	return sb.String()
+}
+
+// Diff compares two versions of the diagram that are still in the history.
+// to defaults to the current version, and from to the one before it.
+func (d *DiagramState) Diff(from, to int64) (*DiagramDiff, error) {
+	d.mu.RLock()
+	if to <= 0 {
+		to = d.version
+	}
+	if from <= 0 {
+		from = max(to-1, 1)
+	}
+	a, errA := d.contentAt(from)
+	b, errB := d.contentAt(to)
+	d.mu.RUnlock()
+	if errA != nil {
+		return nil, fmt.Errorf("version %d is not in the history: %w", from, errA)
+	}
+	if errB != nil {
+		return nil, fmt.Errorf("version %d is not in the history: %w", to, errB)
+	}
+	return diffDiagrams(a, b)
+}
+
+// handleGetDiff compares two versions of the diagram: ?from=&to=.
+func (d *DiagramState) handleGetDiff(w http.ResponseWriter, r *http.Request) {
+	var versions [2]int64
+	for i, name := range []string{"from", "to"} {
+		if s := r.URL.Query().Get(name); s != "" {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, name+" must be a version number", http.StatusBadRequest)
+				return
+			}
+			versions[i] = v
+		}
+	}
+	diff, err := d.Diff(versions[0], versions[1])
+	writeDiff(w, diff, err)
+}
+
+// handlePostDiff compares two diagram texts: {"from", "to"}.
+func handlePostDiff(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	diff, err := diffDiagrams(req.From, req.To)
+	writeDiff(w, diff, err)
+}
+
+func writeDiff(w http.ResponseWriter, diff *DiagramDiff, err error) {
+	switch {
+	case errors.Is(err, errVersionConflict):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// changes returns the changes of a diff as "change element id" strings.
+func changes(diff *DiagramDiff) []string {
+	var out []string
+	for _, c := range diff.Changes {
+		out = append(out, c.Change+" "+c.Element+" "+c.ID)
+	}
+	return out
+}
+
+func TestDiffDiagrams(t *testing.T) {
+	Convey("diffDiagrams", t, func() {
+		Convey("Finds nothing between diagrams that only differ in formatting", func() {
+			diff, err := diffDiagrams("graph TD\n  A[Start]-->B", "graph TD\n\n    B\n    A[Start] --> B;\n")
+			So(err, ShouldBeNil)
+			So(diff.Kind, ShouldEqual, kindFlowchart)
+			So(diff.Changes, ShouldBeEmpty)
+			So(diff.Diagram, ShouldEqual, "")
+		})
+
+		Convey("Finds added, removed and relabeled nodes and edges", func() {
+			diff, err := diffDiagrams(
+				"graph TD\n  A[Start] --> B\n  B --> C\n  C --> D",
+				"graph TD\n  A[Begin] --> B\n  B -->|yes| C\n  C --> E",
+			)
+			So(err, ShouldBeNil)
+			So(changes(diff), ShouldResemble, []string{
+				"relabeled node A",
+				"added node E",
+				"removed node D",
+				"relabeled edge B --> C",
+				"added edge C --> E",
+				"removed edge C --> D",
+			})
+			So(diff.Changes[0].From, ShouldEqual, "Start")
+			So(diff.Changes[0].To, ShouldEqual, "Begin")
+			So(diff.Changes[0].Line, ShouldEqual, 2)
+			So(diff.Changes[5].Line, ShouldEqual, 4)
+		})
+
+		Convey("Finds restyled and moved nodes", func() {
+			diff, _ := diffDiagrams(
+				"graph LR\n  A[One]\n  subgraph s\n    B\n  end",
+				"graph TD\n  A(One)\n  B\n  subgraph s\n  end",
+			)
+			So(changes(diff), ShouldResemble, []string{
+				"restyled node A",
+				"moved node B",
+				"restyled diagram direction",
+			})
+			So(diff.Changes[0].To, ShouldEqual, "shape: round")
+			So(diff.Changes[1].From, ShouldEqual, "s")
+		})
+
+		Convey("Finds style changes", func() {
+			diff, _ := diffDiagrams(
+				"graph TD\n  A\n  classDef hot fill:#f00\n  style A stroke:#000",
+				"graph TD\n  A:::hot\n  classDef hot fill:#f80\n  classDef cold fill:#00f",
+			)
+			So(changes(diff), ShouldResemble, []string{
+				"restyled node A",
+				"restyled classDef hot",
+				"added classDef cold",
+				"removed style A",
+			})
+		})
+
+		Convey("Highlights restyled nodes in the diff diagram", func() {
+			diff, _ := diffDiagrams(
+				"graph TD\n  A:::foo-->B\n  B --> C\n  style C fill:#f00\n  classDef foo fill:#f00\n  classDef bar fill:#00f",
+				"graph TD\n  A:::bar-->B\n  B --> C\n  style C fill:#0f0\n  classDef foo fill:#f00\n  classDef bar fill:#00f",
+			)
+			So(changes(diff), ShouldResemble, []string{"restyled node A", "restyled style C"})
+			So(diff.Diagram, ShouldContainSubstring, "class A,C diffChanged\n")
+			So(diff.Diagram, ShouldEndWith, "    style C "+diffChangedStyle+"\n")
+			So(ParseDiagram(diff.Diagram).Errors, ShouldBeEmpty)
+		})
+
+		Convey("Draws a diff diagram of a flowchart", func() {
+			diff, _ := diffDiagrams(
+				"graph TD\n  A --> B\n  B --> C[Old]",
+				"graph TD\n  A --> B\n  A --> D",
+			)
+			So(diff.Diagram, ShouldStartWith, "graph TD\n  A --> B\n  A --> D\n")
+			So(diff.Diagram, ShouldContainSubstring, "%% removed\n    C[\"Old\"]\n    B --> C\n")
+			So(diff.Diagram, ShouldContainSubstring, "class D diffAdded\n")
+			So(diff.Diagram, ShouldContainSubstring, "class C diffRemoved\n")
+			So(diff.Diagram, ShouldContainSubstring, "linkStyle 1 stroke:#2e7d32")
+			So(diff.Diagram, ShouldContainSubstring, "linkStyle 2 stroke:#c62828")
+
+			d := ParseDiagram(diff.Diagram)
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Edges, ShouldHaveLength, 3)
+		})
+
+		Convey("Finds changes to a sequence diagram", func() {
+			diff, err := diffDiagrams(
+				"sequenceDiagram\n  participant A as Alice\n  A->>B: Hello\n  B->>A: Hi\n  A->>B: Bye",
+				"sequenceDiagram\n  participant A as Alicia\n  A->>B: Hello\n  B-->>A: Hi there\n  B->>C: Forward",
+			)
+			So(err, ShouldBeNil)
+			So(changes(diff), ShouldResemble, []string{
+				"relabeled participant A",
+				"added participant C",
+				"relabeled message B-->>A",
+				"restyled message B-->>A",
+				"removed message A->>B",
+				"added message B->>C",
+			})
+
+			d := ParseDiagram(diff.Diagram)
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Messages, ShouldHaveLength, 4)
+			So(d.Messages[3].Text, ShouldEqual, "(removed) Bye")
+			So(d.Blocks, ShouldHaveLength, 3)
+			So(d.Blocks[0].Kind, ShouldEqual, "rect")
+		})
+
+		Convey("Finds changes to a class diagram", func() {
+			diff, _ := diffDiagrams(
+				"classDiagram\n  class Animal {\n    +eat()\n  }\n  Animal <|-- Duck",
+				"classDiagram\n  class Animal {\n    +eat()\n    +sleep()\n  }\n  Animal <|-- Duck\n  Animal <|-- Cow",
+			)
+			So(changes(diff), ShouldResemble, []string{
+				"added member Animal",
+				"added class Cow",
+				"added relationship Animal <|-- Cow",
+			})
+			So(diff.Diagram, ShouldContainSubstring, `cssClass "Cow" diffAdded`)
+			So(ParseDiagram(diff.Diagram).Errors, ShouldBeEmpty)
+		})
+
+		Convey("Finds changes to a state diagram", func() {
+			diff, _ := diffDiagrams(
+				"stateDiagram-v2\n  [*] --> Idle\n  Idle --> Busy\n  Busy --> [*]",
+				"stateDiagram-v2\n  [*] --> Idle\n  Idle --> Busy : start\n  Busy --> Done",
+			)
+			So(changes(diff), ShouldResemble, []string{
+				"added state Done",
+				"relabeled transition Idle --> Busy",
+				"added transition Busy --> Done",
+				"removed transition Busy --> [*]",
+			})
+			So(ParseDiagram(diff.Diagram).Errors, ShouldBeEmpty)
+		})
+
+		Convey("Compares other diagrams statement by statement", func() {
+			diff, _ := diffDiagrams("pie\n  \"A\" : 1\n  \"B\" : 2", "pie\n  \"A\" : 1\n  \"C\" : 3")
+			So(changes(diff), ShouldResemble, []string{
+				`removed statement "B" : 2`,
+				`added statement "C" : 3`,
+			})
+			So(diff.Diagram, ShouldEqual, "")
+		})
+
+		Convey("Refuses to compare different kinds of diagram", func() {
+			_, err := diffDiagrams("graph TD\n  A", "sequenceDiagram\n  A->>B: x")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDiffHandlers(t *testing.T) {
+	Convey("Given a DiagramState with a few versions", t, func() {
+		ds := NewDiagramState("graph TD\n  A --> B")
+		ds.Set("graph TD\n  A --> B\n  B --> C", "mcp")
+		ds.Set("graph TD\n  A --> B\n  B --> C[See]", "browser")
+
+		get := func(query string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			ds.handleGetDiff(w, httptest.NewRequest("GET", "/api/diagram/diff"+query, nil))
+			return w
+		}
+
+		Convey("The diff defaults to the last change", func() {
+			w := get("")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var diff DiagramDiff
+			So(json.Unmarshal(w.Body.Bytes(), &diff), ShouldBeNil)
+			So(changes(&diff), ShouldResemble, []string{"relabeled node C"})
+		})
+
+		Convey("Any two versions can be compared", func() {
+			var diff DiagramDiff
+			So(json.Unmarshal(get("?from=1&to=3").Body.Bytes(), &diff), ShouldBeNil)
+			So(changes(&diff), ShouldResemble, []string{"added node C", "added edge B --> C"})
+		})
+
+		Convey("Unknown versions are not found", func() {
+			So(get("?from=9").Code, ShouldEqual, http.StatusNotFound)
+			So(get("?to=x").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Two texts can be compared", func() {
+			w := httptest.NewRecorder()
+			body := `{"from": "graph TD\n  A", "to": "graph TD\n  A\n  B"}`
+			handlePostDiff(w, httptest.NewRequest("POST", "/api/diagram/diff", strings.NewReader(body)))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var diff DiagramDiff
+			So(json.Unmarshal(w.Body.Bytes(), &diff), ShouldBeNil)
+			So(changes(&diff), ShouldResemble, []string{"added node B"})
+		})
+	})
+}
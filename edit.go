@@ -0,0 +1,245 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// textEdit replaces src[from:to] with text.
+type textEdit struct {
+	from, to int
+	text     string
+}
+
+// applyEdits makes edits to src. Edits must not overlap, except deletions,
+// which may.
+func applyEdits(src string, edits []textEdit) string {
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].from != edits[j].from {
+			return edits[i].from < edits[j].from
+		}
+		return edits[i].to < edits[j].to
+	})
+	var sb strings.Builder
+	at := 0
+	for _, e := range edits {
+		if e.from > at {
+			sb.WriteString(src[at:e.from])
+		}
+		sb.WriteString(e.text)
+		at = max(at, e.to)
+	}
+	sb.WriteString(src[at:])
+	return sb.String()
+}
+
+// textEditor edits a parsed diagram with the smallest text edits that do
+// it, so the rest of the text keeps its layout and comments.
+type textEditor struct {
+	src   string
+	d     *Diagram
+	edits []textEdit
+}
+
+func (t *textEditor) replace(from, to int, text string) {
+	t.edits = append(t.edits, textEdit{from, to, text})
+}
+
+// text returns the text of span.
+func (t *textEditor) text(s Span) string {
+	return t.src[s.Start.Offset:s.End.Offset]
+}
+
+// result returns the edited text.
+func (t *textEditor) result() string {
+	return applyEdits(t.src, t.edits)
+}
+
+// newline returns the line ending the text uses.
+func (t *textEditor) newline() string {
+	if strings.Contains(t.src, "\r\n") {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// lineStart returns where the line with off starts.
+func (t *textEditor) lineStart(off int) int {
+	return strings.LastIndexByte(t.src[:off], '\n') + 1
+}
+
+// lineEnd returns where the line with off ends, before any \r\n.
+func (t *textEditor) lineEnd(off int) int {
+	end := len(t.src)
+	if i := strings.IndexByte(t.src[off:], '\n'); i >= 0 {
+		end = off + i
+	}
+	if end > off && t.src[end-1] == '\r' {
+		end--
+	}
+	return end
+}
+
+// indent returns the indentation of the line st starts on.
+func (t *textEditor) indent(st Statement) string {
+	from := t.lineStart(st.Span.Start.Offset)
+	before := t.src[from:st.Span.Start.Offset]
+	return before[:len(before)-len(strings.TrimLeft(before, " \t"))]
+}
+
+// aloneOnLine reports whether st is the only statement on its lines.
+func (t *textEditor) aloneOnLine(st Statement) bool {
+	from, to := st.Span.Start.Offset, st.Span.End.Offset
+	before := t.src[t.lineStart(from):from]
+	after := t.src[to:t.lineEnd(to)]
+	return strings.TrimSpace(before) == "" && strings.Trim(after, " \t;") == ""
+}
+
+// remove deletes statement st, with its line if it has one to itself, or
+// else with the semicolon joining it to its neighbour.
+func (t *textEditor) remove(st Statement) {
+	from, to := st.Span.Start.Offset, st.Span.End.Offset
+	if t.aloneOnLine(st) {
+		from, to = t.lineStart(from), t.lineEnd(to)
+		switch {
+		case to < len(t.src):
+			to += len(t.src[to:]) - len(strings.TrimPrefix(strings.TrimPrefix(t.src[to:], "\r"), "\n"))
+		case from > 0:
+			from--
+			if from > 0 && t.src[from-1] == '\r' {
+				from--
+			}
+		}
+		t.replace(from, to, "")
+		return
+	}
+	if rest := strings.TrimLeft(t.src[to:], " \t"); strings.HasPrefix(rest, ";") {
+		to = len(t.src) - len(strings.TrimLeft(rest[1:], " \t"))
+	} else {
+		from = len(strings.TrimRight(t.src[:from], " \t;"))
+	}
+	t.replace(from, to, "")
+}
+
+// rewrite replaces statement st with lines, which go on lines of their own
+// if st has one, or else are joined by semicolons. No lines removes it.
+func (t *textEditor) rewrite(st Statement, lines []string) {
+	if len(lines) == 0 {
+		t.remove(st)
+		return
+	}
+	sep := "; "
+	if t.aloneOnLine(st) {
+		sep = t.newline() + t.indent(st)
+	}
+	t.replace(st.Span.Start.Offset, st.Span.End.Offset, strings.Join(lines, sep))
+}
+
+// blockEnd returns the index of the statement closing the block opened by
+// statement open, or -1 if it is left open.
+func (t *textEditor) blockEnd(open int) int {
+	depth := t.d.Statements[open].Depth
+	for i := open + 1; i < len(t.d.Statements); i++ {
+		if st := t.d.Statements[i]; st.Kind == stmtClose && st.Depth == depth {
+			return i
+		}
+	}
+	return -1
+}
+
+// childIndent returns the indentation of the statements in the block
+// opened by statement open: that of the first one, or one level more than
+// the block's own.
+func (t *textEditor) childIndent(open int) string {
+	depth := t.d.Statements[open].Depth
+	for _, st := range t.d.Statements[open+1:] {
+		if st.Depth <= depth {
+			break
+		}
+		if st.Kind != stmtBlank && st.Depth == depth+1 && t.aloneOnLine(st) {
+			return t.indent(st)
+		}
+	}
+	return t.indent(t.d.Statements[open]) + formatIndent
+}
+
+// topIndent returns the indentation of the statements after the header.
+func (t *textEditor) topIndent() string {
+	for _, st := range t.d.Statements {
+		switch {
+		case st.Kind == stmtBlank || st.Kind == stmtHeader || st.Kind == stmtDirective || st.Depth > 0:
+		case t.aloneOnLine(st):
+			return t.indent(st)
+		}
+	}
+	return formatIndent
+}
+
+// appendTop adds a statement at the end of the diagram.
+func (t *textEditor) appendTop(text string) {
+	for i := len(t.d.Statements) - 1; i >= 0; i-- {
+		if st := t.d.Statements[i]; st.Kind != stmtBlank {
+			at := t.lineEnd(st.Span.End.Offset)
+			t.replace(at, at, t.newline()+t.topIndent()+text)
+			return
+		}
+	}
+	t.replace(len(t.src), len(t.src), text)
+}
+
+// appendIn adds a statement at the end of the block opened by statement
+// open, or at the end of the diagram for -1.
+func (t *textEditor) appendIn(open int, text string) {
+	if open < 0 {
+		t.appendTop(text)
+		return
+	}
+	end := t.blockEnd(open)
+	if end < 0 {
+		t.appendTop(text)
+		return
+	}
+	st := t.d.Statements[end]
+	if !t.aloneOnLine(st) {
+		t.replace(st.Span.Start.Offset, st.Span.Start.Offset, text+"; ")
+		return
+	}
+	at := t.lineStart(st.Span.Start.Offset)
+	t.replace(at, at, t.childIndent(open)+text+t.newline())
+}
+
+// insertAfter adds a statement after statement st: on a line of its own,
+// indented by indent, or if st shares its line, after a semicolon.
+func (t *textEditor) insertAfter(st Statement, indent, text string) {
+	if !t.aloneOnLine(st) {
+		t.replace(st.Span.End.Offset, st.Span.End.Offset, "; "+text)
+		return
+	}
+	at := t.lineEnd(st.Span.End.Offset)
+	t.replace(at, at, t.newline()+indent+text)
+}
+
+// insertBefore adds a statement before statement st: on a line of its own,
+// indented by indent, or if st shares its line, before a semicolon.
+func (t *textEditor) insertBefore(st Statement, indent, text string) {
+	if !t.aloneOnLine(st) {
+		t.replace(st.Span.Start.Offset, st.Span.Start.Offset, text+"; ")
+		return
+	}
+	at := t.lineStart(st.Span.Start.Offset)
+	t.replace(at, at, indent+text+t.newline())
+}
+
+// indentUnit returns one level of indentation as the text uses it.
+func (t *textEditor) indentUnit() string {
+	top := t.topIndent()
+	for _, st := range t.d.Statements {
+		if st.Depth != 1 || st.Kind == stmtBlank || !t.aloneOnLine(st) {
+			continue
+		}
+		if indent := t.indent(st); len(indent) > len(top) && strings.HasPrefix(indent, top) {
+			return indent[len(top):]
+		}
+	}
+	return formatIndent
+}
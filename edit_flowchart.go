@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// classSuffixRe matches the :::classes after a node.
+var classSuffixRe = regexp.MustCompile(`(:::[\w-]+)+$`)
+
+// flowchartEditor parses a flowchart to edit. It refuses other diagrams,
+// and flowcharts with syntax errors, whose spans can't be trusted.
+func flowchartEditor(src string) (*textEditor, error) {
+	d := ParseDiagram(src)
+	if d.Kind != kindFlowchart {
+		return nil, errors.New("the diagram isn't a flowchart")
+	}
+	if len(d.Errors) > 0 {
+		return nil, fmt.Errorf("fix the syntax error at %s first", d.Errors[0])
+	}
+	return &textEditor{src: src, d: d}, nil
+}
+
+// checkNodeID reports whether id can be written as a node id.
+func checkNodeID(id string) error {
+	if id == "" || scanID(id) != len(id) || id == "end" {
+		return fmt.Errorf("%q isn't a valid node id; use letters, digits and underscores, and not end", id)
+	}
+	return nil
+}
+
+// labelText writes a label, in quotes if it has characters Mermaid would
+// read as syntax.
+func labelText(label string) string {
+	if label == "" || label != strings.TrimSpace(label) || strings.ContainsAny(label, "\"()[]{}<>|;#&%`") ||
+		strings.HasPrefix(label, "/") || strings.HasPrefix(label, `\`) {
+		return quoteLabel(label)
+	}
+	return label
+}
+
+// labeledLink writes a flowchart arrow with text after it.
+func labeledLink(arrow, label string) string {
+	if label == "" {
+		return arrow
+	}
+	return arrow + "|" + labelText(label) + "|"
+}
+
+// subgraphStmt returns the statement opening subgraph id, or -1 for "".
+func (t *textEditor) subgraphStmt(id string) (int, error) {
+	if id == "" {
+		return -1, nil
+	}
+	sg := t.d.Subgraph(id)
+	if sg == nil {
+		return 0, fmt.Errorf("there is no subgraph %s", id)
+	}
+	return sg.Stmt, nil
+}
+
+// subgraphAt returns the innermost subgraph containing off, or "".
+func (t *textEditor) subgraphAt(off int) string {
+	id, start := "", -1
+	for _, sg := range t.d.Subgraphs {
+		if sg.Span.Start.Offset <= off && off < sg.Span.End.Offset && sg.Span.Start.Offset > start {
+			id, start = sg.ID, sg.Span.Start.Offset
+		}
+	}
+	return id
+}
+
+// AddNode adds a node with a label and shape, at the end of subgraph if one
+// is given or else of the diagram.
+func AddNode(src, id, label, shape, subgraph string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	if err := checkNodeID(id); err != nil {
+		return "", err
+	}
+	if t.d.Node(id) != nil || t.d.Subgraph(id) != nil {
+		return "", fmt.Errorf("%s is already taken", id)
+	}
+	open, err := t.subgraphStmt(subgraph)
+	if err != nil {
+		return "", err
+	}
+	if label == "" {
+		label = id
+	}
+	if shape == "" {
+		shape = "rect"
+	}
+	t.appendIn(open, nodeText(id, label, shape, labelText))
+	return t.result(), nil
+}
+
+// RemoveNode removes a node with its edges and the style, class and click
+// statements naming it. Other nodes written in the same statements stay.
+func RemoveNode(src, id string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	if t.d.Node(id) == nil {
+		return "", fmt.Errorf("there is no node %s", id)
+	}
+	t.dropEdges(func(e *Edge) bool { return e.From == id || e.To == id }, id)
+	t.dropMentions(id)
+	return t.result(), nil
+}
+
+// RenameNodeID renames a node everywhere it is named. A node shown by its id
+// is given its old id as a label, so that it looks the same.
+func RenameNodeID(src, id, newID string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	n := t.d.Node(id)
+	if n == nil {
+		return "", fmt.Errorf("there is no node %s", id)
+	}
+	if err := checkNodeID(newID); err != nil {
+		return "", err
+	}
+	if newID == id {
+		return src, nil
+	}
+	if t.d.Node(newID) != nil || t.d.Subgraph(newID) != nil {
+		return "", fmt.Errorf("%s is already taken", newID)
+	}
+	for _, span := range t.d.Mentions(id) {
+		text := newID
+		if span == n.Refs[0].ID && !n.defined() {
+			text += "[" + labelText(id) + "]"
+		}
+		t.replace(span.Start.Offset, span.End.Offset, text)
+	}
+	return t.result(), nil
+}
+
+// SetLabel relabels a node, and with shape reshapes it; or relabels the
+// edges with an id like "A --> B", or a subgraph. An empty label shows a
+// node by its id and takes the text off an edge.
+func SetLabel(src, id, label, shape string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	if n := t.d.Node(id); n != nil {
+		if label == "" {
+			label = id
+		}
+		if shape == "" {
+			shape = n.Shape
+		}
+		text := nodeText(id, label, shape, labelText)
+		defined := false
+		for _, r := range n.Refs {
+			if r.Label == "" && r.Shape == "" {
+				continue
+			}
+			classes := classSuffixRe.FindString(t.text(r.Span))
+			t.replace(r.Span.Start.Offset, r.Span.End.Offset-len(classes), text)
+			defined = true
+		}
+		if !defined {
+			r := n.Refs[0]
+			t.replace(r.ID.Start.Offset, r.ID.End.Offset, text)
+		}
+		return t.result(), nil
+	}
+
+	seen := map[Span]bool{}
+	for _, e := range t.d.Edges {
+		if edgeID(e) != id || seen[e.ArrowSpan] {
+			continue
+		}
+		if label != "" && strings.HasPrefix(e.Arrow, "~") {
+			return "", errors.New("an invisible link ~~~ can't have text")
+		}
+		seen[e.ArrowSpan] = true
+		link := labeledLink(e.Arrow, label)
+		if e.ID != "" {
+			link = e.ID + "@" + link
+		}
+		t.replace(e.ArrowSpan.Start.Offset, e.ArrowSpan.End.Offset, link)
+	}
+	if len(seen) > 0 {
+		return t.result(), nil
+	}
+
+	if sg := t.d.Subgraph(id); sg != nil {
+		if checkNodeID(id) != nil {
+			return "", fmt.Errorf("subgraph %q is named by its title; give it an id first", id)
+		}
+		text := "subgraph " + id
+		if label != "" && label != id {
+			text += " [" + labelText(label) + "]"
+		}
+		t.replace(sg.Header.Start.Offset, sg.Header.End.Offset, text)
+		return t.result(), nil
+	}
+	return "", fmt.Errorf("there is no node, edge or subgraph %s", id)
+}
+
+// AddEdge links two nodes, adding any that don't exist yet. The arrow
+// defaults to -->.
+func AddEdge(src, from, to, label, arrow string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	for _, id := range []string{from, to} {
+		if err := checkNodeID(id); err != nil {
+			return "", err
+		}
+	}
+	if arrow == "" {
+		arrow = "-->"
+	}
+	if flowLinkRe.FindString(arrow) != arrow {
+		return "", fmt.Errorf("%q isn't a link such as -->, --- or -.->", arrow)
+	}
+	if label != "" && strings.HasPrefix(arrow, "~") {
+		return "", errors.New("an invisible link ~~~ can't have text")
+	}
+	t.appendTop(from + " " + labeledLink(arrow, label) + " " + to)
+	return t.result(), nil
+}
+
+// RemoveEdge removes the edges from one node to another. The nodes stay.
+func RemoveEdge(src, from, to string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	match := func(e *Edge) bool { return e.From == from && e.To == to }
+	found := false
+	for _, e := range t.d.Edges {
+		found = found || match(e)
+	}
+	if !found {
+		return "", fmt.Errorf("there is no edge from %s to %s", from, to)
+	}
+	t.dropEdges(match, "")
+	return t.result(), nil
+}
+
+// MoveToSubgraph moves a node into a subgraph, or with "" out of any. The
+// mentions of the node that put it in another subgraph are removed, so
+// they must be statements of their own rather than links.
+func MoveToSubgraph(src, id, subgraph string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	n := t.d.Node(id)
+	if n == nil {
+		return "", fmt.Errorf("there is no node %s", id)
+	}
+	open, err := t.subgraphStmt(subgraph)
+	if err != nil {
+		return "", err
+	}
+	if n.Subgraph == subgraph {
+		return src, nil
+	}
+	text, placed := "", false
+	for _, r := range n.Refs {
+		st := t.d.Statements[r.Stmt]
+		in := t.subgraphAt(st.Span.Start.Offset)
+		if in == subgraph {
+			placed = true
+			continue
+		}
+		if in == "" {
+			continue
+		}
+		if st.Kind != stmtNode || t.text(r.Span) != st.Text {
+			return "", fmt.Errorf("%s is linked in subgraph %s on line %d; move or remove that link first", id, in, st.Span.Start.Line)
+		}
+		t.remove(st)
+		if r.Label != "" || r.Shape != "" {
+			text = st.Text
+		}
+	}
+	if subgraph == "" {
+		placed = false
+		for _, r := range n.Refs {
+			placed = placed || t.subgraphAt(t.d.Statements[r.Stmt].Span.Start.Offset) == ""
+		}
+	}
+	if text != "" || !placed {
+		if text == "" {
+			text = id
+		}
+		t.appendIn(open, text)
+	}
+	return t.result(), nil
+}
+
+// SetDirection sets the direction of the flowchart, or of one subgraph.
+func SetDirection(src, direction, subgraph string) (string, error) {
+	t, err := flowchartEditor(src)
+	if err != nil {
+		return "", err
+	}
+	if !flowchartDirections[direction] {
+		return "", fmt.Errorf("unknown direction %q; use TB, TD, BT, RL or LR", direction)
+	}
+	open, err := t.subgraphStmt(subgraph)
+	if err != nil {
+		return "", err
+	}
+	depth, from, to := 0, 0, len(t.d.Statements)
+	if open >= 0 {
+		depth, from = t.d.Statements[open].Depth+1, open+1
+		if end := t.blockEnd(open); end >= 0 {
+			to = end
+		}
+	}
+	for _, st := range t.d.Statements[from:to] {
+		if st.Kind == stmtDirection && st.Depth == depth {
+			_, rest := firstWord(st.Text)
+			at := st.Span.Start.Offset + len(st.Text) - len(rest)
+			t.replace(at, at+len(rest), direction)
+			return t.result(), nil
+		}
+	}
+	if open >= 0 {
+		t.insertAfter(t.d.Statements[open], t.childIndent(open), "direction "+direction)
+		return t.result(), nil
+	}
+	hdr := headerStatement(t.d)
+	word, rest := firstWord(hdr.Text)
+	at := hdr.Span.Start.Offset + len(word)
+	if rest == "" {
+		t.replace(at, at, " "+direction)
+	} else {
+		at = hdr.Span.Start.Offset + len(hdr.Text) - len(rest)
+		t.replace(at, at+len(rest), direction)
+	}
+	return t.result(), nil
+}
+
+// dropEdges removes the edges drop picks, and node gone if it isn't "", by
+// rewriting the statements they are in. Other nodes in those statements
+// stay where they were defined or would otherwise disappear. linkStyle
+// indexes are renumbered to match.
+func (t *textEditor) dropEdges(drop func(*Edge) bool, gone string) {
+	rewrite := map[int]bool{}
+	var removed []int
+	for _, e := range t.d.Edges {
+		if drop(e) {
+			rewrite[e.Stmt] = true
+			removed = append(removed, e.Index)
+		}
+	}
+	if n := t.d.Node(gone); n != nil {
+		for _, r := range n.Refs {
+			rewrite[r.Stmt] = true
+		}
+	}
+	stmts := make([]int, 0, len(rewrite))
+	for i := range rewrite {
+		stmts = append(stmts, i)
+	}
+	sort.Ints(stmts)
+
+	kept := map[string]bool{} // nodes written alone so as not to lose them
+	for _, i := range stmts {
+		t.rewrite(t.d.Statements[i], t.keptStatement(i, drop, gone, rewrite, kept))
+	}
+	t.renumberLinks(removed)
+}
+
+// keptStatement returns what is left of statement i once the edges drop
+// picks and node gone are taken out of it, one link or node a line.
+func (t *textEditor) keptStatement(i int, drop func(*Edge) bool, gone string, rewrite map[int]bool, kept map[string]bool) []string {
+	type mention struct {
+		id  string
+		ref NodeRef
+	}
+	var mentions []mention
+	elsewhere := map[string]bool{}
+	for _, n := range t.d.Nodes {
+		for _, r := range n.Refs {
+			switch {
+			case r.Stmt == i:
+				mentions = append(mentions, mention{n.ID, r})
+			case !rewrite[r.Stmt]:
+				elsewhere[n.ID] = true
+			}
+		}
+	}
+	sort.Slice(mentions, func(a, b int) bool { return mentions[a].ref.ID.Start.Offset < mentions[b].ref.ID.Start.Offset })
+
+	// Write each node as defined here the first time, and by id after.
+	var order []string
+	texts := map[string]string{}
+	defined := map[string]bool{}
+	for _, m := range mentions {
+		def := m.ref.Label != "" || m.ref.Shape != ""
+		if _, ok := texts[m.id]; !ok {
+			order = append(order, m.id)
+		} else if !def || defined[m.id] {
+			continue
+		}
+		texts[m.id], defined[m.id] = t.text(m.ref.Span), def
+	}
+	used := map[string]bool{}
+	node := func(id string) string {
+		if used[id] {
+			return id
+		}
+		used[id] = true
+		return texts[id]
+	}
+
+	var lines []string
+	for _, e := range t.d.Edges {
+		if e.Stmt == i && !drop(e) {
+			lines = append(lines, node(e.From)+" "+strings.TrimSpace(t.text(e.ArrowSpan))+" "+node(e.To))
+		}
+	}
+	for _, id := range order {
+		if id == gone || used[id] || !defined[id] && (elsewhere[id] || kept[id]) {
+			continue
+		}
+		kept[id] = true
+		lines = append(lines, node(id))
+	}
+	return lines
+}
+
+// dropMentions removes node id from the style, class and click statements
+// naming it.
+func (t *textEditor) dropMentions(id string) {
+	for _, st := range t.d.Statements {
+		word, rest := firstWord(st.Text)
+		if !(st.Kind == stmtStyle && (word == "style" || word == "class") || word == "click") {
+			continue
+		}
+		ids, _ := firstWord(rest)
+		names := strings.Split(ids, ",")
+		var others []string
+		for _, name := range names {
+			if strings.TrimSpace(name) != id {
+				others = append(others, name)
+			}
+		}
+		switch {
+		case len(others) == len(names):
+		case len(others) == 0 || word != "class":
+			t.remove(st)
+		default:
+			at := st.Span.Start.Offset + len(st.Text) - len(rest)
+			t.replace(at, at+len(ids), strings.Join(others, ","))
+		}
+	}
+}
+
+// renumberLinks updates the linkStyle statements for the removal of the
+// edges with the given indexes, dropping the styles of those edges.
+func (t *textEditor) renumberLinks(removed []int) {
+	if len(removed) == 0 {
+		return
+	}
+	sort.Ints(removed)
+	for _, st := range t.d.Statements {
+		word, rest := firstWord(st.Text)
+		if st.Kind != stmtStyle || word != "linkStyle" {
+			continue
+		}
+		indexes, _ := firstWord(rest)
+		var others []string
+		for _, s := range strings.Split(indexes, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				others = append(others, s)
+				continue
+			}
+			k := sort.SearchInts(removed, i)
+			if k < len(removed) && removed[k] == i {
+				continue
+			}
+			others = append(others, strconv.Itoa(i-k))
+		}
+		if joined := strings.Join(others, ","); len(others) == 0 {
+			t.remove(st)
+		} else if joined != indexes {
+			at := st.Span.Start.Offset + len(st.Text) - len(rest)
+			t.replace(at, at+len(indexes), joined)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// seqArrows are the arrows a sequence diagram message can have.
+var seqArrows = map[string]bool{
+	"->>": true, "-->>": true, "->": true, "-->": true, "-x": true, "--x": true,
+	"-)": true, "--)": true, "<<->>": true, "<<-->>": true,
+}
+
+// seqIDRe matches a participant id that can be written without an alias.
+var seqIDRe = regexp.MustCompile(`^[^\s\-+<>:,;]+$`)
+
+// seqTextEscapes writes message and note text on one line, with semicolons
+// as entities so they don't end the statement.
+var seqTextEscapes = strings.NewReplacer(";", "#59;", "\r\n", "<br/>", "\n", "<br/>")
+
+// MessageItem is a message of a sequence diagram, numbered from 1.
+type MessageItem struct {
+	Index int    `json:"index"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Arrow string `json:"arrow"`
+	Text  string `json:"text"`
+	Line  int    `json:"line"`
+	Block string `json:"block,omitempty"` // the blocks it is in, outermost first, e.g. "loop retry > alt ok"
+}
+
+// ListMessages numbers the messages of a sequence diagram.
+func ListMessages(d *Diagram) []MessageItem {
+	items := []MessageItem{}
+	for _, m := range d.Messages {
+		var blocks []string
+		for b := m.Block; b >= 0; b = d.Blocks[b].Parent {
+			blk := d.Blocks[b]
+			kind, label := blk.Kind, blk.Label
+			for _, s := range blk.Sections {
+				if s.Span.Start.Offset <= m.Span.Start.Offset {
+					kind, label = s.Kind, s.Label
+				}
+			}
+			blocks = append([]string{strings.TrimSpace(kind + " " + label)}, blocks...)
+		}
+		items = append(items, MessageItem{
+			Index: m.Index,
+			From:  m.From,
+			To:    m.To,
+			Arrow: m.Arrow,
+			Text:  m.Text,
+			Line:  m.Span.Start.Line,
+			Block: strings.Join(blocks, " > "),
+		})
+	}
+	return items
+}
+
+// sequenceEditor parses a sequence diagram to edit. It refuses other
+// diagrams, and sequence diagrams with syntax errors.
+func sequenceEditor(src string) (*textEditor, error) {
+	d := ParseDiagram(src)
+	if d.Kind != kindSequence {
+		return nil, errors.New("the diagram isn't a sequence diagram")
+	}
+	if len(d.Errors) > 0 {
+		return nil, fmt.Errorf("fix the syntax error at %s first", d.Errors[0])
+	}
+	return &textEditor{src: src, d: d}, nil
+}
+
+// checkParticipantID reports whether id can be written as a participant.
+func checkParticipantID(id string) error {
+	if !seqIDRe.MatchString(id) || id == "end" || isSequenceBlock(id) {
+		return fmt.Errorf("%q isn't a valid participant id; leave out spaces and -+<>:,; and use label for the name shown", id)
+	}
+	return nil
+}
+
+// message returns the message numbered index, from 1.
+func (t *textEditor) message(index int) (*Message, error) {
+	if index < 1 || index > len(t.d.Messages) {
+		return nil, fmt.Errorf("there is no message %d; there are %d", index, len(t.d.Messages))
+	}
+	return t.d.Messages[index-1], nil
+}
+
+// topStatement returns the statement at the top level that statement i is
+// in: i itself, or the opening of the outermost block around it.
+func (t *textEditor) topStatement(i int) int {
+	for i > 0 && t.d.Statements[i].Depth > 0 {
+		i--
+	}
+	return i
+}
+
+// insertStep adds a statement after message after, inside the same block,
+// or for 0 before the first message and any block it is in. With no
+// messages it goes at the end.
+func (t *textEditor) insertStep(after int, text string) error {
+	if after == 0 {
+		if len(t.d.Messages) == 0 {
+			t.appendTop(text)
+			return nil
+		}
+		st := t.d.Statements[t.topStatement(t.d.Messages[0].Stmt)]
+		t.insertBefore(st, t.topIndent(), text)
+		return nil
+	}
+	m, err := t.message(after)
+	if err != nil {
+		return err
+	}
+	st := t.d.Statements[m.Stmt]
+	t.insertAfter(st, t.indent(st), text)
+	return nil
+}
+
+// AddParticipant declares a participant, or an actor, with a label shown
+// instead of its id. It goes before participant before if one is given, and
+// otherwise after the participants there are.
+func AddParticipant(src, id, label, kind, before string) (string, error) {
+	t, err := sequenceEditor(src)
+	if err != nil {
+		return "", err
+	}
+	if err := checkParticipantID(id); err != nil {
+		return "", err
+	}
+	if p := t.d.Participant(id); p != nil && p.Declared {
+		return "", fmt.Errorf("%s is already declared", id)
+	}
+	if kind == "" {
+		kind = "participant"
+	}
+	if kind != "participant" && kind != "actor" {
+		return "", fmt.Errorf("kind must be participant or actor, not %q", kind)
+	}
+	text := kind + " " + id
+	if label != "" && label != id {
+		text += " as " + seqTextEscapes.Replace(label)
+	}
+
+	if before != "" {
+		p := t.d.Participant(before)
+		if p == nil || before == id {
+			return "", fmt.Errorf("there is no other participant %s", before)
+		}
+		t.insertBefore(t.d.Statements[t.topStatement(p.Stmt)], t.topIndent(), text)
+		return t.result(), nil
+	}
+	last := -1
+	for _, p := range t.d.Participants {
+		if p.ID != id {
+			last = max(last, t.topStatement(p.Stmt))
+		}
+	}
+	if last < 0 {
+		t.insertAfter(*headerStatement(t.d), t.topIndent(), text)
+		return t.result(), nil
+	}
+	if t.d.Statements[last].Kind == stmtOpen {
+		if end := t.blockEnd(last); end >= 0 {
+			last = end
+		}
+	}
+	t.insertAfter(t.d.Statements[last], t.topIndent(), text)
+	return t.result(), nil
+}
+
+// InsertMessage adds a message after message after, in the same block, or
+// for 0 before the first. The arrow defaults to ->>.
+func InsertMessage(src string, after int, from, to, arrow, text string) (string, error) {
+	t, err := sequenceEditor(src)
+	if err != nil {
+		return "", err
+	}
+	for _, id := range []string{from, to} {
+		if err := checkParticipantID(id); err != nil {
+			return "", err
+		}
+	}
+	if arrow == "" {
+		arrow = "->>"
+	}
+	if !seqArrows[arrow] {
+		return "", fmt.Errorf("%q isn't a message arrow such as ->>, -->>, -x or -)", arrow)
+	}
+	if err := t.insertStep(after, strings.TrimSpace(from+arrow+to+": "+seqTextEscapes.Replace(text))); err != nil {
+		return "", err
+	}
+	return t.result(), nil
+}
+
+// RemoveMessage removes message index, from 1.
+func RemoveMessage(src string, index int) (string, error) {
+	t, err := sequenceEditor(src)
+	if err != nil {
+		return "", err
+	}
+	m, err := t.message(index)
+	if err != nil {
+		return "", err
+	}
+	t.remove(t.d.Statements[m.Stmt])
+	return t.result(), nil
+}
+
+// AddNote adds a note left of, right of or over participants after message
+// after, or for 0 before the first, or for -1 at the end.
+func AddNote(src, position string, actors []string, text string, after int) (string, error) {
+	t, err := sequenceEditor(src)
+	if err != nil {
+		return "", err
+	}
+	position = strings.ToLower(position)
+	switch {
+	case position != "left of" && position != "right of" && position != "over":
+		return "", fmt.Errorf("position must be left of, right of or over, not %q", position)
+	case len(actors) == 0 || len(actors) > 2 || len(actors) == 2 && position != "over":
+		return "", errors.New("a note goes over one or two participants, or left or right of one")
+	}
+	for _, a := range actors {
+		if t.d.Participant(a) == nil {
+			return "", fmt.Errorf("there is no participant %s", a)
+		}
+	}
+	note := fmt.Sprintf("Note %s %s: %s", position, strings.Join(actors, ","), seqTextEscapes.Replace(text))
+	if after < 0 {
+		t.appendTop(note)
+	} else if err := t.insertStep(after, note); err != nil {
+		return "", err
+	}
+	return t.result(), nil
+}
+
+// WrapInBlock wraps messages from to to, counting from 1, in a block such
+// as loop or alt, indenting them one level. The messages must be in the
+// same block.
+func WrapInBlock(src, kind, label string, from, to int) (string, error) {
+	t, err := sequenceEditor(src)
+	if err != nil {
+		return "", err
+	}
+	if !isSequenceBlock(kind) || kind == "box" {
+		return "", fmt.Errorf("%q isn't a block; use loop, alt, opt, par, critical, break or rect", kind)
+	}
+	if from > to {
+		return "", fmt.Errorf("the range %d to %d is backwards", from, to)
+	}
+	first, err := t.message(from)
+	if err != nil {
+		return "", err
+	}
+	last, err := t.message(to)
+	if err != nil {
+		return "", err
+	}
+
+	// Blocks inside the range nest deeper; an end or else of one around it
+	// is shallower.
+	depth := t.d.Statements[first.Stmt].Depth
+	for _, st := range t.d.Statements[first.Stmt : last.Stmt+1] {
+		if st.Depth < depth {
+			return "", fmt.Errorf("messages %d to %d aren't in the same block; wrap a range that doesn't cross an end or else", from, to)
+		}
+	}
+	if t.d.Statements[last.Stmt].Depth != depth {
+		return "", fmt.Errorf("messages %d to %d aren't in the same block; wrap a range that doesn't cross an end or else", from, to)
+	}
+	startSt, endSt := t.d.Statements[first.Stmt], t.d.Statements[last.Stmt]
+	if !t.aloneOnLine(startSt) || !t.aloneOnLine(endSt) {
+		return "", errors.New("the messages share lines with other statements; format the diagram first")
+	}
+
+	indent, unit, nl := t.indent(startSt), t.indentUnit(), t.newline()
+	start := t.lineStart(startSt.Span.Start.Offset)
+	end := t.lineEnd(endSt.Span.End.Offset)
+	t.replace(start, start, indent+strings.TrimSpace(kind+" "+seqTextEscapes.Replace(label))+nl)
+	for at := start; at < end; {
+		if eol := t.lineEnd(at); strings.TrimSpace(t.src[at:eol]) != "" {
+			t.replace(at, at, unit)
+		}
+		next := strings.IndexByte(t.src[at:], '\n')
+		if next < 0 {
+			break
+		}
+		at += next + 1
+	}
+	t.replace(end, end, nl+indent+"end")
+	return t.result(), nil
+}
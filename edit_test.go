@@ -0,0 +1,249 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApplyEdits(t *testing.T) {
+	Convey("applyEdits makes edits in order of position, merging overlapping deletions", t, func() {
+		src := "A; B; C"
+		So(applyEdits(src, []textEdit{{6, 7, "D"}, {0, 1, "X"}}), ShouldEqual, "X; B; D")
+		So(applyEdits(src, []textEdit{{3, 6, ""}, {1, 4, ""}}), ShouldEqual, "AC")
+		So(applyEdits(src, []textEdit{{1, 1, "1"}, {1, 1, "2"}}), ShouldEqual, "A12; B; C")
+	})
+}
+
+func TestFlowchartEdits(t *testing.T) {
+	Convey("Flowchart edits", t, func() {
+		flow := "graph TD\n    %% the happy path\n    A[Start] --> B\n    subgraph s [Stage]\n        C\n    end\n    B --> C\n"
+
+		Convey("AddNode adds a node at the end of the diagram, or of a subgraph", func() {
+			out, err := AddNode(flow, "D", "Done (ok)", "round", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, flow+"    D(\"Done (ok)\")\n")
+
+			out, err = AddNode(flow, "E", "", "", "s")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "        C\n        E\n    end\n")
+
+			_, err = AddNode(flow, "B", "", "", "")
+			So(err, ShouldNotBeNil)
+			_, err = AddNode(flow, "end", "", "", "")
+			So(err, ShouldNotBeNil)
+			_, err = AddNode(flow, "F", "", "", "nope")
+			So(err.Error(), ShouldContainSubstring, "no subgraph nope")
+			_, err = AddNode("sequenceDiagram\n", "F", "", "", "")
+			So(err.Error(), ShouldContainSubstring, "isn't a flowchart")
+		})
+
+		Convey("RemoveNode removes a node with its edges and styles, keeping the rest of each statement", func() {
+			src := "graph LR\n  A[Start] --> B --> C\n  B --> D\n  D\n  class B,D hot\n  style B fill:#f00\n  linkStyle 0,2,3 stroke:#0f0\n"
+			out, err := RemoveNode(src, "B")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph LR\n  A[Start]\n  C\n  D\n  class D hot\n  linkStyle 0 stroke:#0f0\n")
+
+			out, err = RemoveNode("graph TD; A --> B; C", "A")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD; B; C")
+
+			_, err = RemoveNode(src, "Z")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("RenameNodeID renames every mention, keeping how the node looks", func() {
+			out, err := RenameNodeID("graph TD\n  A --> B\n  B --> A\n  style A fill:#f00\n", "A", "Start")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n  Start[A] --> B\n  B --> Start\n  style Start fill:#f00\n")
+
+			out, err = RenameNodeID(flow, "A", "First")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "First[Start] --> B")
+
+			_, err = RenameNodeID(flow, "A", "B")
+			So(err.Error(), ShouldContainSubstring, "taken")
+		})
+
+		Convey("SetLabel relabels nodes, edges and subgraphs", func() {
+			out, err := SetLabel(flow, "A", "Begin", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "    A[Begin] --> B\n")
+
+			out, err = SetLabel("graph TD\n  A:::hot --> B(Go)\n", "B", "Stop", "rhombus")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n  A:::hot --> B{Stop}\n")
+
+			out, err = SetLabel("graph TD\n  A:::hot --> B\n", "A", "x|y", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n  A[\"x|y\"]:::hot --> B\n")
+
+			out, err = SetLabel(flow, "B --> C", "next", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "    B -->|next| C\n")
+			out, err = SetLabel(out, "B --> C", "", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, flow)
+
+			out, err = SetLabel("graph TD\n  A e1@--> B\n", "A --> B", "go", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n  A e1@-->|go| B\n")
+
+			out, err = SetLabel(flow, "s", "Phase 2", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "    subgraph s [Phase 2]\n")
+
+			_, err = SetLabel(flow, "Z", "x", "")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("AddEdge links nodes at the end of the diagram", func() {
+			out, err := AddEdge(flow, "C", "A", "retry", "-.->")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, flow+"    C -.->|retry| A\n")
+
+			_, err = AddEdge(flow, "C", "A", "", "->")
+			So(err, ShouldNotBeNil)
+			_, err = AddEdge(flow, "C", "A", "x", "~~~")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("RemoveEdge removes edges, keeping their nodes", func() {
+			out, err := RemoveEdge(flow, "A", "B")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n    %% the happy path\n    A[Start]\n    subgraph s [Stage]\n        C\n    end\n    B --> C\n")
+
+			out, err = RemoveEdge("graph TD\n  A --> B & C\n", "A", "C")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n  A --> B\n  C\n")
+
+			_, err = RemoveEdge(flow, "C", "A")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("MoveToSubgraph moves a node between subgraphs", func() {
+			out, err := MoveToSubgraph(flow, "A", "s")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "        C\n        A\n    end\n")
+
+			out, err = MoveToSubgraph("graph TD\n  subgraph a\n    X[Box]\n  end\n  subgraph b\n    Y\n  end\n", "X", "b")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n  subgraph a\n  end\n  subgraph b\n    Y\n    X[Box]\n  end\n")
+
+			out, err = MoveToSubgraph(flow, "C", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "    subgraph s [Stage]\n    end\n")
+
+			_, err = MoveToSubgraph("graph TD\n  subgraph a\n    X --> Y\n  end\n", "X", "")
+			So(err.Error(), ShouldContainSubstring, "line 3")
+		})
+
+		Convey("SetDirection changes the header, or a subgraph's direction statement", func() {
+			out, err := SetDirection(flow, "LR", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldStartWith, "graph LR\n")
+
+			out, err = SetDirection("flowchart\n  A\n", "RL", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "flowchart RL\n  A\n")
+
+			out, err = SetDirection(flow, "LR", "s")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "    subgraph s [Stage]\n        direction LR\n        C\n")
+			out, err = SetDirection(out, "BT", "s")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "        direction BT\n")
+
+			_, err = SetDirection(flow, "UP", "")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSequenceEdits(t *testing.T) {
+	Convey("Sequence diagram edits", t, func() {
+		seq := "sequenceDiagram\n  participant A as Alice\n  participant B\n  A->>B: hello\n  loop every minute\n    B-->>A: ping\n  end\n  A->>B: bye\n"
+
+		Convey("ListMessages numbers the messages and says which blocks they are in", func() {
+			items := ListMessages(ParseDiagram("sequenceDiagram\n  alt ok\n    A->>B: yes\n  else failed\n    loop retry\n      A->>B: again\n    end\n  end"))
+			So(items, ShouldHaveLength, 2)
+			So(items[0].Block, ShouldEqual, "alt ok")
+			So(items[1].Index, ShouldEqual, 2)
+			So(items[1].Line, ShouldEqual, 6)
+			So(items[1].Block, ShouldEqual, "else failed > loop retry")
+		})
+
+		Convey("AddParticipant declares a participant after the others, or before one", func() {
+			out, err := AddParticipant(seq, "C", "Carol", "actor", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldStartWith, "sequenceDiagram\n  participant A as Alice\n  participant B\n  actor C as Carol\n  A->>B: hello\n")
+
+			out, err = AddParticipant(seq, "C", "", "", "B")
+			So(err, ShouldBeNil)
+			So(out, ShouldStartWith, "sequenceDiagram\n  participant A as Alice\n  participant C\n  participant B\n")
+
+			out, err = AddParticipant("sequenceDiagram\n  A->>B: hi\n", "A", "Alice", "", "")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "sequenceDiagram\n  A->>B: hi\n  participant A as Alice\n")
+
+			_, err = AddParticipant(seq, "B", "", "", "")
+			So(err.Error(), ShouldContainSubstring, "already declared")
+			_, err = AddParticipant(seq, "my-service", "", "", "")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("InsertMessage adds a message after another, in its block", func() {
+			out, err := InsertMessage(seq, 2, "A", "B", "", "pong; late")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "    B-->>A: ping\n    A->>B: pong#59; late\n  end\n")
+
+			out, err = InsertMessage(seq, 0, "B", "A", "-->>", "ready")
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "  participant B\n  B-->>A: ready\n  A->>B: hello\n")
+
+			_, err = InsertMessage(seq, 4, "A", "B", "", "x")
+			So(err.Error(), ShouldContainSubstring, "there are 3")
+			_, err = InsertMessage(seq, 1, "A", "B", "=>", "x")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("RemoveMessage removes a message by number", func() {
+			out, err := RemoveMessage(seq, 2)
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "  loop every minute\n  end\n")
+		})
+
+		Convey("AddNote adds a note after a message, or at the end", func() {
+			out, err := AddNote(seq, "over", []string{"A", "B"}, "handshake done", 1)
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "  A->>B: hello\n  Note over A,B: handshake done\n")
+
+			out, err = AddNote(seq, "Right of", []string{"B"}, "gone", -1)
+			So(err, ShouldBeNil)
+			So(out, ShouldEndWith, "  A->>B: bye\n  Note right of B: gone\n")
+
+			_, err = AddNote(seq, "left of", []string{"A", "B"}, "x", -1)
+			So(err, ShouldNotBeNil)
+			_, err = AddNote(seq, "over", []string{"Z"}, "x", -1)
+			So(err.Error(), ShouldContainSubstring, "no participant Z")
+		})
+
+		Convey("WrapInBlock wraps a run of messages in a block, indenting them", func() {
+			out, err := WrapInBlock(seq, "opt", "polite", 1, 3)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "sequenceDiagram\n  participant A as Alice\n  participant B\n  opt polite\n    A->>B: hello\n    loop every minute\n      B-->>A: ping\n    end\n    A->>B: bye\n  end\n")
+			So(ParseDiagram(out).Errors, ShouldBeEmpty)
+
+			out, err = WrapInBlock(seq, "alt", "fast", 2, 2)
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, "  loop every minute\n    alt fast\n      B-->>A: ping\n    end\n  end\n")
+
+			_, err = WrapInBlock(seq, "alt", "", 1, 2)
+			So(err.Error(), ShouldContainSubstring, "aren't in the same block")
+			_, err = WrapInBlock(seq, "box", "", 1, 1)
+			So(err, ShouldNotBeNil)
+			_, err = WrapInBlock(seq, "loop", "", 2, 1)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
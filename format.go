@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// formatIndent is one level of indentation in a formatted diagram.
+const formatIndent = "    "
+
+// verbatimKinds are the kinds of diagram whose indentation means something,
+// so the formatter leaves their lines as they are.
+var verbatimKinds = map[string]bool{
+	"mindmap": true,
+	"kanban":  true,
+	"treemap": true,
+	"sankey":  true,
+}
+
+// sectionedKinds indent the lines of each section under it.
+var sectionedKinds = map[string]bool{
+	"gantt":    true,
+	"journey":  true,
+	"timeline": true,
+}
+
+// FormatDiagram formats Mermaid text canonically: one statement per line,
+// indented by nesting, with single spaces around arrows and no runs of
+// blank lines. Formatting formatted text changes nothing. Like gofmt, it
+// refuses text with syntax errors.
+func FormatDiagram(src string) (string, error) {
+	if strings.TrimSpace(src) == "" {
+		return "", nil
+	}
+	d := ParseDiagram(src)
+	if len(d.Errors) > 0 {
+		return "", d.Errors[0]
+	}
+	f := &formatter{src: src, d: d}
+	return f.format(), nil
+}
+
+// formatter writes a parsed diagram back out.
+type formatter struct {
+	src string
+	d   *Diagram
+
+	sb      strings.Builder
+	last    string // kind of the last statement written
+	blank   bool   // whether a blank line is due before the next statement
+	written bool
+}
+
+// write writes a line of text for a statement of the given kind at depth
+// levels of indentation, with any blank line due before it.
+func (f *formatter) write(kind string, depth int, text string) {
+	switch {
+	case !f.blank || !f.written:
+	case kind == stmtClose || kind == stmtSection:
+	case f.last == stmtHeader || f.last == stmtOpen || f.last == stmtSection:
+	default:
+		f.sb.WriteString("\n")
+	}
+	f.blank = false
+	f.sb.WriteString(strings.Repeat(formatIndent, depth) + text + "\n")
+	f.last = kind
+	f.written = true
+}
+
+func (f *formatter) format() string {
+	d := f.d
+	messages := make(map[int]*Message)
+	for _, m := range d.Messages {
+		messages[m.Stmt] = m
+	}
+	notes := make(map[int]*Note)
+	for _, n := range d.Notes {
+		notes[n.Stmt] = n
+	}
+	edges := make(map[int][]*Edge)
+	for _, e := range d.Edges {
+		edges[e.Stmt] = append(edges[e.Stmt], e)
+	}
+
+	header := false
+	other := otherIndenter{kind: d.Kind}
+	for i, s := range d.Statements {
+		switch {
+		case s.Kind == stmtBlank:
+			f.blank = true
+			continue
+		case !header:
+			text := s.Text
+			switch {
+			case s.Kind == stmtHeader && d.Kind == kindFlowchart:
+				text = strings.TrimSpace(d.Header + " " + d.Direction)
+				header = true
+			case s.Kind == stmtHeader:
+				text = collapseSpaces(text)
+				header = true
+			case s.Kind == stmtDirective:
+				text = trimLines(text)
+			}
+			f.write(s.Kind, 0, text)
+			continue
+		case verbatimKinds[d.Kind]:
+			start := strings.LastIndexByte(f.src[:s.Span.Start.Offset], '\n') + 1
+			f.write(s.Kind, 0, strings.TrimRight(f.src[start:s.Span.End.Offset], " \t\r"))
+			continue
+		}
+
+		text := s.Text
+		depth := s.Depth + 1
+		switch s.Kind {
+		case stmtEdge, stmtNode:
+			switch d.Kind {
+			case kindFlowchart:
+				text = f.flowchartChain(s, edges[i])
+			case kindState:
+				if len(edges[i]) == 1 {
+					text = f.transition(s, edges[i][0])
+				}
+			case kindClass, kindER:
+				if len(edges[i]) == 1 {
+					text = f.relationship(s, edges[i][0])
+				}
+			}
+		case stmtMessage:
+			text = messageText(messages[i])
+		case stmtNote:
+			if n := notes[i]; d.Kind == kindSequence && n != nil {
+				text = fmt.Sprintf("%s %s %s: %s", s.Text[:4], n.Position, strings.Join(n.Actors, ","), n.Text)
+			}
+		case stmtParticipant, stmtOpen, stmtClose, stmtSection, stmtStyle, stmtDirection:
+			text = collapseSpaces(text)
+			if s.Kind == stmtOpen && strings.HasSuffix(text, "{") {
+				text = strings.TrimSpace(strings.TrimSuffix(text, "{")) + " {"
+			}
+		case stmtOther, stmtComment, stmtDirective:
+			if !isDetailedKind(d.Kind) {
+				depth = other.depth(s)
+			}
+		}
+		if !sameText(text, s.Text) {
+			text = s.Text
+		}
+		f.write(s.Kind, depth, strings.TrimSpace(text))
+	}
+	return f.sb.String()
+}
+
+// isDetailedKind reports whether the parser knows the statements of a kind
+// of diagram in detail.
+func isDetailedKind(kind string) bool {
+	_, ok := graphElements[kind]
+	return ok || kind == kindSequence
+}
+
+// otherIndenter indents the statements of diagrams the parser doesn't know
+// in detail, by their braces, blocks and sections.
+type otherIndenter struct {
+	kind    string
+	level   int
+	section bool
+}
+
+// depth returns the indentation of s.
+func (o *otherIndenter) depth(s Statement) int {
+	text := s.Text
+	word, _ := firstWord(text)
+	if strings.HasPrefix(text, "}") || o.kind == "block" && text == "end" {
+		o.level = max(o.level-1, 0)
+	}
+	depth := o.level + 1
+	if sectionedKinds[o.kind] && s.Kind == stmtOther {
+		switch {
+		case word == "section":
+			o.section = true
+		case o.section:
+			depth++
+		}
+		if o.kind == "timeline" && strings.HasPrefix(text, ":") {
+			depth++
+		}
+	}
+	if strings.HasSuffix(text, "{") || o.kind == "block" && (word == "block" || strings.HasPrefix(word, "block:")) {
+		o.level++
+	}
+	return depth
+}
+
+// flowchartChain writes nodes joined by links with single spaces around
+// each link and &.
+func (f *formatter) flowchartChain(s Statement, edges []*Edge) string {
+	base := s.Span.Start.Offset
+	var links [][2]int
+	seen := make(map[int]bool)
+	for _, e := range edges {
+		if start := e.ArrowSpan.Start.Offset - base; !seen[start] {
+			seen[start] = true
+			links = append(links, [2]int{start, e.ArrowSpan.End.Offset - base})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i][0] < links[j][0] })
+
+	var sb strings.Builder
+	at := 0
+	for _, l := range links {
+		sb.WriteString(nodeGroupText(s.Text[at:l[0]]))
+		sb.WriteString(" " + linkText(s.Text[l[0]:l[1]]) + " ")
+		at = l[1]
+	}
+	sb.WriteString(nodeGroupText(s.Text[at:]))
+	return sb.String()
+}
+
+// nodeGroupText writes nodes joined by & with single spaces around each &.
+func nodeGroupText(s string) string {
+	var parts []string
+	start, depth, quoted := 0, 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[' || c == '(' || c == '{':
+			depth++
+		case (c == ']' || c == ')' || c == '}') && depth > 0:
+			depth--
+		case c == '&' && depth == 0:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	parts = append(parts, strings.TrimSpace(s[start:]))
+	return strings.Join(parts, " & ")
+}
+
+// linkText writes a flowchart link with its id and text: -->|text|,
+// -- text --> or e1@-->.
+func linkText(raw string) string {
+	if n := flowchartEdgeID(raw); n > 0 {
+		return raw[:n] + linkText(raw[n:])
+	}
+	if m := flowLinkRe.FindString(raw); m != "" {
+		rest := strings.TrimSpace(raw[len(m):])
+		if len(rest) >= 2 && rest[0] == '|' && rest[len(rest)-1] == '|' {
+			return m + "|" + strings.TrimSpace(rest[1:len(rest)-1]) + "|"
+		}
+		if rest == "" {
+			return m
+		}
+		return raw
+	}
+	m := flowLinkOpenRe.FindStringSubmatch(raw)
+	if m == nil {
+		return raw
+	}
+	body := raw[len(m[0]):]
+	loc := flowLinkCloseRes[m[1]].FindStringIndex(body)
+	if loc == nil || strings.TrimSpace(body[loc[1]:]) != "" {
+		return raw
+	}
+	return m[0] + " " + strings.TrimSpace(body[:loc[0]]) + " " + body[loc[0]:loc[1]]
+}
+
+// transition writes a state transition: A --> B: label.
+func (f *formatter) transition(s Statement, e *Edge) string {
+	base := s.Span.Start.Offset
+	from := s.Text[:e.ArrowSpan.Start.Offset-base]
+	to := s.Text[e.ArrowSpan.End.Offset-base : e.Span.End.Offset-base]
+	text := strings.TrimSpace(from) + " --> " + strings.TrimSpace(to)
+	if e.Label != "" {
+		text += ": " + e.Label
+	}
+	return text
+}
+
+// relationship writes a class or entity relationship: A "1" <|-- "*" B : label.
+func (f *formatter) relationship(s Statement, e *Edge) string {
+	base := s.Span.Start.Offset
+	before := s.Text[:e.ArrowSpan.Start.Offset-base]
+	after := s.Text[e.ArrowSpan.End.Offset-base:]
+	label := ""
+	quoted := false
+	for i := 0; i < len(after); i++ {
+		if after[i] == '"' {
+			quoted = !quoted
+		} else if after[i] == ':' && !quoted {
+			after, label = after[:i], strings.TrimSpace(after[i+1:])
+			break
+		}
+	}
+	// Cardinalities are set off from the names by a space.
+	before, after = strings.TrimSpace(before), strings.TrimSpace(after)
+	if strings.HasSuffix(before, `"`) {
+		if j := strings.LastIndex(before[:len(before)-1], `"`); j > 0 {
+			before = before[:j] + " " + before[j:]
+		}
+	}
+	if strings.HasPrefix(after, `"`) {
+		if k := strings.Index(after[1:], `"`); k >= 0 {
+			after = after[:k+2] + " " + after[k+2:]
+		}
+	}
+	text := collapseSpaces(before) + " " + f.src[e.ArrowSpan.Start.Offset:e.ArrowSpan.End.Offset] + " " + collapseSpaces(after)
+	if label != "" {
+		text += " : " + label
+	}
+	return text
+}
+
+// messageText writes a sequence message: From->>+To: text.
+func messageText(m *Message) string {
+	if m == nil {
+		return ""
+	}
+	act := ""
+	switch {
+	case m.Activate:
+		act = "+"
+	case m.Deactivate:
+		act = "-"
+	}
+	text := m.From + m.Arrow + act + m.To + ":"
+	if m.Text != "" {
+		text += " " + m.Text
+	}
+	return text
+}
+
+// collapseSpaces replaces each run of spaces outside quotes with one.
+func collapseSpaces(s string) string {
+	var sb strings.Builder
+	quoted, space := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !quoted && (c == ' ' || c == '\t') {
+			space = true
+			continue
+		}
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+		if c == '"' {
+			quoted = !quoted
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// sameText reports whether a and b differ only in whitespace, which is all
+// the formatter may change.
+func sameText(a, b string) bool {
+	strip := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r < 0x80 && isSpace(byte(r)) {
+				return -1
+			}
+			return r
+		}, s)
+	}
+	return a != "" && strip(a) == strip(b)
+}
+
+// trimLines trims the spaces from the end of each line of s.
+func trimLines(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleFormat formats a diagram text: {"content"} gives {"content",
+// "changed"}, or 400 with the first syntax error.
+func handleFormat(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	formatted, err := FormatDiagram(req.Content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"content": formatted,
+		"changed": formatted != req.Content,
+	})
+}
+
+// diagramExtensions are the extensions of the files fmt formats when given
+// a directory.
+var diagramExtensions = map[string]bool{".mmd": true, ".mermaid": true}
+
+// runFmt implements `mermaid-editor fmt [-l] [-w] [path ...]`, which works
+// like gofmt: it prints the formatted diagram, lists the files whose
+// formatting differs, or rewrites them. It formats standard input when given
+// no paths.
+func runFmt(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	list := fs.Bool("l", false, "list files whose formatting differs")
+	write := fs.Bool("w", false, "write the result to the file instead of standard output")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mermaid-editor fmt [-l] [-w] [path ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "mermaid-editor fmt: can't use -w on standard input")
+			os.Exit(2)
+		}
+		src, err := io.ReadAll(os.Stdin)
+		if err == nil {
+			var listTo io.Writer
+			output := func(formatted string) error {
+				_, err := io.WriteString(os.Stdout, formatted)
+				return err
+			}
+			if *list {
+				listTo, output = os.Stdout, nil
+			}
+			err = formatFile("<standard input>", src, listTo, output)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	failed := false
+	for _, path := range fs.Args() {
+		files, err := diagramFiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+		for _, file := range files {
+			var listTo io.Writer
+			if *list {
+				listTo = os.Stdout
+			}
+			if err := formatPath(file, listTo, *write); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(2)
+	}
+}
+
+// diagramFiles returns path if it is a file, or the diagram files under it
+// if it is a directory.
+func diagramFiles(path string) ([]string, error) {
+	return filesUnder(path, diagramExtensions)
+}
+
+// filesUnder returns path if it is a file, or the files under it with one
+// of extensions if it is a directory, skipping hidden directories and
+// node_modules.
+func filesUnder(path string, extensions map[string]bool) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.WalkDir(path, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() && p != path && (strings.HasPrefix(e.Name(), ".") || e.Name() == "node_modules") {
+			return filepath.SkipDir
+		}
+		if !e.IsDir() && extensions[filepath.Ext(p)] {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// formatPath formats the diagram file at path, listing it on list if that
+// is set and its formatting differs. With write it rewrites the file, and
+// otherwise prints the result unless it lists.
+func formatPath(path string, list io.Writer, write bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var output func(string) error
+	switch {
+	case write:
+		output = func(formatted string) error {
+			if formatted == string(src) {
+				return nil
+			}
+			return os.WriteFile(path, []byte(formatted), info.Mode().Perm())
+		}
+	case list == nil:
+		output = func(formatted string) error {
+			_, err := io.WriteString(os.Stdout, formatted)
+			return err
+		}
+	}
+	return formatFile(path, src, list, output)
+}
+
+// formatFile formats src, read from name, listing name on list if that is
+// set and its formatting differs, then passing the result to output unless
+// that is nil.
+func formatFile(name string, src []byte, list io.Writer, output func(string) error) error {
+	formatted, err := FormatDiagram(string(src))
+	if err != nil {
+		return fmt.Errorf("%s:%w", name, err)
+	}
+	if list != nil && formatted != string(src) {
+		fmt.Fprintln(list, name)
+	}
+	if output == nil {
+		return nil
+	}
+	return output(formatted)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFormatDiagram(t *testing.T) {
+	Convey("FormatDiagram", t, func() {
+		format := func(src string) string {
+			out, err := FormatDiagram(src)
+			So(err, ShouldBeNil)
+			again, err := FormatDiagram(out)
+			So(err, ShouldBeNil)
+			So(again, ShouldEqual, out)
+			return out
+		}
+
+		Convey("Puts flowchart statements on their own lines, with spaces around links", func() {
+			So(format("graph TD;A-->B;B-- text -->C\nA&B-->|  yes |D[Tom & Jerry]"), ShouldEqual,
+				"graph TD\n"+
+					"    A --> B\n"+
+					"    B -- text --> C\n"+
+					"    A & B -->|yes| D[Tom & Jerry]\n")
+		})
+
+		Convey("Keeps edge ids and classes against their links", func() {
+			So(format("graph TD\nA:::hot-->B\nB  e1@-->|  go |C\nC e2@-- on -->D"), ShouldEqual,
+				"graph TD\n"+
+					"    A:::hot --> B\n"+
+					"    B e1@-->|go| C\n"+
+					"    C e2@-- on --> D\n")
+		})
+
+		Convey("Indents blocks and collapses blank lines", func() {
+			So(format("\n\nflowchart  LR\n\n\n  subgraph  one\n\n direction TB\nA---B\n\n  end\n\n\n  classDef hot fill:#f00\n\n"), ShouldEqual,
+				"flowchart LR\n"+
+					"    subgraph one\n"+
+					"        direction TB\n"+
+					"        A --- B\n"+
+					"    end\n"+
+					"\n"+
+					"    classDef hot fill:#f00\n")
+		})
+
+		Convey("Keeps front matter, directives and comments", func() {
+			src := "---\ntitle: Flow\n---\n%%{init: {'theme': 'dark'}}%%\ngraph TD\n  %% the start\n  A"
+			So(format(src), ShouldEqual, "---\ntitle: Flow\n---\n%%{init: {'theme': 'dark'}}%%\ngraph TD\n    %% the start\n    A\n")
+		})
+
+		Convey("Leaves labels alone", func() {
+			So(format(`graph TD
+  A["  spaced   out  "] --> B("a;b")`), ShouldEqual, "graph TD\n    A[\"  spaced   out  \"] --> B(\"a;b\")\n")
+		})
+
+		Convey("Formats sequence diagrams", func() {
+			So(format("sequenceDiagram\nparticipant A as  Alice\nA->>+ B :hello\nalt ok\nB-->>-A:   hi\nelse   no\nnote over A , B : x\nend"), ShouldEqual,
+				"sequenceDiagram\n"+
+					"    participant A as Alice\n"+
+					"    A->>+B: hello\n"+
+					"    alt ok\n"+
+					"        B-->>-A: hi\n"+
+					"    else no\n"+
+					"        note over A,B: x\n"+
+					"    end\n")
+		})
+
+		Convey("Formats class, state and entity relationship diagrams", func() {
+			So(format("classDiagram\nclass Animal{\n+eat()\n}\nAnimal\"1\"<|--\"*\"Duck:is"), ShouldEqual,
+				"classDiagram\n"+
+					"    class Animal {\n"+
+					"        +eat()\n"+
+					"    }\n"+
+					"    Animal \"1\" <|-- \"*\" Duck : is\n")
+			So(format("stateDiagram-v2\n[*]-->A\nstate B {\n[*]  -->  C\n}\nA-->B :  go"), ShouldEqual,
+				"stateDiagram-v2\n"+
+					"    [*] --> A\n"+
+					"    state B {\n"+
+					"        [*] --> C\n"+
+					"    }\n"+
+					"    A --> B: go\n")
+			So(format("erDiagram\nCUSTOMER||--o{ORDER:places"), ShouldEqual, "erDiagram\n    CUSTOMER ||--o{ ORDER : places\n")
+		})
+
+		Convey("Indents the sections of other diagrams", func() {
+			So(format("gantt\ntitle Plan\nsection A\nTask :a1, 2024-01-01, 3d"), ShouldEqual,
+				"gantt\n    title Plan\n    section A\n        Task :a1, 2024-01-01, 3d\n")
+			So(format("requirementDiagram\nrequirement r {\nid: 1\n}"), ShouldEqual,
+				"requirementDiagram\n    requirement r {\n        id: 1\n    }\n")
+		})
+
+		Convey("Keeps the indentation of diagrams where it means something", func() {
+			So(format("mindmap\n  root\n    child   \n      leaf"), ShouldEqual, "mindmap\n  root\n    child\n      leaf\n")
+		})
+
+		Convey("Refuses diagrams with syntax errors", func() {
+			_, err := FormatDiagram("graph TD\n  A -->")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "2:")
+		})
+
+		Convey("Leaves an empty diagram empty", func() {
+			So(format("  \n"), ShouldEqual, "")
+		})
+	})
+}
+
+func TestHandleFormat(t *testing.T) {
+	Convey("POST /api/diagram/format", t, func() {
+		post := func(body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handleFormat(w, httptest.NewRequest("POST", "/api/diagram/format", strings.NewReader(body)))
+			return w
+		}
+
+		Convey("Returns the formatted diagram", func() {
+			w := post(`{"content": "graph TD;A-->B"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var resp struct {
+				Content string `json:"content"`
+				Changed bool   `json:"changed"`
+			}
+			So(json.Unmarshal(w.Body.Bytes(), &resp), ShouldBeNil)
+			So(resp.Content, ShouldEqual, "graph TD\n    A --> B\n")
+			So(resp.Changed, ShouldBeTrue)
+		})
+
+		Convey("Reports syntax errors", func() {
+			w := post(`{"content": "sequenceDiagram\n  A->>B"}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "colon")
+		})
+	})
+}
+
+func TestFormatPath(t *testing.T) {
+	Convey("Given diagram files", t, func() {
+		dir := t.TempDir()
+		messy := filepath.Join(dir, "messy.mmd")
+		tidy := filepath.Join(dir, "tidy.mermaid")
+		os.WriteFile(messy, []byte("graph TD;A-->B"), 0644)
+		os.WriteFile(tidy, []byte("graph TD\n    A --> B\n"), 0644)
+		os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+		os.WriteFile(filepath.Join(dir, ".git", "hidden.mmd"), []byte("graph TD"), 0644)
+		os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("graph TD"), 0644)
+
+		Convey("A directory gives the diagram files in it", func() {
+			files, err := diagramFiles(dir)
+			So(err, ShouldBeNil)
+			So(files, ShouldResemble, []string{messy, tidy})
+		})
+
+		Convey("-w rewrites only the files that need it", func() {
+			So(formatPath(messy, nil, true), ShouldBeNil)
+			data, _ := os.ReadFile(messy)
+			So(string(data), ShouldEqual, "graph TD\n    A --> B\n")
+		})
+
+		Convey("-l lists the files that need it", func() {
+			var listed bytes.Buffer
+			So(formatPath(messy, &listed, false), ShouldBeNil)
+			So(formatPath(tidy, &listed, false), ShouldBeNil)
+			So(listed.String(), ShouldEqual, messy+"\n")
+			data, _ := os.ReadFile(messy)
+			So(string(data), ShouldEqual, "graph TD;A-->B")
+		})
+
+		Convey("-l -w lists the files that need it and rewrites them", func() {
+			var listed bytes.Buffer
+			So(formatPath(messy, &listed, true), ShouldBeNil)
+			So(formatPath(tidy, &listed, true), ShouldBeNil)
+			So(listed.String(), ShouldEqual, messy+"\n")
+			data, _ := os.ReadFile(messy)
+			So(string(data), ShouldEqual, "graph TD\n    A --> B\n")
+		})
+
+		Convey("Errors name the file and position", func() {
+			bad := filepath.Join(dir, "bad.mmd")
+			os.WriteFile(bad, []byte("graph TD\n  end"), 0644)
+			err := formatPath(bad, nil, true)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, bad+":2:3: ")
+		})
+	})
+}
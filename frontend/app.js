@@ -10,7 +10,7 @@ import {
     crosshairCursor,
     highlightActiveLine,
 } from '@codemirror/view';
-import { EditorState, Compartment } from '@codemirror/state';
+import { EditorState, Compartment, ChangeSet } from '@codemirror/state';
 import { history, defaultKeymap, historyKeymap } from '@codemirror/commands';
 import {
     foldGutter,
@@ -27,6 +27,9 @@ import { indentWithTab } from '@codemirror/commands';
 import mermaid from 'mermaid';
 import { mermaidLanguage, mermaidLinter } from './editor.js';
 import { prettyPrintMermaidForEditor } from './format.js';
+import { transformChanges } from './ot.js';
+import { agentLinesExtension, setAgentLines } from './blame.js';
+import { clientColor, keepRemoteCursors, remoteCursorsExtension, setRemoteCursor } from './presence.js';
 
 // Register :q to quit the app
 Vim.defineEx('quit', 'q', () => {
@@ -167,6 +170,26 @@ function createSvgPanZoom(svgEl) {
 let panZoomInstance = null;
 let debounceTimer = null;
 let syncTimer = null;
+// Each tab is its own client, so it can tell its edits from everyone else's.
+const clientId = crypto.randomUUID ? crypto.randomUUID() : Math.random().toString(36).slice(2);
+// The latest server version applied to the editor and its length. Local
+// edits go to the server as deltas against it, one request at a time:
+// inFlight is the request awaiting its echo on the event stream, either
+// { changes } or { full: true, length } for a whole document, and
+// pendingChanges collects the edits made meanwhile. Remote edits are
+// transformed past both (see ot.js), the same way the server transforms
+// ours, so every editor ends up with the same text. When we can't be sure
+// the document matches the server (serverInSync false), we send all of it.
+let serverVersion = 0;
+let serverLength = 0;
+let serverInSync = false;
+let pendingChanges = null;
+let inFlight = null;
+let knownClients = new Map();
+let leaseRenewTimer = null;
+let leaseKey = null; // Lets our writes past the edit lease while we hold it
+let selectionTimer = null;
+let blameTimer = null;
 let renderCounter = 0;
 let isExternalUpdate = false;
 
@@ -178,6 +201,7 @@ const formatBtn = document.getElementById('format-btn');
 const collapseBtn = document.getElementById('collapse-btn');
 const expandBtn = document.getElementById('expand-btn');
 const resetZoomBtn = document.getElementById('reset-zoom-btn');
+const lockBtn = document.getElementById('lock-btn');
 
 // Light theme for CodeMirror
 const lightTheme = EditorView.theme({
@@ -231,13 +255,19 @@ const editor = new EditorView({
             lightTheme,
             mermaidLanguage(),
             mermaidLinter(),
+            remoteCursorsExtension(),
+            agentLinesExtension(),
             EditorView.updateListener.of((update) => {
                 if (update.docChanged) {
                     scheduleRender();
                     if (!isExternalUpdate) {
+                        pendingChanges = pendingChanges ? pendingChanges.compose(update.changes) : update.changes;
                         scheduleSyncToServer();
                     }
                 }
+                if (update.selectionSet && !isExternalUpdate) {
+                    scheduleSelectionSync();
+                }
             }),
         ],
     }),
@@ -294,18 +324,77 @@ async function renderDiagram(code) {
     }
 }
 
-function formatEditorContent() {
+// Click-to-source: clicking a node, subgraph or participant in the preview
+// selects where it is defined. A click that moved is a pan, not a pick.
+let previewPointerDown = null;
+
+previewEl.addEventListener('mousedown', (e) => {
+    previewPointerDown = { x: e.clientX, y: e.clientY };
+});
+
+previewEl.addEventListener('click', async (e) => {
+    const down = previewPointerDown;
+    previewPointerDown = null;
+    if (down && Math.hypot(e.clientX - down.x, e.clientY - down.y) > 4) return;
+    const id = previewElementId(e.target);
+    if (!id) return;
+    try {
+        const { version, items } = await (await fetch(`/api/diagram/outline?id=${encodeURIComponent(id)}`)).json();
+        if (version !== serverVersion || !serverInSync || inFlight || pendingChanges) return;
+        const item = items.find((i) => ['node', 'subgraph', 'participant'].includes(i.element));
+        if (item) selectSpan(item.span);
+    } catch {
+        // Server unavailable — nothing to jump to
+    }
+});
+
+// previewElementId finds the diagram id of the SVG element clicked, walking
+// up from it through what Mermaid renders for nodes, clusters and actors.
+function previewElementId(el) {
+    for (; el && el !== previewEl; el = el.parentElement) {
+        if (el.dataset?.id) return el.dataset.id;
+        if (el.classList?.contains('actor') && el.getAttribute('name')) return el.getAttribute('name');
+        const actor = el.tagName === 'g' && el.querySelector(':scope > .actor[name]');
+        if (actor) return actor.getAttribute('name');
+        const m = el.id && el.id.match(/(?:flowchart|state)-(.+)-\d+$/);
+        if (m) return m[1];
+        if (el.classList?.contains('cluster') && el.id) return el.id;
+    }
+    return null;
+}
+
+// selectSpan selects a span of the diagram, given in lines and columns from 1.
+function selectSpan(span) {
+    const doc = editor.state.doc;
+    const pos = (p) => Math.min(doc.line(Math.min(p.line, doc.lines)).from + p.col - 1, doc.length);
+    editor.dispatch({ selection: { anchor: pos(span.start), head: pos(span.end) }, scrollIntoView: true });
+    editor.focus();
+}
+
+// Format with the editor's formatter, falling back to splitting one-line
+// diagrams when it refuses, e.g. over a syntax error the linter shows.
+async function formatEditorContent() {
     const current = editor.state.doc.toString();
-    const formatted = prettyPrintMermaidForEditor(current);
-    if (formatted === current) return;
+    let formatted = prettyPrintMermaidForEditor(current);
+    try {
+        const resp = await fetch('/api/diagram/format', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ content: current }),
+        });
+        if (resp.ok) formatted = (await resp.json()).content;
+    } catch (e) {
+        // Keep the local formatting
+    }
+    if (formatted === current || editor.state.doc.toString() !== current) return;
 
     editor.dispatch({
         changes: { from: 0, to: editor.state.doc.length, insert: formatted },
     });
 }
 
-formatBtn.addEventListener('click', () => {
-    formatEditorContent();
+formatBtn.addEventListener('click', async () => {
+    await formatEditorContent();
     editor.focus();
 });
 
@@ -491,40 +580,367 @@ downloadPngBtn.addEventListener('click', () => {
 
 function scheduleSyncToServer() {
     clearTimeout(syncTimer);
-    syncTimer = setTimeout(() => {
-        const content = editor.state.doc.toString();
-        fetch('/api/diagram', {
+    syncTimer = setTimeout(syncToServer, 300);
+}
+
+// Send local edits as a delta against serverVersion, or the whole document
+// if we're out of sync or the server can't merge them.
+async function syncToServer() {
+    if (inFlight) return; // Sent when the server acknowledges inFlight
+    if (!serverInSync) {
+        await sendDocument();
+        return;
+    }
+    if (!pendingChanges) return;
+    const changes = toChangeList(pendingChanges);
+    const sent = { changes };
+    inFlight = sent;
+    pendingChanges = null;
+    try {
+        const resp = await fetch('/api/diagram', {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ base: serverVersion, changes, source: 'browser', client: clientId, lease: leaseKey }),
+        });
+        if (resp.ok) return; // Acknowledged on the event stream
+    } catch {
+        // Server unavailable — fall through
+    }
+    if (inFlight === sent) inFlight = null;
+    serverInSync = false;
+    await sendDocument();
+}
+
+// Send our whole document, based on serverVersion so the server merges in
+// the edits made since. Edits made meanwhile are collected in
+// pendingChanges, relative to what we sent. If the server can't merge it,
+// we take its current version as the base and try again, with the
+// conflict markers in our document if there were conflicts.
+async function sendDocument(retries = 2) {
+    const content = editor.state.doc.toString();
+    const sent = { full: true, length: content.length };
+    inFlight = sent;
+    pendingChanges = null;
+    try {
+        const resp = await fetch('/api/diagram', {
             method: 'PUT',
             headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ content, source: 'browser' }),
-        }).catch(() => {
-            // Server unavailable — ignore
+            body: JSON.stringify({ content, base: serverVersion, source: 'browser', client: clientId, lease: leaseKey }),
         });
+        if (resp.ok) return;
+        if (resp.status === 409 && retries > 0 && inFlight === sent) {
+            const conflict = await resp.json();
+            serverVersion = conflict.version;
+            if (conflict.merged_with_markers && !pendingChanges) {
+                isExternalUpdate = true;
+                editor.dispatch({
+                    changes: { from: 0, to: editor.state.doc.length, insert: conflict.merged_with_markers },
+                });
+                isExternalUpdate = false;
+            }
+            await sendDocument(retries - 1);
+            return;
+        }
+    } catch {
+        // Server unavailable — send everything with the next edit
+    }
+    if (inFlight === sent) inFlight = null;
+}
+
+function toChangeList(changeSet) {
+    const changes = [];
+    changeSet.iterChanges((fromA, toA, _fromB, _toB, inserted) => {
+        changes.push({ from: fromA, to: toA, insert: inserted.toString() });
+    });
+    return changes;
+}
+
+function lengthChange(changes) {
+    return changes.reduce((n, c) => n + c.insert.length - (c.to - c.from), 0);
+}
+
+// Handle a diagram event: our own edit coming back, which acknowledges
+// inFlight, or someone else's, which we merge with our unacknowledged edits.
+function handleDiagramEvent(event) {
+    const own = event.client === clientId;
+    if (inFlight?.full && !own) {
+        // Made before our whole document, which the server merges it into;
+        // our document comes back whole then.
+        return;
+    }
+
+    if (event.content !== undefined) {
+        if (own) inFlight = null;
+        if (!inFlight && !pendingChanges) {
+            loadServerContent(event.content, event.version);
+            return;
+        }
+        // The whole document can't be merged with edits the server hasn't
+        // seen; keep ours and send everything.
+        inFlight = null;
+        serverInSync = false;
+        scheduleSyncToServer();
+        return;
+    }
+
+    if (own) {
+        if (!inFlight) return;
+        serverLength = inFlight.full ? inFlight.length : serverLength + lengthChange(event.changes);
+        serverVersion = event.version;
+        serverInSync = true;
+        inFlight = null;
+        if (pendingChanges) syncToServer();
+        scheduleBlame();
+        return;
+    }
+
+    if (!serverInSync || event.base !== serverVersion) {
+        // We can't place the edit; whole documents will sort it out.
+        if (inFlight || pendingChanges) {
+            serverInSync = false;
+            scheduleSyncToServer();
+        } else {
+            reloadFromServer();
+        }
+        return;
+    }
+
+    // Transform the remote edit past ours, and ours past it.
+    let changes = event.changes;
+    if (inFlight) {
+        [changes, inFlight.changes] = transformChanges(changes, inFlight.changes, serverLength);
+    }
+    if (pendingChanges) {
+        const length = pendingChanges.length;
+        const [remote, local] = transformChanges(changes, toChangeList(pendingChanges), length);
+        pendingChanges = ChangeSet.of(local, length + lengthChange(changes));
+        changes = remote;
+    }
+    isExternalUpdate = true;
+    editor.dispatch({ changes });
+    isExternalUpdate = false;
+    serverLength += lengthChange(event.changes);
+    serverVersion = event.version;
+    scheduleBlame();
+}
+
+// Replace the document with content from the server at version.
+function loadServerContent(content, version) {
+    const formattedContent = prettyPrintMermaidForEditor(content);
+    if (formattedContent !== editor.state.doc.toString()) {
+        isExternalUpdate = true;
+        editor.dispatch({
+            changes: { from: 0, to: editor.state.doc.length, insert: formattedContent },
+        });
+        isExternalUpdate = false;
+    }
+    serverVersion = version;
+    serverLength = content.length;
+    serverInSync = editor.state.doc.toString() === content;
+    pendingChanges = null;
+    inFlight = null;
+    scheduleBlame();
+}
+
+async function reloadFromServer() {
+    try {
+        const { content, version } = await (await fetch('/api/diagram')).json();
+        loadServerContent(content, version);
+    } catch {
+        // Server unavailable — the next event will bring us up to date
+    }
+}
+
+// Show who else is connected, and drop the cursors of those who left.
+function updatePresence(clients) {
+    const others = clients.filter((c) => c.id !== clientId);
+    const presence = document.getElementById('presence');
+    presence.replaceChildren(...others.map((c) => {
+        // Other tabs get an initial; agents and tools are named in full, so
+        // it's clear when one is following along.
+        const badge = document.createElement('span');
+        badge.style.backgroundColor = clientColor(c.id);
+        if (c.kind === 'browser') {
+            badge.className = 'presence-badge';
+            badge.textContent = c.name.charAt(0).toUpperCase();
+        } else {
+            badge.className = 'presence-badge presence-agent';
+            badge.textContent = `${c.name} is connected`;
+        }
+        badge.title = `${c.name} (${c.kind})`;
+        return badge;
+    }));
+
+    const effects = [keepRemoteCursors.of(new Set(others.map((c) => c.id)))];
+    for (const c of others) {
+        // Selections of clients we already follow are newer than the list's.
+        if (c.selection && !knownClients.has(c.id)) {
+            effects.push(setRemoteCursor.of({ id: c.id, name: c.name, from: c.selection.from, to: c.selection.to }));
+        }
+    }
+    knownClients = new Map(others.map((c) => [c.id, c]));
+    editor.dispatch({ effects });
+}
+
+// Tint the lines agents wrote, once edits settle. The server's line numbers
+// only fit our document when it has seen all our edits.
+function scheduleBlame() {
+    clearTimeout(blameTimer);
+    blameTimer = setTimeout(async () => {
+        try {
+            const { version, lines } = await (await fetch('/api/diagram/blame')).json();
+            if (version !== serverVersion || !serverInSync || inFlight || pendingChanges) return;
+            const agentLines = lines
+                .filter((l) => l.source !== 'browser' && l.source !== 'initial')
+                .map((l) => {
+                    const name = knownClients.get(l.client)?.name || l.source;
+                    return { from: l.from, to: l.to, title: `Changed by ${name} in version ${l.version}` };
+                });
+            editor.dispatch({ effects: setAgentLines.of(agentLines) });
+        } catch {
+            // Server unavailable — keep the tint we have
+        }
+    }, 500);
+}
+
+// Share the selection so agents can see what the user is looking at
+function scheduleSelectionSync() {
+    clearTimeout(selectionTimer);
+    selectionTimer = setTimeout(() => {
+        const { from, to } = editor.state.selection.main;
+        fetch('/api/selection', {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ from, to, source: 'browser', client: clientId }),
+        }).catch(() => {});
     }, 300);
 }
 
-// Connect to SSE for live updates from external sources (e.g. MCP)
+// ── Edit lease ──────────────────────────────────────────────────────────────
+// Locking keeps agents, scripts and other tabs from changing the diagram
+// while you make a careful edit: only writes with the lease's key get
+// through. The lease is renewed while held, so it only lapses if the tab
+// goes away.
+
+const LEASE_SECONDS = 300;
+
+// Take or renew the lease, keeping the key it comes with.
+async function takeLease() {
+    const resp = await fetch('/api/lease', {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ client: clientId, key: leaseKey, ttl_seconds: LEASE_SECONDS }),
+    });
+    const status = await resp.json();
+    if (status.key) leaseKey = status.key;
+    return status;
+}
+
+function showLease({ held, lease }) {
+    const ours = held && lease.client === clientId && leaseKey !== null;
+    if (!ours) leaseKey = null;
+    lockBtn.classList.toggle('held', held);
+    lockBtn.textContent = ours ? 'Unlock' : held ? 'Locked' : 'Lock';
+    lockBtn.title = ours ? 'Let agents change the diagram again'
+        : held ? `${lease.owner} locked the diagram in another tab`
+            : 'Keep agents from changing the diagram while you edit';
+
+    clearInterval(leaseRenewTimer);
+    leaseRenewTimer = ours ? setInterval(() => takeLease().catch(() => {}), LEASE_SECONDS * 1000 / 3) : null;
+}
+
+lockBtn.addEventListener('click', async () => {
+    try {
+        if (leaseRenewTimer) {
+            const resp = await fetch(`/api/lease?key=${encodeURIComponent(leaseKey)}`, { method: 'DELETE' });
+            if (resp.ok) showLease({ held: false });
+        } else {
+            showLease(await takeLease());
+        }
+    } catch {
+        // Server unavailable
+    }
+});
+
+fetch('/api/lease').then(r => r.json()).then(showLease).catch(() => {});
+
+// Connect to SSE for live updates from other tabs and external sources (e.g.
+// MCP). After a dropped connection EventSource reconnects with Last-Event-ID
+// and the server replays the versions we missed.
 function connectSSE() {
-    const evtSource = new EventSource('/api/events');
+    const evtSource = new EventSource(`/api/events?client=${encodeURIComponent(clientId)}&kind=browser`);
 
-    evtSource.onmessage = (e) => {
+    evtSource.addEventListener('diagram', (e) => {
+        let event;
+        try {
+            event = JSON.parse(e.data);
+        } catch {
+            return; // Ignore malformed events
+        }
         try {
-            const event = JSON.parse(e.data);
-            if (event.source === 'browser') return; // Ignore our own changes
+            handleDiagramEvent(event);
+        } catch {
+            // The edit didn't fit our document; start over from the server's
+            inFlight = null;
+            reloadFromServer();
+        }
+    });
 
-            const formattedContent = prettyPrintMermaidForEditor(event.content);
-            const currentContent = editor.state.doc.toString();
-            if (formattedContent === currentContent) return; // Already in sync
+    evtSource.addEventListener('preferences', (e) => {
+        try {
+            const prefs = JSON.parse(e.data);
+            if (typeof prefs.vimMode === 'boolean' && prefs.vimMode !== vimToggle.checked) {
+                setVimMode(prefs.vimMode);
+            }
+        } catch {
+            // Ignore malformed events
+        }
+    });
 
+    evtSource.addEventListener('selection', (e) => {
+        try {
+            const { from, to, client } = JSON.parse(e.data);
+            if (client === clientId) return;
+            if (client) {
+                // Another editor's selection shows as its cursor.
+                const name = knownClients.get(client)?.name || 'browser';
+                editor.dispatch({ effects: setRemoteCursor.of({ id: client, name, from, to }) });
+                return;
+            }
+            // An agent pointing at part of the diagram moves our selection.
+            const length = editor.state.doc.length;
             isExternalUpdate = true;
             editor.dispatch({
-                changes: { from: 0, to: editor.state.doc.length, insert: formattedContent },
+                selection: { anchor: Math.min(from, length), head: Math.min(to, length) },
+                scrollIntoView: true,
             });
             isExternalUpdate = false;
         } catch {
             // Ignore malformed events
         }
-    };
+    });
+
+    evtSource.addEventListener('lease', (e) => {
+        try {
+            showLease(JSON.parse(e.data));
+        } catch {
+            // Ignore malformed events
+        }
+    });
+
+    evtSource.addEventListener('clients', (e) => {
+        try {
+            updatePresence(JSON.parse(e.data));
+        } catch {
+            // Ignore malformed events
+        }
+    });
+
+    // The editor process is going away; stop reconnecting and say so.
+    evtSource.addEventListener('shutdown', () => {
+        evtSource.close();
+        document.getElementById('stopped-banner').classList.remove('hidden');
+    });
 
     evtSource.onerror = () => {
         // EventSource auto-reconnects
@@ -545,14 +961,11 @@ editor.dom.addEventListener('paste', () => {
 // Initial load: fetch current diagram from server (may have been set via CLI arg)
 fetch('/api/diagram')
     .then(r => r.json())
-    .then(({ content }) => {
+    .then(({ content, version }) => {
         if (content) {
-            const formattedContent = prettyPrintMermaidForEditor(content);
-            isExternalUpdate = true;
-            editor.dispatch({
-                changes: { from: 0, to: editor.state.doc.length, insert: formattedContent },
-            });
-            isExternalUpdate = false;
+            loadServerContent(content, version);
+        } else {
+            serverVersion = version;
         }
         renderDiagram(editor.state.doc.toString());
     })
@@ -0,0 +1,46 @@
+import { StateEffect, StateField } from '@codemirror/state';
+import { Decoration, EditorView } from '@codemirror/view';
+
+// Lines last changed by an agent or script rather than by hand, tinted so
+// it's easy to see what to review. The attribution comes from the server's
+// blame and is kept in place as the document changes until the next one.
+
+// Tint lines: [{ from, to, title }], numbered from 1.
+export const setAgentLines = StateEffect.define();
+
+const agentLine = (title) => Decoration.line({ class: 'cm-agent-line', attributes: { title } });
+
+const agentLines = StateField.define({
+    create() {
+        return Decoration.none;
+    },
+
+    update(lines, tr) {
+        lines = lines.map(tr.changes);
+        for (const effect of tr.effects) {
+            if (!effect.is(setAgentLines)) continue;
+            const { doc } = tr.state;
+            const ranges = [];
+            for (const { from, to, title } of effect.value) {
+                for (let n = from; n <= Math.min(to, doc.lines); n++) {
+                    ranges.push(agentLine(title).range(doc.line(n).from));
+                }
+            }
+            lines = Decoration.set(ranges, true);
+        }
+        return lines;
+    },
+
+    provide: (field) => EditorView.decorations.from(field),
+});
+
+const blameTheme = EditorView.baseTheme({
+    '.cm-agent-line': {
+        backgroundColor: 'rgba(162, 155, 254, 0.12)',
+        boxShadow: 'inset 2px 0 0 rgba(108, 92, 231, 0.5)',
+    },
+});
+
+export function agentLinesExtension() {
+    return [agentLines, blameTheme];
+}
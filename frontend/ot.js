@@ -0,0 +1,112 @@
+// Operational transform for text, the same algorithm as ot.go on the server.
+// An operation is a list of parts that walk the base document from start to
+// end: { retain: n }, { delete: n } or { insert: 'text' }. Lengths are UTF-16
+// code units, i.e. JavaScript string lengths and CodeMirror positions.
+
+function push(op, part) {
+    const last = op[op.length - 1];
+    if (last && part.retain && last.retain) {
+        last.retain += part.retain;
+    } else if (last && part.delete && last.delete) {
+        last.delete += part.delete;
+    } else if (last && part.insert && last.insert) {
+        last.insert += part.insert;
+    } else if (part.retain || part.delete || part.insert) {
+        op.push({ ...part });
+    }
+}
+
+// Build the operation for [{from, to, insert}] changes against a document of
+// baseLength units.
+export function fromChanges(changes, baseLength) {
+    const op = [];
+    let pos = 0;
+    for (const c of changes) {
+        if (c.from < pos || c.to < c.from || c.to > baseLength) {
+            throw new Error(`change ${c.from}-${c.to} is out of order or out of range`);
+        }
+        push(op, { retain: c.from - pos });
+        push(op, { delete: c.to - c.from });
+        push(op, { insert: c.insert });
+        pos = c.to;
+    }
+    push(op, { retain: baseLength - pos });
+    return op;
+}
+
+// Return an operation as [{from, to, insert}] changes against its base.
+export function toChanges(op) {
+    const changes = [];
+    let pos = 0;
+    for (const part of op) {
+        if (part.retain) {
+            pos += part.retain;
+            continue;
+        }
+        const last = changes[changes.length - 1];
+        if (last && last.to === pos) {
+            last.to += part.delete || 0;
+            last.insert += part.insert || '';
+        } else {
+            changes.push({ from: pos, to: pos + (part.delete || 0), insert: part.insert || '' });
+        }
+        pos += part.delete || 0;
+    }
+    return changes;
+}
+
+// Given operations a and b made concurrently against the same document,
+// return [a', b'] such that a then b' equals b then a'. Where both insert at
+// the same place, a's text goes first.
+export function transform(a, b) {
+    const aPrime = [];
+    const bPrime = [];
+    let i = 0;
+    let j = 0;
+    const nextA = () => (i < a.length ? { ...a[i++] } : null);
+    const nextB = () => (j < b.length ? { ...b[j++] } : null);
+    let pa = nextA();
+    let pb = nextB();
+
+    while (pa || pb) {
+        if (pa && pa.insert) {
+            push(aPrime, { insert: pa.insert });
+            push(bPrime, { retain: pa.insert.length });
+            pa = nextA();
+            continue;
+        }
+        if (pb && pb.insert) {
+            push(aPrime, { retain: pb.insert.length });
+            push(bPrime, { insert: pb.insert });
+            pb = nextB();
+            continue;
+        }
+        if (!pa || !pb) {
+            throw new Error('operations have different base lengths');
+        }
+
+        const n = Math.min(pa.retain || pa.delete, pb.retain || pb.delete);
+        if (pa.retain && pb.retain) {
+            push(aPrime, { retain: n });
+            push(bPrime, { retain: n });
+        } else if (pa.delete && pb.retain) {
+            push(aPrime, { delete: n });
+        } else if (pa.retain && pb.delete) {
+            push(bPrime, { delete: n });
+        }
+        // Both deleting the same text needs nothing further.
+
+        if (pa.retain) pa.retain -= n; else pa.delete -= n;
+        if (pb.retain) pb.retain -= n; else pb.delete -= n;
+        if (!pa.retain && !pa.delete) pa = nextA();
+        if (!pb.retain && !pb.delete) pb = nextB();
+    }
+    return [aPrime, bPrime];
+}
+
+// Transform concurrent change lists a and b, both against a document of
+// baseLength units. Returns [a', b'] as change lists.
+export function transformChanges(a, b, baseLength) {
+    const [aPrime, bPrime] = transform(fromChanges(a, baseLength), fromChanges(b, baseLength));
+    return [toChanges(aPrime), toChanges(bPrime)];
+}
@@ -0,0 +1,65 @@
+import { describe, expect, it } from 'vitest';
+import { fromChanges, toChanges, transformChanges } from './ot.js';
+
+function apply(doc, changes) {
+    let out = '';
+    let pos = 0;
+    for (const c of changes) {
+        out += doc.slice(pos, c.from) + c.insert;
+        pos = c.to;
+    }
+    return out + doc.slice(pos);
+}
+
+// Apply a then b' and b then a', which must agree.
+function both(doc, a, b) {
+    const [aPrime, bPrime] = transformChanges(a, b, doc.length);
+    return [apply(apply(doc, a), bPrime), apply(apply(doc, b), aPrime)];
+}
+
+const doc = 'graph TD\n  A-->B';
+
+describe('transformChanges', () => {
+    it('keeps edits in different places', () => {
+        const [ab, ba] = both(doc,
+            [{ from: 6, to: 8, insert: 'LR' }],
+            [{ from: 16, to: 16, insert: '-->C' }]);
+        expect(ab).toBe('graph LR\n  A-->B-->C');
+        expect(ba).toBe(ab);
+    });
+
+    it('puts the first operation\'s text first for inserts at the same place', () => {
+        const [ab, ba] = both(doc,
+            [{ from: 0, to: 0, insert: 'a' }],
+            [{ from: 0, to: 0, insert: 'b' }]);
+        expect(ab.startsWith('ab')).toBe(true);
+        expect(ba).toBe(ab);
+    });
+
+    it('keeps text typed inside a range the other side deleted', () => {
+        const [ab, ba] = both(doc,
+            [{ from: 9, to: 16, insert: '' }],
+            [{ from: 12, to: 12, insert: 'X' }]);
+        expect(ab).toBe('graph TD\nX');
+        expect(ba).toBe(ab);
+    });
+
+    it('removes overlapping deletes once', () => {
+        const [ab, ba] = both(doc,
+            [{ from: 0, to: 6, insert: '' }],
+            [{ from: 3, to: 9, insert: '' }]);
+        expect(ab).toBe('  A-->B');
+        expect(ba).toBe(ab);
+    });
+
+    it('rejects operations on documents of different lengths', () => {
+        expect(() => transformChanges([{ from: 0, to: 5, insert: '' }], [], 3)).toThrow();
+    });
+});
+
+describe('fromChanges / toChanges', () => {
+    it('round-trips a change list', () => {
+        const changes = [{ from: 1, to: 3, insert: 'q' }, { from: 4, to: 4, insert: 'z' }];
+        expect(toChanges(fromChanges(changes, 5))).toEqual(changes);
+    });
+});
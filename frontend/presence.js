@@ -0,0 +1,116 @@
+import { StateEffect, StateField } from '@codemirror/state';
+import { Decoration, EditorView, WidgetType } from '@codemirror/view';
+
+// Other clients' cursors and selections, drawn in the editor and kept in
+// place as the document changes underneath them.
+
+// A stable color for a client id, optionally translucent.
+export function clientColor(id, alpha = 1) {
+    let hash = 0;
+    for (const ch of id) {
+        hash = (hash * 31 + ch.charCodeAt(0)) | 0;
+    }
+    return `hsla(${Math.abs(hash) % 360}, 65%, 45%, ${alpha})`;
+}
+
+// Show a client's selection: { id, name, from, to }.
+export const setRemoteCursor = StateEffect.define();
+
+// Drop the cursors of clients whose ids aren't in the given set.
+export const keepRemoteCursors = StateEffect.define();
+
+class CaretWidget extends WidgetType {
+    constructor(name, color) {
+        super();
+        this.name = name;
+        this.color = color;
+    }
+
+    eq(other) {
+        return other.name === this.name && other.color === this.color;
+    }
+
+    toDOM() {
+        const caret = document.createElement('span');
+        caret.className = 'cm-remote-caret';
+        caret.style.borderLeftColor = this.color;
+        const label = document.createElement('span');
+        label.className = 'cm-remote-label';
+        label.style.backgroundColor = this.color;
+        label.textContent = this.name;
+        caret.appendChild(label);
+        return caret;
+    }
+
+    ignoreEvent() {
+        return true;
+    }
+}
+
+const remoteCursors = StateField.define({
+    create() {
+        return new Map();
+    },
+
+    update(cursors, tr) {
+        let next = cursors;
+        if (tr.docChanged) {
+            next = new Map();
+            for (const [id, c] of cursors) {
+                next.set(id, { ...c, from: tr.changes.mapPos(c.from, -1), to: tr.changes.mapPos(c.to, 1) });
+            }
+        }
+        for (const effect of tr.effects) {
+            if (effect.is(setRemoteCursor)) {
+                const { id, name, from, to } = effect.value;
+                const length = tr.state.doc.length;
+                next = new Map(next);
+                next.set(id, { name, from: Math.min(from, length), to: Math.min(to, length) });
+            } else if (effect.is(keepRemoteCursors)) {
+                next = new Map([...next].filter(([id]) => effect.value.has(id)));
+            }
+        }
+        return next;
+    },
+
+    provide: (field) => EditorView.decorations.from(field, (cursors) => {
+        const ranges = [];
+        for (const [id, c] of cursors) {
+            const color = clientColor(id);
+            if (c.from < c.to) {
+                ranges.push(Decoration.mark({
+                    class: 'cm-remote-selection',
+                    attributes: { style: `background-color: ${clientColor(id, 0.2)}` },
+                }).range(c.from, c.to));
+            }
+            ranges.push(Decoration.widget({ widget: new CaretWidget(c.name, color), side: 1 }).range(c.to));
+        }
+        return Decoration.set(ranges, true);
+    }),
+});
+
+const presenceTheme = EditorView.baseTheme({
+    '.cm-remote-caret': {
+        position: 'relative',
+        borderLeft: '2px solid',
+        marginLeft: '-1px',
+        marginRight: '-1px',
+    },
+    '.cm-remote-label': {
+        position: 'absolute',
+        bottom: '100%',
+        left: '-2px',
+        padding: '0 4px',
+        borderRadius: '3px 3px 3px 0',
+        color: '#fff',
+        fontSize: '10px',
+        lineHeight: '14px',
+        whiteSpace: 'nowrap',
+        pointerEvents: 'none',
+        opacity: '0.85',
+    },
+});
+
+export function remoteCursorsExtension() {
+    return [remoteCursors, presenceTheme];
+}
@@ -2,13 +2,16 @@ module github.com/kmatthias/mermaid-editor
 
 go 1.25.1
 
+require (
+	github.com/modelcontextprotocol/go-sdk v1.3.0
+	github.com/smartystreets/goconvey v1.8.1
+)
+
 require (
 	github.com/google/jsonschema-go v0.4.2 // indirect
 	github.com/gopherjs/gopherjs v1.17.2 // indirect
 	github.com/jtolds/gls v4.20.0+incompatible // indirect
-	github.com/modelcontextprotocol/go-sdk v1.3.0 // indirect
 	github.com/smarty/assertions v1.15.0 // indirect
-	github.com/smartystreets/goconvey v1.8.1 // indirect
 	github.com/yosida95/uritemplate/v3 v3.0.2 // indirect
 	golang.org/x/mod v0.25.0 // indirect
 	golang.org/x/oauth2 v0.30.0 // indirect
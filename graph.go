@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Graph is what a diagram says rather than how it is written: its nodes,
+// edges and subgraphs, or its participants, messages and notes. Only
+// flowchart and sequence graphs can be written back; the others are marked
+// read-only.
+type Graph struct {
+	Kind         string             `json:"kind"` // flowchart, sequence, state, class or er
+	ReadOnly     bool               `json:"read_only,omitempty"`
+	Direction    string             `json:"direction,omitempty"`
+	Nodes        []GraphNode        `json:"nodes,omitempty"`
+	Edges        []GraphEdge        `json:"edges,omitempty"`
+	Subgraphs    []GraphSubgraph    `json:"subgraphs,omitempty"`
+	ClassDefs    []GraphClassDef    `json:"class_defs,omitempty"`
+	Participants []GraphParticipant `json:"participants,omitempty"`
+	Messages     []GraphMessage     `json:"messages,omitempty"`
+	Notes        []GraphNote        `json:"notes,omitempty"`
+}
+
+// GraphNode is a flowchart node, a state, a class or an entity.
+type GraphNode struct {
+	ID       string   `json:"id"`
+	Label    string   `json:"label,omitempty"`
+	Shape    string   `json:"shape,omitempty"`
+	Classes  []string `json:"classes,omitempty"`
+	Style    string   `json:"style,omitempty"`
+	Subgraph string   `json:"subgraph,omitempty"`
+	Members  []string `json:"members,omitempty"`
+}
+
+// GraphEdge is a link between two nodes. For flowcharts, line and head
+// describe the arrow; either it or they are enough to write it.
+type GraphEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Label     string `json:"label,omitempty"`
+	Arrow     string `json:"arrow,omitempty"`
+	Line      string `json:"line,omitempty"` // solid, dotted, thick or invisible
+	Head      string `json:"head,omitempty"` // arrow, circle, cross or none
+	FromLabel string `json:"from_label,omitempty"`
+	ToLabel   string `json:"to_label,omitempty"`
+	Style     string `json:"style,omitempty"`
+}
+
+// GraphSubgraph is a flowchart subgraph, a composite state or a namespace.
+type GraphSubgraph struct {
+	ID        string `json:"id"`
+	Title     string `json:"title,omitempty"`
+	Parent    string `json:"parent,omitempty"`
+	Direction string `json:"direction,omitempty"`
+}
+
+// GraphClassDef is a class nodes can be given.
+type GraphClassDef struct {
+	Name   string `json:"name"`
+	Styles string `json:"styles"`
+}
+
+// GraphParticipant is a sequence diagram participant or actor.
+type GraphParticipant struct {
+	ID    string `json:"id"`
+	Label string `json:"label,omitempty"`
+	Kind  string `json:"kind,omitempty"` // participant or actor
+	Box   string `json:"box,omitempty"`
+}
+
+// GraphMessage is a sequence diagram message. Block names the blocks it is
+// in, outermost first, with the section it is in for a block split into
+// sections, as in "loop retry > else failed". Written back, messages in a
+// row in blocks named alike go in one block.
+type GraphMessage struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Arrow      string `json:"arrow,omitempty"`
+	Text       string `json:"text"`
+	Activate   bool   `json:"activate,omitempty"`
+	Deactivate bool   `json:"deactivate,omitempty"`
+	Block      string `json:"block,omitempty"`
+}
+
+// GraphNote is a sequence diagram note, after the first After messages.
+type GraphNote struct {
+	Position     string   `json:"position"`
+	Participants []string `json:"participants"`
+	Text         string   `json:"text"`
+	After        int      `json:"after"`
+}
+
+// flowArrowType describes a flowchart arrow by its line and head.
+func flowArrowType(arrow string) (line, head string) {
+	switch {
+	case strings.HasPrefix(arrow, "~"):
+		return "invisible", "none"
+	case strings.Contains(arrow, "="):
+		line = "thick"
+	case strings.Contains(arrow, "."):
+		line = "dotted"
+	default:
+		line = "solid"
+	}
+	switch arrow[len(arrow)-1] {
+	case '>':
+		head = "arrow"
+	case 'o':
+		head = "circle"
+	case 'x':
+		head = "cross"
+	default:
+		head = "none"
+	}
+	return line, head
+}
+
+// flowArrow writes the flowchart arrow with a line and head.
+func flowArrow(line, head string) (string, error) {
+	heads := map[string]string{"": ">", "arrow": ">", "circle": "o", "cross": "x"}
+	end, ok := heads[head]
+	switch {
+	case line == "invisible":
+		return "~~~", nil
+	case head == "none":
+		end, ok = "", true
+	case !ok:
+		return "", fmt.Errorf("unknown arrow head %q; use arrow, circle, cross or none", head)
+	}
+	switch line {
+	case "", "solid":
+		if end == "" {
+			return "---", nil
+		}
+		return "--" + end, nil
+	case "dotted":
+		return "-.-" + end, nil
+	case "thick":
+		if end == "" {
+			return "===", nil
+		}
+		return "==" + end, nil
+	}
+	return "", fmt.Errorf("unknown line %q; use solid, dotted, thick or invisible", line)
+}
+
+// DiagramGraph returns the graph of a parsed diagram.
+func DiagramGraph(d *Diagram) Graph {
+	g := Graph{Kind: d.Kind, Direction: d.Direction, ReadOnly: !graphWritable(d.Kind)}
+	styles := map[string][]string{}
+	linkStyles := map[string][]string{}
+	for _, s := range d.Styles {
+		if s.Link {
+			linkStyles[s.Target] = append(linkStyles[s.Target], s.Styles)
+		} else {
+			styles[s.Target] = append(styles[s.Target], s.Styles)
+		}
+	}
+	for _, n := range d.Nodes {
+		g.Nodes = append(g.Nodes, GraphNode{
+			ID:       n.ID,
+			Label:    n.Label,
+			Shape:    n.Shape,
+			Classes:  n.Classes,
+			Style:    strings.Join(styles[n.ID], ","),
+			Subgraph: n.Subgraph,
+			Members:  n.Members,
+		})
+	}
+	for _, e := range d.Edges {
+		edge := GraphEdge{
+			From:      e.From,
+			To:        e.To,
+			Label:     e.Label,
+			Arrow:     e.Arrow,
+			FromLabel: e.FromLabel,
+			ToLabel:   e.ToLabel,
+			Style:     strings.Join(linkStyles[strconv.Itoa(e.Index)], ","),
+		}
+		if d.Kind == kindFlowchart {
+			edge.Line, edge.Head = flowArrowType(e.Arrow)
+		}
+		g.Edges = append(g.Edges, edge)
+	}
+	for _, sg := range d.Subgraphs {
+		g.Subgraphs = append(g.Subgraphs, GraphSubgraph{ID: sg.ID, Title: sg.Title, Parent: sg.Parent, Direction: sg.Direction})
+	}
+	for _, c := range d.ClassDefs {
+		g.ClassDefs = append(g.ClassDefs, GraphClassDef{Name: c.Name, Styles: c.Styles})
+	}
+	for _, p := range d.Participants {
+		g.Participants = append(g.Participants, GraphParticipant{ID: p.ID, Label: p.Label, Kind: p.Kind, Box: p.Box})
+	}
+	for i, m := range ListMessages(d) {
+		msg := d.Messages[i]
+		g.Messages = append(g.Messages, GraphMessage{
+			From:       m.From,
+			To:         m.To,
+			Arrow:      m.Arrow,
+			Text:       m.Text,
+			Activate:   msg.Activate,
+			Deactivate: msg.Deactivate,
+			Block:      m.Block,
+		})
+	}
+	for _, n := range d.Notes {
+		after := 0
+		for _, m := range d.Messages {
+			if m.Span.Start.Offset < n.Span.Start.Offset {
+				after++
+			}
+		}
+		g.Notes = append(g.Notes, GraphNote{Position: n.Position, Participants: n.Actors, Text: n.Text, After: after})
+	}
+	return g
+}
+
+// GraphMermaid writes a flowchart or sequence diagram graph as Mermaid.
+func GraphMermaid(g Graph) (string, error) {
+	switch g.Kind {
+	case kindFlowchart:
+		return flowchartFromGraph(g)
+	case kindSequence:
+		return sequenceFromGraph(g)
+	}
+	return "", fmt.Errorf("can't write a %q graph; only flowchart and sequence graphs can be written, the others are read-only", g.Kind)
+}
+
+// graphWritable reports whether GraphMermaid can write a graph of kind.
+func graphWritable(kind string) bool {
+	return kind == kindFlowchart || kind == kindSequence
+}
+
+// flowchartFromGraph writes a flowchart: class definitions, nodes outside
+// subgraphs, the subgraphs with their nodes, then the edges and styles.
+func flowchartFromGraph(g Graph) (string, error) {
+	dir := g.Direction
+	if dir == "" {
+		dir = "TD"
+	}
+	if !flowchartDirections[dir] {
+		return "", fmt.Errorf("unknown direction %q; use TB, TD, BT, RL or LR", dir)
+	}
+
+	subgraphs := map[string]GraphSubgraph{}
+	children := map[string][]string{}
+	for _, sg := range g.Subgraphs {
+		if err := checkNodeID(sg.ID); err != nil {
+			return "", fmt.Errorf("subgraph: %w", err)
+		}
+		if _, ok := subgraphs[sg.ID]; ok {
+			return "", fmt.Errorf("subgraph %s is given twice", sg.ID)
+		}
+		subgraphs[sg.ID] = sg
+		children[sg.Parent] = append(children[sg.Parent], sg.ID)
+	}
+	members := map[string][]GraphNode{}
+	seen := map[string]bool{}
+	for _, n := range g.Nodes {
+		if err := checkNodeID(n.ID); err != nil {
+			return "", err
+		}
+		if seen[n.ID] || subgraphs[n.ID].ID != "" {
+			return "", fmt.Errorf("%s is given twice", n.ID)
+		}
+		seen[n.ID] = true
+		if _, ok := subgraphs[n.Subgraph]; n.Subgraph != "" && !ok {
+			return "", fmt.Errorf("node %s is in subgraph %s, which isn't in subgraphs", n.ID, n.Subgraph)
+		}
+		members[n.Subgraph] = append(members[n.Subgraph], n)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("flowchart " + dir + "\n")
+	for _, c := range g.ClassDefs {
+		sb.WriteString(formatIndent + "classDef " + c.Name + " " + c.Styles + "\n")
+	}
+	written := map[string]bool{}
+	var write func(parent string, depth int) error
+	write = func(parent string, depth int) error {
+		indent := strings.Repeat(formatIndent, depth)
+		for _, n := range members[parent] {
+			label, shape := n.Label, n.Shape
+			if label == "" {
+				label = n.ID
+			}
+			if shape == "" {
+				shape = "rect"
+			}
+			sb.WriteString(indent + nodeText(n.ID, label, shape, labelText) + "\n")
+		}
+		for _, id := range children[parent] {
+			if written[id] {
+				return fmt.Errorf("subgraph %s is inside itself", id)
+			}
+			written[id] = true
+			sg := subgraphs[id]
+			header := "subgraph " + id
+			if sg.Title != "" && sg.Title != id {
+				header += " [" + labelText(sg.Title) + "]"
+			}
+			sb.WriteString(indent + header + "\n")
+			if sg.Direction != "" {
+				if !flowchartDirections[sg.Direction] {
+					return fmt.Errorf("unknown direction %q for subgraph %s", sg.Direction, id)
+				}
+				sb.WriteString(indent + formatIndent + "direction " + sg.Direction + "\n")
+			}
+			if err := write(id, depth+1); err != nil {
+				return err
+			}
+			sb.WriteString(indent + "end\n")
+		}
+		return nil
+	}
+	if err := write("", 1); err != nil {
+		return "", err
+	}
+	if len(written) < len(subgraphs) {
+		return "", errors.New("every subgraph's parent must be another subgraph in subgraphs")
+	}
+
+	var linkStyles []string
+	for i, e := range g.Edges {
+		for _, id := range []string{e.From, e.To} {
+			if err := checkNodeID(id); err != nil {
+				return "", fmt.Errorf("edge %d: %w", i, err)
+			}
+		}
+		arrow := e.Arrow
+		if arrow == "" {
+			var err error
+			if arrow, err = flowArrow(e.Line, e.Head); err != nil {
+				return "", fmt.Errorf("edge %d: %w", i, err)
+			}
+		} else if flowLinkRe.FindString(arrow) != arrow {
+			return "", fmt.Errorf("edge %d: %q isn't a link such as -->, --- or -.->", i, arrow)
+		}
+		if e.Label != "" && strings.HasPrefix(arrow, "~") {
+			return "", fmt.Errorf("edge %d: an invisible link ~~~ can't have text", i)
+		}
+		sb.WriteString(formatIndent + e.From + " " + labeledLink(arrow, e.Label) + " " + e.To + "\n")
+		if e.Style != "" {
+			linkStyles = append(linkStyles, fmt.Sprintf("linkStyle %d %s", i, e.Style))
+		}
+	}
+
+	var classes []string
+	classNodes := map[string][]string{}
+	for _, n := range g.Nodes {
+		for _, c := range n.Classes {
+			if classNodes[c] == nil {
+				classes = append(classes, c)
+			}
+			classNodes[c] = append(classNodes[c], n.ID)
+		}
+	}
+	for _, c := range classes {
+		sb.WriteString(formatIndent + "class " + strings.Join(classNodes[c], ",") + " " + c + "\n")
+	}
+	for _, n := range g.Nodes {
+		if n.Style != "" {
+			sb.WriteString(formatIndent + "style " + n.ID + " " + n.Style + "\n")
+		}
+	}
+	for _, l := range linkStyles {
+		sb.WriteString(formatIndent + l + "\n")
+	}
+	return sb.String(), nil
+}
+
+// sequenceFromGraph writes a sequence diagram: the participants, in boxes
+// where they have one, then the messages with the notes among them.
+func sequenceFromGraph(g Graph) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("sequenceDiagram\n")
+	box := ""
+	for _, p := range g.Participants {
+		if err := checkParticipantID(p.ID); err != nil {
+			return "", err
+		}
+		kind := p.Kind
+		if kind == "" {
+			kind = "participant"
+		}
+		if kind != "participant" && kind != "actor" {
+			return "", fmt.Errorf("participant %s: kind must be participant or actor, not %q", p.ID, kind)
+		}
+		if p.Box != box {
+			if box != "" {
+				sb.WriteString(formatIndent + "end\n")
+			}
+			if p.Box != "" {
+				sb.WriteString(formatIndent + "box " + seqTextEscapes.Replace(p.Box) + "\n")
+			}
+			box = p.Box
+		}
+		indent := formatIndent
+		if box != "" {
+			indent += formatIndent
+		}
+		line := kind + " " + p.ID
+		if p.Label != "" && p.Label != p.ID {
+			line += " as " + seqTextEscapes.Replace(p.Label)
+		}
+		sb.WriteString(indent + line + "\n")
+	}
+	if box != "" {
+		sb.WriteString(formatIndent + "end\n")
+	}
+
+	notes := append([]GraphNote(nil), g.Notes...)
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].After < notes[j].After })
+	for _, n := range notes {
+		if n.After < 0 || n.After > len(g.Messages) {
+			return "", fmt.Errorf("a note comes after message %d, but there are %d", n.After, len(g.Messages))
+		}
+		position := strings.ToLower(n.Position)
+		if position != "left of" && position != "right of" && position != "over" {
+			return "", fmt.Errorf("note position must be left of, right of or over, not %q", n.Position)
+		}
+		if len(n.Participants) == 0 || len(n.Participants) > 2 || len(n.Participants) == 2 && position != "over" {
+			return "", errors.New("a note goes over one or two participants, or left or right of one")
+		}
+	}
+	// open is the blocks the last message was in, as its Block names them,
+	// and kinds the keyword each of them was opened with.
+	var open, kinds []string
+	indent := func() string { return strings.Repeat(formatIndent, len(open)+1) }
+	writeNotes := func(after int) {
+		for len(notes) > 0 && notes[0].After == after {
+			n := notes[0]
+			fmt.Fprintf(&sb, "%sNote %s %s: %s\n", indent(), strings.ToLower(n.Position), strings.Join(n.Participants, ","), seqTextEscapes.Replace(n.Text))
+			notes = notes[1:]
+		}
+	}
+	writeNotes(0)
+	for i, m := range g.Messages {
+		for _, id := range []string{m.From, m.To} {
+			if err := checkParticipantID(id); err != nil {
+				return "", fmt.Errorf("message %d: %w", i+1, err)
+			}
+		}
+		path, err := messageBlocks(m.Block)
+		if err != nil {
+			return "", fmt.Errorf("message %d: %w", i+1, err)
+		}
+		same := 0
+		for same < len(open) && same < len(path) && open[same] == path[same] {
+			same++
+		}
+		// Close the blocks the message isn't in, unless it is in the next
+		// section of one.
+		for len(open) > same {
+			depth := len(open) - 1
+			if depth == same && depth < len(path) {
+				if word, label := firstWord(path[depth]); sequenceBlocks[kinds[depth]] == word {
+					open[depth] = path[depth]
+					sb.WriteString(strings.Repeat(formatIndent, depth+1) + strings.TrimSpace(word+" "+seqTextEscapes.Replace(label)) + "\n")
+					break
+				}
+			}
+			open, kinds = open[:depth], kinds[:depth]
+			sb.WriteString(indent() + "end\n")
+		}
+		for len(open) < len(path) {
+			b := path[len(open)]
+			word, label := firstWord(b)
+			kind := word
+			if block := sectionBlock(word); !isSequenceBlock(word) {
+				// A section of a block with no messages before it.
+				kind = block
+				sb.WriteString(indent() + block + "\n")
+			}
+			sb.WriteString(indent() + strings.TrimSpace(word+" "+seqTextEscapes.Replace(label)) + "\n")
+			open, kinds = append(open, b), append(kinds, kind)
+		}
+		arrow := m.Arrow
+		if arrow == "" {
+			arrow = "->>"
+		}
+		if !seqArrows[arrow] {
+			return "", fmt.Errorf("message %d: %q isn't a message arrow such as ->>, -->>, -x or -)", i+1, arrow)
+		}
+		act := ""
+		if m.Activate {
+			act = "+"
+		} else if m.Deactivate {
+			act = "-"
+		}
+		sb.WriteString(strings.TrimRight(indent()+m.From+arrow+act+m.To+": "+seqTextEscapes.Replace(m.Text), " ") + "\n")
+		writeNotes(i + 1)
+	}
+	for len(open) > 0 {
+		open = open[:len(open)-1]
+		sb.WriteString(indent() + "end\n")
+	}
+	return sb.String(), nil
+}
+
+// messageBlocks splits a message's Block into the blocks it names,
+// outermost first.
+func messageBlocks(block string) ([]string, error) {
+	if block == "" {
+		return nil, nil
+	}
+	path := strings.Split(block, " > ")
+	for _, b := range path {
+		word, _ := firstWord(b)
+		if word == "" || word == "box" || !isSequenceBlock(word) && sectionBlock(word) == "" {
+			return nil, fmt.Errorf("%q isn't a block such as loop, alt or else", b)
+		}
+	}
+	return path, nil
+}
+
+// handleGetGraph returns the current diagram as a graph.
+func (d *DiagramState) handleGetGraph(w http.ResponseWriter, r *http.Request) {
+	content, version := d.Get()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version": version,
+		"graph":   DiagramGraph(ParseDiagram(content)),
+	})
+}
+
+// handleSetGraph replaces the diagram with one written from a flowchart or
+// sequence diagram graph. Like handleSetDiagram, edits made since a base
+// version are merged in, and the edit lease is respected.
+func (d *DiagramState) handleSetGraph(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Graph  Graph  `json:"graph"`
+		Source string `json:"source"`
+		Client string `json:"client"`
+		Base   int64  `json:"base"`
+		Lease  string `json:"lease"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	content, err := GraphMermaid(req.Graph)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Source == "" {
+		req.Source = "api"
+	}
+
+	version, merged, err := d.SetFrom(req.Base, content, req.Source, req.Client, req.Lease)
+	var locked *LeaseError
+	if errors.As(err, &locked) {
+		writeLeaseError(w, locked)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		writeConflict(w, d, err)
+		return
+	}
+	resp := map[string]any{"version": version, "content": content}
+	if merged {
+		resp["merged"] = true
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiagramGraph(t *testing.T) {
+	Convey("DiagramGraph", t, func() {
+		Convey("Describes a flowchart's nodes, edges, subgraphs and styles", func() {
+			d := ParseDiagram("graph LR\n  classDef hot fill:#f00\n  A[Start] ==>|go| B((End))\n  subgraph s [Stage]\n    direction TB\n    C\n  end\n  B -.-x C\n  class A hot\n  style B stroke:#0f0\n  linkStyle 1 stroke:#00f")
+			g := DiagramGraph(d)
+			So(g.Kind, ShouldEqual, kindFlowchart)
+			So(g.ReadOnly, ShouldBeFalse)
+			So(g.Direction, ShouldEqual, "LR")
+			So(g.Nodes, ShouldHaveLength, 3)
+			So(g.Nodes[0], ShouldResemble, GraphNode{ID: "A", Label: "Start", Shape: "rect", Classes: []string{"hot"}})
+			So(g.Nodes[1].Shape, ShouldEqual, "circle")
+			So(g.Nodes[1].Style, ShouldEqual, "stroke:#0f0")
+			So(g.Nodes[2].Subgraph, ShouldEqual, "s")
+			So(g.Edges[0].Line, ShouldEqual, "thick")
+			So(g.Edges[0].Head, ShouldEqual, "arrow")
+			So(g.Edges[0].Label, ShouldEqual, "go")
+			So(g.Edges[1].Line, ShouldEqual, "dotted")
+			So(g.Edges[1].Head, ShouldEqual, "cross")
+			So(g.Edges[1].Style, ShouldEqual, "stroke:#00f")
+			So(g.Subgraphs, ShouldResemble, []GraphSubgraph{{ID: "s", Title: "Stage", Direction: "TB"}})
+			So(g.ClassDefs, ShouldResemble, []GraphClassDef{{Name: "hot", Styles: "fill:#f00"}})
+		})
+
+		Convey("Describes a sequence diagram's participants, messages and notes", func() {
+			d := ParseDiagram("sequenceDiagram\n  actor A as Alice\n  A->>+B: hi\n  loop retry\n    B-->>-A: ok\n  end\n  Note over A,B: done")
+			g := DiagramGraph(d)
+			So(g.Participants, ShouldResemble, []GraphParticipant{{ID: "A", Label: "Alice", Kind: "actor"}, {ID: "B", Label: "B", Kind: "participant"}})
+			So(g.Messages, ShouldHaveLength, 2)
+			So(g.Messages[0].Activate, ShouldBeTrue)
+			So(g.Messages[1].Deactivate, ShouldBeTrue)
+			So(g.Messages[1].Block, ShouldEqual, "loop retry")
+			So(g.Notes, ShouldResemble, []GraphNote{{Position: "over", Participants: []string{"A", "B"}, Text: "done", After: 2}})
+			So(g.ReadOnly, ShouldBeFalse)
+		})
+
+		Convey("Marks graphs it can't write back as read-only", func() {
+			for _, src := range []string{"stateDiagram-v2\n  [*] --> A", "classDiagram\n  A <|-- B", "erDiagram\n  A ||--o{ B : has"} {
+				g := DiagramGraph(ParseDiagram(src))
+				So(g.ReadOnly, ShouldBeTrue)
+				_, err := GraphMermaid(g)
+				So(err.Error(), ShouldContainSubstring, "read-only")
+			}
+		})
+	})
+}
+
+func TestGraphMermaid(t *testing.T) {
+	Convey("GraphMermaid", t, func() {
+		Convey("Writes a flowchart that parses back to the same graph", func() {
+			g := Graph{
+				Kind:      kindFlowchart,
+				Direction: "LR",
+				Nodes: []GraphNode{
+					{ID: "A", Label: "Start here", Classes: []string{"hot"}},
+					{ID: "B", Label: "End", Shape: "circle", Style: "stroke:#0f0"},
+					{ID: "C", Subgraph: "inner"},
+				},
+				Edges: []GraphEdge{
+					{From: "A", To: "B", Label: "go", Line: "thick"},
+					{From: "B", To: "C", Arrow: "-.->", Style: "stroke:#00f"},
+				},
+				Subgraphs: []GraphSubgraph{
+					{ID: "outer", Title: "Outer"},
+					{ID: "inner", Parent: "outer", Direction: "TB"},
+				},
+				ClassDefs: []GraphClassDef{{Name: "hot", Styles: "fill:#f00"}},
+			}
+			src, err := GraphMermaid(g)
+			So(err, ShouldBeNil)
+			So(src, ShouldEqual, "flowchart LR\n"+
+				"    classDef hot fill:#f00\n"+
+				"    A[Start here]\n"+
+				"    B((End))\n"+
+				"    subgraph outer [Outer]\n"+
+				"        subgraph inner\n"+
+				"            direction TB\n"+
+				"            C\n"+
+				"        end\n"+
+				"    end\n"+
+				"    A ==>|go| B\n"+
+				"    B -.-> C\n"+
+				"    class A hot\n"+
+				"    style B stroke:#0f0\n"+
+				"    linkStyle 1 stroke:#00f\n")
+
+			d := ParseDiagram(src)
+			So(d.Errors, ShouldBeEmpty)
+			back := DiagramGraph(d)
+			So(back.Nodes, ShouldHaveLength, 3)
+			So(back.Nodes[0].Classes, ShouldResemble, []string{"hot"})
+			So(back.Nodes[2].Subgraph, ShouldEqual, "inner")
+			So(back.Subgraphs[1].Parent, ShouldEqual, "outer")
+			So(back.Edges[1].Style, ShouldEqual, "stroke:#00f")
+		})
+
+		Convey("Writes a sequence diagram with notes among the messages", func() {
+			g := Graph{
+				Kind: kindSequence,
+				Participants: []GraphParticipant{
+					{ID: "A", Label: "Alice", Kind: "actor", Box: "Client"},
+					{ID: "B"},
+				},
+				Messages: []GraphMessage{
+					{From: "A", To: "B", Text: "hi there", Activate: true},
+					{From: "B", To: "A", Arrow: "-->>", Text: "ok", Deactivate: true},
+				},
+				Notes: []GraphNote{{Position: "right of", Participants: []string{"B"}, Text: "thinks", After: 1}},
+			}
+			src, err := GraphMermaid(g)
+			So(err, ShouldBeNil)
+			So(src, ShouldEqual, "sequenceDiagram\n"+
+				"    box Client\n"+
+				"        actor A as Alice\n"+
+				"    end\n"+
+				"    participant B\n"+
+				"    A->>+B: hi there\n"+
+				"    Note right of B: thinks\n"+
+				"    B-->>-A: ok\n")
+			So(ParseDiagram(src).Errors, ShouldBeEmpty)
+		})
+
+		Convey("Writes the blocks messages are in, so a diagram comes back the same", func() {
+			src := "sequenceDiagram\n" +
+				"    participant A\n" +
+				"    participant B\n" +
+				"    A->>B: start\n" +
+				"    loop retry\n" +
+				"        alt ok\n" +
+				"            B-->>A: done\n" +
+				"        else busy\n" +
+				"            B-->>A: wait\n" +
+				"            opt tired\n" +
+				"                A->>A: rest\n" +
+				"            end\n" +
+				"        else failed\n" +
+				"            B-->>A: error\n" +
+				"        end\n" +
+				"        A->>B: again\n" +
+				"    end\n" +
+				"    A->>B: bye\n"
+			g := DiagramGraph(ParseDiagram(src))
+			So(g.Messages[3].Block, ShouldEqual, "loop retry > else busy > opt tired")
+			out, err := GraphMermaid(g)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, src)
+			So(ParseDiagram(out).Errors, ShouldBeEmpty)
+			So(DiagramGraph(ParseDiagram(out)), ShouldResemble, g)
+		})
+
+		Convey("Opens the block of a section with no messages before it", func() {
+			src, err := GraphMermaid(Graph{Kind: kindSequence, Messages: []GraphMessage{{From: "A", To: "B", Text: "hi", Block: "else no"}}})
+			So(err, ShouldBeNil)
+			So(src, ShouldEqual, "sequenceDiagram\n    alt\n    else no\n        A->>B: hi\n    end\n")
+		})
+
+		Convey("Rejects graphs it can't write", func() {
+			for _, g := range []Graph{
+				{Kind: kindClass},
+				{Kind: kindFlowchart, Direction: "up"},
+				{Kind: kindFlowchart, Nodes: []GraphNode{{ID: "a b"}}},
+				{Kind: kindFlowchart, Nodes: []GraphNode{{ID: "A"}, {ID: "A"}}},
+				{Kind: kindFlowchart, Nodes: []GraphNode{{ID: "A", Subgraph: "s"}}},
+				{Kind: kindFlowchart, Subgraphs: []GraphSubgraph{{ID: "s", Parent: "t"}}},
+				{Kind: kindFlowchart, Edges: []GraphEdge{{From: "A", To: "B", Arrow: "=>"}}},
+				{Kind: kindFlowchart, Edges: []GraphEdge{{From: "A", To: "B", Line: "wavy"}}},
+				{Kind: kindSequence, Messages: []GraphMessage{{From: "A", To: "B", Arrow: "=>"}}},
+				{Kind: kindSequence, Messages: []GraphMessage{{From: "A", To: "B", Block: "box Client"}}},
+				{Kind: kindSequence, Messages: []GraphMessage{{From: "A", To: "B", Block: "loop > when"}}},
+				{Kind: kindSequence, Notes: []GraphNote{{Position: "over", Participants: []string{"A"}, After: 1}}},
+			} {
+				_, err := GraphMermaid(g)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestHandleGraph(t *testing.T) {
+	Convey("/api/diagram/graph", t, func() {
+		ds := NewDiagramState("graph TD\n  A --> B")
+
+		Convey("GET returns the graph with the version", func() {
+			w := httptest.NewRecorder()
+			ds.handleGetGraph(w, httptest.NewRequest("GET", "/api/diagram/graph", nil))
+			var out struct {
+				Version int64 `json:"version"`
+				Graph   Graph `json:"graph"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Version, ShouldEqual, 1)
+			So(out.Graph.Edges, ShouldResemble, []GraphEdge{{From: "A", To: "B", Arrow: "-->", Line: "solid", Head: "arrow"}})
+		})
+
+		Convey("PUT replaces the diagram with one written from the graph", func() {
+			body := `{"base": 1, "graph": {"kind": "flowchart", "nodes": [{"id": "X", "label": "New"}]}}`
+			w := httptest.NewRecorder()
+			ds.handleSetGraph(w, httptest.NewRequest("PUT", "/api/diagram/graph", strings.NewReader(body)))
+			So(w.Code, ShouldEqual, 200)
+			var out struct {
+				Version int64  `json:"version"`
+				Content string `json:"content"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Version, ShouldEqual, 2)
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "flowchart TD\n    X[New]\n")
+			So(out.Content, ShouldEqual, content)
+		})
+
+		Convey("PUT rejects a graph it can't write", func() {
+			body := `{"base": 1, "graph": {"kind": "pie"}}`
+			w := httptest.NewRecorder()
+			ds.handleSetGraph(w, httptest.NewRequest("PUT", "/api/diagram/graph", strings.NewReader(body)))
+			So(w.Code, ShouldEqual, 400)
+			content, _ := ds.Get()
+			So(content, ShouldEqual, "graph TD\n  A --> B")
+		})
+
+		Convey("GET marks a state diagram's graph read-only, and PUT says so", func() {
+			ds := NewDiagramState("stateDiagram-v2\n  [*] --> A")
+			w := httptest.NewRecorder()
+			ds.handleGetGraph(w, httptest.NewRequest("GET", "/api/diagram/graph", nil))
+			var out struct {
+				Version int64 `json:"version"`
+				Graph   Graph `json:"graph"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Graph.ReadOnly, ShouldBeTrue)
+
+			body, _ := json.Marshal(map[string]any{"base": out.Version, "graph": out.Graph})
+			w = httptest.NewRecorder()
+			ds.handleSetGraph(w, httptest.NewRequest("PUT", "/api/diagram/graph", strings.NewReader(string(body))))
+			So(w.Code, ShouldEqual, 400)
+			So(w.Body.String(), ShouldContainSubstring, "read-only")
+		})
+	})
+}
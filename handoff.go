@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/jsonrpc"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// States of a handoffConn.
+const (
+	handoffPending = iota // the workspace isn't known yet
+	handoffLocal          // this process serves the session
+	handoffRelay          // the session is relayed to a running instance
+)
+
+// handoffConn carries a --workspace=roots session while its workspace is
+// worked out. The local server sees the handshake and the replies to its
+// own requests, such as roots/list; anything else the agent sends waits
+// until serveLocal hands it the session, or relay passes the session on to
+// an instance already running for the workspace.
+type handoffConn struct {
+	agent mcp.Connection
+	local chan jsonrpc.Message
+	done  chan struct{}
+
+	mu        sync.Mutex
+	state     int
+	handshake []jsonrpc.Message // initialize and notifications/initialized, to replay
+	held      []jsonrpc.Message
+	remote    mcp.Connection
+	err       error
+}
+
+// handoffTransport connects the local server to a handoffConn over stdio.
+type handoffTransport struct {
+	conn *handoffConn
+}
+
+func (t *handoffTransport) Connect(ctx context.Context) (mcp.Connection, error) {
+	agent, err := (&mcp.StdioTransport{}).Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = newHandoffConn(agent)
+	return t.conn, nil
+}
+
+func newHandoffConn(agent mcp.Connection) *handoffConn {
+	c := &handoffConn{agent: agent, local: make(chan jsonrpc.Message), done: make(chan struct{})}
+	go c.pump()
+	return c
+}
+
+// pump reads what the agent sends and routes it by state.
+func (c *handoffConn) pump() {
+	for {
+		msg, err := c.agent.Read(context.Background())
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		switch c.state {
+		case handoffPending:
+			req, ok := msg.(*jsonrpc.Request)
+			if ok && req.Method != "initialize" && req.Method != "notifications/initialized" {
+				c.held = append(c.held, msg)
+				c.mu.Unlock()
+				continue
+			}
+			if ok {
+				c.handshake = append(c.handshake, msg)
+			}
+		case handoffRelay:
+			err := c.remote.Write(context.Background(), msg)
+			c.mu.Unlock()
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			continue
+		}
+		c.mu.Unlock()
+		if !c.deliver(msg) {
+			return
+		}
+	}
+}
+
+// deliver passes msg to the local server, unless the connection is done.
+func (c *handoffConn) deliver(msg jsonrpc.Message) bool {
+	select {
+	case c.local <- msg:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// fail ends the connection with err, the first time it is called.
+func (c *handoffConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+// serveLocal hands the session to the local server, with what the agent
+// sent while it waited.
+func (c *handoffConn) serveLocal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = handoffLocal
+	for _, msg := range c.held {
+		if !c.deliver(msg) {
+			break
+		}
+	}
+	c.held = nil
+}
+
+// relay passes the session on to remote: it repeats the agent's handshake
+// there, sends what the agent sent while it waited, then relays both ways
+// until either side disconnects. The local server sees the connection end
+// then. If the handshake fails, the session is left pending.
+func (c *handoffConn) relay(ctx context.Context, remote mcp.Connection) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, msg := range c.handshake {
+		if err := remote.Write(ctx, msg); err != nil {
+			return err
+		}
+		req := msg.(*jsonrpc.Request)
+		if !req.IsCall() {
+			continue
+		}
+		// The agent already has the local server's reply.
+		for {
+			reply, err := remote.Read(ctx)
+			if err != nil {
+				return err
+			}
+			if resp, ok := reply.(*jsonrpc.Response); ok && resp.ID == req.ID {
+				if resp.Error != nil {
+					return fmt.Errorf("initialize: %w", resp.Error)
+				}
+				break
+			}
+		}
+	}
+	for _, msg := range c.held {
+		if err := remote.Write(ctx, msg); err != nil {
+			return err
+		}
+	}
+	c.held, c.state, c.remote = nil, handoffRelay, remote
+
+	go func() {
+		for {
+			msg, err := remote.Read(context.Background())
+			if err == nil {
+				err = c.agent.Write(context.Background(), msg)
+			}
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *handoffConn) Read(ctx context.Context) (jsonrpc.Message, error) {
+	select {
+	case msg := <-c.local:
+		return msg, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *handoffConn) Write(ctx context.Context, msg jsonrpc.Message) error {
+	return c.agent.Write(ctx, msg)
+}
+
+func (c *handoffConn) Close() error {
+	c.fail(errors.New("connection closed"))
+	c.mu.Lock()
+	remote := c.remote
+	c.mu.Unlock()
+	if remote != nil {
+		remote.Close()
+	}
+	return c.agent.Close()
+}
+
+func (c *handoffConn) SessionID() string { return "" }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type WhoAmIOutput struct {
+	Server string `json:"server"`
+}
+
+// whoAmIServer is an MCP server with one tool that answers with its name.
+func whoAmIServer(name string, opts *mcp.ServerOptions) *mcp.Server {
+	s := mcp.NewServer(&mcp.Implementation{Name: name}, opts)
+	mcp.AddTool(s, &mcp.Tool{Name: "whoami"}, func(ctx context.Context, req *mcp.CallToolRequest, input struct{}) (*mcp.CallToolResult, WhoAmIOutput, error) {
+		return nil, WhoAmIOutput{Server: name}, nil
+	})
+	return s
+}
+
+func TestHandoff(t *testing.T) {
+	Convey("Given an agent whose session waits for its workspace", t, func() {
+		ctx := context.Background()
+		st, ct := mcp.NewInMemoryTransports()
+		agent, err := st.Connect(ctx)
+		So(err, ShouldBeNil)
+		conn := newHandoffConn(agent)
+
+		decide := make(chan func())
+		opts := &mcp.ServerOptions{
+			InitializedHandler: func(ctx context.Context, req *mcp.InitializedRequest) {
+				go func() {
+					// Ask for roots first, as runMCP does.
+					req.Session.ListRoots(ctx, nil)
+					(<-decide)()
+				}()
+			},
+		}
+		local := whoAmIServer("local", opts)
+		ss, err := local.Connect(ctx, &connTransport{conn}, nil)
+		So(err, ShouldBeNil)
+		defer ss.Close()
+
+		connected := make(chan *mcp.ClientSession)
+		go func() {
+			cs, err := mcp.NewClient(&mcp.Implementation{Name: "agent"}, nil).Connect(ctx, ct, nil)
+			if err != nil {
+				panic(err)
+			}
+			connected <- cs
+		}()
+		cs := <-connected
+		defer cs.Close()
+
+		// The agent calls a tool before the workspace is known.
+		answer := make(chan string, 1)
+		go func() {
+			res, err := cs.CallTool(ctx, &mcp.CallToolParams{Name: "whoami"})
+			if err != nil {
+				answer <- err.Error()
+				return
+			}
+			answer <- res.StructuredContent.(map[string]any)["server"].(string)
+		}()
+
+		Convey("serveLocal lets the local server answer", func() {
+			decide <- conn.serveLocal
+			So(<-answer, ShouldEqual, "local")
+		})
+
+		Convey("relay passes the session on to a running instance", func() {
+			rs, rc := mcp.NewInMemoryTransports()
+			remoteSession, err := whoAmIServer("remote", nil).Connect(ctx, rs, nil)
+			So(err, ShouldBeNil)
+			defer remoteSession.Close()
+			remote, err := rc.Connect(ctx)
+			So(err, ShouldBeNil)
+
+			errc := make(chan error, 1)
+			decide <- func() { errc <- conn.relay(ctx, remote) }
+			So(<-errc, ShouldBeNil)
+			So(<-answer, ShouldEqual, "remote")
+
+			cs.Close()
+			ss.Wait()
+		})
+	})
+}
+
+// connTransport is a Transport for a connection that is already open.
+type connTransport struct {
+	conn mcp.Connection
+}
+
+func (t *connTransport) Connect(context.Context) (mcp.Connection, error) {
+	return t.conn, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// eventLease is the SSE event sent when the edit lease is taken or released.
+const eventLease = "lease"
+
+// Limits on how long an edit lease lasts before it must be renewed.
+const (
+	defaultLeaseTTL = 2 * time.Minute
+	maxLeaseTTL     = 30 * time.Minute
+)
+
+// Lease is held by the user while making a careful manual edit. Until it
+// expires, writes without its key are rejected. Only the tab that took it
+// is given the key; client ids are no secret, as every client sees them.
+type Lease struct {
+	Owner   string    `json:"owner"`
+	Client  string    `json:"client,omitempty"`
+	Expires time.Time `json:"expires"`
+	Key     string    `json:"-"`
+}
+
+// LeaseError is returned for a write blocked by someone else's lease.
+type LeaseError struct {
+	Lease Lease
+}
+
+func (e *LeaseError) Error() string {
+	return fmt.Sprintf("%s is editing the diagram; try again in %s",
+		e.Lease.Owner, time.Until(e.Lease.Expires).Round(time.Second))
+}
+
+// errLeaseHeld is returned when taking or releasing a lease without its key.
+var errLeaseHeld = errors.New("the edit lease is held by another client")
+
+// errLeaseNotBrowser is returned when a client other than an editor tab asks
+// for the lease.
+var errLeaseNotBrowser = errors.New("only an editor tab following /api/events can take the edit lease")
+
+// leaseStatus is the JSON form of the lease for the API and SSE.
+type leaseStatus struct {
+	Held  bool   `json:"held"`
+	Lease *Lease `json:"lease,omitempty"`
+}
+
+// currentLease returns the lease if it hasn't expired. It is called with mu
+// held.
+func (d *DiagramState) currentLease() (Lease, bool) {
+	if d.lease == nil || time.Now().After(d.lease.Expires) {
+		return Lease{}, false
+	}
+	return *d.lease, true
+}
+
+// checkLease returns a *LeaseError if a write with leaseKey is blocked: only
+// the lease holder, which has its key, may write. It is called with mu held.
+func (d *DiagramState) checkLease(leaseKey string) error {
+	lease, ok := d.currentLease()
+	if !ok || leaseKey != "" && leaseKey == lease.Key {
+		return nil
+	}
+	return &LeaseError{Lease: lease}
+}
+
+// Lease returns the edit lease if one is held.
+func (d *DiagramState) Lease() (Lease, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.currentLease()
+}
+
+// AcquireLease takes the edit lease for client for ttl, capped at
+// maxLeaseTTL, or renews it given its key. Only a connected browser tab may
+// hold it: it returns errLeaseNotBrowser for other clients, and errLeaseHeld
+// with the current lease if the lease is held and key isn't its key.
+func (d *DiagramState) AcquireLease(client, owner, key string, ttl time.Duration) (Lease, error) {
+	if d.clients.kind(client) != clientBrowser {
+		return Lease{}, errLeaseNotBrowser
+	}
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	ttl = min(ttl, maxLeaseTTL)
+	if owner == "" {
+		owner = "The user"
+	}
+
+	d.mu.Lock()
+	current, ok := d.currentLease()
+	if ok && (key == "" || key != current.Key) {
+		d.mu.Unlock()
+		current.Key = ""
+		return current, errLeaseHeld
+	}
+	if !ok {
+		key = newToken()
+	}
+	lease := Lease{Owner: owner, Client: client, Expires: time.Now().Add(ttl), Key: key}
+	d.lease = &lease
+	d.mu.Unlock()
+
+	d.Publish(eventLease, leaseStatus{Held: true, Lease: &lease})
+	return lease, nil
+}
+
+// ReleaseLease gives up the edit lease given its key. Releasing a lease
+// that has expired or was never taken is not an error.
+func (d *DiagramState) ReleaseLease(key string) error {
+	d.mu.Lock()
+	current, ok := d.currentLease()
+	if ok && key != current.Key {
+		d.mu.Unlock()
+		return errLeaseHeld
+	}
+	d.lease = nil
+	d.mu.Unlock()
+
+	if ok {
+		d.Publish(eventLease, leaseStatus{})
+	}
+	return nil
+}
+
+// handleGetLease reports whether the edit lease is held, and by whom.
+func (d *DiagramState) handleGetLease(w http.ResponseWriter, r *http.Request) {
+	var status leaseStatus
+	if lease, ok := d.Lease(); ok {
+		status = leaseStatus{Held: true, Lease: &lease}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleAcquireLease takes the edit lease, answering with its key, or renews
+// it given the key. It answers 403 for a client that isn't a connected
+// browser tab, and 409 with the current lease if someone else holds it.
+func (d *DiagramState) handleAcquireLease(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Client     string `json:"client"`
+		Owner      string `json:"owner"`
+		Key        string `json:"key"`
+		TTLSeconds int    `json:"ttl_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Client == "" {
+		http.Error(w, "client is required", http.StatusBadRequest)
+		return
+	}
+
+	lease, err := d.AcquireLease(req.Client, req.Owner, req.Key, time.Duration(req.TTLSeconds)*time.Second)
+	if errors.Is(err, errLeaseNotBrowser) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(leaseStatus{Held: true, Lease: &lease})
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		leaseStatus
+		Key string `json:"key"`
+	}{leaseStatus{Held: true, Lease: &lease}, lease.Key})
+}
+
+// handleReleaseLease gives up the edit lease given its ?key=.
+func (d *DiagramState) handleReleaseLease(w http.ResponseWriter, r *http.Request) {
+	if err := d.ReleaseLease(r.URL.Query().Get("key")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeLeaseError answers 423 for a write blocked by the edit lease.
+func writeLeaseError(w http.ResponseWriter, err *LeaseError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLocked)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": err.Error(),
+		"lease": err.Lease,
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEditLease(t *testing.T) {
+	Convey("Given a DiagramState", t, func() {
+		ds := NewDiagramState("graph TD")
+		ds.Connect("tab-1", clientBrowser, "")
+		ds.Connect("tab-2", clientBrowser, "")
+
+		Convey("Without a lease anyone may write", func() {
+			_, _, err := ds.SetFrom(0, "graph LR", "mcp", "", "")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("While the user holds the lease", func() {
+			lease, err := ds.AcquireLease("tab-1", "Ana", "", time.Minute)
+			So(err, ShouldBeNil)
+			So(lease.Key, ShouldNotBeEmpty)
+
+			Convey("Agent and API writes are rejected", func() {
+				_, _, err := ds.SetFrom(0, "graph LR", "mcp", "", "")
+				var locked *LeaseError
+				So(errors.As(err, &locked), ShouldBeTrue)
+				So(locked.Lease.Owner, ShouldEqual, "Ana")
+				So(err.Error(), ShouldStartWith, "Ana is editing the diagram")
+
+				_, err = ds.Apply(1, []TextChange{{From: 0, To: 0, Insert: "x"}}, "api", "", "")
+				So(errors.As(err, &locked), ShouldBeTrue)
+
+				content, _ := ds.Get()
+				So(content, ShouldEqual, "graph TD")
+			})
+
+			Convey("Its holder can still write with its key", func() {
+				_, err := ds.Apply(1, []TextChange{{From: 6, To: 8, Insert: "LR"}}, "browser", "tab-1", lease.Key)
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Other tabs, and anyone using the holder's client id, are rejected", func() {
+				_, err := ds.Apply(1, []TextChange{{From: 6, To: 8, Insert: "LR"}}, "browser", "tab-2", "")
+				var locked *LeaseError
+				So(errors.As(err, &locked), ShouldBeTrue)
+				_, _, err = ds.SetFrom(0, "graph LR", "browser", "tab-1", "")
+				So(errors.As(err, &locked), ShouldBeTrue)
+				_, _, err = ds.SetFrom(0, "graph LR", "browser", "tab-1", "guess")
+				So(errors.As(err, &locked), ShouldBeTrue)
+			})
+
+			Convey("A script that registers as a browser tab is rejected", func() {
+				ds.Connect("script", clientBrowser, "")
+				_, _, err := ds.SetFrom(0, "graph LR", "browser", "script", "")
+				var locked *LeaseError
+				So(errors.As(err, &locked), ShouldBeTrue)
+
+				held, err := ds.AcquireLease("script", "", "", time.Minute)
+				So(err, ShouldEqual, errLeaseHeld)
+				So(held.Key, ShouldBeEmpty)
+				So(ds.ReleaseLease(""), ShouldEqual, errLeaseHeld)
+			})
+
+			Convey("Another client can't take or release it", func() {
+				_, err := ds.AcquireLease("tab-2", "", "", time.Minute)
+				So(err, ShouldEqual, errLeaseHeld)
+				_, err = ds.AcquireLease("tab-1", "", "", time.Minute)
+				So(err, ShouldEqual, errLeaseHeld)
+				So(ds.ReleaseLease("guess"), ShouldEqual, errLeaseHeld)
+			})
+
+			Convey("Its holder can renew and release it", func() {
+				renewed, err := ds.AcquireLease("tab-1", "Ana", lease.Key, 5*time.Minute)
+				So(err, ShouldBeNil)
+				So(time.Until(renewed.Expires), ShouldBeGreaterThan, 4*time.Minute)
+				So(renewed.Key, ShouldEqual, lease.Key)
+
+				So(ds.ReleaseLease(lease.Key), ShouldBeNil)
+				_, held := ds.Lease()
+				So(held, ShouldBeFalse)
+			})
+		})
+
+		Convey("Only a browser tab can take the lease", func() {
+			ds.Connect("agent", clientMCP, "")
+			for _, client := range []string{"agent", "unknown", ""} {
+				_, err := ds.AcquireLease(client, "", "", time.Minute)
+				So(err, ShouldEqual, errLeaseNotBrowser)
+			}
+			_, held := ds.Lease()
+			So(held, ShouldBeFalse)
+		})
+
+		Convey("A lease stops blocking writes once it expires", func() {
+			ds.AcquireLease("tab-1", "", "", 10*time.Millisecond)
+			time.Sleep(20 * time.Millisecond)
+			_, _, err := ds.SetFrom(0, "graph LR", "mcp", "", "")
+			So(err, ShouldBeNil)
+
+			_, err = ds.AcquireLease("tab-2", "", "", time.Minute)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Leases are capped at the maximum length", func() {
+			lease, _ := ds.AcquireLease("tab-1", "", "", 24*time.Hour)
+			So(time.Until(lease.Expires), ShouldBeLessThanOrEqualTo, maxLeaseTTL)
+		})
+
+		Convey("Taking and releasing the lease is announced", func() {
+			events := ds.Listen()
+			defer ds.Unlisten(events)
+			lease, _ := ds.AcquireLease("tab-1", "", "", time.Minute)
+			So((<-events).Type, ShouldEqual, eventLease)
+			ds.ReleaseLease(lease.Key)
+			So((<-events).Data, ShouldResemble, leaseStatus{})
+		})
+	})
+}
+
+func TestLeaseHTTPHandlers(t *testing.T) {
+	Convey("Given a DiagramState", t, func() {
+		ds := NewDiagramState("graph TD")
+		ds.Connect("tab-1", clientBrowser, "")
+		ds.Connect("tab-2", clientBrowser, "")
+		do := func(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+			return w
+		}
+
+		Convey("PUT /api/lease takes the lease and GET /api/lease reports it", func() {
+			w := do(ds.handleAcquireLease, "PUT", "/api/lease", `{"client": "tab-1", "owner": "Ana", "ttl_seconds": 60}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, `"key":`)
+
+			w = do(ds.handleGetLease, "GET", "/api/lease", "")
+			So(w.Body.String(), ShouldNotContainSubstring, "key")
+			var status leaseStatus
+			So(json.NewDecoder(w.Body).Decode(&status), ShouldBeNil)
+			So(status.Held, ShouldBeTrue)
+			So(status.Lease.Owner, ShouldEqual, "Ana")
+		})
+
+		Convey("PUT /api/lease without a client returns 400", func() {
+			w := do(ds.handleAcquireLease, "PUT", "/api/lease", `{}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("PUT /api/lease from a client that isn't a browser tab returns 403", func() {
+			w := do(ds.handleAcquireLease, "PUT", "/api/lease", `{"client": "script"}`)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("While the lease is held", func() {
+			var taken struct {
+				Key string `json:"key"`
+			}
+			w := do(ds.handleAcquireLease, "PUT", "/api/lease", `{"client": "tab-1"}`)
+			So(json.NewDecoder(w.Body).Decode(&taken), ShouldBeNil)
+
+			Convey("Another client taking it gets 409", func() {
+				w := do(ds.handleAcquireLease, "PUT", "/api/lease", `{"client": "tab-2"}`)
+				So(w.Code, ShouldEqual, http.StatusConflict)
+			})
+
+			Convey("PUT /api/diagram from a script returns 423", func() {
+				w := do(ds.handleSetDiagram, "PUT", "/api/diagram", `{"content": "graph LR", "source": "cli"}`)
+				So(w.Code, ShouldEqual, http.StatusLocked)
+				So(w.Body.String(), ShouldContainSubstring, "is editing the diagram")
+			})
+
+			Convey("PUT /api/diagram claiming source browser still returns 423", func() {
+				w := do(ds.handleSetDiagram, "PUT", "/api/diagram", `{"content": "graph LR", "source": "browser", "client": "script"}`)
+				So(w.Code, ShouldEqual, http.StatusLocked)
+			})
+
+			Convey("PUT /api/diagram with its key is let through", func() {
+				w := do(ds.handleSetDiagram, "PUT", "/api/diagram", `{"content": "graph LR", "source": "browser", "client": "tab-1", "lease": "`+taken.Key+`"}`)
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+
+			Convey("DELETE /api/lease without its key returns 409", func() {
+				w := do(ds.handleReleaseLease, "DELETE", "/api/lease?client=tab-1", "")
+				So(w.Code, ShouldEqual, http.StatusConflict)
+			})
+
+			Convey("DELETE /api/lease with its key releases it", func() {
+				w := do(ds.handleReleaseLease, "DELETE", "/api/lease?key="+taken.Key, "")
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				w = do(ds.handleSetDiagram, "PUT", "/api/diagram", `{"content": "graph LR", "source": "cli"}`)
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Severities of LintIssue, and off for a rule turned off.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+	severityOff     = "off"
+)
+
+// lintConfigFile is the name of the project lint config file, looked for in
+// the project directory and its parents.
+const lintConfigFile = ".mermaid-lint.json"
+
+// defaultMaxLabel is the longest label, in characters per line, that
+// long-label accepts unless configured otherwise.
+const defaultMaxLabel = 50
+
+// LintIssue is a problem the linter found.
+type LintIssue struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Span     Span   `json:"span"`
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s (%s)", i.Span.Start.Line, i.Span.Start.Col, i.Severity, i.Message, i.Rule)
+}
+
+// lintRule is a check the linter runs, by default at severity.
+type lintRule struct {
+	id       string
+	severity string
+	check    func(l *linter)
+	summary  string
+}
+
+// lintRules are the rules, in the order their issues are reported on the
+// same line.
+var lintRules = []lintRule{
+	{"syntax", severityError, lintSyntax, "Syntax error"},
+	{"reserved-id", severityError, lintReservedID, "end used as a node id or participant name"},
+	{"unquoted-parens", severityError, lintUnquotedParens, "Flowchart label with parentheses that isn't in quotes"},
+	{"duplicate-id", severityWarning, lintDuplicateID, "One node id given different labels"},
+	{"unconnected-node", severityWarning, lintUnconnected, "Node without edges in a diagram that has some"},
+	{"unreachable-state", severityWarning, lintUnreachable, "State that can't be reached from the start state"},
+	{"unused-classdef", severityWarning, lintUnusedClassDef, "classDef style no node uses"},
+	{"long-label", severityInfo, lintLongLabel, "Label with a line longer than the maximum"},
+}
+
+// RuleConfig configures a rule: its severity, or off, and for long-label the
+// longest label allowed. In the config file a rule may be given as just its
+// severity.
+type RuleConfig struct {
+	Severity string `json:"severity,omitempty"`
+	Max      int    `json:"max,omitempty"`
+}
+
+func (r *RuleConfig) UnmarshalJSON(b []byte) error {
+	var severity string
+	if json.Unmarshal(b, &severity) == nil {
+		*r = RuleConfig{Severity: severity}
+		return nil
+	}
+	type plain RuleConfig
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// LintConfig configures the linter by rule id.
+type LintConfig struct {
+	Rules map[string]RuleConfig `json:"rules"`
+}
+
+// validate checks that the config names known rules and severities.
+func (c LintConfig) validate() error {
+	for id, r := range c.Rules {
+		if findLintRule(id) == nil {
+			return fmt.Errorf("unknown lint rule %q", id)
+		}
+		switch r.Severity {
+		case "", severityError, severityWarning, severityInfo, severityOff:
+		default:
+			return fmt.Errorf("rule %s: severity must be error, warning, info or off, not %q", id, r.Severity)
+		}
+	}
+	return nil
+}
+
+func findLintRule(id string) *lintRule {
+	for i := range lintRules {
+		if lintRules[i].id == id {
+			return &lintRules[i]
+		}
+	}
+	return nil
+}
+
+// findLintConfig returns the path of the lint config file for dir: the
+// nearest one in dir or its parents, or "" if there is none.
+func findLintConfig(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, lintConfigFile)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadLintConfig reads the lint config for dir, if it has one.
+func loadLintConfig(dir string) (LintConfig, error) {
+	var c LintConfig
+	path := findLintConfig(dir)
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// projectLintConfig reads the lint config of the workspace, or of the
+// directory the editor runs in for the global instance. A broken config is
+// logged and ignored.
+func projectLintConfig() LintConfig {
+	dir := workspaceRoot()
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	c, err := loadLintConfig(dir)
+	if err != nil {
+		log.Printf("Ignoring lint config: %v", err)
+	}
+	return c
+}
+
+// linter runs the rules over a diagram.
+type linter struct {
+	d      *Diagram
+	config LintConfig
+	rule   *lintRule
+	issues []LintIssue
+}
+
+// LintDiagram parses src and checks it against the rules, returning the
+// issues in the order they appear.
+func LintDiagram(src string, c LintConfig) []LintIssue {
+	l := &linter{d: ParseDiagram(src), config: c, issues: []LintIssue{}}
+	for i := range lintRules {
+		l.rule = &lintRules[i]
+		if l.severity() != severityOff {
+			l.rule.check(l)
+		}
+	}
+	sort.SliceStable(l.issues, func(i, j int) bool {
+		return l.issues[i].Span.Start.Offset < l.issues[j].Span.Start.Offset
+	})
+	return l.issues
+}
+
+// severity returns the configured severity of the current rule.
+func (l *linter) severity() string {
+	if r := l.config.Rules[l.rule.id]; r.Severity != "" {
+		return r.Severity
+	}
+	return l.rule.severity
+}
+
+func (l *linter) report(at Span, format string, args ...any) {
+	l.issues = append(l.issues, LintIssue{
+		Rule:     l.rule.id,
+		Severity: l.severity(),
+		Message:  fmt.Sprintf(format, args...),
+		Span:     at,
+	})
+}
+
+// graph reports whether the diagram has nodes and edges.
+func (l *linter) graph() bool {
+	_, ok := graphElements[l.d.Kind]
+	return ok
+}
+
+func lintSyntax(l *linter) {
+	for _, e := range l.d.Errors {
+		l.report(e.Span, "%s", e.Message)
+	}
+}
+
+// lintReservedID reports end used as an id, which closes the enclosing
+// block instead.
+func lintReservedID(l *linter) {
+	switch l.d.Kind {
+	case kindFlowchart:
+		if n := l.d.Node("end"); n != nil {
+			l.report(n.Refs[0].ID, "end can't be a node id; use End, or another id with end as its label")
+		}
+	case kindSequence:
+		if p := l.d.Participant("end"); p != nil {
+			l.report(p.Refs[0], "end can't be a participant name; use End, or an alias: participant E as end")
+		}
+	}
+}
+
+// lintUnquotedParens reports flowchart labels with parentheses that aren't
+// quoted, which Mermaid takes for shape brackets.
+func lintUnquotedParens(l *linter) {
+	if l.d.Kind != kindFlowchart {
+		return
+	}
+	for _, n := range l.d.Nodes {
+		for _, r := range n.Refs {
+			if r.Label != "" && !r.Quoted && strings.ContainsAny(r.Label, "()") {
+				l.report(r.LabelSpan, "label of %s has parentheses; put it in quotes: \"%s\"", n.ID, r.Label)
+			}
+		}
+	}
+}
+
+// lintDuplicateID reports nodes given different labels in different places,
+// which usually means two nodes were meant.
+func lintDuplicateID(l *linter) {
+	if !l.graph() || l.d.Kind == kindState {
+		return
+	}
+	for _, n := range l.d.Nodes {
+		first := ""
+		for _, r := range n.Refs {
+			switch {
+			case r.Label == "":
+			case first == "":
+				first = r.Label
+			case r.Label != first:
+				l.report(r.Span, "%s is labeled %q here but %q before; use a new id for a different node", n.ID, r.Label, first)
+			}
+		}
+	}
+}
+
+// lintUnconnected reports nodes without edges in a diagram that has some.
+func lintUnconnected(l *linter) {
+	if !l.graph() || len(l.d.Edges) == 0 {
+		return
+	}
+	connected := make(map[string]bool)
+	for _, e := range l.d.Edges {
+		connected[e.From] = true
+		connected[e.To] = true
+	}
+	for _, n := range l.d.Nodes {
+		if !connected[n.ID] && n.Shape != "terminal" && l.d.Subgraph(n.ID) == nil {
+			l.report(n.Span, "%s isn't connected to anything", n.ID)
+		}
+	}
+}
+
+// lintUnreachable reports states that can't be reached from the start
+// state.
+func lintUnreachable(l *linter) {
+	if l.d.Kind != kindState || l.d.Node("[*]") == nil {
+		return
+	}
+	next := make(map[string][]string)
+	for _, e := range l.d.Edges {
+		next[e.From] = append(next[e.From], e.To)
+	}
+	reached := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		if reached[id] {
+			return
+		}
+		reached[id] = true
+		for _, to := range next[id] {
+			visit(to)
+		}
+		// Entering a composite state enters its start state, or any of its
+		// states if it has none.
+		if sg := l.d.Subgraph(id); sg != nil {
+			if l.d.Node(id+"/[*]") != nil {
+				visit(id + "/[*]")
+			} else {
+				for _, child := range sg.Nodes {
+					visit(child)
+				}
+			}
+		}
+	}
+	visit("[*]")
+	for _, n := range l.d.Nodes {
+		if !reached[n.ID] && n.Shape != "terminal" && len(next[n.ID])+incoming(l.d, n.ID) > 0 {
+			l.report(n.Span, "%s can't be reached from the start state", n.ID)
+		}
+	}
+}
+
+// incoming counts the edges into id.
+func incoming(d *Diagram, id string) int {
+	count := 0
+	for _, e := range d.Edges {
+		if e.To == id {
+			count++
+		}
+	}
+	return count
+}
+
+// lintUnusedClassDef reports classDef styles no node uses.
+func lintUnusedClassDef(l *linter) {
+	used := make(map[string]bool)
+	for _, n := range l.d.Nodes {
+		for _, c := range n.Classes {
+			used[c] = true
+		}
+	}
+	for _, c := range l.d.ClassDefs {
+		if !used[c.Name] && c.Name != "default" {
+			l.report(c.Span, "classDef %s isn't used by any node", c.Name)
+		}
+	}
+}
+
+// lintLongLabel reports labels with lines longer than the configured max.
+func lintLongLabel(l *linter) {
+	limit := l.config.Rules[l.rule.id].Max
+	if limit <= 0 {
+		limit = defaultMaxLabel
+	}
+	check := func(at Span, what, label string) {
+		for _, line := range labelLines(label) {
+			if n := utf8.RuneCountInString(line); n > limit {
+				l.report(at, "%s is %d characters long; break it with <br> or shorten it to %d", what, n, limit)
+				return
+			}
+		}
+	}
+	for _, n := range l.d.Nodes {
+		for _, r := range n.Refs {
+			if r.Label != "" && r.Label != n.ID {
+				check(r.LabelSpan, "label of "+n.ID, r.Label)
+			}
+		}
+	}
+	for _, e := range l.d.Edges {
+		if e.Label != "" {
+			check(e.Span, "label of "+edgeID(e), e.Label)
+		}
+	}
+	for _, m := range l.d.Messages {
+		check(m.Span, fmt.Sprintf("message %d", m.Index), m.Text)
+	}
+}
+
+// labelLines splits a label at its line breaks.
+func labelLines(label string) []string {
+	for _, br := range []string{"<br/>", "<br />", "<BR>", "\\n"} {
+		label = strings.ReplaceAll(label, br, "\n")
+	}
+	return strings.Split(strings.ReplaceAll(label, "<br>", "\n"), "\n")
+}
+
+// lintCounts counts the issues of each severity.
+func lintCounts(issues []LintIssue) (errors, warnings int) {
+	for _, i := range issues {
+		switch i.Severity {
+		case severityError:
+			errors++
+		case severityWarning:
+			warnings++
+		}
+	}
+	return errors, warnings
+}
+
+// runLint implements `mermaid-editor lint [-json] [path ...]`. It prints the
+// issues in each diagram file, or in standard input when given no paths,
+// using the lint config of each file's project, and exits with 1 if any
+// issue is an error.
+func runLint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the issues as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mermaid-editor lint [-json] [path ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	type fileIssues struct {
+		File   string      `json:"file"`
+		Issues []LintIssue `json:"issues"`
+	}
+	var results []fileIssues
+	failed, errored := false, false
+	lint := func(name, dir string, src []byte) {
+		c, err := loadLintConfig(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			return
+		}
+		issues := LintDiagram(string(src), c)
+		if n, _ := lintCounts(issues); n > 0 {
+			errored = true
+		}
+		results = append(results, fileIssues{File: name, Issues: issues})
+	}
+
+	if fs.NArg() == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		lint("<standard input>", ".", src)
+	}
+	for _, path := range fs.Args() {
+		files, err := diagramFiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+		for _, file := range files {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+				continue
+			}
+			lint(file, filepath.Dir(file), src)
+		}
+	}
+
+	if *asJSON {
+		writeJSON(os.Stdout, results)
+	} else {
+		for _, r := range results {
+			for _, i := range r.Issues {
+				fmt.Printf("%s:%s\n", r.File, i)
+			}
+		}
+	}
+	switch {
+	case failed:
+		os.Exit(2)
+	case errored:
+		os.Exit(1)
+	}
+}
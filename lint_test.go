@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// rules returns the rule of each issue.
+func rules(issues []LintIssue) []string {
+	out := []string{}
+	for _, i := range issues {
+		out = append(out, i.Rule)
+	}
+	return out
+}
+
+func TestLintDiagram(t *testing.T) {
+	Convey("LintDiagram", t, func() {
+		lint := func(src string) []LintIssue { return LintDiagram(src, LintConfig{}) }
+
+		Convey("Finds nothing wrong with a tidy diagram", func() {
+			So(lint("graph TD\n  A[Start] --> B\n  classDef hot fill:#f00\n  class B hot"), ShouldBeEmpty)
+		})
+
+		Convey("Reports syntax errors", func() {
+			issues := lint("sequenceDiagram\n  A->>B")
+			So(rules(issues), ShouldResemble, []string{"syntax"})
+			So(issues[0].Severity, ShouldEqual, severityError)
+			So(issues[0].Span.Start.Line, ShouldEqual, 2)
+		})
+
+		Convey("Reports end as an id", func() {
+			issues := lint("graph TD\n  A --> end")
+			So(rules(issues), ShouldResemble, []string{"reserved-id"})
+			So(issues[0].Span.Start.Col, ShouldEqual, 9)
+			So(rules(lint("sequenceDiagram\n  A->>end: hi")), ShouldResemble, []string{"reserved-id"})
+		})
+
+		Convey("Reports unquoted labels with parentheses", func() {
+			issues := lint("graph TD\n  A[Start (here)] --> B[\"Quoted (fine)\"]")
+			So(rules(issues), ShouldResemble, []string{"unquoted-parens"})
+			So(issues[0].Span.Start.Col, ShouldEqual, 5)
+			So(issues[0].Message, ShouldContainSubstring, `"Start (here)"`)
+		})
+
+		Convey("Reports one id given different labels", func() {
+			issues := lint("graph TD\n  A[Start] --> B\n  A[Begin] --> C\n  A[Start] --> D")
+			So(rules(issues), ShouldResemble, []string{"duplicate-id"})
+			So(issues[0].Span.Start.Line, ShouldEqual, 3)
+		})
+
+		Convey("Reports nodes that aren't connected", func() {
+			issues := lint("graph TD\n  A --> B\n  C\n  subgraph s\n    A\n  end")
+			So(rules(issues), ShouldResemble, []string{"unconnected-node"})
+			So(issues[0].Message, ShouldStartWith, "C ")
+			So(lint("classDiagram\n  class A\n  class B"), ShouldBeEmpty)
+		})
+
+		Convey("Reports states that can't be reached", func() {
+			issues := lint("stateDiagram-v2\n  [*] --> A\n  A --> B\n  state B {\n    [*] --> C\n    D --> C\n  }\n  E --> A")
+			So(rules(issues), ShouldResemble, []string{"unreachable-state", "unreachable-state"})
+			So(issues[0].Message, ShouldStartWith, "D ")
+			So(issues[1].Message, ShouldStartWith, "E ")
+		})
+
+		Convey("Reports unused classDefs", func() {
+			issues := lint("graph TD\n  A:::hot --> B\n  classDef hot fill:#f00\n  classDef cold fill:#00f\n  classDef default stroke:#000")
+			So(rules(issues), ShouldResemble, []string{"unused-classdef"})
+			So(issues[0].Span.Start.Line, ShouldEqual, 4)
+		})
+
+		Convey("Reports long labels by their longest line", func() {
+			long := "a label that runs on far longer than anyone could read"
+			So(rules(lint("graph TD\n  A[\""+long+"\"] --> B")), ShouldResemble, []string{"long-label"})
+			So(lint("graph TD\n  A[\"a label that runs on<br>far longer than<br>anyone could read\"] --> B"), ShouldBeEmpty)
+			So(rules(lint("sequenceDiagram\n  A->>B: "+long)), ShouldResemble, []string{"long-label"})
+		})
+
+		Convey("Follows the config", func() {
+			src := "graph TD\n  A --> B\n  C\n  D[\"a label of forty characters, give or take\"] --> A"
+			c := LintConfig{Rules: map[string]RuleConfig{
+				"unconnected-node": {Severity: severityOff},
+				"long-label":       {Severity: severityError, Max: 20},
+			}}
+			issues := LintDiagram(src, c)
+			So(rules(issues), ShouldResemble, []string{"long-label"})
+			So(issues[0].Severity, ShouldEqual, severityError)
+		})
+	})
+}
+
+func TestLintConfig(t *testing.T) {
+	Convey("Given a project with a lint config", t, func() {
+		root := t.TempDir()
+		sub := filepath.Join(root, "docs", "diagrams")
+		os.MkdirAll(sub, 0755)
+		write := func(config string) {
+			os.WriteFile(filepath.Join(root, lintConfigFile), []byte(config), 0644)
+		}
+
+		Convey("It is found from a directory below", func() {
+			write(`{"rules": {"long-label": {"severity": "warning", "max": 30}, "unused-classdef": "off"}}`)
+			c, err := loadLintConfig(sub)
+			So(err, ShouldBeNil)
+			So(c.Rules["long-label"], ShouldResemble, RuleConfig{Severity: severityWarning, Max: 30})
+			So(c.Rules["unused-classdef"].Severity, ShouldEqual, severityOff)
+		})
+
+		Convey("Unknown rules and severities are rejected", func() {
+			write(`{"rules": {"no-such-rule": "error"}}`)
+			_, err := loadLintConfig(sub)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "no-such-rule")
+
+			write(`{"rules": {"long-label": "fatal"}}`)
+			_, err = loadLintConfig(sub)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Issues serialize with their span", func() {
+			issues := LintDiagram("graph TD\n  A --> end", LintConfig{})
+			data, err := json.Marshal(issues[0])
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"rule":"reserved-id","severity":"error"`)
+			So(issues[0].String(), ShouldEqual, "2:9: error: end can't be a node id; use End, or another id with end as its label (reserved-id)")
+		})
+	})
+}
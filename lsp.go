@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSON-RPC error codes used by the language server.
+const (
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcRequestFailed  = -32803
+)
+
+// LSP symbol, completion item and diagnostic kinds used here.
+const (
+	symbolModule    = 2
+	symbolNamespace = 3
+	symbolClass     = 5
+	symbolString    = 15
+	symbolObject    = 19
+	symbolEvent     = 24
+
+	completionVariable = 6
+	completionKeyword  = 14
+
+	diagnosticError   = 1
+	diagnosticWarning = 2
+	diagnosticInfo    = 3
+)
+
+// completionKeywords are the statement keywords offered for each kind of
+// diagram.
+var completionKeywords = map[string][]string{
+	kindFlowchart: {"subgraph", "end", "direction", "classDef", "class", "style", "linkStyle", "click"},
+	kindSequence: {"participant", "actor", "autonumber", "activate", "deactivate", "Note", "loop", "alt", "else",
+		"opt", "par", "and", "critical", "option", "break", "rect", "box", "end"},
+	kindClass: {"class", "namespace", "classDef", "cssClass", "note", "direction"},
+	kindState: {"state", "note", "end note", "direction", "classDef", "class"},
+	kindER:    {},
+}
+
+// rpcError is a JSON-RPC error.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// rpcRequest is a JSON-RPC request, or a notification if it has no id.
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"` // in UTF-16 code units
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspSymbol struct {
+	Name           string      `json:"name"`
+	Detail         string      `json:"detail,omitempty"`
+	Kind           int         `json:"kind"`
+	Range          lspRange    `json:"range"`
+	SelectionRange lspRange    `json:"selectionRange"`
+	Children       []lspSymbol `json:"children,omitempty"`
+}
+
+// textDocumentPosition is the params of the requests made at a position.
+type textDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// lspDocument is a document open in the client.
+type lspDocument struct {
+	URI      string
+	Text     string
+	Markdown bool
+}
+
+// docDiagram is a diagram in a document: all of a diagram file, or a
+// mermaid block of a markdown file.
+type docDiagram struct {
+	d      *Diagram
+	src    string
+	offset int // of src in the document
+}
+
+// diagrams parses the diagrams in the document.
+func (doc *lspDocument) diagrams() []docDiagram {
+	if !doc.Markdown {
+		return []docDiagram{{ParseDiagram(doc.Text), doc.Text, 0}}
+	}
+	var out []docDiagram
+	for _, e := range markdownDiagrams(doc.Text) {
+		out = append(out, docDiagram{ParseDiagram(e.Text), e.Text, e.Offset})
+	}
+	return out
+}
+
+// diagramAt returns the diagram the byte offset is in.
+func (doc *lspDocument) diagramAt(offset int) (docDiagram, bool) {
+	for _, dd := range doc.diagrams() {
+		if offset >= dd.offset && offset <= dd.offset+len(dd.src) {
+			return dd, true
+		}
+	}
+	return docDiagram{}, false
+}
+
+// lspPos converts a byte offset in text to an LSP position.
+func lspPos(text string, offset int) lspPosition {
+	offset = min(offset, len(text))
+	start := strings.LastIndexByte(text[:offset], '\n') + 1
+	return lspPosition{Line: strings.Count(text[:offset], "\n"), Character: utf16Len(text[start:offset])}
+}
+
+// lspOffset converts an LSP position to a byte offset in text, clamping it
+// to the line.
+func lspOffset(text string, p lspPosition) int {
+	offset := 0
+	for range p.Line {
+		i := strings.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		offset += i + 1
+	}
+	for units := 0; offset < len(text) && text[offset] != '\n' && units < p.Character; {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		units += utf16Len(string(r))
+		offset += size
+	}
+	return offset
+}
+
+// rangeOf returns the LSP range of span in a diagram of the document.
+func (doc *lspDocument) rangeOf(dd docDiagram, span Span) lspRange {
+	return lspRange{
+		Start: lspPos(doc.Text, dd.offset+span.Start.Offset),
+		End:   lspPos(doc.Text, dd.offset+span.End.Offset),
+	}
+}
+
+// idAt returns the node id or participant name around the byte offset in
+// src, and its span, or "" if there is none.
+func idAt(src string, offset int) (string, int, int) {
+	isID := func(i int) bool {
+		r, _ := utf8.DecodeRuneInString(src[i:])
+		return isIDRune(r)
+	}
+	// Hyphens and dots join the words of an id, as scanID has it.
+	joins := func(i int) bool {
+		return (src[i] == '-' || src[i] == '.') && i > 0 && i+1 < len(src) && isID(i+1) && isIDRuneBefore(src, i)
+	}
+	from, to := offset, offset
+	for from > 0 {
+		r, size := utf8.DecodeLastRuneInString(src[:from])
+		if isIDRune(r) || joins(from-size) {
+			from -= size
+			continue
+		}
+		break
+	}
+	for to < len(src) && (isID(to) || joins(to)) {
+		_, size := utf8.DecodeRuneInString(src[to:])
+		to += size
+	}
+	return src[from:to], from, to
+}
+
+func isIDRuneBefore(s string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return isIDRune(r)
+}
+
+// lspServer is a Language Server speaking JSON-RPC over a pair of streams.
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*lspDocument
+	shutdown bool
+	preview  chan string // the latest diagram to mirror into the editor, if on
+}
+
+// runLSP implements `mermaid-editor lsp [-preview]`, a Language Server on
+// standard input and output for diagram files and the mermaid blocks of
+// markdown files. With -preview it mirrors the diagram being edited into
+// the running editor.
+func runLSP(args []string) {
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+	preview := fs.Bool("preview", false, "mirror the diagram being edited into the running editor")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mermaid-editor lsp [-preview]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	s := newLSPServer(os.Stdin, os.Stdout)
+	if *preview {
+		setupWorkspace()
+		s.preview = make(chan string, 1)
+		go mirrorPreview(s.preview)
+	}
+	if err := s.serve(); err != nil {
+		log.Fatal(err)
+	}
+	if !s.shutdown {
+		os.Exit(1)
+	}
+}
+
+func newLSPServer(in io.Reader, out io.Writer) *lspServer {
+	return &lspServer{in: bufio.NewReader(in), out: out, docs: map[string]*lspDocument{}}
+}
+
+// serve handles messages until the client sends exit or closes the stream.
+func (s *lspServer) serve() error {
+	for {
+		body, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			log.Printf("Ignoring malformed message: %v", err)
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req.Method, req.Params)
+		if req.ID == nil {
+			if err != nil {
+				log.Printf("Failed to handle %s: %v", req.Method, err)
+			}
+			continue
+		}
+		s.respond(req.ID, result, err)
+	}
+}
+
+// read reads the body of the next message.
+func (s *lspServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("bad Content-Length: %v", err)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without a Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	return body, err
+}
+
+// write sends a message.
+func (s *lspServer) write(msg map[string]any) {
+	msg["jsonrpc"] = "2.0"
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) respond(id json.RawMessage, result any, err error) {
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: rpcRequestFailed, Message: err.Error()}
+		}
+		s.write(map[string]any{"id": id, "error": rpcErr})
+		return
+	}
+	s.write(map[string]any{"id": id, "result": result})
+}
+
+func (s *lspServer) notify(method string, params any) {
+	s.write(map[string]any{"method": method, "params": params})
+}
+
+// handle runs a request or notification, returning the result for a
+// request.
+func (s *lspServer) handle(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":           1, // the whole document on every change
+				"completionProvider":         map[string]any{},
+				"hoverProvider":              true,
+				"definitionProvider":         true,
+				"renameProvider":             true,
+				"documentFormattingProvider": true,
+				"documentSymbolProvider":     true,
+			},
+			"serverInfo": map[string]any{"name": "mermaid-editor", "version": version},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI        string `json:"uri"`
+				LanguageID string `json:"languageId"`
+				Text       string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		doc := &lspDocument{
+			URI:      p.TextDocument.URI,
+			Text:     p.TextDocument.Text,
+			Markdown: p.TextDocument.LanguageID == "markdown" || markdownExtensions[filepath.Ext(p.TextDocument.URI)],
+		}
+		s.docs[doc.URI] = doc
+		s.changed(doc, "")
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		doc := s.docs[p.TextDocument.URI]
+		if doc == nil || len(p.ContentChanges) == 0 {
+			return nil, nil
+		}
+		old := doc.Text
+		doc.Text = p.ContentChanges[len(p.ContentChanges)-1].Text
+		s.changed(doc, old)
+	case "textDocument/didClose":
+		var p textDocumentPosition
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]any{"uri": p.TextDocument.URI, "diagnostics": []lspDiagnostic{}})
+	case "textDocument/completion":
+		return s.positional(params, s.completion)
+	case "textDocument/hover":
+		return s.positional(params, s.hover)
+	case "textDocument/definition":
+		return s.positional(params, s.definition)
+	case "textDocument/rename":
+		var p struct {
+			textDocumentPosition
+			NewName string `json:"newName"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		doc := s.docs[p.TextDocument.URI]
+		if doc == nil {
+			return nil, &rpcError{rpcInvalidParams, "unknown document " + p.TextDocument.URI}
+		}
+		return s.rename(doc, lspOffset(doc.Text, p.Position), p.NewName)
+	case "textDocument/formatting":
+		doc, err := s.document(params)
+		if err != nil {
+			return nil, err
+		}
+		return s.formatting(doc), nil
+	case "textDocument/documentSymbol":
+		doc, err := s.document(params)
+		if err != nil {
+			return nil, err
+		}
+		return s.symbols(doc), nil
+	default:
+		if !strings.HasPrefix(method, "$/") && method != "initialized" && method != "textDocument/didSave" {
+			return nil, &rpcError{rpcMethodNotFound, "unsupported method " + method}
+		}
+	}
+	return nil, nil
+}
+
+// document returns the open document params name.
+func (s *lspServer) document(params json.RawMessage) (*lspDocument, error) {
+	var p textDocumentPosition
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	doc := s.docs[p.TextDocument.URI]
+	if doc == nil {
+		return nil, &rpcError{rpcInvalidParams, "unknown document " + p.TextDocument.URI}
+	}
+	return doc, nil
+}
+
+// positional runs a request made at a position in a diagram, answering
+// null outside of one.
+func (s *lspServer) positional(params json.RawMessage, f func(*lspDocument, docDiagram, int) any) (any, error) {
+	var p textDocumentPosition
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	doc, err := s.document(params)
+	if err != nil {
+		return nil, err
+	}
+	offset := lspOffset(doc.Text, p.Position)
+	dd, ok := doc.diagramAt(offset)
+	if !ok {
+		return nil, nil
+	}
+	return f(doc, dd, offset-dd.offset), nil
+}
+
+// changed publishes the diagnostics of a document that changed from old,
+// and mirrors it into the editor if asked to.
+func (s *lspServer) changed(doc *lspDocument, old string) {
+	s.notify("textDocument/publishDiagnostics", map[string]any{"uri": doc.URI, "diagnostics": s.diagnostics(doc)})
+	if s.preview == nil {
+		return
+	}
+	// Of a markdown file, mirror the first diagram that changed.
+	was := map[string]bool{}
+	if doc.Markdown {
+		for _, e := range markdownDiagrams(old) {
+			was[e.Text] = true
+		}
+	} else {
+		was[old] = true
+	}
+	for _, dd := range doc.diagrams() {
+		if !was[dd.src] {
+			select {
+			case <-s.preview:
+			default:
+			}
+			s.preview <- dd.src
+			return
+		}
+	}
+}
+
+// mirrorPreview sets each diagram it receives in the running editor.
+func mirrorPreview(diagrams chan string) {
+	var c *Client
+	for content := range diagrams {
+		if c == nil {
+			if c = existingClient(); c == nil {
+				continue
+			}
+		}
+		if _, err := c.SetDiagram(content, "lsp"); err != nil {
+			log.Printf("Failed to mirror the diagram: %v", err)
+			c = nil
+		}
+	}
+}
+
+// lintConfigFor returns the lint config of the project a document is in.
+func lintConfigFor(uri string) LintConfig {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return LintConfig{}
+	}
+	c, err := loadLintConfig(filepath.Dir(filepath.FromSlash(u.Path)))
+	if err != nil {
+		log.Printf("Ignoring lint config: %v", err)
+	}
+	return c
+}
+
+// diagnostics lints the diagrams of a document.
+func (s *lspServer) diagnostics(doc *lspDocument) []lspDiagnostic {
+	c := lintConfigFor(doc.URI)
+	out := []lspDiagnostic{}
+	for _, dd := range doc.diagrams() {
+		for _, i := range LintDiagram(dd.src, c) {
+			severity := diagnosticInfo
+			switch i.Severity {
+			case severityError:
+				severity = diagnosticError
+			case severityWarning:
+				severity = diagnosticWarning
+			}
+			out = append(out, lspDiagnostic{
+				Range:    doc.rangeOf(dd, i.Span),
+				Severity: severity,
+				Code:     i.Rule,
+				Source:   "mermaid-editor",
+				Message:  i.Message,
+			})
+		}
+	}
+	return out
+}
+
+// completion offers the diagram types before the header, and after it the
+// keywords of the diagram and the ids already in it.
+func (s *lspServer) completion(doc *lspDocument, dd docDiagram, offset int) any {
+	items := []lspCompletionItem{}
+	if st := headerStatement(dd.d); st == nil || dd.d.Kind == "" || st.Span.End.Offset >= offset {
+		for keyword := range diagramKinds {
+			items = append(items, lspCompletionItem{Label: keyword, Kind: completionKeyword})
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+		return items
+	}
+	for _, keyword := range completionKeywords[dd.d.Kind] {
+		items = append(items, lspCompletionItem{Label: keyword, Kind: completionKeyword})
+	}
+	for _, n := range dd.d.Nodes {
+		items = append(items, lspCompletionItem{Label: n.ID, Kind: completionVariable, Detail: n.Label})
+	}
+	for _, p := range dd.d.Participants {
+		items = append(items, lspCompletionItem{Label: p.ID, Kind: completionVariable, Detail: p.Label})
+	}
+	return items
+}
+
+// hover describes the node or participant under the cursor.
+func (s *lspServer) hover(doc *lspDocument, dd docDiagram, offset int) any {
+	id, from, to := idAt(dd.src, offset)
+	if id == "" {
+		return nil
+	}
+	var text string
+	if n := dd.d.Node(id); n != nil {
+		in, out := 0, 0
+		for _, e := range dd.d.Edges {
+			if e.To == id {
+				in++
+			}
+			if e.From == id {
+				out++
+			}
+		}
+		text = fmt.Sprintf("**%s** %s", id, n.Shape)
+		if n.Label != id {
+			text += fmt.Sprintf(": %s", n.Label)
+		}
+		text += fmt.Sprintf("\n\n%d in, %d out", in, out)
+		if n.Subgraph != "" {
+			text += fmt.Sprintf(", in %s", n.Subgraph)
+		}
+	} else if p := dd.d.Participant(id); p != nil {
+		text = fmt.Sprintf("**%s** %s", id, p.Kind)
+		if p.Label != id {
+			text += fmt.Sprintf(": %s", p.Label)
+		}
+		sent, received := 0, 0
+		for _, m := range dd.d.Messages {
+			if m.From == id {
+				sent++
+			}
+			if m.To == id {
+				received++
+			}
+		}
+		text += fmt.Sprintf("\n\n%d messages sent, %d received", sent, received)
+	} else if sg := dd.d.Subgraph(id); sg != nil {
+		text = fmt.Sprintf("**%s** subgraph: %s\n\n%d nodes", id, sg.Title, len(sg.Nodes))
+	} else {
+		return nil
+	}
+	return map[string]any{
+		"contents": map[string]string{"kind": "markdown", "value": text},
+		"range": lspRange{
+			Start: lspPos(doc.Text, dd.offset+from),
+			End:   lspPos(doc.Text, dd.offset+to),
+		},
+	}
+}
+
+// definition finds where the node, participant or subgraph under the cursor
+// is defined.
+func (s *lspServer) definition(doc *lspDocument, dd docDiagram, offset int) any {
+	id, _, _ := idAt(dd.src, offset)
+	var span Span
+	switch {
+	case id == "":
+		return nil
+	case dd.d.Node(id) != nil:
+		span = dd.d.Node(id).Span
+	case dd.d.Participant(id) != nil:
+		span = dd.d.Participant(id).Span
+	case dd.d.Subgraph(id) != nil:
+		span = dd.d.Subgraph(id).Header
+	default:
+		return nil
+	}
+	return lspLocation{URI: doc.URI, Range: doc.rangeOf(dd, span)}
+}
+
+// rename renames the node or participant under the cursor everywhere it is
+// mentioned.
+func (s *lspServer) rename(doc *lspDocument, offset int, name string) (any, error) {
+	dd, ok := doc.diagramAt(offset)
+	if !ok {
+		return nil, &rpcError{rpcRequestFailed, "not in a diagram"}
+	}
+	id, _, _ := idAt(dd.src, offset-dd.offset)
+	if id == "" || dd.d.Node(id) == nil && dd.d.Participant(id) == nil {
+		return nil, &rpcError{rpcRequestFailed, "only node ids and participant names can be renamed"}
+	}
+	if scanID(name) != len(name) || name == "" || name == "end" {
+		return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("%q isn't a valid id", name)}
+	}
+	if name != id && (dd.d.Node(name) != nil || dd.d.Participant(name) != nil) {
+		return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("%s is already taken", name)}
+	}
+	edits := []lspTextEdit{}
+	for _, span := range dd.d.Mentions(id) {
+		edits = append(edits, lspTextEdit{Range: doc.rangeOf(dd, span), NewText: name})
+	}
+	return map[string]any{"changes": map[string][]lspTextEdit{doc.URI: edits}}, nil
+}
+
+// formatting formats each diagram of a document that parses.
+func (s *lspServer) formatting(doc *lspDocument) []lspTextEdit {
+	edits := []lspTextEdit{}
+	for _, dd := range doc.diagrams() {
+		formatted, err := FormatDiagram(dd.src)
+		if err != nil || formatted == dd.src {
+			continue
+		}
+		edits = append(edits, lspTextEdit{
+			Range: lspRange{
+				Start: lspPos(doc.Text, dd.offset),
+				End:   lspPos(doc.Text, dd.offset+len(dd.src)),
+			},
+			NewText: formatted,
+		})
+	}
+	return edits
+}
+
+// symbols outlines a document: each diagram's subgraphs and nodes, or
+// participants, blocks, messages and notes. The diagrams of a markdown file
+// each get a symbol of their own.
+func (s *lspServer) symbols(doc *lspDocument) []lspSymbol {
+	out := []lspSymbol{}
+	for _, dd := range doc.diagrams() {
+		children := diagramSymbols(doc, dd)
+		if !doc.Markdown {
+			return children
+		}
+		r := lspRange{Start: lspPos(doc.Text, dd.offset), End: lspPos(doc.Text, dd.offset+len(dd.src))}
+		out = append(out, lspSymbol{Name: "mermaid", Detail: dd.d.Header, Kind: symbolModule, Range: r, SelectionRange: r, Children: children})
+	}
+	return out
+}
+
+// spanWithin reports whether span lies inside outer.
+func spanWithin(span, outer Span) bool {
+	return span.Start.Offset >= outer.Start.Offset && span.End.Offset <= outer.End.Offset
+}
+
+// sortSymbols puts symbols and their children in the order they appear.
+func sortSymbols(syms []lspSymbol) {
+	sort.SliceStable(syms, func(i, j int) bool {
+		a, b := syms[i].Range.Start, syms[j].Range.Start
+		return a.Line < b.Line || a.Line == b.Line && a.Character < b.Character
+	})
+	for i := range syms {
+		sortSymbols(syms[i].Children)
+	}
+}
+
+// diagramSymbols outlines one diagram.
+func diagramSymbols(doc *lspDocument, dd docDiagram) []lspSymbol {
+	d := dd.d
+	symbol := func(name, detail string, kind int, span, selection Span) lspSymbol {
+		return lspSymbol{Name: name, Detail: detail, Kind: kind, Range: doc.rangeOf(dd, span), SelectionRange: doc.rangeOf(dd, selection)}
+	}
+	top := []lspSymbol{}
+	if d.Kind == kindSequence {
+		for _, p := range d.Participants {
+			top = append(top, symbol(p.ID, p.Label, symbolClass, p.Span, p.Span))
+		}
+		// Messages go in their innermost block, and blocks in theirs. A
+		// block comes after the blocks it holds, so it is complete when
+		// placed.
+		blocks := make([]lspSymbol, len(d.Blocks))
+		for i, b := range d.Blocks {
+			blocks[i] = symbol(b.Kind, b.Label, symbolNamespace, b.Span, b.Span)
+		}
+		for _, m := range d.Messages {
+			sym := symbol(fmt.Sprintf("%d. %s%s%s", m.Index, m.From, m.Arrow, m.To), m.Text, symbolEvent, m.Span, m.Span)
+			if m.Block >= 0 {
+				blocks[m.Block].Children = append(blocks[m.Block].Children, sym)
+			} else {
+				top = append(top, sym)
+			}
+		}
+		for i := len(d.Blocks) - 1; i >= 0; i-- {
+			if p := d.Blocks[i].Parent; p >= 0 {
+				blocks[p].Children = append(blocks[p].Children, blocks[i])
+			} else {
+				top = append(top, blocks[i])
+			}
+		}
+		for _, n := range d.Notes {
+			top = append(top, symbol("note "+n.Position+" "+strings.Join(n.Actors, ","), n.Text, symbolString, n.Span, n.Span))
+		}
+		sortSymbols(top)
+		return top
+	}
+
+	groups := make([]lspSymbol, len(d.Subgraphs))
+	index := map[string]int{}
+	for i, sg := range d.Subgraphs {
+		groups[i] = symbol(sg.ID, sg.Title, symbolNamespace, sg.Span, sg.Header)
+		index[sg.ID] = i
+	}
+	for _, n := range d.Nodes {
+		sym := symbol(n.ID, n.Label, symbolObject, n.Span, n.Span)
+		// A node defined outside its subgraph stays outside it here, as a
+		// symbol must lie within its parent.
+		if i, ok := index[n.Subgraph]; ok && spanWithin(n.Span, d.Subgraphs[i].Span) {
+			groups[i].Children = append(groups[i].Children, sym)
+		} else {
+			top = append(top, sym)
+		}
+	}
+	for i := len(d.Subgraphs) - 1; i >= 0; i-- {
+		if p, ok := index[d.Subgraphs[i].Parent]; ok {
+			groups[p].Children = append(groups[p].Children, groups[i])
+		} else {
+			top = append(top, groups[i])
+		}
+	}
+	sortSymbols(top)
+	return top
+}
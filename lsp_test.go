@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// lspExchange sends messages to a language server and returns what it sent
+// back, by method for notifications and by id for responses.
+func lspExchange(msgs ...map[string]any) map[string]map[string]any {
+	var in bytes.Buffer
+	for _, m := range msgs {
+		m["jsonrpc"] = "2.0"
+		body, _ := json.Marshal(m)
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	var out bytes.Buffer
+	So(newLSPServer(&in, &out).serve(), ShouldBeNil)
+
+	got := map[string]map[string]any{}
+	r := bufio.NewReader(&out)
+	for {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return got
+		}
+		length, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "Content-Length:")))
+		r.ReadString('\n')
+		body := make([]byte, length)
+		io.ReadFull(r, body)
+		var msg map[string]any
+		json.Unmarshal(body, &msg)
+		if id, ok := msg["id"]; ok {
+			got[fmt.Sprint(id)] = msg
+		} else {
+			got[msg["method"].(string)] = msg
+		}
+	}
+}
+
+// didOpen opens a document with text.
+func didOpen(uri, language, text string) map[string]any {
+	return map[string]any{"method": "textDocument/didOpen", "params": map[string]any{
+		"textDocument": map[string]any{"uri": uri, "languageId": language, "version": 1, "text": text},
+	}}
+}
+
+// at makes a request at a position in a document.
+func at(id int, method, uri string, line, character int, extra ...any) map[string]any {
+	params := map[string]any{
+		"textDocument": map[string]any{"uri": uri},
+		"position":     map[string]any{"line": line, "character": character},
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		params[extra[i].(string)] = extra[i+1]
+	}
+	return map[string]any{"id": id, "method": method, "params": params}
+}
+
+func TestLSPPositions(t *testing.T) {
+	Convey("LSP positions count UTF-16 code units", t, func() {
+		text := "graph TD\n  A[😀] --> B"
+		offset := strings.Index(text, "]")
+		p := lspPos(text, offset)
+		So(p, ShouldResemble, lspPosition{Line: 1, Character: 6})
+		So(lspOffset(text, p), ShouldEqual, offset)
+		So(lspOffset(text, lspPosition{Line: 0, Character: 99}), ShouldEqual, len("graph TD"))
+	})
+
+	Convey("idAt finds the id around an offset", t, func() {
+		src := "A-->my-node"
+		id, from, to := idAt(src, 8)
+		So(id, ShouldEqual, "my-node")
+		So(from, ShouldEqual, 4)
+		So(to, ShouldEqual, len(src))
+		id, _, _ = idAt(src, 0)
+		So(id, ShouldEqual, "A")
+	})
+}
+
+func TestLSPServer(t *testing.T) {
+	Convey("Given a language server", t, func() {
+		const uri = "file:///tmp/flow.mmd"
+		flow := "graph TD\n  A[Start] --> B\n  B --> end\n  style A fill:#f00"
+		initialize := map[string]any{"id": 1, "method": "initialize", "params": map[string]any{}}
+		shutdown := map[string]any{"id": 99, "method": "shutdown"}
+
+		Convey("It answers initialize with its capabilities", func() {
+			got := lspExchange(initialize, shutdown, map[string]any{"method": "exit"})
+			caps := got["1"]["result"].(map[string]any)["capabilities"].(map[string]any)
+			So(caps["renameProvider"], ShouldEqual, true)
+			So(caps["documentFormattingProvider"], ShouldEqual, true)
+			So(got["99"]["result"], ShouldBeNil)
+		})
+
+		Convey("It publishes diagnostics for an opened document", func() {
+			got := lspExchange(didOpen(uri, "mermaid", flow))
+			params := got["textDocument/publishDiagnostics"]["params"].(map[string]any)
+			So(params["uri"], ShouldEqual, uri)
+			diags := params["diagnostics"].([]any)
+			So(diags, ShouldHaveLength, 1)
+			diag := diags[0].(map[string]any)
+			So(diag["code"], ShouldEqual, "reserved-id")
+			So(diag["severity"], ShouldEqual, diagnosticError)
+			So(diag["range"].(map[string]any)["start"], ShouldResemble, map[string]any{"line": 2.0, "character": 8.0})
+		})
+
+		Convey("It finds diagrams in markdown, with positions in the file", func() {
+			md := "# Notes\n\n```mermaid\nsequenceDiagram\n  A->>B\n```\n"
+			got := lspExchange(didOpen("file:///tmp/notes.md", "markdown", md))
+			diags := got["textDocument/publishDiagnostics"]["params"].(map[string]any)["diagnostics"].([]any)
+			So(diags, ShouldHaveLength, 1)
+			So(diags[0].(map[string]any)["range"].(map[string]any)["start"].(map[string]any)["line"], ShouldEqual, 4)
+		})
+
+		Convey("It completes keywords and ids", func() {
+			got := lspExchange(didOpen(uri, "mermaid", flow), at(2, "textDocument/completion", uri, 2, 2))
+			var labels []string
+			for _, item := range got["2"]["result"].([]any) {
+				labels = append(labels, item.(map[string]any)["label"].(string))
+			}
+			So(labels, ShouldContain, "subgraph")
+			So(labels, ShouldContain, "A")
+			So(labels, ShouldNotContain, "sequenceDiagram")
+
+			got = lspExchange(didOpen(uri, "mermaid", "gr"), at(2, "textDocument/completion", uri, 0, 2))
+			So(fmt.Sprint(got["2"]["result"]), ShouldContainSubstring, "flowchart")
+		})
+
+		Convey("It describes the node under the cursor", func() {
+			got := lspExchange(didOpen(uri, "mermaid", flow), at(2, "textDocument/hover", uri, 1, 2))
+			value := got["2"]["result"].(map[string]any)["contents"].(map[string]any)["value"]
+			So(value, ShouldEqual, "**A** rect: Start\n\n0 in, 1 out")
+		})
+
+		Convey("It goes to where a node is defined", func() {
+			got := lspExchange(didOpen(uri, "mermaid", flow), at(2, "textDocument/definition", uri, 3, 8))
+			r := got["2"]["result"].(map[string]any)["range"].(map[string]any)
+			So(r["start"], ShouldResemble, map[string]any{"line": 1.0, "character": 2.0})
+			So(r["end"], ShouldResemble, map[string]any{"line": 1.0, "character": 10.0})
+		})
+
+		Convey("It renames a node everywhere it is named", func() {
+			got := lspExchange(didOpen(uri, "mermaid", flow), at(2, "textDocument/rename", uri, 1, 2, "newName", "Begin"))
+			edits := got["2"]["result"].(map[string]any)["changes"].(map[string]any)[uri].([]any)
+			So(edits, ShouldHaveLength, 2)
+			So(edits[1].(map[string]any)["range"].(map[string]any)["start"], ShouldResemble, map[string]any{"line": 3.0, "character": 8.0})
+
+			got = lspExchange(didOpen(uri, "mermaid", flow), at(2, "textDocument/rename", uri, 1, 2, "newName", "B"))
+			So(got["2"]["error"].(map[string]any)["message"], ShouldContainSubstring, "taken")
+		})
+
+		Convey("It formats each diagram", func() {
+			md := "```mermaid\ngraph TD;A-->B\n```\n\n```mermaid\ngraph TD\n    C --> D\n```\n"
+			got := lspExchange(didOpen("file:///tmp/doc.md", "markdown", md),
+				map[string]any{"id": 2, "method": "textDocument/formatting", "params": map[string]any{"textDocument": map[string]any{"uri": "file:///tmp/doc.md"}}})
+			edits := got["2"]["result"].([]any)
+			So(edits, ShouldHaveLength, 1)
+			So(edits[0].(map[string]any)["newText"], ShouldEqual, "graph TD\n    A --> B\n")
+		})
+
+		Convey("It outlines subgraphs and their nodes", func() {
+			src := "graph TD\n  X --> Y\n  subgraph s [Stage]\n    Y\n    Z\n  end"
+			got := lspExchange(didOpen(uri, "mermaid", src),
+				map[string]any{"id": 2, "method": "textDocument/documentSymbol", "params": map[string]any{"textDocument": map[string]any{"uri": uri}}})
+			symbols := got["2"]["result"].([]any)
+			var names []string
+			for _, s := range symbols {
+				names = append(names, s.(map[string]any)["name"].(string))
+			}
+			So(names, ShouldResemble, []string{"X", "Y", "s"})
+			children := symbols[2].(map[string]any)["children"].([]any)
+			So(children, ShouldHaveLength, 1)
+			So(children[0].(map[string]any)["name"], ShouldEqual, "Z")
+		})
+
+		Convey("It refuses methods it doesn't know", func() {
+			got := lspExchange(map[string]any{"id": 2, "method": "textDocument/codeLens", "params": map[string]any{}})
+			So(got["2"]["error"].(map[string]any)["code"], ShouldEqual, rpcMethodNotFound)
+		})
+	})
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -12,11 +12,16 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
 //go:embed static
@@ -25,48 +30,80 @@ var staticFiles embed.FS
 var server *http.Server
 var serverURL string
 var diagram *DiagramState
+var store *documentStore
+
+// socketActivated is set when systemd passed in the listening sockets. The
+// sockets, and the token clients read before activating us, then belong to
+// the service rather than to this process.
+var socketActivated bool
 
-// stateDirOverride allows tests to redirect state files to a temp directory.
+// stateDirOverride replaces the default state directory. It is set by
+// --state-dir, and by tests to redirect state files to a temp directory.
 var stateDirOverride string
 
+// stateDir returns the state directory of this instance's scope: the global
+// directory, or a per-workspace directory when --workspace is in effect.
 func stateDir() string {
-	if stateDirOverride != "" {
-		return stateDirOverride
-	}
-	dir, err := os.UserCacheDir()
-	if err != nil {
-		dir = os.TempDir()
-	}
-	return filepath.Join(dir, "mermaid-editor")
+	return workspaceStateDir(workspaceRoot())
 }
 
-func pidFile() string   { return filepath.Join(stateDir(), "pid") }
-func portFile() string  { return filepath.Join(stateDir(), "port") }
-func prefsFile() string { return filepath.Join(stateDir(), "preferences.json") }
+func pidFile() string       { return filepath.Join(stateDir(), "pid") }
+func portFile() string      { return filepath.Join(stateDir(), "port") }
+func prefsFile() string     { return filepath.Join(stateDir(), "preferences.json") }
+func workspaceFile() string { return filepath.Join(stateDir(), "workspace") }
+func documentFile() string  { return filepath.Join(stateDir(), "diagram.mmd") }
+func socketFile() string    { return filepath.Join(stateDir(), "sock") }
+func serviceFile() string   { return filepath.Join(stateDir(), "service") }
 
 // checkExisting returns the URL of a running instance, or "" if none.
 func checkExisting() string {
-	pidBytes, err := os.ReadFile(pidFile())
+	return checkExistingIn(stateDir())
+}
+
+// checkExistingIn returns the URL of the instance whose state lives in dir,
+// or "" if it isn't running. An installed socket-activated service counts as
+// running: connecting to its fixed port starts it.
+func checkExistingIn(dir string) string {
+	if !processRunning(filepath.Join(dir, "pid")) {
+		return serviceURL(dir)
+	}
+	portBytes, err := os.ReadFile(filepath.Join(dir, "port"))
 	if err != nil {
 		return ""
 	}
+	port := strings.TrimSpace(string(portBytes))
+	return fmt.Sprintf("http://127.0.0.1:%s", port)
+}
+
+// processRunning reports whether the process named in pidPath is alive.
+func processRunning(pidPath string) bool {
+	pidBytes, err := os.ReadFile(pidPath)
+	if err != nil {
+		return false
+	}
 	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
 	if err != nil {
-		return ""
+		return false
 	}
 	proc, err := os.FindProcess(pid)
 	if err != nil {
-		return ""
+		return false
 	}
 	// Signal 0 checks if the process exists without killing it.
-	if proc.Signal(syscall.Signal(0)) != nil {
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// serviceURL returns the fixed URL of the socket-activated service whose
+// state lives in dir, or "" if none is installed.
+func serviceURL(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "service"))
+	if err != nil {
 		return ""
 	}
-	portBytes, err := os.ReadFile(portFile())
-	if err != nil {
+	port := strings.TrimSpace(string(data))
+	if port == "" {
 		return ""
 	}
-	port := strings.TrimSpace(string(portBytes))
 	return fmt.Sprintf("http://127.0.0.1:%s", port)
 }
 
@@ -75,55 +112,185 @@ func writeState(port int) {
 	os.MkdirAll(dir, 0755)
 	os.WriteFile(pidFile(), []byte(strconv.Itoa(os.Getpid())), 0644)
 	os.WriteFile(portFile(), []byte(strconv.Itoa(port)), 0644)
+	// A socket-activated instance keeps the service's token, which clients
+	// may have read before the connection that started us.
+	if apiToken = ""; socketActivated {
+		apiToken = readToken(dir)
+	}
+	if apiToken == "" {
+		apiToken = newToken()
+		writeToken(apiToken)
+	}
+	setAllowedHosts(port)
+	if root := workspaceRoot(); root != "" {
+		os.WriteFile(workspaceFile(), []byte(root), 0644)
+	}
 }
 
+// clearState removes this instance's state files. It leaves them alone if
+// another instance has taken over the state directory since we started.
 func clearState() {
+	if !ownsState() {
+		return
+	}
 	os.Remove(pidFile())
 	os.Remove(portFile())
+	if !socketActivated {
+		os.Remove(socketFile())
+		os.Remove(tokenFile())
+	}
 }
 
-// fileArg returns the first non-flag argument from the command line, or "".
-func fileArg() string {
-	for _, arg := range os.Args[1:] {
-		if !strings.HasPrefix(arg, "-") {
-			return arg
-		}
+// ownsState reports whether the pid file names this process.
+func ownsState() bool {
+	data, err := os.ReadFile(pidFile())
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return err == nil && pid == os.Getpid()
+}
+
+// runSubcommand handles subcommands that don't start an editor. It returns
+// true if one ran.
+func runSubcommand() bool {
+	if len(cfg.Args) == 0 {
+		return false
 	}
-	return ""
+	switch cfg.Args[0] {
+	case "list":
+		runList()
+		return true
+	case "url":
+		runURL(cfg.Args[1:])
+		return true
+	case "service":
+		runService(cfg.Args[1:])
+		return true
+	case "fmt":
+		runFmt(cfg.Args[1:])
+		return true
+	case "lint":
+		runLint(cfg.Args[1:])
+		return true
+	case "check":
+		runCheck(cfg.Args[1:])
+		return true
+	case "lsp":
+		runLSP(cfg.Args[1:])
+		return true
+	}
+	return false
+}
+
+// setupWorkspace applies --workspace for the current process.
+func setupWorkspace() {
+	root, err := resolveWorkspace(cfg.Workspace)
+	if err != nil {
+		log.Fatalf("Invalid workspace: %v", err)
+	}
+	setWorkspaceRoot(root)
+}
+
+// startStore creates the document store for the current scope and starts
+// persisting diagram changes to it.
+func startStore() {
+	store = newDocumentStore(documentFile(), diagram)
+	go store.Watch()
 }
 
 // activateExisting brings a running instance to the foreground. It tries the
 // /api/focus endpoint first (which activates the native macOS window) and falls
 // back to opening the URL in the default browser.
-func activateExisting(baseURL string) {
-	resp, err := http.Post(baseURL+"/api/focus", "", nil)
-	if err == nil {
-		resp.Body.Close()
-		if resp.StatusCode == http.StatusNoContent {
-			return
-		}
+func activateExisting(c *Client) {
+	if c.Focus() || cfg.NoBrowser {
+		return
 	}
-	openBrowser(baseURL)
+	openBrowser(c.URL)
 }
 
-// pushDiagram sends diagram content to a running editor instance via HTTP PUT.
-func pushDiagram(baseURL, content string) {
-	body, _ := json.Marshal(map[string]string{
-		"content": content,
-		"source":  "cli",
-	})
-	req, err := http.NewRequest("PUT", baseURL+"/api/diagram", bytes.NewReader(body))
-	if err != nil {
+// pushDiagram sends diagram content to a running editor instance.
+func pushDiagram(c *Client, content string) {
+	if _, err := c.SetDiagram(content, "cli"); err != nil {
 		log.Printf("Failed to push diagram: %v", err)
-		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+}
+
+// newMux builds the HTTP handler shared by every mode and listener.
+func newMux(mcpServer *mcp.Server) *http.ServeMux {
+	staticFS, err := fs.Sub(staticFiles, "static")
 	if err != nil {
-		log.Printf("Failed to push diagram: %v", err)
-		return
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/diagram", diagram.handleGetDiagram)
+	mux.HandleFunc("PUT /api/diagram", diagram.handleSetDiagram)
+	mux.HandleFunc("PATCH /api/diagram", diagram.handlePatchDiagram)
+	mux.HandleFunc("GET /api/diagram/blame", diagram.handleGetBlame)
+	mux.HandleFunc("GET /api/diagram/outline", diagram.handleGetOutline)
+	mux.HandleFunc("GET /api/diagram/graph", diagram.handleGetGraph)
+	mux.HandleFunc("PUT /api/diagram/graph", diagram.handleSetGraph)
+	mux.HandleFunc("GET /api/diagram/diff", diagram.handleGetDiff)
+	mux.HandleFunc("POST /api/diagram/diff", handlePostDiff)
+	mux.HandleFunc("POST /api/diagram/format", handleFormat)
+	mux.HandleFunc("GET /api/events", diagram.handleDiagramSSE)
+	mux.HandleFunc("GET /api/selection", diagram.handleGetSelection)
+	mux.HandleFunc("PUT /api/selection", diagram.handleSetSelection)
+	mux.HandleFunc("GET /api/clients", diagram.handleGetClients)
+	mux.HandleFunc("GET /api/lease", diagram.handleGetLease)
+	mux.HandleFunc("PUT /api/lease", diagram.handleAcquireLease)
+	mux.HandleFunc("DELETE /api/lease", diagram.handleReleaseLease)
+	mux.HandleFunc("GET /api/status", handleStatus)
+	mux.HandleFunc("POST /api/download", handleDownload)
+	mux.HandleFunc("GET /api/preferences", handleGetPreferences)
+	mux.HandleFunc("PUT /api/preferences", handleSetPreferences)
+	mux.HandleFunc("POST /api/focus", handleFocus)
+	mux.HandleFunc("POST /api/quit", handleQuit)
+	// With idle shutdown on, drop proxied sessions whose agent went away
+	// without closing them, or they would keep the editor alive forever.
+	mux.Handle("/mcp", mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server {
+		return mcpServer
+	}, &mcp.StreamableHTTPOptions{SessionTimeout: time.Duration(cfg.IdleTimeout)}))
+	mux.Handle("/", http.FileServer(http.FS(staticFS)))
+	return mux
+}
+
+// serveAPI serves the API on the TCP listener and on a user-only Unix
+// socket: sock if systemd passed one in, otherwise one created in the state
+// directory where the platform supports it.
+func serveAPI(listener, sock net.Listener, mcpServer *mcp.Server) {
+	activity.setMCPServer(mcpServer)
+	server = &http.Server{
+		Handler:     guardAPI(trackActivity(newMux(mcpServer))),
+		ConnContext: markSocketConn,
+	}
+	// Long-lived streams never go idle on their own; end them so Shutdown
+	// doesn't have to wait out its timeout.
+	server.RegisterOnShutdown(diagram.Close)
+	server.RegisterOnShutdown(func() {
+		for ss := range mcpServer.Sessions() {
+			ss.Close()
+		}
+	})
+
+	listeners := []net.Listener{listener}
+	if sock == nil {
+		var err error
+		if sock, err = listenSocket(socketFile()); err != nil {
+			log.Printf("Unix socket unavailable, serving over TCP only: %v", err)
+		}
+	}
+	if sock != nil {
+		listeners = append(listeners, sock)
+	}
+	for _, l := range listeners {
+		go func() {
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
 	}
-	resp.Body.Close()
 }
 
 // startServer checks for an existing instance, starts the HTTP server in a
@@ -131,7 +298,7 @@ func pushDiagram(baseURL, content string) {
 // instance was found (browser opened to it, nothing more to do).
 func startServer() bool {
 	var initialContent string
-	if f := fileArg(); f != "" {
+	if f := cfg.File; f != "" {
 		data, err := os.ReadFile(f)
 		if err != nil {
 			log.Fatalf("Cannot read %s: %v", f, err)
@@ -139,53 +306,47 @@ func startServer() bool {
 		initialContent = string(data)
 	}
 
-	if url := checkExisting(); url != "" {
-		fmt.Printf("Already running at %s\n", url)
-		if initialContent != "" {
-			pushDiagram(url, initialContent)
-		}
-		activateExisting(url)
-		return false
-	}
+	setupWorkspace()
 
-	staticFS, err := fs.Sub(staticFiles, "static")
+	inherited, err := activatedListeners()
 	if err != nil {
 		log.Fatal(err)
 	}
+	socketActivated = inherited != nil
+
+	// When systemd started us, the service's state files point back at this
+	// very process, so there is no other instance to defer to.
+	if c := existingClient(); c != nil && !socketActivated {
+		fmt.Printf("Already running at %s\n", c.URL)
+		if initialContent != "" {
+			pushDiagram(c, initialContent)
+		}
+		activateExisting(c)
+		return false
+	}
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	listener, sock, url, err := openListeners(inherited)
 	if err != nil {
 		log.Fatal(err)
 	}
 	port := listener.Addr().(*net.TCPAddr).Port
-	url := fmt.Sprintf("http://127.0.0.1:%d", port)
 
 	serverURL = url
 	writeState(port)
 
+	if initialContent == "" {
+		initialContent = loadDocument(documentFile())
+	}
 	diagram = NewDiagramState(initialContent)
+	startStore()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /api/diagram", diagram.handleGetDiagram)
-	mux.HandleFunc("PUT /api/diagram", diagram.handleSetDiagram)
-	mux.HandleFunc("GET /api/events", diagram.handleDiagramSSE)
-	mux.HandleFunc("POST /api/download", handleDownload)
-	mux.HandleFunc("GET /api/preferences", handleGetPreferences)
-	mux.HandleFunc("PUT /api/preferences", handleSetPreferences)
-	mux.HandleFunc("POST /api/focus", handleFocus)
-	mux.HandleFunc("POST /api/quit", handleQuit)
-	mux.Handle("/", http.FileServer(http.FS(staticFS)))
-
-	server = &http.Server{Handler: mux}
+	ready := make(chan struct{})
+	close(ready)
+	serveAPI(listener, sock, newMCPServer(nil, ready))
+	startIdleWatch()
 
 	fmt.Printf("MermAId Editor running at %s\n", url)
 
-	go func() {
-		if err := server.Serve(listener); err != http.ErrServerClosed {
-			log.Fatal(err)
-		}
-	}()
-
 	return true
 }
 
@@ -212,6 +373,10 @@ func handleSetPreferences(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "failed to save preferences", http.StatusInternalServerError)
 		return
 	}
+	if diagram != nil {
+		// Keep other open tabs in step.
+		diagram.Publish(eventPreferences, prefs)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -248,12 +413,56 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+// shutdownTimeout bounds how long shutdown waits for in-flight requests
+// before dropping them.
+const shutdownTimeout = 5 * time.Second
+
+// quitRequested is closed to ask the main goroutine to shut down.
+var (
+	quitRequested = make(chan struct{})
+	quitOnce      sync.Once
+)
+
+// signalQuit asks the main goroutine to shut down and return from main.
+func signalQuit() {
+	quitOnce.Do(func() { close(quitRequested) })
+}
+
+// waitForSignal blocks until the process is asked to stop by a signal or
+// signalQuit, then shuts down.
+func waitForSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	select {
+	case <-ctx.Done():
+	case <-quitRequested:
+	}
+
+	shutdown()
+}
+
+// shutdown stops accepting connections, lets in-flight requests finish and
+// tells SSE clients the editor stopped, then saves the document and removes
+// the state files.
 func shutdown() {
 	if server != nil {
-		server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Timed out waiting for requests, closing: %v", err)
+			server.Close()
+		}
+	}
+	if store != nil {
+		store.Flush()
 	}
 	clearState()
-	fmt.Println("Stopped.")
+	if cfg.MCP {
+		// stdout carries the MCP session.
+		fmt.Fprintln(os.Stderr, "Stopped.")
+	} else {
+		fmt.Println("Stopped.")
+	}
 }
 
 func openBrowser(url string) {
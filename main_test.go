@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -11,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -155,6 +160,20 @@ func TestPreferences(t *testing.T) {
 			So(saved["theme"], ShouldEqual, "dark")
 		})
 
+		Convey("PUT broadcasts the preferences to open editors", func() {
+			useTestStateDir(t)
+			diagram = NewDiagramState("")
+			Reset(func() { diagram = nil })
+			events := diagram.Listen()
+
+			req := httptest.NewRequest("PUT", "/api/preferences", strings.NewReader(`{"vimMode":false}`))
+			handleSetPreferences(httptest.NewRecorder(), req)
+
+			event := <-events
+			So(event.Type, ShouldEqual, eventPreferences)
+			So(event.Data, ShouldResemble, map[string]any{"vimMode": false})
+		})
+
 		Convey("PUT with invalid JSON returns 400", func() {
 			useTestStateDir(t)
 
@@ -184,33 +203,6 @@ func TestPreferences(t *testing.T) {
 	})
 }
 
-func TestFileArg(t *testing.T) {
-	Convey("Given fileArg()", t, func() {
-		origArgs := os.Args
-		t.Cleanup(func() { os.Args = origArgs })
-
-		Convey("Returns empty string when no arguments", func() {
-			os.Args = []string{"mermaid-editor"}
-			So(fileArg(), ShouldEqual, "")
-		})
-
-		Convey("Returns the first non-flag argument", func() {
-			os.Args = []string{"mermaid-editor", "diagram.mmd"}
-			So(fileArg(), ShouldEqual, "diagram.mmd")
-		})
-
-		Convey("Skips flags and returns the file argument", func() {
-			os.Args = []string{"mermaid-editor", "--mcp", "diagram.mmd"}
-			So(fileArg(), ShouldEqual, "diagram.mmd")
-		})
-
-		Convey("Returns empty when only flags are present", func() {
-			os.Args = []string{"mermaid-editor", "--mcp"}
-			So(fileArg(), ShouldEqual, "")
-		})
-	})
-}
-
 func TestPushDiagram(t *testing.T) {
 	Convey("Given a running editor server", t, func() {
 		ds := NewDiagramState("old content")
@@ -220,7 +212,7 @@ func TestPushDiagram(t *testing.T) {
 		t.Cleanup(srv.Close)
 
 		Convey("pushDiagram updates the diagram content", func() {
-			pushDiagram(srv.URL, "graph TD; A-->B")
+			pushDiagram(newHTTPClient(srv.URL, ""), "graph TD; A-->B")
 
 			content, version := ds.Get()
 			So(content, ShouldEqual, "graph TD; A-->B")
@@ -256,6 +248,17 @@ func TestStateFiles(t *testing.T) {
 			So(os.IsNotExist(err), ShouldBeTrue)
 		})
 
+		Convey("clearState leaves state files another instance took over", func() {
+			writeState(1234)
+			os.WriteFile(pidFile(), []byte("99999999"), 0644)
+			clearState()
+
+			_, err := os.Stat(portFile())
+			So(err, ShouldBeNil)
+			_, err = os.Stat(tokenFile())
+			So(err, ShouldBeNil)
+		})
+
 		Convey("checkExisting returns empty string when no state files exist", func() {
 			So(checkExisting(), ShouldEqual, "")
 		})
@@ -268,6 +271,13 @@ func TestStateFiles(t *testing.T) {
 			So(checkExisting(), ShouldEqual, "")
 		})
 
+		Convey("checkExisting returns the fixed URL of an installed service", func() {
+			os.MkdirAll(tmp, 0755)
+			os.WriteFile(serviceFile(), []byte("4700"), 0644)
+
+			So(checkExisting(), ShouldEqual, "http://127.0.0.1:4700")
+		})
+
 		Convey("checkExisting returns the URL for an active process", func() {
 			os.MkdirAll(tmp, 0755)
 			os.WriteFile(pidFile(), []byte(strconv.Itoa(os.Getpid())), 0644)
@@ -277,3 +287,46 @@ func TestStateFiles(t *testing.T) {
 		})
 	})
 }
+
+func TestShutdown(t *testing.T) {
+	Convey("Given a running API server", t, func() {
+		useTestStateDir(t)
+		Reset(func() {
+			server, diagram, store = nil, nil, nil
+			apiToken = ""
+			apiHosts = map[string]bool{}
+		})
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		port := listener.Addr().(*net.TCPAddr).Port
+		writeState(port)
+		diagram = NewDiagramState("graph TD")
+		startStore()
+		ready := make(chan struct{})
+		close(ready)
+		serveAPI(listener, nil, newMCPServer(nil, ready))
+
+		c := newHTTPClient(fmt.Sprintf("http://127.0.0.1:%d", port), apiToken)
+		resp, err := c.do(context.Background(), "GET", "/api/events", nil)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+		Convey("shutdown ends SSE streams, saves the document and clears state", func() {
+			diagram.Set("graph LR", "api")
+
+			start := time.Now()
+			shutdown()
+			So(time.Since(start), ShouldBeLessThan, shutdownTimeout)
+
+			data, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEndWith, "event: shutdown\ndata: {}\n\n")
+
+			So(loadDocument(documentFile()), ShouldEqual, "graph LR")
+			_, err = os.Stat(pidFile())
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
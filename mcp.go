@@ -2,26 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io/fs"
+	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
-// isMCPMode checks if --mcp was passed on the command line.
-func isMCPMode() bool {
-	for _, arg := range os.Args[1:] {
-		if arg == "--mcp" {
-			return true
-		}
-	}
-	return false
-}
-
 // MCP tool input/output types
 
 type GetDiagramInput struct{}
@@ -32,84 +24,775 @@ type GetDiagramOutput struct {
 }
 
 type SetDiagramInput struct {
-	Content string `json:"content" jsonschema:"the complete Mermaid diagram text"`
+	Content     string `json:"content" jsonschema:"the complete Mermaid diagram text"`
+	BaseVersion int64  `json:"base_version,omitempty" jsonschema:"the version from get_diagram that content was edited from; edits made since, e.g. by the user, are merged in instead of overwritten"`
+	Sanitize    *bool  `json:"sanitize,omitempty" jsonschema:"fix common mistakes first: a code fence around the diagram, curly quotes, a misspelled diagram type or direction, labels with quotes or brackets, and end as an id; defaults to the user's preference"`
 }
 
 type SetDiagramOutput struct {
-	Success bool  `json:"success" jsonschema:"whether the update succeeded"`
-	Version int64 `json:"version" jsonschema:"the new version number"`
+	Success   bool            `json:"success" jsonschema:"whether the update succeeded"`
+	Version   int64           `json:"version" jsonschema:"the new version number, or the current one if the update conflicted"`
+	Merged    bool            `json:"merged,omitempty" jsonschema:"whether edits made since base_version were merged in"`
+	Conflicts []MergeConflict `json:"conflicts,omitempty" jsonschema:"where content conflicts with edits made since base_version; nothing was changed"`
+	Content   string          `json:"content,omitempty" jsonschema:"on conflict, the merge with <<<<<<< current / ======= / >>>>>>> proposed markers; resolve them and set_diagram again with version as base_version"`
+	Lint      []LintIssue     `json:"lint,omitempty" jsonschema:"problems the linter found in the diagram as set; fix errors, and consider warnings"`
+	Fixes     []SanitizeFix   `json:"fixes,omitempty" jsonschema:"the mistakes fixed in content before it was set; avoid them next time"`
 }
 
-// runMCP starts the HTTP server and the MCP stdio server.
-// The HTTP server serves the editor UI and diagram API.
-// The MCP server exposes tools for reading/writing the diagram via stdio.
-func runMCP() {
-	staticFS, err := fs.Sub(staticFiles, "static")
-	if err != nil {
-		log.Fatal(err)
-	}
+type GetLeaseInput struct{}
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		log.Fatal(err)
-	}
-	port := listener.Addr().(*net.TCPAddr).Port
-	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+type GetLeaseOutput struct {
+	Held             bool   `json:"held" jsonschema:"whether the user holds the edit lease, blocking set_diagram"`
+	Owner            string `json:"owner,omitempty" jsonschema:"who holds the lease"`
+	Expires          string `json:"expires,omitempty" jsonschema:"when the lease expires unless renewed, in RFC 3339"`
+	RemainingSeconds int    `json:"remaining_seconds,omitempty" jsonschema:"seconds until the lease expires unless renewed"`
+}
 
-	serverURL = url
-	writeState(port)
-	defer clearState()
+type GetBlameInput struct{}
 
-	diagram = NewDiagramState("")
+type GetBlameOutput struct {
+	Version int64        `json:"version" jsonschema:"the version the attribution is for"`
+	Lines   []BlameRange `json:"lines" jsonschema:"runs of lines, numbered from 1, with the source (browser for the user's own edits, mcp for agents), client and version that last changed them"`
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /api/diagram", diagram.handleGetDiagram)
-	mux.HandleFunc("PUT /api/diagram", diagram.handleSetDiagram)
-	mux.HandleFunc("GET /api/events", diagram.handleDiagramSSE)
-	mux.HandleFunc("POST /api/download", handleDownload)
-	mux.Handle("/", http.FileServer(http.FS(staticFS)))
+type GetOutlineInput struct {
+	ID string `json:"id,omitempty" jsonschema:"only the items with this id, e.g. a node id; leave it out for the whole outline"`
+}
 
-	server = &http.Server{Handler: mux}
+type GetOutlineOutput struct {
+	Version int64         `json:"version" jsonschema:"the version the outline is of"`
+	Kind    string        `json:"kind" jsonschema:"the kind of diagram, e.g. flowchart or sequence"`
+	Items   []OutlineItem `json:"items" jsonschema:"the subgraphs, nodes, edges, participants, messages and notes in text order, each with its id and its span (lines and columns from 1) where it is defined; nodes and participants list every mention in refs"`
+}
 
-	fmt.Fprintf(os.Stderr, "MermAId Editor running at %s\n", url)
+type GetDiagramGraphInput struct{}
 
-	go func() {
-		if err := server.Serve(listener); err != http.ErrServerClosed {
-			log.Fatal(err)
+type GetDiagramGraphOutput struct {
+	Version int64 `json:"version" jsonschema:"the version the graph is of"`
+	Graph   Graph `json:"graph" jsonschema:"the diagram as data: kind and direction, then nodes, edges, subgraphs and class_defs for flowcharts and similar diagrams, or participants, messages and notes for sequence diagrams"`
+}
+
+type FormatDiagramInput struct {
+	Content string `json:"content,omitempty" jsonschema:"a diagram to format and return; leave it out to format the diagram in the editor"`
+}
+
+type FormatDiagramOutput struct {
+	Content string `json:"content" jsonschema:"the formatted diagram"`
+	Changed bool   `json:"changed" jsonschema:"whether formatting changed anything"`
+	Version int64  `json:"version,omitempty" jsonschema:"when formatting the diagram in the editor, its version after formatting"`
+}
+
+type LintDiagramInput struct {
+	Content string `json:"content,omitempty" jsonschema:"a diagram to lint; leave it out to lint the diagram in the editor"`
+}
+
+type LintDiagramOutput struct {
+	Issues   []LintIssue `json:"issues" jsonschema:"the problems found, each with its rule, severity (error, warning or info), message and span"`
+	Errors   int         `json:"errors" jsonschema:"how many issues are errors, which keep the diagram from rendering as intended"`
+	Warnings int         `json:"warnings" jsonschema:"how many issues are warnings"`
+}
+
+type DiffDiagramsInput struct {
+	FromVersion int64  `json:"from_version,omitempty" jsonschema:"the older version to compare; defaults to the one before to_version"`
+	ToVersion   int64  `json:"to_version,omitempty" jsonschema:"the newer version to compare; defaults to the current version"`
+	FromText    string `json:"from_text,omitempty" jsonschema:"an older diagram text to compare instead of a version"`
+	ToText      string `json:"to_text,omitempty" jsonschema:"a newer diagram text to compare instead of a version; defaults to the current diagram when from_text is given"`
+}
+
+type AddNodeInput struct {
+	ID       string `json:"id" jsonschema:"the id of the new node"`
+	Label    string `json:"label,omitempty" jsonschema:"the text shown on the node; defaults to its id"`
+	Shape    string `json:"shape,omitempty" jsonschema:"rect (the default), round, stadium, subroutine, cylinder, circle, double-circle, rhombus, hexagon, parallelogram, parallelogram-alt, trapezoid, trapezoid-alt or asymmetric"`
+	Subgraph string `json:"subgraph,omitempty" jsonschema:"the id of a subgraph to add it to"`
+}
+
+type RemoveNodeInput struct {
+	ID string `json:"id" jsonschema:"the id of the node to remove"`
+}
+
+type RenameNodeIDInput struct {
+	ID    string `json:"id" jsonschema:"the node's id"`
+	NewID string `json:"new_id" jsonschema:"the id to give it"`
+}
+
+type SetLabelInput struct {
+	ID    string `json:"id" jsonschema:"a node id, a subgraph id, or an edge id as get_outline gives it, e.g. A --> B"`
+	Label string `json:"label" jsonschema:"the new text; quotes are added where needed. Empty shows a node by its id, or takes the text off an edge"`
+	Shape string `json:"shape,omitempty" jsonschema:"for a node, a new shape such as round or rhombus; defaults to its current one"`
+}
+
+type AddEdgeInput struct {
+	From  string `json:"from" jsonschema:"the id of the node the edge starts at; a new id adds a node"`
+	To    string `json:"to" jsonschema:"the id of the node the edge ends at; a new id adds a node"`
+	Label string `json:"label,omitempty" jsonschema:"text on the edge"`
+	Arrow string `json:"arrow,omitempty" jsonschema:"the link, such as --> (the default), ---, -.->, ==> or ~~~"`
+}
+
+type RemoveEdgeInput struct {
+	From string `json:"from" jsonschema:"the id of the node the edges start at"`
+	To   string `json:"to" jsonschema:"the id of the node the edges end at"`
+}
+
+type MoveToSubgraphInput struct {
+	ID       string `json:"id" jsonschema:"the id of the node to move"`
+	Subgraph string `json:"subgraph,omitempty" jsonschema:"the id of the subgraph to move it to; leave it out to move it out of any"`
+}
+
+type SetDirectionInput struct {
+	Direction string `json:"direction" jsonschema:"TB, TD, BT, RL or LR"`
+	Subgraph  string `json:"subgraph,omitempty" jsonschema:"the id of a subgraph to set the direction of, rather than the whole flowchart"`
+}
+
+type AddParticipantInput struct {
+	ID     string `json:"id" jsonschema:"the participant's id, used in messages"`
+	Label  string `json:"label,omitempty" jsonschema:"the name shown instead of the id, written as participant id as label"`
+	Kind   string `json:"kind,omitempty" jsonschema:"participant (the default) or actor"`
+	Before string `json:"before,omitempty" jsonschema:"the id of a participant to place it before; by default it goes after the others"`
+}
+
+type InsertMessageInput struct {
+	AfterIndex int    `json:"after_index" jsonschema:"the number of the message, from list_messages, to put it after, inside the same block; 0 puts it first"`
+	From       string `json:"from" jsonschema:"the participant sending it"`
+	To         string `json:"to" jsonschema:"the participant receiving it"`
+	Arrow      string `json:"arrow,omitempty" jsonschema:"->> (the default), -->>, ->, -->, -x, --x, -) or --)"`
+	Text       string `json:"text" jsonschema:"the message text"`
+}
+
+type WrapInBlockInput struct {
+	Kind  string `json:"kind" jsonschema:"loop, alt, opt, par, critical, break or rect"`
+	Label string `json:"label,omitempty" jsonschema:"the block's condition or title, or for rect its color"`
+	From  int    `json:"from" jsonschema:"the number of the first message to wrap, from list_messages"`
+	To    int    `json:"to" jsonschema:"the number of the last message to wrap; it must be in the same block as the first"`
+}
+
+type AddNoteInput struct {
+	Position     string   `json:"position" jsonschema:"left of, right of or over"`
+	Participants []string `json:"participants" jsonschema:"the participant the note is beside, or one or two it is over"`
+	Text         string   `json:"text" jsonschema:"the note text"`
+	AfterIndex   *int     `json:"after_index,omitempty" jsonschema:"the number of the message to put it after; 0 puts it first, and leaving it out puts it at the end"`
+}
+
+type RemoveMessageInput struct {
+	Index int `json:"index" jsonschema:"the number of the message to remove, from list_messages"`
+}
+
+type ListMessagesInput struct{}
+
+type ListMessagesOutput struct {
+	Version  int64         `json:"version" jsonschema:"the version the list is of"`
+	Messages []MessageItem `json:"messages" jsonschema:"the messages numbered from 1 in order, with the line each is on and the blocks, such as loop or alt, it is in"`
+}
+
+type EditDiagramOutput struct {
+	Version int64       `json:"version" jsonschema:"the version after the edit"`
+	Lint    []LintIssue `json:"lint,omitempty" jsonschema:"problems the linter found in the diagram as edited"`
+}
+
+type ListClientsInput struct{}
+
+type ListClientsOutput struct {
+	Clients          []ClientInfo `json:"clients" jsonschema:"the connected clients: browser tabs, MCP sessions and CLI watchers"`
+	BrowserConnected bool         `json:"browser_connected" jsonschema:"whether a browser tab is showing the diagram"`
+}
+
+// newMCPServer creates the MCP server with tools that directly access the
+// diagram state. Tool handlers wait for ready, which is closed once the
+// instance's scope is known and diagram is loaded.
+func newMCPServer(opts *mcp.ServerOptions, ready <-chan struct{}) *mcp.Server {
+	var o mcp.ServerOptions
+	if opts != nil {
+		o = *opts
+	}
+	initialized := o.InitializedHandler
+	o.InitializedHandler = func(ctx context.Context, req *mcp.InitializedRequest) {
+		if initialized != nil {
+			initialized(ctx, req)
 		}
-	}()
-	defer func() {
-		server.Close()
-		fmt.Fprintln(os.Stderr, "Stopped.")
-	}()
+		go trackMCPSession(req.Session, ready)
+	}
+	opts = &o
 
-	// Create MCP server with tools that directly access diagram state
 	s := mcp.NewServer(
 		&mcp.Implementation{
 			Name:    "mermaid-editor",
 			Version: version,
 		},
-		nil,
+		opts,
 	)
 
 	mcp.AddTool(s, &mcp.Tool{
 		Name:        "get_diagram",
 		Description: "Get the current Mermaid diagram text from the editor",
 	}, func(ctx context.Context, req *mcp.CallToolRequest, input GetDiagramInput) (*mcp.CallToolResult, GetDiagramOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
 		content, version := diagram.Get()
 		return nil, GetDiagramOutput{Content: content, Version: version}, nil
 	})
 
 	mcp.AddTool(s, &mcp.Tool{
 		Name:        "set_diagram",
-		Description: "Replace the entire Mermaid diagram in the editor. The change appears live in the browser.",
+		Description: "Replace the entire Mermaid diagram in the editor. The change appears live in the browser. Pass the version you read as base_version so that edits the user made meanwhile are merged rather than lost.",
 	}, func(ctx context.Context, req *mcp.CallToolRequest, input SetDiagramInput) (*mcp.CallToolResult, SetDiagramOutput, error) {
-		version := diagram.Set(input.Content, "mcp")
-		return nil, SetDiagramOutput{Success: true, Version: version}, nil
+		<-ready
+		content, fixes := sanitizeWrite(input.Content, input.Sanitize)
+		version, merged, err := diagram.SetFrom(input.BaseVersion, content, "mcp", mcpClientID(req.Session), "")
+		var conflict *ConflictError
+		var locked *LeaseError
+		switch {
+		case errors.As(err, &locked):
+			return nil, SetDiagramOutput{}, fmt.Errorf("%w; call get_lease to see when it expires, or offer the change to the user instead", err)
+		case errors.As(err, &conflict):
+			return &mcp.CallToolResult{IsError: true}, SetDiagramOutput{
+				Version:   conflict.Version,
+				Conflicts: conflict.Conflicts,
+				Content:   conflict.Merged,
+			}, nil
+		case errors.Is(err, errVersionConflict):
+			return nil, SetDiagramOutput{}, fmt.Errorf("base_version %d is too old to merge with; get_diagram and try again", input.BaseVersion)
+		case err != nil:
+			return nil, SetDiagramOutput{}, err
+		}
+		if merged {
+			// Lint what was committed, not what someone wrote since.
+			if committed, err := diagram.At(version); err == nil {
+				content = committed
+			}
+		}
+		return nil, SetDiagramOutput{
+			Success: true,
+			Version: version,
+			Merged:  merged,
+			Lint:    LintDiagram(content, projectLintConfig()),
+			Fixes:   fixes,
+		}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "get_lease",
+		Description: "Check whether the user holds the edit lease. While they do, set_diagram is rejected so as not to disturb a careful manual edit.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input GetLeaseInput) (*mcp.CallToolResult, GetLeaseOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		lease, ok := diagram.Lease()
+		if !ok {
+			return nil, GetLeaseOutput{}, nil
+		}
+		return nil, GetLeaseOutput{
+			Held:             true,
+			Owner:            lease.Owner,
+			Expires:          lease.Expires.Format(time.RFC3339),
+			RemainingSeconds: int(time.Until(lease.Expires).Seconds()),
+		}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "get_blame",
+		Description: "Find out who last changed each line of the diagram. Lines with source browser were edited by hand by the user; keep their changes in mind before rewriting them.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input GetBlameInput) (*mcp.CallToolResult, GetBlameOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		lines, version := diagram.Blame()
+		return nil, GetBlameOutput{Version: version, Lines: lines}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "get_outline",
+		Description: "Get the structure of the diagram with where each part is in the text: subgraphs, nodes and edges, or participants, messages and notes. Use it to find where a node is defined or mentioned before making a precise edit.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input GetOutlineInput) (*mcp.CallToolResult, GetOutlineOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		content, version := diagram.Get()
+		d := ParseDiagram(content)
+		return nil, GetOutlineOutput{Version: version, Kind: d.Kind, Items: outlineMatching(Outline(d), input.ID)}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "get_diagram_graph",
+		Description: "Get the diagram as a graph: its nodes, edges and subgraphs with their labels, shapes, arrows and styles, or its participants, messages and notes. Use it to reason about what the diagram says without parsing Mermaid. State, class and ER diagram graphs are read-only (marked read_only): only flowchart and sequence graphs can be written back with PUT /api/diagram/graph.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input GetDiagramGraphInput) (*mcp.CallToolResult, GetDiagramGraphOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		content, version := diagram.Get()
+		return nil, GetDiagramGraphOutput{Version: version, Graph: DiagramGraph(ParseDiagram(content))}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "add_node",
+		Description: "Add a node to the flowchart in the editor, optionally inside a subgraph. The rest of the text is left as it is.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input AddNodeInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return AddNode(src, input.ID, input.Label, input.Shape, input.Subgraph)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "remove_node",
+		Description: "Remove a node from the flowchart in the editor, with its edges and the style, class and click statements naming it. Other nodes on the same lines are kept.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input RemoveNodeInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return RemoveNode(src, input.ID)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "rename_node_id",
+		Description: "Rename a node's id everywhere it is named in the flowchart in the editor, including style and class statements. A node shown by its id keeps showing the old one as its label.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input RenameNodeIDInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return RenameNodeID(src, input.ID, input.NewID)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "set_label",
+		Description: "Change the text of a node, edge or subgraph in the flowchart in the editor, and optionally a node's shape. Labels are quoted where needed.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input SetLabelInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return SetLabel(src, input.ID, input.Label, input.Shape)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "add_edge",
+		Description: "Link two nodes in the flowchart in the editor, adding either if it doesn't exist yet. The link goes at the end of the diagram.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input AddEdgeInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return AddEdge(src, input.From, input.To, input.Label, input.Arrow)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "remove_edge",
+		Description: "Remove the edges from one node to another in the flowchart in the editor. The nodes are kept, and linkStyle indexes renumbered.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input RemoveEdgeInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return RemoveEdge(src, input.From, input.To)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "move_to_subgraph",
+		Description: "Move a node into a subgraph of the flowchart in the editor, or out of any. Fails if the node is linked inside the subgraph it is in; move those links first.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input MoveToSubgraphInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return MoveToSubgraph(src, input.ID, input.Subgraph)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "set_direction",
+		Description: "Set the direction the flowchart in the editor, or one of its subgraphs, runs in.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input SetDirectionInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return SetDirection(src, input.Direction, input.Subgraph)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_messages",
+		Description: "List the messages of the sequence diagram in the editor, numbered from 1, with the blocks each is in. Use the numbers with insert_message, wrap_in_block, add_note and remove_message.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input ListMessagesInput) (*mcp.CallToolResult, ListMessagesOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		content, version := diagram.Get()
+		d := ParseDiagram(content)
+		if d.Kind != kindSequence {
+			return nil, ListMessagesOutput{}, errors.New("the diagram isn't a sequence diagram")
+		}
+		return nil, ListMessagesOutput{Version: version, Messages: ListMessages(d)}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "add_participant",
+		Description: "Declare a participant or actor in the sequence diagram in the editor, with the name shown for it, before a given participant or after the others. Participants are drawn in the order they are first named.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input AddParticipantInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return AddParticipant(src, input.ID, input.Label, input.Kind, input.Before)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "insert_message",
+		Description: "Insert a message into the sequence diagram in the editor after the message numbered after_index, inside the same block. The rest of the text is left as it is.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input InsertMessageInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return InsertMessage(src, input.AfterIndex, input.From, input.To, input.Arrow, input.Text)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "wrap_in_block",
+		Description: "Wrap a run of messages in the sequence diagram in the editor, from and to by number, in a loop, alt, opt, par, critical, break or rect block, indenting them.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input WrapInBlockInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return WrapInBlock(src, input.Kind, input.Label, input.From, input.To)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "add_note",
+		Description: "Add a note beside or over participants in the sequence diagram in the editor, after a given message or at the end.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input AddNoteInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		after := -1
+		if input.AfterIndex != nil {
+			after = *input.AfterIndex
+		}
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return AddNote(src, input.Position, input.Participants, input.Text, after)
+		})
+		return nil, out, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "remove_message",
+		Description: "Remove a message from the sequence diagram in the editor by its number from list_messages. The messages after it are renumbered.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input RemoveMessageInput) (*mcp.CallToolResult, EditDiagramOutput, error) {
+		<-ready
+		out, err := editDiagram(mcpClientID(req.Session), func(src string) (string, error) {
+			return RemoveMessage(src, input.Index)
+		})
+		return nil, out, err
 	})
 
-	if err := s.Run(context.Background(), &mcp.StdioTransport{}); err != nil {
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "format_diagram",
+		Description: "Format a Mermaid diagram canonically: one statement per line, indented by nesting, with consistent arrow spacing and blank lines. Without content, formats the diagram in the editor. Fails on syntax errors, naming the first.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input FormatDiagramInput) (*mcp.CallToolResult, FormatDiagramOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		if input.Content != "" {
+			formatted, err := FormatDiagram(input.Content)
+			if err != nil {
+				return nil, FormatDiagramOutput{}, err
+			}
+			return nil, FormatDiagramOutput{Content: formatted, Changed: formatted != input.Content}, nil
+		}
+		content, version := diagram.Get()
+		formatted, err := FormatDiagram(content)
+		if err != nil {
+			return nil, FormatDiagramOutput{}, err
+		}
+		if formatted == content {
+			return nil, FormatDiagramOutput{Content: content, Version: version}, nil
+		}
+		version, _, err = diagram.SetFrom(version, formatted, "mcp", mcpClientID(req.Session), "")
+		var locked *LeaseError
+		switch {
+		case errors.As(err, &locked):
+			return nil, FormatDiagramOutput{}, fmt.Errorf("%w; call get_lease to see when it expires", err)
+		case err != nil:
+			return nil, FormatDiagramOutput{}, fmt.Errorf("the diagram changed while formatting; try again: %w", err)
+		}
+		content, version = diagram.Get()
+		return nil, FormatDiagramOutput{Content: content, Changed: true, Version: version}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "lint_diagram",
+		Description: "Check a Mermaid diagram for syntax errors and likely mistakes: end used as an id, unquoted labels with parentheses, one id given different labels, unconnected nodes, unreachable states, unused classDefs and over-long labels. Without content, checks the diagram in the editor. Rules and severities follow the project's .mermaid-lint.json.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input LintDiagramInput) (*mcp.CallToolResult, LintDiagramOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		content := input.Content
+		if content == "" {
+			content, _ = diagram.Get()
+		}
+		issues := LintDiagram(content, projectLintConfig())
+		errors, warnings := lintCounts(issues)
+		return nil, LintDiagramOutput{Issues: issues, Errors: errors, Warnings: warnings}, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "diff_diagrams",
+		Description: "Compare two versions of the diagram, or two diagram texts, by meaning rather than by line: nodes, edges, participants, messages and classes added, removed or relabeled, and style changes. Use it to see what the user changed since you last looked. The diagram field is a renderable diagram with the changes highlighted.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input DiffDiagramsInput) (*mcp.CallToolResult, *DiagramDiff, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		if input.FromText == "" && input.ToText == "" {
+			diff, err := diagram.Diff(input.FromVersion, input.ToVersion)
+			return nil, diff, err
+		}
+		to := input.ToText
+		if to == "" {
+			to, _ = diagram.Get()
+		}
+		diff, err := diffDiagrams(input.FromText, to)
+		return nil, diff, err
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_clients",
+		Description: "List who is connected to the editor: browser tabs, agents and CLI watchers, with when each was last active. Check browser_connected before asking the user to look at the diagram.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input ListClientsInput) (*mcp.CallToolResult, ListClientsOutput, error) {
+		<-ready
+		diagram.clients.touch(mcpClientID(req.Session))
+		out := ListClientsOutput{Clients: diagram.Clients()}
+		for _, c := range out.Clients {
+			if c.Kind == clientBrowser {
+				out.BrowserConnected = true
+			}
+		}
+		return nil, out, nil
+	})
+
+	return s
+}
+
+// editDiagram makes an edit to the diagram in the editor and sets the
+// result, merging in any edits made meanwhile.
+func editDiagram(client string, edit func(src string) (string, error)) (EditDiagramOutput, error) {
+	diagram.clients.touch(client)
+	content, version := diagram.Get()
+	edited, err := edit(content)
+	if err != nil {
+		return EditDiagramOutput{}, err
+	}
+	if edited != content {
+		version, _, err = diagram.SetFrom(version, edited, "mcp", client, "")
+		var locked *LeaseError
+		switch {
+		case errors.As(err, &locked):
+			return EditDiagramOutput{}, fmt.Errorf("%w; call get_lease to see when it expires, or offer the change to the user instead", err)
+		case err != nil:
+			return EditDiagramOutput{}, fmt.Errorf("the diagram changed while editing; try again: %w", err)
+		}
+		content, _ = diagram.Get()
+	}
+	return EditDiagramOutput{Version: version, Lint: LintDiagram(content, projectLintConfig())}, nil
+}
+
+// mcpClientID returns the client id of an MCP session.
+func mcpClientID(ss *mcp.ServerSession) string {
+	if id := ss.ID(); id != "" {
+		return "mcp-" + id
+	}
+	return "mcp-stdio"
+}
+
+// trackMCPSession lists an MCP session as a connected client, named after
+// the agent, until the session ends.
+func trackMCPSession(ss *mcp.ServerSession, ready <-chan struct{}) {
+	<-ready
+	name := ""
+	if p := ss.InitializeParams(); p != nil && p.ClientInfo != nil {
+		name = p.ClientInfo.Title
+		if name == "" {
+			name = p.ClientInfo.Name
+		}
+	}
+	id, d := mcpClientID(ss), diagram
+	d.Connect(id, clientMCP, name)
+	ss.Wait()
+	d.Disconnect(id)
+}
+
+// runMCP starts the HTTP server and the MCP stdio server.
+// The HTTP server serves the editor UI and diagram API.
+// The MCP server exposes tools for reading/writing the diagram via stdio.
+//
+// If an instance is already running in the same scope, runMCP instead proxies
+// the stdio session to that instance so the agent and the user share one
+// editor.
+//
+// With --workspace=roots the instance is scoped to the client's first root,
+// which is only known after the MCP handshake, so the HTTP side starts from
+// the initialized notification instead of up front, and a session for a
+// workspace that already has an instance is handed off to it then.
+func runMCP() {
+	arg := cfg.Workspace
+	if arg != workspaceRoots {
+		root, err := resolveWorkspace(arg)
+		if err != nil {
+			log.Fatalf("Invalid workspace: %v", err)
+		}
+		setWorkspaceRoot(root)
+		if c := existingClient(); c != nil {
+			fmt.Fprintf(os.Stderr, "Using running MermAId Editor at %s\n", c.URL)
+			if err := proxyMCP(c); err != nil {
+				fmt.Fprintf(os.Stderr, "MCP proxy error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	listener, url, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	serverURL = url
+	defer shutdown()
+
+	var s *mcp.Server
+	ready := make(chan struct{})
+	var startOnce sync.Once
+	start := func(root string) {
+		startOnce.Do(func() {
+			setWorkspaceRoot(root)
+			writeState(port)
+			diagram = NewDiagramState(loadDocument(documentFile()))
+			startStore()
+			serveAPI(listener, nil, s)
+			startIdleWatch()
+
+			if root != "" {
+				fmt.Fprintf(os.Stderr, "MermAId Editor running at %s (workspace %s)\n", url, root)
+			} else {
+				fmt.Fprintf(os.Stderr, "MermAId Editor running at %s\n", url)
+			}
+			close(ready)
+		})
+	}
+	opts := &mcp.ServerOptions{}
+	var transport mcp.Transport = &mcp.StdioTransport{}
+	if arg == workspaceRoots {
+		handoff := &handoffTransport{}
+		transport = handoff
+		opts.InitializedHandler = func(ctx context.Context, req *mcp.InitializedRequest) {
+			// Asking the client for its roots from inside the notification
+			// handler would block the session's read loop.
+			go func() {
+				root := clientWorkspace(req.Session)
+				setWorkspaceRoot(root)
+				if c := existingClient(); c != nil {
+					err := relayMCP(handoff.conn, c)
+					if err == nil {
+						listener.Close()
+						fmt.Fprintf(os.Stderr, "Using running MermAId Editor at %s\n", c.URL)
+						return
+					}
+					fmt.Fprintf(os.Stderr, "Can't use running MermAId Editor at %s: %v\n", c.URL, err)
+				}
+				handoff.conn.serveLocal()
+				start(root)
+			}()
+		}
+	}
+	s = newMCPServer(opts, ready)
+	if arg != workspaceRoots {
+		start(workspaceRoot())
+	}
+
+	// The session ends when the agent disconnects or the editor is asked to
+	// quit; either way the deferred shutdown runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-quitRequested
+		cancel()
+	}()
+	if err := s.Run(ctx, transport); err != nil && ctx.Err() == nil {
 		fmt.Fprintf(os.Stderr, "MCP server error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// proxyMCP relays the stdio MCP session to the /mcp endpoint of a running
+// instance until either side disconnects.
+func proxyMCP(c *Client) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, err := (&mcp.StdioTransport{}).Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	remote, err := remoteMCP(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	errc := make(chan error, 2)
+	relay := func(from, to mcp.Connection) {
+		for {
+			msg, err := from.Read(ctx)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if err := to.Write(ctx, msg); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	go relay(local, remote)
+	go relay(remote, local)
+
+	if err := <-errc; err != io.EOF && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// remoteMCP connects to the /mcp endpoint of a running instance.
+func remoteMCP(ctx context.Context, c *Client) (mcp.Connection, error) {
+	return (&mcp.StreamableClientTransport{
+		Endpoint:   c.base + "/mcp",
+		HTTPClient: c.http,
+	}).Connect(ctx)
+}
+
+// relayMCP hands a roots-mode session off to a running instance.
+func relayMCP(conn *handoffConn, c *Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	remote, err := remoteMCP(context.Background(), c)
+	if err != nil {
+		return err
+	}
+	if err := conn.relay(ctx, remote); err != nil {
+		remote.Close()
+		return err
+	}
+	return nil
+}
+
+// clientWorkspace asks an MCP client for its roots and returns the workspace
+// they point at. Clients without roots support fall back to the git root of
+// the current directory, and failing that to the global instance.
+func clientWorkspace(ss *mcp.ServerSession) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if res, err := ss.ListRoots(ctx, nil); err == nil {
+		uris := make([]string, 0, len(res.Roots))
+		for _, r := range res.Roots {
+			uris = append(uris, r.URI)
+		}
+		if root := rootsWorkspace(uris); root != "" {
+			return root
+		}
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		return gitRoot(cwd)
+	}
+	return ""
+}
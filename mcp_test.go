@@ -1,38 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/modelcontextprotocol/go-sdk/mcp"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
-func TestMCPMode(t *testing.T) {
-	Convey("Given the --mcp flag parser", t, func() {
-		origArgs := os.Args
-		defer func() { os.Args = origArgs }()
-
-		Convey("It returns false without --mcp", func() {
-			os.Args = []string{"mermaid-editor"}
-			So(isMCPMode(), ShouldBeFalse)
-		})
-
-		Convey("It returns true with --mcp", func() {
-			os.Args = []string{"mermaid-editor", "--mcp"}
-			So(isMCPMode(), ShouldBeTrue)
-		})
-
-		Convey("It returns true with --mcp among other flags", func() {
-			os.Args = []string{"mermaid-editor", "--other", "--mcp", "--flag"}
-			So(isMCPMode(), ShouldBeTrue)
-		})
-	})
-}
-
 func TestMCPDiagramAccess(t *testing.T) {
 	Convey("Given a DiagramState served over HTTP", t, func() {
 		ds := NewDiagramState("sequenceDiagram\n  Alice->>Bob: Hi")
@@ -108,3 +89,371 @@ func TestMCPDiagramAccess(t *testing.T) {
 		})
 	})
 }
+
+func TestMCPClients(t *testing.T) {
+	Convey("Given an agent connected to the MCP server", t, func() {
+		diagram = NewDiagramState("graph TD")
+		diagram.Connect("tab-1", clientBrowser, "")
+
+		ready := make(chan struct{})
+		close(ready)
+		st, ct := mcp.NewInMemoryTransports()
+		ss, err := newMCPServer(nil, ready).Connect(context.Background(), st, nil)
+		So(err, ShouldBeNil)
+		cs, err := mcp.NewClient(&mcp.Implementation{Name: "claude-code", Title: "Claude"}, nil).Connect(context.Background(), ct, nil)
+		So(err, ShouldBeNil)
+
+		listed := func() []ClientInfo {
+			var clients []ClientInfo
+			for range 100 {
+				if clients = diagram.Clients(); len(clients) == 2 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return clients
+		}
+
+		// trackMCPSession reads diagram once the session is up; it must have
+		// listed the session before the next test replaces diagram.
+		So(listed(), ShouldHaveLength, 2)
+		Reset(func() {
+			cs.Close()
+			ss.Wait()
+			diagram = nil
+		})
+
+		Convey("The session is listed as a client named after the agent", func() {
+			clients := listed()
+			So(clients, ShouldHaveLength, 2)
+			So(clients[1].Kind, ShouldEqual, "mcp")
+			So(clients[1].Name, ShouldEqual, "Claude")
+
+			cs.Close()
+			ss.Wait()
+			for range 100 {
+				if len(diagram.Clients()) == 1 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(diagram.Clients(), ShouldHaveLength, 1)
+		})
+
+		Convey("list_clients reports whether a browser is connected", func() {
+			defer cs.Close()
+			listed()
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{Name: "list_clients"})
+			So(err, ShouldBeNil)
+			So(res.IsError, ShouldBeFalse)
+
+			var out ListClientsOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(out.BrowserConnected, ShouldBeTrue)
+			So(out.Clients, ShouldHaveLength, 2)
+		})
+
+		Convey("set_diagram with an old base_version merges the user's edits", func() {
+			defer cs.Close()
+			diagram.Set("graph TD\n  A-->B", "browser")
+			diagram.Set("graph TD\n  A-->B\n  B-->C", "browser")
+			call := func(content string) (*mcp.CallToolResult, SetDiagramOutput) {
+				res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+					Name:      "set_diagram",
+					Arguments: map[string]any{"content": content, "base_version": 2},
+				})
+				So(err, ShouldBeNil)
+				var out SetDiagramOutput
+				data, _ := json.Marshal(res.StructuredContent)
+				So(json.Unmarshal(data, &out), ShouldBeNil)
+				return res, out
+			}
+
+			res, out := call("graph LR\n  A-->B")
+			So(res.IsError, ShouldBeFalse)
+			So(out.Merged, ShouldBeTrue)
+			content, _ := diagram.Get()
+			So(content, ShouldEqual, "graph LR\n  A-->B\n  B-->C")
+
+			res, out = call("graph TD\n  A-->X")
+			So(res.IsError, ShouldBeTrue)
+			So(out.Success, ShouldBeFalse)
+			So(out.Conflicts, ShouldHaveLength, 1)
+			So(out.Content, ShouldContainSubstring, "<<<<<<< current")
+			So(out.Version, ShouldEqual, 4)
+		})
+
+		Convey("set_diagram lints the diagram it merged, not just what it was sent", func() {
+			defer cs.Close()
+			diagram.Set("graph TD\n  A-->B", "browser")
+			diagram.Set("graph TD\n  A-->B\n  C", "browser")
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "set_diagram",
+				Arguments: map[string]any{"content": "graph LR\n  A-->B", "base_version": 2},
+			})
+			So(err, ShouldBeNil)
+			var out SetDiagramOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(out.Merged, ShouldBeTrue)
+			So(rules(out.Lint), ShouldResemble, []string{"unconnected-node"})
+		})
+
+		Convey("set_diagram with a base_version no longer in the history says it is too old", func() {
+			defer cs.Close()
+			for i := range historySize {
+				diagram.Set(fmt.Sprintf("graph TD\n  A%d", i), "browser")
+			}
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "set_diagram",
+				Arguments: map[string]any{"content": "graph LR", "base_version": 1},
+			})
+			So(err, ShouldBeNil)
+			So(res.IsError, ShouldBeTrue)
+			So(res.Content[0].(*mcp.TextContent).Text, ShouldContainSubstring, "base_version 1 is too old")
+		})
+
+		Convey("While the user holds the edit lease set_diagram is rejected", func() {
+			defer cs.Close()
+			diagram.AcquireLease("tab-1", "Ana", "", time.Minute)
+
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{Name: "get_lease"})
+			So(err, ShouldBeNil)
+			var lease GetLeaseOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &lease), ShouldBeNil)
+			So(lease.Held, ShouldBeTrue)
+			So(lease.Owner, ShouldEqual, "Ana")
+
+			res, err = cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "set_diagram",
+				Arguments: map[string]any{"content": "graph LR"},
+			})
+			So(err, ShouldBeNil)
+			So(res.IsError, ShouldBeTrue)
+			So(res.Content[0].(*mcp.TextContent).Text, ShouldContainSubstring, "Ana is editing the diagram")
+		})
+
+		Convey("get_blame tells the user's lines from the agent's", func() {
+			defer cs.Close()
+			_, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "set_diagram",
+				Arguments: map[string]any{"content": "graph TD\n  A-->B\n  B-->C"},
+			})
+			So(err, ShouldBeNil)
+			diagram.SetBy("graph TD\n  A-->X\n  B-->C", "browser", "tab-1")
+
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{Name: "get_blame"})
+			So(err, ShouldBeNil)
+			var out GetBlameOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(out.Lines, ShouldHaveLength, 3)
+			So(out.Lines[1].Source, ShouldEqual, "browser")
+			So(out.Lines[1].From, ShouldEqual, 2)
+			So(out.Lines[2].Source, ShouldEqual, "mcp")
+			So(out.Lines[2].Client, ShouldStartWith, "mcp-")
+		})
+
+		Convey("get_outline finds where a node is defined", func() {
+			defer cs.Close()
+			diagram.Set("graph TD\n  A --> B\n  B[Done]", "browser")
+
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "get_outline",
+				Arguments: map[string]any{"id": "B"},
+			})
+			So(err, ShouldBeNil)
+			var out GetOutlineOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(out.Kind, ShouldEqual, kindFlowchart)
+			So(out.Items, ShouldHaveLength, 1)
+			So(out.Items[0].Label, ShouldEqual, "Done")
+			So(out.Items[0].Span.Start.Line, ShouldEqual, 3)
+			So(out.Items[0].Refs, ShouldHaveLength, 2)
+		})
+
+		Convey("get_diagram_graph returns the diagram as a graph", func() {
+			defer cs.Close()
+			diagram.Set("graph LR\n  A[Start] -.->|maybe| B", "browser")
+
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{Name: "get_diagram_graph"})
+			So(err, ShouldBeNil)
+			var out GetDiagramGraphOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(out.Graph.Direction, ShouldEqual, "LR")
+			So(out.Graph.Nodes, ShouldHaveLength, 2)
+			So(out.Graph.Edges, ShouldHaveLength, 1)
+			So(out.Graph.Edges[0].Line, ShouldEqual, "dotted")
+			So(out.Graph.Edges[0].Label, ShouldEqual, "maybe")
+		})
+
+		Convey("The flowchart tools edit the diagram in place", func() {
+			defer cs.Close()
+			diagram.Set("graph TD\n  %% keep me\n  A --> B", "browser")
+
+			call := func(name string, args map[string]any) EditDiagramOutput {
+				res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{Name: name, Arguments: args})
+				So(err, ShouldBeNil)
+				So(res.IsError, ShouldBeFalse)
+				var out EditDiagramOutput
+				data, _ := json.Marshal(res.StructuredContent)
+				So(json.Unmarshal(data, &out), ShouldBeNil)
+				return out
+			}
+			call("add_node", map[string]any{"id": "C", "label": "Done"})
+			call("add_edge", map[string]any{"from": "B", "to": "C", "label": "ok"})
+			call("set_label", map[string]any{"id": "A", "label": "Start"})
+			out := call("remove_edge", map[string]any{"from": "A", "to": "B"})
+
+			content, version := diagram.Get()
+			So(out.Version, ShouldEqual, version)
+			So(content, ShouldEqual, "graph TD\n  %% keep me\n  A[Start]\n  C[Done]\n  B -->|ok| C")
+
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "remove_node",
+				Arguments: map[string]any{"id": "Z"},
+			})
+			So(err, ShouldBeNil)
+			So(res.IsError, ShouldBeTrue)
+			So(res.Content[0].(*mcp.TextContent).Text, ShouldContainSubstring, "no node Z")
+		})
+
+		Convey("The sequence tools refer to messages by number", func() {
+			defer cs.Close()
+			diagram.Set("sequenceDiagram\n  A->>B: hello\n  B-->>A: hi", "browser")
+
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "insert_message",
+				Arguments: map[string]any{"after_index": 1, "from": "A", "to": "B", "text": "how are you?"},
+			})
+			So(err, ShouldBeNil)
+			So(res.IsError, ShouldBeFalse)
+			res, err = cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "add_note",
+				Arguments: map[string]any{"position": "over", "participants": []string{"A", "B"}, "text": "small talk"},
+			})
+			So(err, ShouldBeNil)
+			So(res.IsError, ShouldBeFalse)
+
+			res, err = cs.CallTool(context.Background(), &mcp.CallToolParams{Name: "list_messages"})
+			So(err, ShouldBeNil)
+			var out ListMessagesOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(out.Messages, ShouldHaveLength, 3)
+			So(out.Messages[1].Text, ShouldEqual, "how are you?")
+			So(out.Messages[1].Line, ShouldEqual, 3)
+
+			content, _ := diagram.Get()
+			So(content, ShouldEqual, "sequenceDiagram\n  A->>B: hello\n  A->>B: how are you?\n  B-->>A: hi\n  Note over A,B: small talk")
+		})
+
+		Convey("set_diagram and lint_diagram report lint issues", func() {
+			defer cs.Close()
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "set_diagram",
+				Arguments: map[string]any{"content": "graph TD\n  A --> end"},
+			})
+			So(err, ShouldBeNil)
+			var set SetDiagramOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &set), ShouldBeNil)
+			So(set.Success, ShouldBeTrue)
+			So(rules(set.Lint), ShouldResemble, []string{"reserved-id"})
+
+			res, err = cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "lint_diagram",
+				Arguments: map[string]any{"content": "graph TD\n  A --> B\n  C"},
+			})
+			So(err, ShouldBeNil)
+			var out LintDiagramOutput
+			data, _ = json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(rules(out.Issues), ShouldResemble, []string{"unconnected-node"})
+			So(out.Errors, ShouldEqual, 0)
+			So(out.Warnings, ShouldEqual, 1)
+		})
+
+		Convey("set_diagram with sanitize reports the fixes it made", func() {
+			defer cs.Close()
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "set_diagram",
+				Arguments: map[string]any{"content": "```mermaid\ngraph td\n  A[f(x)] --> B\n```", "sanitize": true},
+			})
+			So(err, ShouldBeNil)
+			var set SetDiagramOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &set), ShouldBeNil)
+			So(set.Success, ShouldBeTrue)
+			So(fixRules(set.Fixes), ShouldResemble, []string{"code-fence", "direction", "label"})
+			So(set.Lint, ShouldBeEmpty)
+			content, _ := diagram.Get()
+			So(content, ShouldEqual, "graph TD\n  A[\"f(x)\"] --> B")
+		})
+
+		Convey("format_diagram formats text or the diagram in the editor", func() {
+			defer cs.Close()
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "format_diagram",
+				Arguments: map[string]any{"content": "graph TD;A-->B"},
+			})
+			So(err, ShouldBeNil)
+			var out FormatDiagramOutput
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(out.Content, ShouldEqual, "graph TD\n    A --> B\n")
+			So(out.Changed, ShouldBeTrue)
+			So(out.Version, ShouldEqual, 0)
+
+			diagram.Set("sequenceDiagram\nA->>B :hi", "browser")
+			res, err = cs.CallTool(context.Background(), &mcp.CallToolParams{Name: "format_diagram"})
+			So(err, ShouldBeNil)
+			out = FormatDiagramOutput{}
+			data, _ = json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			content, version := diagram.Get()
+			So(content, ShouldEqual, "sequenceDiagram\n    A->>B: hi\n")
+			So(out.Version, ShouldEqual, version)
+		})
+
+		Convey("diff_diagrams compares versions and texts", func() {
+			defer cs.Close()
+			diagram.Set("graph TD\n  A-->B", "browser")
+			diagram.Set("graph TD\n  A-->B\n  B-->C", "browser")
+
+			res, err := cs.CallTool(context.Background(), &mcp.CallToolParams{Name: "diff_diagrams"})
+			So(err, ShouldBeNil)
+			var out DiagramDiff
+			data, _ := json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(changes(&out), ShouldResemble, []string{"added node C", "added edge B --> C"})
+
+			res, err = cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "diff_diagrams",
+				Arguments: map[string]any{"from_text": "graph TD\n  A-->B\n  B-->C\n  C-->D"},
+			})
+			So(err, ShouldBeNil)
+			out = DiagramDiff{}
+			data, _ = json.Marshal(res.StructuredContent)
+			So(json.Unmarshal(data, &out), ShouldBeNil)
+			So(changes(&out), ShouldResemble, []string{"removed node D", "removed edge C --> D"})
+		})
+
+		Convey("Edits by the agent name its session", func() {
+			defer cs.Close()
+			listed()
+			ch := diagram.Subscribe()
+			defer diagram.Unsubscribe(ch)
+			_, err := cs.CallTool(context.Background(), &mcp.CallToolParams{
+				Name:      "set_diagram",
+				Arguments: map[string]any{"content": "graph LR"},
+			})
+			So(err, ShouldBeNil)
+			So((<-ch).Client, ShouldStartWith, "mcp-")
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MergeConflict is a region both sides of a three-way merge changed
+// differently. Line is where it starts in the current diagram, counting
+// from 1.
+type MergeConflict struct {
+	Line     int    `json:"line"`
+	Base     string `json:"base"`
+	Current  string `json:"current"`
+	Proposed string `json:"proposed"`
+}
+
+// ConflictError is returned when an edit based on an older version can't be
+// merged with the edits made since.
+type ConflictError struct {
+	Conflicts []MergeConflict
+	// Merged is the merge with each conflict written out between
+	// <<<<<<< current, ======= and >>>>>>> proposed markers.
+	Merged string
+	// Version is the current version the merge was made against.
+	Version int64
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Conflicts) == 1 {
+		return fmt.Sprintf("edit conflicts with changes made since its base version at line %d", e.Conflicts[0].Line)
+	}
+	return fmt.Sprintf("edit conflicts with changes made since its base version in %d places", len(e.Conflicts))
+}
+
+// merge3 merges the changes from base to current with those from base to
+// proposed, line by line. Where both changed the same lines differently it
+// returns a *ConflictError.
+func merge3(base, current, proposed string) (string, error) {
+	// Compare every line with its newline, so one side appending to a text
+	// without a final newline doesn't look like it changed the last line.
+	finalNewline := strings.HasSuffix(proposed, "\n")
+	if proposed == base {
+		finalNewline = strings.HasSuffix(current, "\n")
+	}
+	o, a, b := splitLines(base), splitLines(current), splitLines(proposed)
+	matchA, matchB := matchLines(o, a), matchLines(o, b)
+
+	var merged, marked strings.Builder
+	var conflicts []MergeConflict
+	line := 1 // in current
+	emit := func(lines []string) {
+		for _, l := range lines {
+			merged.WriteString(l)
+			marked.WriteString(l)
+		}
+	}
+
+	i, j, k := 0, 0, 0
+	for i < len(o) || j < len(a) || k < len(b) {
+		// Lines unchanged on both sides.
+		n := 0
+		for i+n < len(o) && matchA[i+n] == j+n && matchB[i+n] == k+n {
+			n++
+		}
+		if n > 0 {
+			emit(o[i : i+n])
+			i, j, k, line = i+n, j+n, k+n, line+n
+			continue
+		}
+
+		// Otherwise a changed region runs to the next line both sides kept.
+		ni, nj, nk := i, len(a), len(b)
+		for ni < len(o) && (matchA[ni] < 0 || matchB[ni] < 0) {
+			ni++
+		}
+		if ni < len(o) {
+			nj, nk = matchA[ni], matchB[ni]
+		}
+		oc, ac, bc := o[i:ni], a[j:nj], b[k:nk]
+		switch {
+		case equalLines(oc, ac) || equalLines(ac, bc):
+			emit(bc)
+		case equalLines(oc, bc):
+			emit(ac)
+		default:
+			conflicts = append(conflicts, MergeConflict{
+				Line:     line,
+				Base:     strings.Join(oc, ""),
+				Current:  strings.Join(ac, ""),
+				Proposed: strings.Join(bc, ""),
+			})
+			marked.WriteString("<<<<<<< current\n" + strings.Join(ac, "") +
+				"=======\n" + strings.Join(bc, "") + ">>>>>>> proposed\n")
+		}
+		i, j, k, line = ni, nj, nk, line+len(ac)
+	}
+
+	if conflicts != nil {
+		return "", &ConflictError{Conflicts: conflicts, Merged: marked.String()}
+	}
+	if !finalNewline {
+		return strings.TrimSuffix(merged.String(), "\n"), nil
+	}
+	return merged.String(), nil
+}
+
+// splitLines splits s into lines, each ending in a newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	lines := strings.SplitAfter(s, "\n")
+	return lines[:len(lines)-1]
+}
+
+func equalLines(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLines pairs the lines of o with those of a along a longest common
+// subsequence: match[i] is the index in a of line i of o, or -1.
+func matchLines(o, a []string) []int {
+	// lcs[i][j] is the LCS length of o[i:] and a[j:].
+	lcs := make([][]int, len(o)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(a)+1)
+	}
+	for i := len(o) - 1; i >= 0; i-- {
+		for j := len(a) - 1; j >= 0; j-- {
+			if o[i] == a[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	match := make([]int, len(o))
+	i, j := 0, 0
+	for i < len(o) {
+		switch {
+		case j < len(a) && o[i] == a[j]:
+			match[i] = j
+			i, j = i+1, j+1
+		case j < len(a) && lcs[i][j+1] >= lcs[i+1][j]:
+			j++
+		default:
+			match[i] = -1
+			i++
+		}
+	}
+	return match
+}
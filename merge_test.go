@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "graph TD\n  A-->B\n  B-->C\n  C-->D\n"
+
+	Convey("Given a three-way merge", t, func() {
+		Convey("Edits to different lines are combined", func() {
+			out, err := merge3(base,
+				"graph TD\n  A-->B\n  B-->X\n  C-->D\n",
+				"graph LR\n  A-->B\n  B-->C\n  C-->D\n  D-->E\n")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph LR\n  A-->B\n  B-->X\n  C-->D\n  D-->E\n")
+		})
+
+		Convey("The same edit on both sides is taken once", func() {
+			same := "graph TD\n  A-->B\n  B-->Y\n  C-->D\n"
+			out, err := merge3(base, same, same)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, same)
+		})
+
+		Convey("Lines deleted on one side stay deleted", func() {
+			out, err := merge3(base,
+				"graph TD\n  A-->B\n  C-->D\n",
+				"graph TD\n  A-->B\n  B-->C\n  C-->D\n  D-->E\n")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph TD\n  A-->B\n  C-->D\n  D-->E\n")
+		})
+
+		Convey("A missing final newline doesn't make appended lines conflict", func() {
+			out, err := merge3("graph TD\n  A-->B", "graph TD\n  A-->B\n  B-->C", "graph LR\n  A-->B")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, "graph LR\n  A-->B\n  B-->C")
+		})
+
+		Convey("Different edits to the same line conflict", func() {
+			_, err := merge3(base,
+				"graph TD\n  A-->B\n  B-->X\n  C-->D\n",
+				"graph TD\n  A-->B\n  B-->Y\n  C-->D\n")
+			var conflict *ConflictError
+			So(errors.As(err, &conflict), ShouldBeTrue)
+			So(conflict.Conflicts, ShouldResemble, []MergeConflict{{
+				Line:     3,
+				Base:     "  B-->C\n",
+				Current:  "  B-->X\n",
+				Proposed: "  B-->Y\n",
+			}})
+			So(conflict.Merged, ShouldEqual, "graph TD\n  A-->B\n"+
+				"<<<<<<< current\n  B-->X\n=======\n  B-->Y\n>>>>>>> proposed\n"+
+				"  C-->D\n")
+		})
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// textOp is an operational-transform operation over a whole document: a
+// sequence of parts that together walk the base document from start to end.
+// Lengths are in UTF-16 code units. The browser has the same implementation
+// in frontend/ot.js; both must transform identically for editors to converge.
+type textOp []opPart
+
+// opPart retains or deletes n units of the base document, or inserts text.
+// Exactly one field is set.
+type opPart struct {
+	retain int
+	delete int
+	insert string
+}
+
+func (op *textOp) retainN(n int) {
+	if n == 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].retain > 0 {
+		(*op)[last].retain += n
+		return
+	}
+	*op = append(*op, opPart{retain: n})
+}
+
+func (op *textOp) deleteN(n int) {
+	if n == 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].delete > 0 {
+		(*op)[last].delete += n
+		return
+	}
+	*op = append(*op, opPart{delete: n})
+}
+
+func (op *textOp) insertText(s string) {
+	if s == "" {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].insert != "" {
+		(*op)[last].insert += s
+		return
+	}
+	*op = append(*op, opPart{insert: s})
+}
+
+// opFromChanges builds the operation for changes against a document of
+// baseLen units.
+func opFromChanges(changes []TextChange, baseLen int) (textOp, error) {
+	var op textOp
+	pos := 0
+	for _, c := range changes {
+		if c.From < pos || c.To < c.From || c.To > baseLen {
+			return nil, fmt.Errorf("change %d-%d is out of order or out of range", c.From, c.To)
+		}
+		op.retainN(c.From - pos)
+		op.deleteN(c.To - c.From)
+		op.insertText(c.Insert)
+		pos = c.To
+	}
+	op.retainN(baseLen - pos)
+	return op, nil
+}
+
+// changes returns op as changes against its base document.
+func (op textOp) changes() []TextChange {
+	changes := []TextChange{}
+	pos := 0
+	for _, p := range op {
+		switch {
+		case p.retain > 0:
+			pos += p.retain
+		default:
+			// Merge a delete and the insert next to it into one change.
+			if n := len(changes); n > 0 && changes[n-1].To == pos {
+				last := &changes[n-1]
+				last.To += p.delete
+				last.Insert += p.insert
+			} else {
+				changes = append(changes, TextChange{From: pos, To: pos + p.delete, Insert: p.insert})
+			}
+			pos += p.delete
+		}
+	}
+	return changes
+}
+
+// transform takes two operations made concurrently against the same document
+// and returns a' and b' such that applying a then b' gives the same document
+// as b then a'. Where both insert at the same place, a's text goes first.
+func transform(a, b textOp) (textOp, textOp, error) {
+	var aPrime, bPrime textOp
+	i, j := 0, 0
+	var pa, pb opPart
+	next := func(op textOp, k *int) opPart {
+		if *k < len(op) {
+			*k++
+			return op[*k-1]
+		}
+		return opPart{}
+	}
+	empty := func(p opPart) bool { return p.retain == 0 && p.delete == 0 && p.insert == "" }
+	pa, pb = next(a, &i), next(b, &j)
+
+	for !empty(pa) || !empty(pb) {
+		switch {
+		case pa.insert != "":
+			aPrime.insertText(pa.insert)
+			bPrime.retainN(utf16Len(pa.insert))
+			pa = next(a, &i)
+			continue
+		case pb.insert != "":
+			aPrime.retainN(utf16Len(pb.insert))
+			bPrime.insertText(pb.insert)
+			pb = next(b, &j)
+			continue
+		case empty(pa) || empty(pb):
+			return nil, nil, errors.New("operations have different base lengths")
+		}
+
+		n := min(pa.retain+pa.delete, pb.retain+pb.delete)
+		switch {
+		case pa.retain > 0 && pb.retain > 0:
+			aPrime.retainN(n)
+			bPrime.retainN(n)
+		case pa.delete > 0 && pb.retain > 0:
+			aPrime.deleteN(n)
+		case pa.retain > 0 && pb.delete > 0:
+			bPrime.deleteN(n)
+		}
+		// Both deleting the same text needs nothing further.
+
+		pa = consume(pa, n)
+		pb = consume(pb, n)
+		if empty(pa) {
+			pa = next(a, &i)
+		}
+		if empty(pb) {
+			pb = next(b, &j)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// consume shortens a retain or delete part by n units.
+func consume(p opPart, n int) opPart {
+	if p.retain > 0 {
+		p.retain -= n
+	} else {
+		p.delete -= n
+	}
+	return p
+}
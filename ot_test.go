@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// randomChanges returns sorted, non-overlapping random edits of doc.
+func randomChanges(rng *rand.Rand, doc string) []TextChange {
+	runes := []rune(doc)
+	var changes []TextChange
+	pos := 0
+	for pos <= len(runes) && rng.Intn(3) > 0 {
+		from := pos + rng.Intn(len(runes)-pos+1)
+		to := from + rng.Intn(len(runes)-from+1)
+		if rng.Intn(2) == 0 {
+			to = from
+		}
+		insert := []string{"", "x", "yz", "é", "😀", "\n"}[rng.Intn(6)]
+		changes = append(changes, TextChange{
+			From:   utf16Len(string(runes[:from])),
+			To:     utf16Len(string(runes[:to])),
+			Insert: insert,
+		})
+		pos = to + 1
+	}
+	return changes
+}
+
+func TestTransform(t *testing.T) {
+	Convey("Given two concurrent edits of the same document", t, func() {
+		doc := "graph TD\n  A-->B"
+		n := utf16Len(doc)
+
+		apply := func(text string, changes []TextChange) string {
+			out, err := applyChanges(text, changes)
+			So(err, ShouldBeNil)
+			return out
+		}
+		both := func(a, b []TextChange) (string, string) {
+			opA, err := opFromChanges(a, n)
+			So(err, ShouldBeNil)
+			opB, err := opFromChanges(b, n)
+			So(err, ShouldBeNil)
+			aPrime, bPrime, err := transform(opA, opB)
+			So(err, ShouldBeNil)
+			return apply(apply(doc, a), bPrime.changes()), apply(apply(doc, b), aPrime.changes())
+		}
+
+		Convey("Edits in different places both survive", func() {
+			ab, ba := both(
+				[]TextChange{{From: 6, To: 8, Insert: "LR"}},
+				[]TextChange{{From: 16, To: 16, Insert: "-->C"}},
+			)
+			So(ab, ShouldEqual, "graph LR\n  A-->B-->C")
+			So(ba, ShouldEqual, ab)
+		})
+
+		Convey("Inserts at the same place keep the first operation's text first", func() {
+			ab, ba := both(
+				[]TextChange{{From: 0, To: 0, Insert: "a"}},
+				[]TextChange{{From: 0, To: 0, Insert: "b"}},
+			)
+			So(ab, ShouldStartWith, "ab")
+			So(ba, ShouldEqual, ab)
+		})
+
+		Convey("Text typed inside a range the other side deleted is kept", func() {
+			ab, ba := both(
+				[]TextChange{{From: 9, To: 16}},
+				[]TextChange{{From: 12, To: 12, Insert: "X"}},
+			)
+			So(ab, ShouldEqual, "graph TD\nX")
+			So(ba, ShouldEqual, ab)
+		})
+
+		Convey("Overlapping deletes remove the union once", func() {
+			ab, ba := both(
+				[]TextChange{{From: 0, To: 6}},
+				[]TextChange{{From: 3, To: 9}},
+			)
+			So(ab, ShouldEqual, "  A-->B")
+			So(ba, ShouldEqual, ab)
+		})
+
+		Convey("Operations on different documents are rejected", func() {
+			opA, _ := opFromChanges(nil, 3)
+			opB, _ := opFromChanges(nil, 4)
+			_, _, err := transform(opA, opB)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Random concurrent edits always converge", t, func() {
+		rng := rand.New(rand.NewSource(1))
+		docs := []string{"", "a", "graph TD\n  A-->B\n  B-->C", "é😀 mixed\nunits"}
+		for i := 0; i < 2000; i++ {
+			doc := docs[i%len(docs)]
+			a, b := randomChanges(rng, doc), randomChanges(rng, doc)
+			opA, err := opFromChanges(a, utf16Len(doc))
+			So(err, ShouldBeNil)
+			opB, err := opFromChanges(b, utf16Len(doc))
+			So(err, ShouldBeNil)
+			aPrime, bPrime, err := transform(opA, opB)
+			So(err, ShouldBeNil)
+
+			ab, err := applyChanges(doc, a)
+			So(err, ShouldBeNil)
+			ab, err = applyChanges(ab, bPrime.changes())
+			So(err, ShouldBeNil)
+			ba, err := applyChanges(doc, b)
+			So(err, ShouldBeNil)
+			ba, err = applyChanges(ba, aPrime.changes())
+			So(err, ShouldBeNil)
+			if ab != ba {
+				So(ab, ShouldEqual, ba)
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// OutlineItem is an element of a diagram and where it is in the text.
+type OutlineItem struct {
+	Element string `json:"element"` // subgraph, node, edge, participant, message or note
+	ID      string `json:"id"`
+	Label   string `json:"label,omitempty"`
+	Parent  string `json:"parent,omitempty"` // the subgraph, composite state, namespace or box it is in
+	Span    Span   `json:"span"`             // where it is defined; a subgraph or box runs to its end
+	Refs    []Span `json:"refs,omitempty"`   // every mention of a node or participant id
+}
+
+// Outline lists the subgraphs, nodes and edges of a diagram, or its
+// participants, messages and notes, in the order they appear.
+func Outline(d *Diagram) []OutlineItem {
+	items := []OutlineItem{}
+	for _, sg := range d.Subgraphs {
+		items = append(items, OutlineItem{Element: "subgraph", ID: sg.ID, Label: sg.Title, Parent: sg.Parent, Span: sg.Span})
+	}
+	for _, n := range d.Nodes {
+		items = append(items, OutlineItem{Element: "node", ID: n.ID, Label: n.Label, Parent: n.Subgraph, Span: n.Span, Refs: d.Mentions(n.ID)})
+	}
+	for _, e := range d.Edges {
+		items = append(items, OutlineItem{Element: "edge", ID: edgeID(e), Label: e.Label, Span: e.Span})
+	}
+	for _, p := range d.Participants {
+		items = append(items, OutlineItem{Element: "participant", ID: p.ID, Label: p.Label, Parent: p.Box, Span: p.Span, Refs: d.Mentions(p.ID)})
+	}
+	for _, m := range d.Messages {
+		items = append(items, OutlineItem{Element: "message", ID: messageID(m), Label: m.Text, Span: m.Span})
+	}
+	for _, n := range d.Notes {
+		items = append(items, OutlineItem{Element: "note", ID: noteID(n), Label: n.Text, Span: n.Span})
+	}
+	sortOutline(items)
+	return items
+}
+
+// sortOutline orders items by where they start, outer ones first.
+func sortOutline(items []OutlineItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i].Span, items[j].Span
+		if a.Start.Offset != b.Start.Offset {
+			return a.Start.Offset < b.Start.Offset
+		}
+		return a.End.Offset > b.End.Offset
+	})
+}
+
+// outlineMatching returns the items of the outline with id, or all of them
+// for "".
+func outlineMatching(items []OutlineItem, id string) []OutlineItem {
+	if id == "" {
+		return items
+	}
+	out := []OutlineItem{}
+	for _, item := range items {
+		if item.ID == id {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// handleGetOutline returns the outline of the current diagram, or with ?id=
+// the items for one id.
+func (d *DiagramState) handleGetOutline(w http.ResponseWriter, r *http.Request) {
+	content, version := d.Get()
+	parsed := ParseDiagram(content)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version": version,
+		"kind":    parsed.Kind,
+		"items":   outlineMatching(Outline(parsed), r.URL.Query().Get("id")),
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// outlineIDs returns "element id" for each item.
+func outlineIDs(items []OutlineItem) []string {
+	out := []string{}
+	for _, i := range items {
+		out = append(out, i.Element+" "+i.ID)
+	}
+	return out
+}
+
+func TestOutline(t *testing.T) {
+	Convey("Outline", t, func() {
+		Convey("Lists the subgraphs, nodes and edges of a flowchart in text order", func() {
+			d := ParseDiagram("graph TD\n  A[Start] --> B\n  subgraph s [Stage]\n    C\n  end\n  style A fill:#f00")
+			items := Outline(d)
+			So(outlineIDs(items), ShouldResemble, []string{"edge A --> B", "node A", "node B", "subgraph s", "node C"})
+			So(items[1].Label, ShouldEqual, "Start")
+			So(items[1].Refs, ShouldHaveLength, 2)
+			So(items[3].Span.Start.Line, ShouldEqual, 3)
+			So(items[3].Span.End.Line, ShouldEqual, 5)
+			So(items[4].Parent, ShouldEqual, "s")
+		})
+
+		Convey("Lists the participants, messages and notes of a sequence diagram", func() {
+			d := ParseDiagram("sequenceDiagram\n  participant A as Alice\n  A->>B: hi\n  Note over A,B: done")
+			items := Outline(d)
+			So(outlineIDs(items), ShouldResemble, []string{"participant A", "message A->>B", "participant B", "note over A,B"})
+			So(items[0].Label, ShouldEqual, "Alice")
+			So(items[0].Refs, ShouldHaveLength, 3)
+		})
+	})
+}
+
+func TestHandleGetOutline(t *testing.T) {
+	Convey("GET /api/diagram/outline", t, func() {
+		ds := NewDiagramState("graph TD\n  A --> B\n  B --> C")
+
+		Convey("Returns the outline with the version", func() {
+			w := httptest.NewRecorder()
+			ds.handleGetOutline(w, httptest.NewRequest("GET", "/api/diagram/outline", nil))
+			var out struct {
+				Version int64         `json:"version"`
+				Kind    string        `json:"kind"`
+				Items   []OutlineItem `json:"items"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Version, ShouldEqual, 1)
+			So(out.Kind, ShouldEqual, kindFlowchart)
+			So(out.Items, ShouldHaveLength, 5)
+		})
+
+		Convey("Narrows it to one id", func() {
+			w := httptest.NewRecorder()
+			ds.handleGetOutline(w, httptest.NewRequest("GET", "/api/diagram/outline?id=B", nil))
+			var out struct {
+				Items []OutlineItem `json:"items"`
+			}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(outlineIDs(out.Items), ShouldResemble, []string{"node B"})
+			So(out.Items[0].Span.Start.Line, ShouldEqual, 2)
+			So(out.Items[0].Span.Start.Col, ShouldEqual, 9)
+		})
+	})
+}
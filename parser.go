@@ -0,0 +1,530 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// diagramKinds maps the keyword a diagram starts with to its kind.
+var diagramKinds = map[string]string{
+	"graph":              kindFlowchart,
+	"flowchart":          kindFlowchart,
+	"flowchart-elk":      kindFlowchart,
+	"sequenceDiagram":    kindSequence,
+	"classDiagram":       kindClass,
+	"classDiagram-v2":    kindClass,
+	"stateDiagram":       kindState,
+	"stateDiagram-v2":    kindState,
+	"erDiagram":          kindER,
+	"gantt":              "gantt",
+	"pie":                "pie",
+	"journey":            "journey",
+	"gitGraph":           "gitGraph",
+	"mindmap":            "mindmap",
+	"timeline":           "timeline",
+	"quadrantChart":      "quadrantChart",
+	"requirementDiagram": "requirement",
+	"C4Context":          "c4",
+	"C4Container":        "c4",
+	"C4Component":        "c4",
+	"C4Dynamic":          "c4",
+	"C4Deployment":       "c4",
+	"sankey-beta":        "sankey",
+	"xychart-beta":       "xychart",
+	"block-beta":         "block",
+	"packet-beta":        "packet",
+	"architecture-beta":  "architecture",
+	"kanban":             "kanban",
+	"radar-beta":         "radar",
+	"treemap-beta":       "treemap",
+	"zenuml":             "zenuml",
+}
+
+// flowchartDirections are the directions a flowchart or subgraph can run in.
+var flowchartDirections = map[string]bool{"TB": true, "TD": true, "BT": true, "RL": true, "LR": true}
+
+// frame is a block the parser is inside of.
+type frame struct {
+	kind  string // subgraph, block, class, namespace, state, entity or note
+	id    string // of the subgraph, class, state or entity
+	index int    // into Diagram.Blocks, Subgraphs or Notes
+	stmt  int
+}
+
+type parser struct {
+	src     string
+	lines   []int // byte offset where each line starts
+	d       *Diagram
+	stack   []frame
+	cur     int // index of the statement being parsed
+	classes []pendingClass
+}
+
+// pendingClass is a class statement, applied once all nodes are known.
+type pendingClass struct {
+	id, class string
+}
+
+// ParseDiagram parses Mermaid text. It always returns a Diagram, with any
+// problems in its Errors.
+func ParseDiagram(src string) *Diagram {
+	p := &parser{
+		src:   src,
+		lines: lineStarts(src),
+		d: &Diagram{
+			Statements:   []Statement{},
+			nodes:        make(map[string]*Node),
+			participants: make(map[string]*Participant),
+		},
+	}
+	for i := 0; i < len(p.lines); i++ {
+		start, end := p.line(i)
+		text := src[start:end]
+		trimmed := strings.TrimSpace(text)
+		off := start + strings.Index(text, trimmed)
+		switch {
+		case p.inNote():
+			p.add(stmtOther, trimmed, off, off+len(trimmed))
+			p.stateNoteLine(trimmed)
+		case trimmed == "":
+			p.add(stmtBlank, "", start, start)
+		case trimmed == "---" && p.d.Header == "" && p.onlyBlank():
+			// Front matter runs to the next ---.
+			j := i + 1
+			for j < len(p.lines) {
+				s, e := p.line(j)
+				if strings.TrimSpace(p.src[s:e]) == "---" {
+					break
+				}
+				j++
+			}
+			if j == len(p.lines) {
+				p.add(stmtDirective, trimmed, off, off+3)
+				p.errorf(off, off+3, "front matter is missing its closing ---")
+				continue
+			}
+			_, e := p.line(j)
+			p.add(stmtDirective, strings.TrimRight(src[off:e], " \t\r"), off, e)
+			i = j
+		case strings.HasPrefix(trimmed, "%%{"):
+			p.add(stmtDirective, trimmed, off, off+len(trimmed))
+		case strings.HasPrefix(trimmed, "%%"):
+			p.add(stmtComment, trimmed, off, off+len(trimmed))
+		case p.d.Header == "":
+			p.header(trimmed, off)
+		case p.d.Kind == kindFlowchart:
+			// A quoted label may run over several lines.
+			for strings.Count(trimmed, `"`)%2 == 1 && i+1 < len(p.lines) {
+				i++
+				_, end = p.line(i)
+				trimmed = strings.TrimSpace(src[off:end])
+			}
+			p.statements(trimmed, off, p.flowchartStatement)
+		case p.d.Kind == kindSequence:
+			p.statements(trimmed, off, p.sequenceStatement)
+		case p.d.Kind == kindClass:
+			p.statement(trimmed, off, p.classStatement)
+		case p.d.Kind == kindState:
+			p.statement(trimmed, off, p.stateStatement)
+		case p.d.Kind == kindER:
+			p.statement(trimmed, off, p.erStatement)
+		default:
+			p.add(stmtOther, trimmed, off, off+len(trimmed))
+		}
+	}
+	p.finish()
+	return p.d
+}
+
+// lineStarts returns the byte offset where each line of src starts.
+func lineStarts(src string) []int {
+	starts := []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' && i+1 < len(src) {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// line returns where line i starts and ends, without its line break.
+func (p *parser) line(i int) (int, int) {
+	start, end := p.lines[i], len(p.src)
+	if i+1 < len(p.lines) {
+		end = p.lines[i+1]
+	}
+	return start, start + len(strings.TrimRight(p.src[start:end], "\r\n"))
+}
+
+// pos returns the position of byte offset off.
+func (p *parser) pos(off int) Pos {
+	line := sort.Search(len(p.lines), func(i int) bool { return p.lines[i] > off })
+	start := p.lines[line-1]
+	return Pos{Offset: off, Line: line, Col: utf8.RuneCountInString(p.src[start:off]) + 1}
+}
+
+func (p *parser) span(from, to int) Span {
+	return Span{Start: p.pos(from), End: p.pos(to)}
+}
+
+// add appends a statement and makes it the current one.
+func (p *parser) add(kind, text string, from, to int) int {
+	p.d.Statements = append(p.d.Statements, Statement{
+		Kind:  kind,
+		Text:  text,
+		Span:  p.span(from, to),
+		Depth: len(p.stack),
+	})
+	p.cur = len(p.d.Statements) - 1
+	return p.cur
+}
+
+// setKind sets the kind of the current statement.
+func (p *parser) setKind(kind string) {
+	p.d.Statements[p.cur].Kind = kind
+}
+
+func (p *parser) errorf(from, to int, format string, args ...any) {
+	p.d.Errors = append(p.d.Errors, ParseError{Span: p.span(from, to), Message: fmt.Sprintf(format, args...)})
+}
+
+// onlyBlank reports whether every statement so far is blank.
+func (p *parser) onlyBlank() bool {
+	for _, s := range p.d.Statements {
+		if s.Kind != stmtBlank {
+			return false
+		}
+	}
+	return true
+}
+
+// header parses the line naming the diagram type, which for flowcharts may
+// carry the direction and the first statements.
+func (p *parser) header(text string, off int) {
+	word, rest := firstWord(text)
+	word = strings.TrimSuffix(word, ";")
+	p.d.Header = word
+	p.d.Kind = diagramKinds[word]
+	if p.d.Kind == "" {
+		p.add(stmtOther, text, off, off+len(text))
+		p.errorf(off, off+len(word), "unknown diagram type %q", word)
+		return
+	}
+	if p.d.Kind != kindFlowchart {
+		p.add(stmtHeader, text, off, off+len(text))
+		return
+	}
+
+	end := len(text)
+	if i := strings.IndexByte(text, ';'); i >= 0 {
+		end = i
+	}
+	dir := strings.TrimSpace(text[len(word):end])
+	if flowchartDirections[dir] {
+		p.d.Direction = dir
+	} else if dir != "" {
+		p.errorf(off+len(word), off+end, "unknown direction %q; use TB, TD, BT, RL or LR", dir)
+	}
+	p.add(stmtHeader, strings.TrimSpace(text[:end]), off, off+len(strings.TrimSpace(text[:end])))
+	if end < len(text) && rest != "" {
+		p.statements(text[end+1:], off+end+1, p.flowchartStatement)
+	}
+}
+
+// statements splits text at semicolons and parses each statement.
+func (p *parser) statements(text string, off int, parse func(text string, off int)) {
+	for _, s := range splitStatements(text) {
+		p.statement(text[s[0]:s[1]], off+s[0], parse)
+	}
+}
+
+// statement adds a statement for text and parses it.
+func (p *parser) statement(text string, off int, parse func(text string, off int)) {
+	p.add(stmtOther, text, off, off+len(text))
+	parse(text, off)
+}
+
+// splitStatements returns the ranges of the statements in text, which are
+// separated by semicolons outside quotes and brackets, trimmed of spaces.
+func splitStatements(text string) [][2]int {
+	var ranges [][2]int
+	add := func(from, to int) {
+		for from < to && isSpace(text[from]) {
+			from++
+		}
+		for to > from && isSpace(text[to-1]) {
+			to--
+		}
+		if from < to {
+			ranges = append(ranges, [2]int{from, to})
+		}
+	}
+	start, depth, quoted := 0, 0, false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[' || c == '(' || c == '{':
+			depth++
+		case (c == ']' || c == ')' || c == '}') && depth > 0:
+			depth--
+		case c == ';' && depth == 0:
+			add(start, i)
+			start = i + 1
+		}
+	}
+	add(start, len(text))
+	return ranges
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// firstWord splits s at its first run of spaces.
+func firstWord(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// unquote strips the quotes around a label, and the backticks of a
+// markdown string.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+		if len(s) >= 2 && s[0] == '`' && s[len(s)-1] == '`' {
+			s = s[1 : len(s)-1]
+		}
+	}
+	return s
+}
+
+// push enters a block opened by the current statement.
+func (p *parser) push(f frame) {
+	p.setKind(stmtOpen)
+	f.stmt = p.cur
+	p.stack = append(p.stack, f)
+}
+
+// top returns the innermost block, if any.
+func (p *parser) top() (frame, bool) {
+	if len(p.stack) == 0 {
+		return frame{}, false
+	}
+	return p.stack[len(p.stack)-1], true
+}
+
+// pop leaves the innermost block, which the current statement closes, and
+// returns it.
+func (p *parser) pop() (frame, bool) {
+	f, ok := p.top()
+	if !ok {
+		return f, false
+	}
+	p.stack = p.stack[:len(p.stack)-1]
+	stmt := &p.d.Statements[p.cur]
+	stmt.Kind = stmtClose
+	stmt.Depth = len(p.stack)
+	p.closeSpan(f, stmt.Span.End)
+	return f, true
+}
+
+// closeSpan ends the span of the block f at end.
+func (p *parser) closeSpan(f frame, end Pos) {
+	start := p.d.Statements[f.stmt].Span.Start
+	switch f.kind {
+	case "subgraph", "namespace":
+		p.d.Subgraphs[f.index].Span = Span{Start: start, End: end}
+	case "state":
+		if f.index >= 0 {
+			p.d.Subgraphs[f.index].Span = Span{Start: start, End: end}
+		}
+	case "block":
+		p.d.Blocks[f.index].Span = Span{Start: start, End: end}
+	case "note":
+		p.d.Notes[f.index].Span = Span{Start: start, End: end}
+	}
+}
+
+// section marks the current statement as starting a new section of the
+// innermost block.
+func (p *parser) section() {
+	stmt := &p.d.Statements[p.cur]
+	stmt.Kind = stmtSection
+	stmt.Depth = max(len(p.stack)-1, 0)
+}
+
+// subgraph returns the id of the innermost subgraph, composite state or
+// namespace, or "".
+func (p *parser) subgraph() string {
+	for i := len(p.stack) - 1; i >= 0; i-- {
+		switch f := p.stack[i]; f.kind {
+		case "subgraph", "namespace", "state":
+			return f.id
+		}
+	}
+	return ""
+}
+
+// ref records a mention of node id, creating the node on first mention.
+func (p *parser) ref(id string, r NodeRef, shape string) *Node {
+	r.Stmt = p.cur
+	n := p.d.nodes[id]
+	if n == nil {
+		n = &Node{ID: id, Label: id, Shape: shape, Span: r.Span}
+		p.d.nodes[id] = n
+		p.d.Nodes = append(p.d.Nodes, n)
+	}
+	if sg := p.subgraph(); sg != "" && n.Subgraph == "" && sg != id {
+		n.Subgraph = sg
+		if s := p.d.Subgraph(sg); s != nil {
+			s.Nodes = append(s.Nodes, id)
+		}
+	}
+	if r.Label != "" || r.Shape != "" {
+		if !n.defined() {
+			n.Span = r.Span
+		}
+		if r.Label != "" {
+			n.Label = r.Label
+		}
+		if r.Shape != "" {
+			n.Shape = r.Shape
+		}
+	}
+	n.Refs = append(n.Refs, r)
+	return n
+}
+
+// defined reports whether the node was given a label or shape.
+func (n *Node) defined() bool {
+	for _, r := range n.Refs {
+		if r.Label != "" || r.Shape != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// addEdge records an edge.
+func (p *parser) addEdge(e *Edge) {
+	e.Index = len(p.d.Edges)
+	e.Stmt = p.cur
+	p.d.Edges = append(p.d.Edges, e)
+}
+
+// styleStatement parses classDef, class, style and linkStyle, shared by the
+// diagram types that support them, and reports whether it was one.
+func (p *parser) styleStatement(word, rest string, off int) bool {
+	switch word {
+	case "classDef":
+		names, styles := firstWord(rest)
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				p.d.ClassDefs = append(p.d.ClassDefs, &ClassDef{Name: name, Styles: styles, Span: p.d.Statements[p.cur].Span})
+			}
+		}
+	case "class", "cssClass":
+		ids, class := firstWord(rest)
+		if word == "cssClass" {
+			ids = unquote(ids)
+		}
+		if class == "" {
+			p.errorf(off, off+len(word)+1+len(rest), "%s needs node ids and a class name", word)
+			break
+		}
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				p.classes = append(p.classes, pendingClass{id: id, class: class})
+			}
+		}
+	case "style":
+		id, styles := firstWord(rest)
+		p.d.Styles = append(p.d.Styles, &Style{Target: id, Styles: styles, Span: p.d.Statements[p.cur].Span})
+	case "linkStyle":
+		indexes, styles := firstWord(rest)
+		for _, i := range strings.Split(indexes, ",") {
+			p.d.Styles = append(p.d.Styles, &Style{Target: strings.TrimSpace(i), Link: true, Styles: styles, Span: p.d.Statements[p.cur].Span})
+		}
+	default:
+		return false
+	}
+	p.setKind(stmtStyle)
+	return true
+}
+
+// finish reports blocks left open and resolves what needed every statement
+// to be seen.
+func (p *parser) finish() {
+	end := p.pos(len(p.src))
+	for len(p.stack) > 0 {
+		f := p.stack[len(p.stack)-1]
+		p.stack = p.stack[:len(p.stack)-1]
+		p.closeSpan(f, end)
+		span := p.d.Statements[f.stmt].Span
+		var msg string
+		switch f.kind {
+		case "subgraph":
+			msg = fmt.Sprintf("subgraph %s is missing its end", f.id)
+		case "block":
+			msg = fmt.Sprintf("%s is missing its end", p.d.Blocks[f.index].Kind)
+		case "note":
+			msg = "note is missing its end note"
+		default:
+			msg = fmt.Sprintf("%s is missing its closing }", f.id)
+		}
+		p.d.Errors = append(p.d.Errors, ParseError{Span: span, Message: msg})
+	}
+
+	for _, c := range p.classes {
+		if n := p.d.nodes[c.id]; n != nil {
+			n.Classes = append(n.Classes, c.class)
+		}
+	}
+
+	// A flowchart edge can point at a subgraph, which isn't a node.
+	if p.d.Kind == kindFlowchart && len(p.d.Subgraphs) > 0 {
+		nodes := p.d.Nodes[:0]
+		for _, n := range p.d.Nodes {
+			if p.d.Subgraph(n.ID) != nil && !n.defined() {
+				delete(p.d.nodes, n.ID)
+				continue
+			}
+			nodes = append(nodes, n)
+		}
+		p.d.Nodes = nodes
+	}
+
+	// So can e1@{ animate: true }, which sets properties of edge e1.
+	if p.d.Kind == kindFlowchart {
+		edgeIDs, linked := map[string]bool{}, map[string]bool{}
+		for _, e := range p.d.Edges {
+			if e.ID != "" {
+				edgeIDs[e.ID] = true
+			}
+			linked[e.From], linked[e.To] = true, true
+		}
+		if len(edgeIDs) > 0 {
+			nodes := p.d.Nodes[:0]
+			for _, n := range p.d.Nodes {
+				if edgeIDs[n.ID] && !linked[n.ID] {
+					delete(p.d.nodes, n.ID)
+					continue
+				}
+				nodes = append(nodes, n)
+			}
+			p.d.Nodes = nodes
+		}
+	}
+
+	sort.SliceStable(p.d.Errors, func(i, j int) bool {
+		return p.d.Errors[i].Span.Start.Offset < p.d.Errors[j].Span.Start.Offset
+	})
+}
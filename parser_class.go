@@ -0,0 +1,240 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// classNamePattern matches a class name, with any generic type.
+const classNamePattern = "([\\w`]+)(~[^~]*~)?"
+
+var (
+	// A relationship: A "1" <|-- "*" B : label.
+	classRelationRe = regexp.MustCompile(`^` + classNamePattern + `\s*(?:"([^"]*)"\s*)?(<\||\*|o|<)?(--|\.\.)(\|>|\*|o|>)?\s*(?:"([^"]*)"\s*)?` + classNamePattern + `\s*(?::\s*(.*))?$`)
+	// A declaration: class A, class A~T~["Label"]:::css {.
+	classDeclRe   = regexp.MustCompile(`^class\s+` + classNamePattern + `(?:\["([^"]*)"\])?(?::::([\w-]+))?\s*(\{)?\s*(\})?$`)
+	classMemberRe = regexp.MustCompile(`^` + classNamePattern + `\s*:\s*(.+)$`)
+	// An annotation: <<interface>> A.
+	classAnnotationRe = regexp.MustCompile(`^<<([^>]+)>>\s*([\w` + "`" + `]+)?$`)
+	classNoteRe       = regexp.MustCompile(`^note\s+(?:for\s+([\w` + "`" + `]+)\s+)?"(.*)"$`)
+	classOnlyRe       = regexp.MustCompile(`^` + classNamePattern + `(?::::([\w-]+))?$`)
+)
+
+// classStatement parses one class diagram statement.
+func (p *parser) classStatement(text string, off int) {
+	if f, ok := p.top(); ok && f.kind == "class" {
+		if text == "}" {
+			p.pop()
+			return
+		}
+		p.setKind(stmtMember)
+		n := p.d.nodes[f.id]
+		n.Members = append(n.Members, text)
+		return
+	}
+
+	word, rest := firstWord(text)
+	if word != "class" && p.styleStatement(word, rest, off) {
+		return
+	}
+	switch {
+	case text == "}":
+		if f, ok := p.top(); !ok || f.kind != "namespace" {
+			p.errorf(off, off+1, "} without a namespace to close")
+			return
+		}
+		p.pop()
+	case word == "namespace":
+		id := strings.TrimSpace(strings.TrimSuffix(rest, "{"))
+		p.d.Subgraphs = append(p.d.Subgraphs, &Subgraph{
+			ID:     id,
+			Title:  id,
+			Parent: p.subgraph(),
+			Nodes:  []string{},
+			Header: p.d.Statements[p.cur].Span,
+			Stmt:   p.cur,
+		})
+		p.push(frame{kind: "namespace", id: id, index: len(p.d.Subgraphs) - 1})
+	case word == "direction":
+		p.setKind(stmtDirection)
+		p.d.Direction = rest
+	case word == "class":
+		p.classDecl(text, off)
+	case strings.HasPrefix(text, "<<"):
+		m := classAnnotationRe.FindStringSubmatchIndex(text)
+		if m == nil || m[4] < 0 {
+			p.errorf(off, off+len(text), "annotation needs a class: <<interface>> Name")
+			return
+		}
+		p.setKind(stmtMember)
+		n := p.classRef(text, off, m[4], m[5], -1, -1)
+		n.Members = append(n.Members, text[:m[3]+2])
+	case strings.HasPrefix(text, "note"):
+		m := classNoteRe.FindStringSubmatch(text)
+		if m == nil {
+			p.errorf(off, off+len(text), `expected note "text" or note for Class "text"`)
+			return
+		}
+		p.setKind(stmtNote)
+		note := &Note{Position: "over", Text: m[2], Span: p.d.Statements[p.cur].Span, Stmt: p.cur}
+		if m[1] != "" {
+			note.Position = "for"
+			note.Actors = []string{strings.Trim(m[1], "`")}
+		}
+		p.d.Notes = append(p.d.Notes, note)
+	case word == "click" || word == "link" || word == "callback" ||
+		strings.HasPrefix(word, "accTitle") || strings.HasPrefix(word, "accDescr"):
+	default:
+		p.classRelationOrMember(text, off)
+	}
+}
+
+// classDecl parses class A, class A["Label"] and class A {, which opens
+// its members.
+func (p *parser) classDecl(text string, off int) {
+	m := classDeclRe.FindStringSubmatchIndex(text)
+	if m == nil {
+		p.errorf(off, off+len(text), "expected class Name, optionally followed by {")
+		return
+	}
+	n := p.classRef(text, off, m[2], m[3], m[4], m[5])
+	p.setKind(stmtNode)
+	if m[6] >= 0 {
+		n.Label = text[m[6]:m[7]]
+	}
+	if m[8] >= 0 {
+		p.classes = append(p.classes, pendingClass{id: n.ID, class: text[m[8]:m[9]]})
+	}
+	if m[10] >= 0 && m[12] < 0 {
+		p.push(frame{kind: "class", id: n.ID})
+	}
+}
+
+// classRef records a mention of the class named text[from:to], with its
+// generic type at text[gfrom:gto] if any.
+func (p *parser) classRef(text string, off, from, to, gfrom, gto int) *Node {
+	id := strings.Trim(text[from:to], "`")
+	end := to
+	label := ""
+	if gfrom >= 0 {
+		end = gto
+		label = id + text[gfrom:gto]
+	}
+	return p.ref(id, NodeRef{ID: p.span(off+from, off+to), Span: p.span(off+from, off+end), Label: label}, "class")
+}
+
+// classRelationOrMember parses A <|-- B : label, A : member or a lone
+// class name.
+func (p *parser) classRelationOrMember(text string, off int) {
+	if m := classRelationRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtEdge)
+		from := p.classRef(text, off, m[2], m[3], m[4], m[5])
+		to := p.classRef(text, off, m[16], m[17], m[18], m[19])
+		// The arrow runs from the left head, if any, through the right one.
+		start, end := m[10], m[11]
+		if m[8] >= 0 {
+			start = m[8]
+		}
+		if m[12] >= 0 {
+			end = m[13]
+		}
+		e := &Edge{
+			From:      from.ID,
+			To:        to.ID,
+			Arrow:     text[start:end],
+			Span:      p.d.Statements[p.cur].Span,
+			ArrowSpan: p.span(off+start, off+end),
+		}
+		if m[6] >= 0 {
+			e.FromLabel = text[m[6]:m[7]]
+		}
+		if m[14] >= 0 {
+			e.ToLabel = text[m[14]:m[15]]
+		}
+		if m[20] >= 0 {
+			e.Label = strings.TrimSpace(text[m[20]:m[21]])
+		}
+		p.addEdge(e)
+		return
+	}
+	if m := classMemberRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtMember)
+		n := p.classRef(text, off, m[2], m[3], m[4], m[5])
+		n.Members = append(n.Members, strings.TrimSpace(text[m[6]:m[7]]))
+		return
+	}
+	if m := classOnlyRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtNode)
+		n := p.classRef(text, off, m[2], m[3], m[4], m[5])
+		if m[6] >= 0 {
+			p.classes = append(p.classes, pendingClass{id: n.ID, class: text[m[6]:m[7]]})
+		}
+		return
+	}
+	p.errorf(off, off+len(text), "unrecognized statement %q", text)
+}
+
+var (
+	// A relationship: A ||--o{ B : label.
+	erRelationRe = regexp.MustCompile(`^([\w\-]+)\s*(\|o|\|\||\}o|\}\|)(--|\.\.)(o\||\|\||o\{|\|\{)\s*([\w\-]+)\s*:\s*(.*)$`)
+	erEntityRe   = regexp.MustCompile(`^([\w\-]+)(?:\["([^"]*)"\])?\s*(\{)?$`)
+)
+
+// erStatement parses one entity relationship diagram statement.
+func (p *parser) erStatement(text string, off int) {
+	if f, ok := p.top(); ok && f.kind == "entity" {
+		if text == "}" {
+			p.pop()
+			return
+		}
+		p.setKind(stmtMember)
+		n := p.d.nodes[f.id]
+		n.Members = append(n.Members, text)
+		return
+	}
+
+	word, rest := firstWord(text)
+	if p.styleStatement(word, rest, off) {
+		return
+	}
+	if word == "direction" {
+		p.setKind(stmtDirection)
+		p.d.Direction = rest
+		return
+	}
+	if strings.HasPrefix(word, "accTitle") || strings.HasPrefix(word, "accDescr") || strings.HasPrefix(word, "title") {
+		return
+	}
+	if m := erRelationRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtEdge)
+		from := text[m[2]:m[3]]
+		to := text[m[10]:m[11]]
+		p.ref(from, NodeRef{ID: p.span(off+m[2], off+m[3]), Span: p.span(off+m[2], off+m[3])}, "entity")
+		p.ref(to, NodeRef{ID: p.span(off+m[10], off+m[11]), Span: p.span(off+m[10], off+m[11])}, "entity")
+		p.addEdge(&Edge{
+			From:      from,
+			To:        to,
+			Arrow:     text[m[4]:m[9]],
+			Label:     unquote(text[m[12]:m[13]]),
+			Span:      p.d.Statements[p.cur].Span,
+			ArrowSpan: p.span(off+m[4], off+m[9]),
+		})
+		return
+	}
+	if m := erEntityRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtNode)
+		id := text[m[2]:m[3]]
+		ref := NodeRef{ID: p.span(off+m[2], off+m[3]), Span: p.span(off, off+len(text))}
+		if m[4] >= 0 {
+			ref.Label = text[m[4]:m[5]]
+			ref.Quoted = true
+			ref.LabelSpan = p.span(off+m[4]-1, off+m[5]+1)
+		}
+		p.ref(id, ref, "entity")
+		if m[6] >= 0 {
+			p.push(frame{kind: "entity", id: id})
+		}
+		return
+	}
+	p.errorf(off, off+len(text), "unrecognized statement %q", text)
+}
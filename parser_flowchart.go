@@ -0,0 +1,413 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// shapeClose is a closing bracket and the node shape it makes.
+type shapeClose struct {
+	close, shape string
+}
+
+// flowchartShapes lists node shapes by their opening bracket, longest first.
+var flowchartShapes = []struct {
+	open   string
+	closes []shapeClose
+}{
+	{"(((", []shapeClose{{")))", "double-circle"}}},
+	{"((", []shapeClose{{"))", "circle"}}},
+	{"([", []shapeClose{{"])", "stadium"}}},
+	{"[[", []shapeClose{{"]]", "subroutine"}}},
+	{"[(", []shapeClose{{")]", "cylinder"}}},
+	{"{{", []shapeClose{{"}}", "hexagon"}}},
+	{"[/", []shapeClose{{"/]", "parallelogram"}, {`\]`, "trapezoid"}}},
+	{`[\`, []shapeClose{{`\]`, "parallelogram-alt"}, {"/]", "trapezoid-alt"}}},
+	{"(", []shapeClose{{")", "round"}}},
+	{"[", []shapeClose{{"]", "rect"}}},
+	{"{", []shapeClose{{"}", "rhombus"}}},
+	{">", []shapeClose{{"]", "asymmetric"}}},
+}
+
+// shapeBrackets returns the brackets that give a flowchart node shape.
+func shapeBrackets(shape string) (string, string) {
+	for _, s := range flowchartShapes {
+		for _, c := range s.closes {
+			if c.shape == shape {
+				return s.open, c.close
+			}
+		}
+	}
+	return "[", "]"
+}
+
+var (
+	// A link without text: -->, ---, -.->, ==>, ~~~, <-->, o--o, --x and
+	// their longer forms.
+	flowLinkRe = regexp.MustCompile(`^(?:[<ox]?(?:-{2,}[>ox]|-{3,}|={2,}[>ox]|={3,}|-\.+-[>ox]?)|~{3,})`)
+	// The start of a link with text, as in -- text -->.
+	flowLinkOpenRe = regexp.MustCompile(`^[<ox]?(--|==|-\.)`)
+	// The end of a link with text, by how it started.
+	flowLinkCloseRes = map[string]*regexp.Regexp{
+		"--": regexp.MustCompile(`-{2,}[>ox]|-{3,}`),
+		"==": regexp.MustCompile(`={2,}[>ox]|={3,}`),
+		"-.": regexp.MustCompile(`\.+-[>ox]?`),
+	}
+)
+
+// scanner walks a statement.
+type scanner struct {
+	s   string
+	i   int
+	off int // of s in the diagram text
+}
+
+func (sc *scanner) rest() string { return sc.s[sc.i:] }
+func (sc *scanner) done() bool   { return sc.i >= len(sc.s) }
+func (sc *scanner) at() int      { return sc.off + sc.i }
+
+func (sc *scanner) skipSpace() {
+	for sc.i < len(sc.s) && isSpace(sc.s[sc.i]) {
+		sc.i++
+	}
+}
+
+func isIDRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// scanID returns the length of the node id at the start of s. Hyphens and
+// dots may join words of an id, but don't start a link.
+func scanID(s string) int {
+	i := 0
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if isIDRune(r) {
+			i += size
+			continue
+		}
+		if (r == '-' || r == '.') && i > 0 && i+size < len(s) {
+			if next, _ := utf8.DecodeRuneInString(s[i+size:]); isIDRune(next) {
+				i += size
+				continue
+			}
+		}
+		break
+	}
+	return i
+}
+
+// flowchartStatement parses one flowchart statement.
+func (p *parser) flowchartStatement(text string, off int) {
+	word, rest := firstWord(text)
+	if p.styleStatement(word, rest, off) {
+		return
+	}
+	switch {
+	case word == "subgraph":
+		p.subgraphStatement(rest, off)
+	case text == "end":
+		if f, ok := p.top(); !ok || f.kind != "subgraph" {
+			p.errorf(off, off+3, "end without a subgraph to close")
+			return
+		}
+		p.pop()
+	case word == "direction":
+		if !flowchartDirections[rest] {
+			p.errorf(off, off+len(text), "unknown direction %q; use TB, TD, BT, RL or LR", rest)
+		}
+		p.setKind(stmtDirection)
+		if f, ok := p.top(); ok && f.kind == "subgraph" {
+			p.d.Subgraphs[f.index].Direction = rest
+		} else {
+			p.d.Direction = rest
+		}
+	case word == "click" || word == "call" || strings.HasPrefix(word, "accTitle") || strings.HasPrefix(word, "accDescr"):
+	default:
+		p.flowchartChain(&scanner{s: text, off: off})
+	}
+}
+
+// subgraphStatement opens a subgraph: subgraph id, subgraph id [title] or
+// subgraph "title".
+func (p *parser) subgraphStatement(rest string, off int) {
+	id, title := rest, rest
+	if i := strings.IndexByte(rest, '['); i > 0 && strings.HasSuffix(rest, "]") {
+		id, title = strings.TrimSpace(rest[:i]), unquote(rest[i+1:len(rest)-1])
+	} else if strings.HasPrefix(rest, `"`) {
+		id, title = unquote(rest), unquote(rest)
+	}
+	if id == "" {
+		p.errorf(off, off+len("subgraph"), "subgraph needs an id or a title")
+		id = "subgraph"
+	}
+	p.d.Subgraphs = append(p.d.Subgraphs, &Subgraph{
+		ID:     id,
+		Title:  title,
+		Parent: p.subgraph(),
+		Nodes:  []string{},
+		Header: p.d.Statements[p.cur].Span,
+		Stmt:   p.cur,
+	})
+	if parent := p.d.Subgraph(p.subgraph()); parent != nil {
+		parent.Nodes = append(parent.Nodes, id)
+	}
+	p.push(frame{kind: "subgraph", id: id, index: len(p.d.Subgraphs) - 1})
+}
+
+// flowchartChain parses nodes joined by links: A --> B & C -- text --> D.
+func (p *parser) flowchartChain(sc *scanner) {
+	from, ok := p.flowchartGroup(sc)
+	if !ok {
+		p.errorf(sc.at(), sc.off+len(sc.s), "expected a node id, found %q", sc.rest())
+		return
+	}
+	for {
+		sc.skipSpace()
+		if sc.done() {
+			break
+		}
+		start := sc.at()
+		edgeID := ""
+		if n := flowchartEdgeID(sc.rest()); n > 0 {
+			edgeID = sc.rest()[:n-1]
+			sc.i += n
+		}
+		arrow, label, ok := p.flowchartLink(sc)
+		if !ok {
+			p.errorf(sc.at(), sc.off+len(sc.s), "unexpected %q; expected a link such as -->", sc.rest())
+			return
+		}
+		arrowSpan := p.span(start, sc.at())
+		sc.skipSpace()
+		to, ok := p.flowchartGroup(sc)
+		if !ok {
+			p.errorf(start, sc.off+len(sc.s), "link %s needs a node after it", arrow)
+			return
+		}
+		for _, f := range from {
+			for _, t := range to {
+				p.addEdge(&Edge{
+					ID:        edgeID,
+					From:      f.id,
+					To:        t.id,
+					Arrow:     arrow,
+					Label:     label,
+					Span:      Span{Start: f.span.Start, End: t.span.End},
+					ArrowSpan: arrowSpan,
+				})
+			}
+		}
+		p.setKind(stmtEdge)
+		from = to
+	}
+	if p.d.Statements[p.cur].Kind == stmtOther {
+		p.setKind(stmtNode)
+	}
+}
+
+type groupNode struct {
+	id   string
+	span Span
+}
+
+// flowchartGroup parses nodes joined by &.
+func (p *parser) flowchartGroup(sc *scanner) ([]groupNode, bool) {
+	var group []groupNode
+	for {
+		id, ref, ok := p.flowchartNode(sc)
+		if !ok {
+			return nil, false
+		}
+		p.ref(id, ref, "rect")
+		group = append(group, groupNode{id: id, span: ref.Span})
+
+		save := sc.i
+		sc.skipSpace()
+		if !strings.HasPrefix(sc.rest(), "&") {
+			sc.i = save
+			return group, true
+		}
+		sc.i++
+		sc.skipSpace()
+	}
+}
+
+// flowchartNode parses a node mention: an id with an optional shape and
+// label, and :::classes.
+func (p *parser) flowchartNode(sc *scanner) (string, NodeRef, bool) {
+	start := sc.i
+	n := scanID(sc.rest())
+	if n == 0 {
+		return "", NodeRef{}, false
+	}
+	id := sc.s[start : start+n]
+	sc.i += n
+	ref := NodeRef{ID: p.span(sc.off+start, sc.at())}
+
+	if strings.HasPrefix(sc.rest(), "@{") {
+		if end := strings.IndexByte(sc.rest(), '}'); end > 0 {
+			p.shapeProperties(sc.rest()[2:end], &ref, sc.at()+2)
+			sc.i += end + 1
+		}
+	} else {
+		p.flowchartShape(sc, &ref)
+	}
+
+	// A class name ends where a link starts, as in A:::hot-->B.
+	var classes []string
+	for strings.HasPrefix(sc.rest(), ":::") {
+		sc.i += 3
+		m := scanID(sc.rest())
+		classes = append(classes, sc.rest()[:m])
+		sc.i += m
+	}
+	ref.Span = p.span(sc.off+start, sc.at())
+	for _, c := range classes {
+		p.classes = append(p.classes, pendingClass{id: id, class: c})
+	}
+	return id, ref, true
+}
+
+// flowchartShape parses the bracketed label of a node, if there is one.
+func (p *parser) flowchartShape(sc *scanner, ref *NodeRef) {
+	rest := sc.rest()
+	for _, s := range flowchartShapes {
+		if !strings.HasPrefix(rest, s.open) {
+			continue
+		}
+		body := rest[len(s.open):]
+		from, to, end, shape := -1, -1, -1, ""
+
+		// A quoted label may contain brackets.
+		if q := len(body) - len(strings.TrimLeft(body, " ")); strings.HasPrefix(body[q:], `"`) {
+			if e := strings.IndexByte(body[q+1:], '"'); e >= 0 {
+				after := q + 1 + e + 1
+				trail := len(body[after:]) - len(strings.TrimLeft(body[after:], " "))
+				for _, c := range s.closes {
+					if strings.HasPrefix(body[after+trail:], c.close) {
+						from, to, end, shape = q, after, after+trail+len(c.close), c.shape
+						ref.Quoted = true
+						break
+					}
+				}
+			}
+		}
+		if shape == "" {
+			for _, c := range s.closes {
+				if i := strings.Index(body, c.close); i >= 0 && (to < 0 || i < to) {
+					from, to, end, shape = 0, i, i+len(c.close), c.shape
+				}
+			}
+		}
+		if shape == "" {
+			continue
+		}
+
+		base := sc.at() + len(s.open)
+		raw := body[from:to]
+		lead := len(raw) - len(strings.TrimLeft(raw, " "))
+		raw = strings.TrimSpace(raw)
+		ref.Shape = shape
+		ref.Label = unquote(raw)
+		ref.LabelSpan = p.span(base+from+lead, base+from+lead+len(raw))
+		sc.i += len(s.open) + end
+		return
+	}
+}
+
+// shapeProperties parses the properties of the id@{ shape: …, label: … }
+// syntax.
+func (p *parser) shapeProperties(props string, ref *NodeRef, off int) {
+	for _, prop := range splitProperties(props) {
+		key, value, ok := strings.Cut(props[prop[0]:prop[1]], ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "shape":
+			ref.Shape = strings.TrimSpace(value)
+		case "label":
+			raw := strings.TrimSpace(value)
+			start := off + prop[0] + len(key) + 1 + strings.Index(value, raw)
+			ref.Label = unquote(raw)
+			ref.Quoted = strings.HasPrefix(raw, `"`)
+			ref.LabelSpan = p.span(start, start+len(raw))
+		}
+	}
+	if ref.Shape == "" && ref.Label != "" {
+		ref.Shape = "rect"
+	}
+}
+
+// splitProperties returns the ranges of the comma-separated properties in
+// s, skipping commas inside quotes.
+func splitProperties(s string) [][2]int {
+	var ranges [][2]int
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				ranges = append(ranges, [2]int{start, i})
+				start = i + 1
+			}
+		}
+	}
+	return append(ranges, [2]int{start, len(s)})
+}
+
+// flowchartEdgeID returns the length of the edge id and @ that s starts
+// with, as in e1@-->, or 0 if it doesn't start with one.
+func flowchartEdgeID(s string) int {
+	n := scanID(s)
+	if n == 0 || !strings.HasPrefix(s[n:], "@") {
+		return 0
+	}
+	if link := s[n+1:]; flowLinkRe.MatchString(link) || flowLinkOpenRe.MatchString(link) {
+		return n + 1
+	}
+	return 0
+}
+
+// flowchartLink parses a link with any text, returning the arrow without
+// its text: -- text --> gives -->.
+func (p *parser) flowchartLink(sc *scanner) (arrow, label string, ok bool) {
+	rest := sc.rest()
+	if m := flowLinkRe.FindString(rest); m != "" {
+		arrow = m
+		sc.i += len(m)
+	} else if m := flowLinkOpenRe.FindStringSubmatch(rest); m != nil {
+		body := rest[len(m[0]):]
+		loc := flowLinkCloseRes[m[1]].FindStringIndex(body)
+		if loc == nil {
+			return "", "", false
+		}
+		head := strings.TrimSuffix(m[0], m[1])
+		if m[1] == "-." {
+			head += "-"
+		}
+		arrow = head + body[loc[0]:loc[1]]
+		label = strings.TrimSpace(body[:loc[0]])
+		sc.i += len(m[0]) + loc[1]
+	} else {
+		return "", "", false
+	}
+
+	// Text may also follow the arrow between pipes: -->|text|.
+	save := sc.i
+	sc.skipSpace()
+	if strings.HasPrefix(sc.rest(), "|") {
+		if end := strings.IndexByte(sc.rest()[1:], '|'); end >= 0 {
+			label = unquote(sc.rest()[1 : end+1])
+			sc.i += end + 2
+			return arrow, label, true
+		}
+	}
+	sc.i = save
+	return arrow, unquote(label), true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// A message: From->>+To: text. Participant names can't contain the
+	// characters arrows are made of.
+	seqMessageRe = regexp.MustCompile(`^([^\-+<>:,;]+?)\s*(<<-->>|<<->>|-->>|->>|-->|->|--x|-x|--\)|-\))\s*([+-]?)\s*([^\-+<>:,;]+?)\s*(?::(.*))?$`)
+	seqNoteRe    = regexp.MustCompile(`(?i)^note\s+(left of|right of|over)\s+([^:]+?)\s*:(.*)$`)
+)
+
+// sequenceBlocks are the keywords that open a block, and the sections each
+// may be split into.
+var sequenceBlocks = map[string]string{
+	"loop":     "",
+	"alt":      "else",
+	"opt":      "",
+	"par":      "and",
+	"critical": "option",
+	"break":    "",
+	"rect":     "",
+	"box":      "",
+}
+
+// sequenceStatement parses one sequence diagram statement.
+func (p *parser) sequenceStatement(text string, off int) {
+	word, rest := firstWord(text)
+	switch {
+	case word == "participant" || word == "actor":
+		p.declareParticipant(word, rest, off+len(text)-len(rest))
+	case word == "create":
+		kind, rest := firstWord(rest)
+		if kind != "participant" && kind != "actor" {
+			p.errorf(off, off+len(text), "create needs participant or actor")
+			return
+		}
+		p.declareParticipant(kind, rest, off+len(text)-len(rest))
+	case word == "destroy":
+		p.mention(rest, off+len(text)-len(rest))
+	case word == "activate" || word == "deactivate":
+		p.mention(rest, off+len(text)-len(rest))
+	case isSequenceBlock(word):
+		p.d.Blocks = append(p.d.Blocks, &Block{Kind: word, Label: rest, Parent: p.block(), Stmt: p.cur})
+		p.push(frame{kind: "block", index: len(p.d.Blocks) - 1})
+	case word == "else" || word == "and" || word == "option":
+		f, ok := p.top()
+		if !ok || f.kind != "block" || sequenceBlocks[p.d.Blocks[f.index].Kind] != word {
+			p.errorf(off, off+len(word), "%s outside %s", word, sectionBlock(word))
+			return
+		}
+		b := p.d.Blocks[f.index]
+		b.Sections = append(b.Sections, Section{Kind: word, Label: rest, Span: p.d.Statements[p.cur].Span})
+		p.section()
+	case text == "end":
+		if f, ok := p.top(); !ok || f.kind != "block" {
+			p.errorf(off, off+3, "end without a block to close")
+			return
+		}
+		p.pop()
+	case strings.EqualFold(word, "note"):
+		p.sequenceNote(text, off)
+	case word == "autonumber" || word == "title" || strings.HasPrefix(word, "title:") ||
+		strings.HasPrefix(word, "accTitle") || strings.HasPrefix(word, "accDescr") ||
+		word == "link" || word == "links" || word == "properties" || word == "details":
+	default:
+		p.sequenceMessage(text, off)
+	}
+}
+
+func isSequenceBlock(word string) bool {
+	_, ok := sequenceBlocks[word]
+	return ok
+}
+
+// sectionBlock returns the block a section keyword belongs in.
+func sectionBlock(word string) string {
+	for block, section := range sequenceBlocks {
+		if section == word {
+			return block
+		}
+	}
+	return ""
+}
+
+// block returns the index of the innermost block, or -1.
+func (p *parser) block() int {
+	for i := len(p.stack) - 1; i >= 0; i-- {
+		if p.stack[i].kind == "block" {
+			return p.stack[i].index
+		}
+	}
+	return -1
+}
+
+// box returns the label of the box being declared in, if any.
+func (p *parser) box() string {
+	if b := p.block(); b >= 0 && p.d.Blocks[b].Kind == "box" {
+		return p.d.Blocks[b].Label
+	}
+	return ""
+}
+
+// declareParticipant parses participant id or participant id as label.
+func (p *parser) declareParticipant(kind, rest string, off int) {
+	id, label := rest, ""
+	if i := strings.Index(rest, " as "); i >= 0 {
+		id, label = strings.TrimSpace(rest[:i]), strings.TrimSpace(rest[i+4:])
+	}
+	if i := strings.Index(id, "@{"); i >= 0 {
+		id = strings.TrimSpace(id[:i])
+	}
+	if id == "" {
+		p.errorf(off-len(kind)-1, off, "%s needs a name", kind)
+		return
+	}
+	p.setKind(stmtParticipant)
+	pt := p.participant(id, p.span(off, off+len(id)))
+	if !pt.Declared {
+		pt.Span = p.d.Statements[p.cur].Span
+		pt.Stmt = p.cur
+	}
+	pt.Declared = true
+	pt.Kind = kind
+	if label != "" {
+		pt.Label = label
+	}
+	if box := p.box(); box != "" {
+		pt.Box = box
+	}
+}
+
+// mention records a participant named outside a declaration.
+func (p *parser) mention(name string, off int) {
+	if name == "" {
+		return
+	}
+	p.participant(name, p.span(off, off+len(name)))
+}
+
+// participant records a mention of participant id, creating it on first
+// mention.
+func (p *parser) participant(id string, at Span) *Participant {
+	pt := p.d.participants[id]
+	if pt == nil {
+		pt = &Participant{ID: id, Label: id, Kind: "participant", Span: at, Stmt: p.cur}
+		p.d.participants[id] = pt
+		p.d.Participants = append(p.d.Participants, pt)
+	}
+	pt.Refs = append(pt.Refs, at)
+	return pt
+}
+
+// sequenceNote parses Note left of A: text, Note right of A: text and
+// Note over A,B: text.
+func (p *parser) sequenceNote(text string, off int) {
+	m := seqNoteRe.FindStringSubmatchIndex(text)
+	if m == nil {
+		p.errorf(off, off+len(text), "expected Note left of, right of or over a participant, then a colon and text")
+		return
+	}
+	p.setKind(stmtNote)
+	note := &Note{
+		Position: strings.ToLower(text[m[2]:m[3]]),
+		Text:     strings.TrimSpace(text[m[6]:m[7]]),
+		Span:     p.d.Statements[p.cur].Span,
+		Stmt:     p.cur,
+	}
+	at := off + m[4]
+	for _, part := range strings.Split(text[m[4]:m[5]], ",") {
+		name := strings.TrimSpace(part)
+		p.mention(name, at+len(part)-len(strings.TrimLeft(part, " ")))
+		note.Actors = append(note.Actors, name)
+		at += len(part) + 1
+	}
+	p.d.Notes = append(p.d.Notes, note)
+}
+
+// sequenceMessage parses From->>To: text.
+func (p *parser) sequenceMessage(text string, off int) {
+	m := seqMessageRe.FindStringSubmatchIndex(text)
+	if m == nil {
+		p.errorf(off, off+len(text), "unrecognized statement %q", text)
+		return
+	}
+	if m[10] < 0 {
+		p.errorf(off, off+len(text), "message needs a colon and text after %s", text[m[8]:m[9]])
+		return
+	}
+	p.setKind(stmtMessage)
+	from, to := text[m[2]:m[3]], text[m[8]:m[9]]
+	p.participant(from, p.span(off+m[2], off+m[3]))
+	p.participant(to, p.span(off+m[8], off+m[9]))
+	act := text[m[6]:m[7]]
+	p.d.Messages = append(p.d.Messages, &Message{
+		Index:      len(p.d.Messages) + 1,
+		From:       from,
+		To:         to,
+		Arrow:      text[m[4]:m[5]],
+		Text:       strings.TrimSpace(text[m[10]:m[11]]),
+		Activate:   act == "+",
+		Deactivate: act == "-",
+		Block:      p.block(),
+		Span:       p.d.Statements[p.cur].Span,
+		Stmt:       p.cur,
+	})
+}
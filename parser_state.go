@@ -0,0 +1,220 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// stateIDPattern matches a state id or the start and end state [*].
+const stateIDPattern = `(\[\*\]|[\w.\-]+?)(?::::([\w-]+))?`
+
+var (
+	// A transition: A --> B : label.
+	stateTransitionRe = regexp.MustCompile(`^` + stateIDPattern + `\s*-->\s*` + stateIDPattern + `\s*(?::\s*(.*))?$`)
+	// state "Description" as A {
+	stateAliasRe = regexp.MustCompile(`^state\s+"([^"]*)"\s+as\s+([\w.\-]+)\s*(\{)?$`)
+	// state A <<fork>> {
+	stateDeclRe = regexp.MustCompile(`^state\s+([\w.\-]+)\s*(?:<<(\w+)>>)?\s*(\{)?$`)
+	// A : description, or state A : description.
+	stateDescRe = regexp.MustCompile(`^(?:state\s+)?([\w.\-]+)\s*:\s*(.*)$`)
+	stateNoteRe = regexp.MustCompile(`^note\s+(left of|right of)\s+([\w.\-]+)\s*(?::\s*(.*))?$`)
+	stateOnlyRe = regexp.MustCompile(`^` + stateIDPattern + `$`)
+)
+
+// stateStatement parses one state diagram statement.
+func (p *parser) stateStatement(text string, off int) {
+	word, rest := firstWord(text)
+	if word != "state" && p.styleStatement(word, rest, off) {
+		return
+	}
+	switch {
+	case text == "}":
+		if f, ok := p.top(); !ok || f.kind != "state" {
+			p.errorf(off, off+1, "} without a composite state to close")
+			return
+		}
+		p.pop()
+	case text == "--":
+		if f, ok := p.top(); !ok || f.kind != "state" {
+			p.errorf(off, off+2, "-- outside a composite state")
+			return
+		}
+		p.section()
+	case word == "direction":
+		p.setKind(stmtDirection)
+		if f, ok := p.top(); ok && f.kind == "state" && f.index >= 0 {
+			p.d.Subgraphs[f.index].Direction = rest
+		} else {
+			p.d.Direction = rest
+		}
+	case word == "note":
+		p.stateNote(text, off)
+	case word == "hide" || word == "scale" || strings.HasPrefix(word, "accTitle") || strings.HasPrefix(word, "accDescr"):
+	default:
+		p.stateDecl(text, off)
+	}
+}
+
+// stateDecl parses transitions, state declarations and descriptions.
+func (p *parser) stateDecl(text string, off int) {
+	if m := stateTransitionRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtEdge)
+		from := p.stateRef(text, off, m[2], m[3], m[4], m[5])
+		to := p.stateRef(text, off, m[6], m[7], m[8], m[9])
+		arrow := strings.Index(text[m[3]:], "-->") + m[3]
+		e := &Edge{
+			From:      from.ID,
+			To:        to.ID,
+			Arrow:     "-->",
+			Span:      p.span(off+m[2], off+max(m[7], m[9])),
+			ArrowSpan: p.span(off+arrow, off+arrow+3),
+		}
+		if m[10] >= 0 {
+			e.Label = strings.TrimSpace(text[m[10]:m[11]])
+		}
+		p.addEdge(e)
+		return
+	}
+	if m := stateAliasRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtNode)
+		n := p.ref(text[m[4]:m[5]], NodeRef{
+			ID:        p.span(off+m[4], off+m[5]),
+			Span:      p.span(off, off+len(text)),
+			Label:     text[m[2]:m[3]],
+			LabelSpan: p.span(off+m[2]-1, off+m[3]+1),
+			Quoted:    true,
+		}, "state")
+		if m[6] >= 0 {
+			p.composite(n)
+		}
+		return
+	}
+	if m := stateDeclRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtNode)
+		ref := NodeRef{ID: p.span(off+m[2], off+m[3]), Span: p.span(off, off+len(text))}
+		if m[4] >= 0 {
+			ref.Shape = text[m[4]:m[5]]
+		}
+		n := p.ref(text[m[2]:m[3]], ref, "state")
+		if m[6] >= 0 {
+			p.composite(n)
+		}
+		return
+	}
+	if m := stateDescRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtNode)
+		desc := strings.TrimSpace(text[m[4]:m[5]])
+		start := off + m[4] + strings.Index(text[m[4]:], desc)
+		n := p.d.nodes[text[m[2]:m[3]]]
+		label := desc
+		if n != nil && n.labeled() {
+			label = n.Label + "\n" + desc
+		}
+		p.ref(text[m[2]:m[3]], NodeRef{
+			ID:        p.span(off+m[2], off+m[3]),
+			Span:      p.span(off, off+len(text)),
+			Label:     label,
+			LabelSpan: p.span(start, start+len(desc)),
+		}, "state")
+		return
+	}
+	if m := stateOnlyRe.FindStringSubmatchIndex(text); m != nil {
+		p.setKind(stmtNode)
+		p.stateRef(text, off, m[2], m[3], m[4], m[5])
+		return
+	}
+	p.errorf(off, off+len(text), "unrecognized statement %q", text)
+}
+
+// labeled reports whether a label was given in any mention of the node.
+func (n *Node) labeled() bool {
+	for _, r := range n.Refs {
+		if r.Label != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// stateRef records a mention of the state at text[from:to], with a :::class
+// at text[cfrom:cto] if any. Each composite state has a [*] of its own.
+func (p *parser) stateRef(text string, off, from, to, cfrom, cto int) *Node {
+	id := text[from:to]
+	end := to
+	if cfrom >= 0 {
+		end = cto
+	}
+	ref := NodeRef{ID: p.span(off+from, off+to), Span: p.span(off+from, off+end)}
+	shape := "state"
+	if id == "[*]" {
+		shape = "terminal"
+		ref.Label = id
+		if sg := p.subgraph(); sg != "" {
+			id = sg + "/[*]"
+		}
+	}
+	n := p.ref(id, ref, shape)
+	if cfrom >= 0 {
+		p.classes = append(p.classes, pendingClass{id: id, class: text[cfrom:cto]})
+	}
+	return n
+}
+
+// composite opens the composite state n.
+func (p *parser) composite(n *Node) {
+	p.d.Subgraphs = append(p.d.Subgraphs, &Subgraph{
+		ID:     n.ID,
+		Title:  n.Label,
+		Parent: p.subgraph(),
+		Nodes:  []string{},
+		Header: p.d.Statements[p.cur].Span,
+		Stmt:   p.cur,
+	})
+	p.push(frame{kind: "state", id: n.ID, index: len(p.d.Subgraphs) - 1})
+}
+
+// stateNote parses note left of A : text, or the first line of a note
+// running to end note.
+func (p *parser) stateNote(text string, off int) {
+	m := stateNoteRe.FindStringSubmatchIndex(text)
+	if m == nil {
+		p.errorf(off, off+len(text), "expected note left of or right of a state")
+		return
+	}
+	p.setKind(stmtNote)
+	n := p.stateRef(text, off, m[4], m[5], -1, -1)
+	note := &Note{
+		Position: text[m[2]:m[3]],
+		Actors:   []string{n.ID},
+		Span:     p.d.Statements[p.cur].Span,
+		Stmt:     p.cur,
+	}
+	if m[6] >= 0 {
+		note.Text = strings.TrimSpace(text[m[6]:m[7]])
+	}
+	p.d.Notes = append(p.d.Notes, note)
+	if m[6] < 0 {
+		p.push(frame{kind: "note", index: len(p.d.Notes) - 1})
+	}
+}
+
+// inNote reports whether the parser is inside a note running to end note.
+func (p *parser) inNote() bool {
+	f, ok := p.top()
+	return ok && f.kind == "note"
+}
+
+// stateNoteLine parses a line of a note running to end note.
+func (p *parser) stateNoteLine(text string) {
+	f, _ := p.top()
+	if text == "end note" {
+		p.pop()
+		return
+	}
+	p.setKind(stmtMember)
+	note := p.d.Notes[f.index]
+	if note.Text != "" {
+		note.Text += "\n"
+	}
+	note.Text += text
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseDiagram(t *testing.T) {
+	Convey("ParseDiagram", t, func() {
+		Convey("Finds the kind of diagram past front matter and comments", func() {
+			d := ParseDiagram("---\ntitle: Flow\n---\n%% a comment\n%%{init: {'theme': 'dark'}}%%\nflowchart LR\n  A-->B")
+			So(d.Kind, ShouldEqual, kindFlowchart)
+			So(d.Header, ShouldEqual, "flowchart")
+			So(d.Direction, ShouldEqual, "LR")
+			So(d.Errors, ShouldBeEmpty)
+
+			So(ParseDiagram("graph TD").Kind, ShouldEqual, kindFlowchart)
+			So(ParseDiagram("stateDiagram-v2").Kind, ShouldEqual, kindState)
+			So(ParseDiagram("gantt\n  title Plan").Kind, ShouldEqual, "gantt")
+			So(ParseDiagram("").Kind, ShouldEqual, "")
+		})
+
+		Convey("Reports an unknown diagram type", func() {
+			d := ParseDiagram("flowchat TD\n  A-->B")
+			So(d.Errors, ShouldNotBeEmpty)
+			So(d.Errors[0].Span.Start.Line, ShouldEqual, 1)
+		})
+
+		Convey("Records the position of each statement", func() {
+			d := ParseDiagram("graph TD\n  A-->B\n  B-->C")
+			So(d.Statements, ShouldHaveLength, 3)
+			s := d.Statements[2]
+			So(s.Kind, ShouldEqual, stmtEdge)
+			So(s.Text, ShouldEqual, "B-->C")
+			So(s.Span.Start, ShouldResemble, Pos{Offset: 19, Line: 3, Col: 3})
+			So(s.Span.End.Col, ShouldEqual, 8)
+		})
+
+		Convey("Gives the nesting depth of statements in blocks", func() {
+			d := ParseDiagram("graph TD\n  subgraph one\n    A\n  end\n  B")
+			So(d.Statements[1].Kind, ShouldEqual, stmtOpen)
+			So(d.Statements[1].Depth, ShouldEqual, 0)
+			So(d.Statements[2].Depth, ShouldEqual, 1)
+			So(d.Statements[3].Kind, ShouldEqual, stmtClose)
+			So(d.Statements[3].Depth, ShouldEqual, 0)
+		})
+
+		Convey("Reports blocks left open", func() {
+			d := ParseDiagram("graph TD\n  subgraph one\n    A")
+			So(d.Errors, ShouldHaveLength, 1)
+			So(d.Errors[0].Message, ShouldContainSubstring, "end")
+		})
+
+		Convey("Parses style statements", func() {
+			d := ParseDiagram("graph TD\n  A-->B\n  classDef hot fill:#f00\n  class A hot\n  style B stroke:#00f\n  linkStyle 0 stroke:#0f0")
+			So(d.ClassDefs, ShouldHaveLength, 1)
+			So(d.ClassDefs[0].Name, ShouldEqual, "hot")
+			So(d.ClassDefs[0].Styles, ShouldEqual, "fill:#f00")
+			So(d.Node("A").Classes, ShouldResemble, []string{"hot"})
+			So(d.Styles, ShouldHaveLength, 2)
+			So(d.Styles[0].Target, ShouldEqual, "B")
+			So(d.Styles[1].Link, ShouldBeTrue)
+			So(d.Styles[1].Target, ShouldEqual, "0")
+		})
+	})
+}
+
+func TestParseFlowchart(t *testing.T) {
+	Convey("ParseDiagram with a flowchart", t, func() {
+		Convey("Parses nodes with their labels and shapes", func() {
+			d := ParseDiagram("flowchart TD\n  A[Start] --> B{Is it?}\n  B -->|Yes| C((Done))\n  D[(\"Store (db)\")]")
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Nodes, ShouldHaveLength, 4)
+			So(d.Node("A").Label, ShouldEqual, "Start")
+			So(d.Node("A").Shape, ShouldEqual, "rect")
+			So(d.Node("B").Shape, ShouldEqual, "rhombus")
+			So(d.Node("C").Shape, ShouldEqual, "circle")
+			So(d.Node("D").Label, ShouldEqual, "Store (db)")
+			So(d.Node("D").Shape, ShouldEqual, "cylinder")
+		})
+
+		Convey("Gives undefined nodes their id as label", func() {
+			d := ParseDiagram("graph TD\n  A --> B")
+			So(d.Node("B").Label, ShouldEqual, "B")
+			So(d.Node("B").Shape, ShouldEqual, "rect")
+		})
+
+		Convey("Keeps every mention of a node", func() {
+			d := ParseDiagram("graph TD\n  A[Start] --> B\n  B --> A")
+			a := d.Node("A")
+			So(a.Refs, ShouldHaveLength, 2)
+			So(a.Refs[0].ID.Start.Col, ShouldEqual, 3)
+			So(a.Refs[0].Label, ShouldEqual, "Start")
+			So(a.Refs[1].ID.Start.Line, ShouldEqual, 3)
+			So(a.Span.Start.Line, ShouldEqual, 2)
+		})
+
+		Convey("Parses edges with their arrows and labels", func() {
+			d := ParseDiagram("graph LR\n  A -- goes to --> B\n  B -.-> C\n  C ==>|fast| D\n  D --- E")
+			So(d.Edges, ShouldHaveLength, 4)
+			So(d.Edges[0].Label, ShouldEqual, "goes to")
+			So(d.Edges[0].Arrow, ShouldEqual, "-->")
+			So(d.Edges[1].Arrow, ShouldEqual, "-.->")
+			So(d.Edges[2].Label, ShouldEqual, "fast")
+			So(d.Edges[2].Arrow, ShouldEqual, "==>")
+			So(d.Edges[3].Arrow, ShouldEqual, "---")
+			So(d.Edges[3].Index, ShouldEqual, 3)
+		})
+
+		Convey("Expands chains and & groups into edges", func() {
+			d := ParseDiagram("graph LR\n  A & B --> C --> D")
+			So(d.Edges, ShouldHaveLength, 3)
+			So(d.Edges[0].From, ShouldEqual, "A")
+			So(d.Edges[1].From, ShouldEqual, "B")
+			So(d.Edges[2].From, ShouldEqual, "C")
+			So(d.Edges[2].To, ShouldEqual, "D")
+		})
+
+		Convey("Splits statements at semicolons", func() {
+			d := ParseDiagram("graph TD; A-->B; B-->C;")
+			So(d.Edges, ShouldHaveLength, 2)
+		})
+
+		Convey("Parses subgraphs and puts nodes in them", func() {
+			d := ParseDiagram("graph TD\n  subgraph outer [Outer]\n    direction LR\n    subgraph inner\n      A\n    end\n    B\n  end\n  A --> C")
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Subgraphs, ShouldHaveLength, 2)
+			outer := d.Subgraph("outer")
+			So(outer.Title, ShouldEqual, "Outer")
+			So(outer.Direction, ShouldEqual, "LR")
+			So(outer.Span.End.Line, ShouldEqual, 8)
+			So(d.Subgraph("inner").Parent, ShouldEqual, "outer")
+			So(d.Node("A").Subgraph, ShouldEqual, "inner")
+			So(d.Node("B").Subgraph, ShouldEqual, "outer")
+			So(d.Node("C").Subgraph, ShouldEqual, "")
+			So(d.Node("outer"), ShouldBeNil)
+		})
+
+		Convey("Parses classes given with :::", func() {
+			d := ParseDiagram("graph TD\n  A:::hot --> B")
+			So(d.Node("A").Classes, ShouldResemble, []string{"hot"})
+		})
+
+		Convey("Ends a ::: class where a link starts", func() {
+			d := ParseDiagram("graph TD\n  A:::foo-->C\n  B:::my-class-.->C")
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Node("A").Classes, ShouldResemble, []string{"foo"})
+			So(d.Node("B").Classes, ShouldResemble, []string{"my-class"})
+			So(d.Edges, ShouldHaveLength, 2)
+			So(d.Edges[1].Arrow, ShouldEqual, "-.->")
+		})
+
+		Convey("Parses edge ids", func() {
+			d := ParseDiagram("graph TD\n  A e1@--> B\n  B e2@-- text --> C\n  e1@{ animate: true }")
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Edges, ShouldHaveLength, 2)
+			So(d.Edges[0].ID, ShouldEqual, "e1")
+			So(d.Edges[0].Arrow, ShouldEqual, "-->")
+			So(d.Edges[1].ID, ShouldEqual, "e2")
+			So(d.Edges[1].Label, ShouldEqual, "text")
+			So(d.Node("e1"), ShouldBeNil)
+			So(d.Nodes, ShouldHaveLength, 3)
+		})
+
+		Convey("Reports end outside a subgraph", func() {
+			d := ParseDiagram("graph TD\n  A\n  end")
+			So(d.Errors, ShouldHaveLength, 1)
+			So(d.Errors[0].Span.Start.Line, ShouldEqual, 3)
+		})
+
+		Convey("Finds every mention of an id, in style statements too", func() {
+			src := "graph TD\n  A --> B\n  B --> A\n  class A,B hot\n  style A fill:#f00\n  click A href"
+			var found []string
+			for _, span := range ParseDiagram(src).Mentions("A") {
+				found = append(found, fmt.Sprintf("%d:%d %s", span.Start.Line, span.Start.Col, src[span.Start.Offset:span.End.Offset]))
+			}
+			So(found, ShouldResemble, []string{"2:3 A", "3:9 A", "4:9 A", "5:9 A", "6:9 A"})
+		})
+	})
+}
+
+func TestParseSequence(t *testing.T) {
+	Convey("ParseDiagram with a sequence diagram", t, func() {
+		Convey("Parses participants and messages", func() {
+			d := ParseDiagram("sequenceDiagram\n  participant A as Alice\n  actor B\n  A->>+B: Hello\n  B-->>-A: Hi\n  A->>C: Also")
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Participants, ShouldHaveLength, 3)
+			So(d.Participant("A").Label, ShouldEqual, "Alice")
+			So(d.Participant("A").Declared, ShouldBeTrue)
+			So(d.Participant("B").Kind, ShouldEqual, "actor")
+			So(d.Participant("C").Declared, ShouldBeFalse)
+			So(d.Messages, ShouldHaveLength, 3)
+			m := d.Messages[0]
+			So(m.Index, ShouldEqual, 1)
+			So(m.From, ShouldEqual, "A")
+			So(m.To, ShouldEqual, "B")
+			So(m.Arrow, ShouldEqual, "->>")
+			So(m.Text, ShouldEqual, "Hello")
+			So(m.Activate, ShouldBeTrue)
+			So(d.Messages[1].Deactivate, ShouldBeTrue)
+			So(d.Messages[1].Arrow, ShouldEqual, "-->>")
+		})
+
+		Convey("Parses blocks and their sections", func() {
+			d := ParseDiagram("sequenceDiagram\n  alt ok\n    A->>B: yes\n  else not ok\n    A->>B: no\n  end\n  loop every minute\n    A->>B: ping\n  end")
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Blocks, ShouldHaveLength, 2)
+			So(d.Blocks[0].Kind, ShouldEqual, "alt")
+			So(d.Blocks[0].Label, ShouldEqual, "ok")
+			So(d.Blocks[0].Sections, ShouldHaveLength, 1)
+			So(d.Blocks[0].Sections[0].Label, ShouldEqual, "not ok")
+			So(d.Blocks[0].Span.End.Line, ShouldEqual, 6)
+			So(d.Messages[1].Block, ShouldEqual, 0)
+			So(d.Messages[2].Block, ShouldEqual, 1)
+		})
+
+		Convey("Parses notes", func() {
+			d := ParseDiagram("sequenceDiagram\n  Note over A,B: Both\n  note left of A: One")
+			So(d.Notes, ShouldHaveLength, 2)
+			So(d.Notes[0].Position, ShouldEqual, "over")
+			So(d.Notes[0].Actors, ShouldResemble, []string{"A", "B"})
+			So(d.Notes[0].Text, ShouldEqual, "Both")
+			So(d.Notes[1].Position, ShouldEqual, "left of")
+		})
+
+		Convey("Reports a message without text", func() {
+			d := ParseDiagram("sequenceDiagram\n  A->>B")
+			So(d.Errors, ShouldHaveLength, 1)
+			So(d.Errors[0].Message, ShouldContainSubstring, "colon")
+		})
+
+		Convey("Reports a section outside its block", func() {
+			d := ParseDiagram("sequenceDiagram\n  loop\n    A->>B: x\n  else\n  end")
+			So(d.Errors, ShouldHaveLength, 1)
+			So(d.Errors[0].Message, ShouldEqual, "else outside alt")
+		})
+	})
+}
+
+func TestParseClass(t *testing.T) {
+	Convey("ParseDiagram with a class diagram", t, func() {
+		d := ParseDiagram("classDiagram\n  class Animal {\n    +String name\n    +eat()\n  }\n  <<interface>> Animal\n  Animal <|-- Duck : is\n  Duck \"1\" --> \"*\" Egg\n  Duck : +swim()\n  class List~T~\n  namespace Farm {\n    class Cow\n  }")
+		So(d.Errors, ShouldBeEmpty)
+
+		Convey("Parses classes with their members", func() {
+			So(d.Node("Animal").Members, ShouldResemble, []string{"+String name", "+eat()", "<<interface>>"})
+			So(d.Node("Duck").Members, ShouldResemble, []string{"+swim()"})
+			So(d.Node("List").Label, ShouldEqual, "List~T~")
+		})
+
+		Convey("Parses relationships with their cardinalities", func() {
+			So(d.Edges, ShouldHaveLength, 2)
+			So(d.Edges[0].From, ShouldEqual, "Animal")
+			So(d.Edges[0].Arrow, ShouldEqual, "<|--")
+			So(d.Edges[0].Label, ShouldEqual, "is")
+			So(d.Edges[1].FromLabel, ShouldEqual, "1")
+			So(d.Edges[1].ToLabel, ShouldEqual, "*")
+		})
+
+		Convey("Puts classes in namespaces", func() {
+			So(d.Subgraph("Farm"), ShouldNotBeNil)
+			So(d.Node("Cow").Subgraph, ShouldEqual, "Farm")
+		})
+	})
+}
+
+func TestParseState(t *testing.T) {
+	Convey("ParseDiagram with a state diagram", t, func() {
+		d := ParseDiagram("stateDiagram-v2\n  [*] --> Idle\n  Idle --> Busy : start\n  state \"Working hard\" as Busy {\n    [*] --> Step\n    Step --> [*]\n  }\n  Idle : waiting\n  note right of Idle : resting\n  Busy --> [*]")
+		So(d.Errors, ShouldBeEmpty)
+
+		Convey("Parses states and transitions", func() {
+			So(d.Node("Busy").Label, ShouldEqual, "Working hard")
+			So(d.Node("Idle").Label, ShouldEqual, "waiting")
+			So(d.Edges, ShouldHaveLength, 5)
+			So(d.Edges[1].Label, ShouldEqual, "start")
+		})
+
+		Convey("Gives each composite state its own start and end", func() {
+			So(d.Edges[2].From, ShouldEqual, "Busy/[*]")
+			So(d.Node("Busy/[*]").Shape, ShouldEqual, "terminal")
+			So(d.Edges[4].To, ShouldEqual, "[*]")
+			So(d.Node("Step").Subgraph, ShouldEqual, "Busy")
+		})
+
+		Convey("Parses notes", func() {
+			So(d.Notes, ShouldHaveLength, 1)
+			So(d.Notes[0].Actors, ShouldResemble, []string{"Idle"})
+			So(d.Notes[0].Text, ShouldEqual, "resting")
+		})
+
+		Convey("Parses notes running to end note", func() {
+			d := ParseDiagram("stateDiagram-v2\n  A\n  note left of A\n    first\n    second\n  end note")
+			So(d.Errors, ShouldBeEmpty)
+			So(d.Notes[0].Text, ShouldEqual, "first\nsecond")
+		})
+	})
+}
+
+func TestParseER(t *testing.T) {
+	Convey("ParseDiagram with an entity relationship diagram", t, func() {
+		d := ParseDiagram("erDiagram\n  CUSTOMER ||--o{ ORDER : places\n  ORDER {\n    string id PK\n  }")
+		So(d.Errors, ShouldBeEmpty)
+		So(d.Edges, ShouldHaveLength, 1)
+		So(d.Edges[0].Arrow, ShouldEqual, "||--o{")
+		So(d.Edges[0].Label, ShouldEqual, "places")
+		So(d.Node("ORDER").Members, ShouldResemble, []string{"string id PK"})
+	})
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// SanitizeFix is a mistake the sanitizer fixed.
+type SanitizeFix struct {
+	Rule    string `json:"rule"`
+	Line    int    `json:"line,omitempty"` // in the fixed diagram; none for a removed code fence
+	Message string `json:"message"`
+}
+
+// sanitizer fixes the mistakes agents most often make in Mermaid text, one
+// kind at a time, so that each pass sees the fixes of the ones before.
+type sanitizer struct {
+	src   string
+	edits []textEdit
+	fixes []SanitizeFix
+}
+
+// sanitizePasses run in order. The code fences and quotes go first, as
+// they keep the diagram from parsing at all.
+var sanitizePasses = []func(*sanitizer){
+	sanitizeFences,
+	sanitizeQuotes,
+	sanitizeDiagramType,
+	sanitizeDirections,
+	sanitizeLabels,
+	sanitizeReservedIDs,
+}
+
+var (
+	fenceOpenRe  = regexp.MustCompile("^(```|~~~)\\s*(mermaid)?\\s*$")
+	fenceCloseRe = regexp.MustCompile("^(```|~~~)\\s*$")
+)
+
+// smartQuotes straightens the curly quotes word processors and chat
+// interfaces put in.
+var smartQuotes = strings.NewReplacer("“", `"`, "”", `"`, "„", `"`, "‘", "'", "’", "'")
+
+// directionWords are the directions people write out instead of using
+// Mermaid's abbreviations, in capitals without hyphens or spaces, and the
+// abbreviations they get backwards.
+var directionWords = map[string]string{
+	"DT":          "TD",
+	"VERTICAL":    "TD",
+	"HORIZONTAL":  "LR",
+	"TOPDOWN":     "TD",
+	"TOPBOTTOM":   "TB",
+	"TOPTOBOTTOM": "TB",
+	"DOWN":        "TD",
+	"BOTTOMUP":    "BT",
+	"BOTTOMTOP":   "BT",
+	"BOTTOMTOTOP": "BT",
+	"UP":          "BT",
+	"LEFTRIGHT":   "LR",
+	"LEFTTORIGHT": "LR",
+	"RIGHT":       "LR",
+	"RIGHTLEFT":   "RL",
+	"RIGHTTOLEFT": "RL",
+	"LEFT":        "RL",
+}
+
+// SanitizeDiagram fixes the common mistakes that keep agent-written
+// diagrams from rendering: a markdown code fence around the diagram, curly
+// quotes, a misspelled diagram type or direction, labels with quotes or
+// brackets that aren't in quotes, and end used as an id. The fixes are
+// deterministic, and each is reported.
+func SanitizeDiagram(src string) (string, []SanitizeFix) {
+	s := &sanitizer{src: src, fixes: []SanitizeFix{}}
+	for _, pass := range sanitizePasses {
+		pass(s)
+		s.apply()
+	}
+	return s.src, s.fixes
+}
+
+// edit queues a replacement of src[from:to] and records the fix.
+func (s *sanitizer) edit(from, to int, text string, rule string, line int, format string, args ...any) {
+	s.edits = append(s.edits, textEdit{from, to, text})
+	s.fix(rule, line, format, args...)
+}
+
+func (s *sanitizer) fix(rule string, line int, format string, args ...any) {
+	s.fixes = append(s.fixes, SanitizeFix{Rule: rule, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// apply makes the queued edits, which must not overlap.
+func (s *sanitizer) apply() {
+	s.src = applyEdits(s.src, s.edits)
+	s.edits = nil
+}
+
+// sanitizeFences removes a markdown code fence around the diagram.
+func sanitizeFences(s *sanitizer) {
+	lines := strings.Split(s.src, "\n")
+	first, last := 0, len(lines)-1
+	for first < len(lines) && strings.TrimSpace(lines[first]) == "" {
+		first++
+	}
+	for last > first && strings.TrimSpace(lines[last]) == "" {
+		last--
+	}
+	if first >= len(lines) || !fenceOpenRe.MatchString(strings.TrimSpace(lines[first])) {
+		return
+	}
+	if last > first && fenceCloseRe.MatchString(strings.TrimSpace(lines[last])) {
+		lines = append(lines[:last], lines[last+1:]...)
+	}
+	s.src = strings.Join(lines[first+1:], "\n")
+	s.fix("code-fence", 0, "removed the markdown code fence around the diagram; send the diagram text alone")
+}
+
+// sanitizeQuotes straightens curly quotes, which Mermaid doesn't take for
+// quotes.
+func sanitizeQuotes(s *sanitizer) {
+	offset := 0
+	for i, line := range strings.SplitAfter(s.src, "\n") {
+		if fixed := smartQuotes.Replace(line); fixed != line {
+			s.edit(offset, offset+len(line), fixed, "smart-quotes", i+1, "replaced curly quotes with straight ones")
+		}
+		offset += len(line)
+	}
+}
+
+// headerStatement returns the statement naming the diagram type, if any.
+func headerStatement(d *Diagram) *Statement {
+	for i, st := range d.Statements {
+		switch st.Kind {
+		case stmtBlank, stmtComment, stmtDirective:
+			continue
+		}
+		return &d.Statements[i]
+	}
+	return nil
+}
+
+// sanitizeDiagramType fixes the capitalization or spelling of the diagram
+// type, as in Flowchart, sequencediagram or grpah.
+func sanitizeDiagramType(s *sanitizer) {
+	d := ParseDiagram(s.src)
+	st := headerStatement(d)
+	if st == nil || d.Kind != "" {
+		return
+	}
+	word, _ := firstWord(st.Text)
+	word = strings.TrimSuffix(word, ";")
+	keywords := make([]string, 0, len(diagramKinds))
+	for keyword := range diagramKinds {
+		if strings.EqualFold(keyword, word) {
+			keywords = []string{keyword}
+			break
+		}
+		keywords = append(keywords, keyword)
+	}
+	keyword := closestWord(strings.ToLower(word), keywords, strings.ToLower)
+	if keyword == "" {
+		return
+	}
+	off := st.Span.Start.Offset
+	s.edit(off, off+len(word), keyword, "diagram-type", st.Span.Start.Line, "changed the diagram type %s to %s", word, keyword)
+}
+
+// closestWord returns the one word of words, compared as norm makes them,
+// that is nearest to word and close enough to be a typo of it: a letter
+// or two wrong, missing, extra or swapped, and one for short words. It
+// returns "" if no word is that close, or two are equally close.
+func closestWord(word string, words []string, norm func(string) string) string {
+	limit := 1
+	if len(word) > 5 {
+		limit = 2
+	}
+	best, bestDist, tied := "", limit+1, false
+	for _, w := range words {
+		switch dist := editDistance(word, norm(w)); {
+		case dist < bestDist:
+			best, bestDist, tied = w, dist, false
+		case dist == bestDist:
+			tied = true
+		}
+	}
+	if tied {
+		return ""
+	}
+	return best
+}
+
+// editDistance returns how many letters have to be changed, added, removed
+// or swapped with their neighbor to turn a into b.
+func editDistance(a, b string) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(a)][len(b)]
+}
+
+// normalDirection returns the flowchart direction dir was meant to be, or
+// "" if it can't tell.
+func normalDirection(dir string) string {
+	d := strings.NewReplacer("-", "", "_", "", " ", "", ">", "").Replace(strings.ToUpper(dir))
+	if flowchartDirections[d] {
+		return d
+	}
+	if fixed, ok := directionWords[d]; ok {
+		return fixed
+	}
+	// Two letters are too few to tell one typo from another, as DT is as
+	// near BT as TD; only the words are matched loosely.
+	if len(d) <= 2 {
+		return ""
+	}
+	words := make([]string, 0, len(directionWords))
+	for w := range directionWords {
+		words = append(words, w)
+	}
+	return directionWords[closestWord(d, words, func(w string) string { return w })]
+}
+
+// sanitizeDirections fixes misspelled flowchart directions, as in graph td
+// or direction left-right.
+func sanitizeDirections(s *sanitizer) {
+	d := ParseDiagram(s.src)
+	if d.Kind != kindFlowchart {
+		return
+	}
+	for _, st := range d.Statements {
+		if st.Kind != stmtHeader && st.Kind != stmtDirection {
+			continue
+		}
+		word, dir := firstWord(st.Text)
+		if dir == "" || flowchartDirections[dir] {
+			continue
+		}
+		fixed := normalDirection(dir)
+		if fixed == "" {
+			continue
+		}
+		off := st.Span.Start.Offset + strings.Index(st.Text[len(word):], dir) + len(word)
+		s.edit(off, off+len(dir), fixed, "direction", st.Span.Start.Line, "changed the direction %s to %s; use TB, TD, BT, RL or LR", dir, fixed)
+	}
+}
+
+// labelBrackets are the brackets of the shapes whose label may itself hold
+// a matching pair, as in A[List [1]].
+var labelBrackets = map[string][2]byte{"rect": {'[', ']'}, "round": {'(', ')'}, "rhombus": {'{', '}'}}
+
+// sanitizeLabels puts flowchart labels with quotes, parentheses or brackets
+// in quotes, so Mermaid doesn't take them for the end of the label or for a
+// shape. A broken label keeps the parser from seeing the rest of its line,
+// so it goes again until there is nothing more to quote.
+func sanitizeLabels(s *sanitizer) {
+	for {
+		d := ParseDiagram(s.src)
+		if d.Kind != kindFlowchart {
+			return
+		}
+		quoteLabels(s, d)
+		if len(s.edits) == 0 {
+			return
+		}
+		s.apply()
+	}
+}
+
+// quoteLabels queues the quoting of the labels of d that need it.
+func quoteLabels(s *sanitizer, d *Diagram) {
+	for _, n := range d.Nodes {
+		for _, r := range n.Refs {
+			if r.Label == "" || r.Quoted {
+				continue
+			}
+			from, to := r.LabelSpan.Start.Offset, r.LabelSpan.End.Offset
+			// The parser ends the label at the first closing bracket; take
+			// in the pairs the label opened, up to the bracket that closes
+			// the shape.
+			if b, ok := labelBrackets[r.Shape]; ok && !strings.HasPrefix(s.src[r.ID.End.Offset:], "@{") {
+				depth := 1 + strings.Count(s.src[from:to], string(b[0])) - strings.Count(s.src[from:to], string(b[1]))
+				if depth > 1 {
+					// The parser's closing bracket closes a pair of the
+					// label's; look on from there.
+					for i := to; depth > 0 && i < len(s.src) && s.src[i] != '\n'; i++ {
+						switch s.src[i] {
+						case b[0]:
+							depth++
+						case b[1]:
+							if depth--; depth == 0 {
+								to = i
+							}
+						}
+					}
+					if depth > 0 {
+						continue
+					}
+				}
+			}
+			label := s.src[from:to]
+			if len(label) >= 2 && label[0] == '"' && label[len(label)-1] == '"' {
+				label = label[1 : len(label)-1]
+			}
+			if !strings.ContainsAny(label, `"()[]{}`) {
+				continue
+			}
+			s.edit(from, to, `"`+strings.ReplaceAll(label, `"`, "#quot;")+`"`, "label", r.LabelSpan.Start.Line,
+				"put the label of %s in quotes, as it has quotes or brackets; write a quote inside a label as #quot;", n.ID)
+		}
+	}
+}
+
+// sanitizeReservedIDs renames a node or participant called end, which
+// Mermaid takes for the end of a block, keeping end as what is shown.
+func sanitizeReservedIDs(s *sanitizer) {
+	d := ParseDiagram(s.src)
+	switch d.Kind {
+	case kindFlowchart:
+		n := d.Node("end")
+		if n == nil {
+			return
+		}
+		id := freeID(d, "End")
+		for i, r := range n.Refs {
+			text := id
+			if i == 0 && !n.defined() {
+				text += "[end]"
+			}
+			s.edits = append(s.edits, textEdit{r.ID.Start.Offset, r.ID.End.Offset, text})
+		}
+		s.fix("reserved-id", n.Refs[0].ID.Start.Line, "renamed node end to %s, as end closes a subgraph; end is still its label", id)
+	case kindSequence:
+		p := d.Participant("end")
+		if p == nil {
+			return
+		}
+		id := freeID(d, "End")
+		for _, r := range p.Refs {
+			text := id
+			if p.Declared && p.Label == "end" && r.Start.Offset >= p.Span.Start.Offset && r.End.Offset <= p.Span.End.Offset {
+				text += " as end"
+			}
+			s.edits = append(s.edits, textEdit{r.Start.Offset, r.End.Offset, text})
+		}
+		s.fix("reserved-id", p.Refs[0].Start.Line, "renamed participant end to %s, as end closes a block", id)
+	}
+}
+
+// freeID returns id, or id with a number after it, whichever isn't taken.
+func freeID(d *Diagram, id string) string {
+	taken := func(id string) bool {
+		return d.Node(id) != nil || d.Subgraph(id) != nil || d.Participant(id) != nil
+	}
+	if !taken(id) {
+		return id
+	}
+	for i := 2; ; i++ {
+		if candidate := fmt.Sprintf("%s%d", id, i); !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// sanitizeByDefault reports whether the user asked, in their preferences,
+// for writes to be sanitized.
+func sanitizeByDefault() bool {
+	data, err := os.ReadFile(prefsFile())
+	if err != nil {
+		return false
+	}
+	var prefs struct {
+		Sanitize bool `json:"sanitize"`
+	}
+	json.Unmarshal(data, &prefs)
+	return prefs.Sanitize
+}
+
+// sanitizeWrite sanitizes content written by an agent or script if asked
+// to, or else if the user prefers it.
+func sanitizeWrite(content string, sanitize *bool) (string, []SanitizeFix) {
+	if sanitize == nil && !sanitizeByDefault() || sanitize != nil && !*sanitize {
+		return content, nil
+	}
+	return SanitizeDiagram(content)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fixRules returns the rule of each fix.
+func fixRules(fixes []SanitizeFix) []string {
+	out := []string{}
+	for _, f := range fixes {
+		out = append(out, f.Rule)
+	}
+	return out
+}
+
+func TestSanitizeDiagram(t *testing.T) {
+	Convey("SanitizeDiagram", t, func() {
+		Convey("Leaves a good diagram alone", func() {
+			src := "graph TD\n  A[\"Start (here)\"] --> B{OK?}\n  B -->|yes| C"
+			out, fixes := SanitizeDiagram(src)
+			So(out, ShouldEqual, src)
+			So(fixes, ShouldBeEmpty)
+		})
+
+		Convey("Removes a code fence around the diagram", func() {
+			out, fixes := SanitizeDiagram("```mermaid\ngraph TD\n  A --> B\n```\n")
+			So(out, ShouldEqual, "graph TD\n  A --> B\n")
+			So(fixRules(fixes), ShouldResemble, []string{"code-fence"})
+			So(fixes[0].Line, ShouldEqual, 0)
+		})
+
+		Convey("Straightens curly quotes", func() {
+			out, fixes := SanitizeDiagram("graph TD\n  A[“Bob’s”] --> B")
+			So(out, ShouldEqual, "graph TD\n  A[\"Bob's\"] --> B")
+			So(fixRules(fixes), ShouldResemble, []string{"smart-quotes"})
+			So(fixes[0].Line, ShouldEqual, 2)
+		})
+
+		Convey("Fixes the diagram type and direction", func() {
+			out, fixes := SanitizeDiagram("Flowchart td\n  subgraph s\n    direction left-right\n    A\n  end")
+			So(out, ShouldEqual, "flowchart TD\n  subgraph s\n    direction LR\n    A\n  end")
+			So(fixRules(fixes), ShouldResemble, []string{"diagram-type", "direction", "direction"})
+			So(fixes[2].Line, ShouldEqual, 3)
+
+			out, _ = SanitizeDiagram("sequencediagram\n  A->>B: hi")
+			So(out, ShouldEqual, "sequenceDiagram\n  A->>B: hi")
+		})
+
+		Convey("Fixes a misspelled diagram type", func() {
+			out, fixes := SanitizeDiagram("grpah TD\n  A --> B")
+			So(out, ShouldEqual, "graph TD\n  A --> B")
+			So(fixRules(fixes), ShouldResemble, []string{"diagram-type"})
+
+			out, _ = SanitizeDiagram("sequenceDiagarm\n  A->>B: hi")
+			So(out, ShouldEqual, "sequenceDiagram\n  A->>B: hi")
+			out, _ = SanitizeDiagram("flowhcart LR\n  A --> B")
+			So(out, ShouldEqual, "flowchart LR\n  A --> B")
+
+			Convey("but not a word too far from any type to tell", func() {
+				out, fixes := SanitizeDiagram("chart TD\n  A --> B")
+				So(out, ShouldEqual, "chart TD\n  A --> B")
+				So(fixes, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Fixes a backwards or misspelled direction", func() {
+			out, fixes := SanitizeDiagram("graph DT\n  A --> B")
+			So(out, ShouldEqual, "graph TD\n  A --> B")
+			So(fixRules(fixes), ShouldResemble, []string{"direction"})
+
+			out, _ = SanitizeDiagram("flowchart left-to-rihgt\n  A --> B")
+			So(out, ShouldEqual, "flowchart LR\n  A --> B")
+
+			Convey("but not two letters it can't tell apart", func() {
+				out, fixes := SanitizeDiagram("graph XY\n  A --> B")
+				So(out, ShouldEqual, "graph XY\n  A --> B")
+				So(fixes, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Quotes labels with quotes or brackets", func() {
+			out, fixes := SanitizeDiagram("graph TD\n  A[Start (here)] --> B[He said \"hi\"]\n  B --> C[List [1]]\n  C --> D(f(x))\n  D --> E[\"a \"b\" c\"]")
+			So(out, ShouldEqual, "graph TD\n"+
+				"  A[\"Start (here)\"] --> B[\"He said #quot;hi#quot;\"]\n"+
+				"  B --> C[\"List [1]\"]\n"+
+				"  C --> D(\"f(x)\")\n"+
+				"  D --> E[\"a #quot;b#quot; c\"]")
+			So(fixRules(fixes), ShouldResemble, []string{"label", "label", "label", "label", "label"})
+			So(ParseDiagram(out).Errors, ShouldBeEmpty)
+		})
+
+		Convey("Quotes a label whose brackets don't end it, up to the bracket that does", func() {
+			out, fixes := SanitizeDiagram("graph TD\n  A[a [b] c] --> B\n  B(f(x) + g(y)) --> C{x [1] [2] y}")
+			So(out, ShouldEqual, "graph TD\n"+
+				"  A[\"a [b] c\"] --> B\n"+
+				"  B(\"f(x) + g(y)\") --> C{\"x [1] [2] y\"}")
+			So(fixRules(fixes), ShouldResemble, []string{"label", "label", "label"})
+			So(ParseDiagram(out).Errors, ShouldBeEmpty)
+		})
+
+		Convey("Renames end, keeping it as the label", func() {
+			out, fixes := SanitizeDiagram("graph TD\n  A --> end\n  end --> B\n  End[Other]")
+			So(out, ShouldEqual, "graph TD\n  A --> End2[end]\n  End2 --> B\n  End[Other]")
+			So(fixRules(fixes), ShouldResemble, []string{"reserved-id"})
+			So(fixes[0].Line, ShouldEqual, 2)
+
+			out, _ = SanitizeDiagram("sequenceDiagram\n  participant end\n  A->>end: hi")
+			So(out, ShouldEqual, "sequenceDiagram\n  participant End as end\n  A->>End: hi")
+		})
+
+		Convey("Fixes one mistake after another", func() {
+			out, fixes := SanitizeDiagram("```\ngraph top-down\n  A[“quoted”] --> end\n```")
+			So(out, ShouldEqual, "graph TD\n  A[\"quoted\"] --> End[end]")
+			So(fixRules(fixes), ShouldResemble, []string{"code-fence", "smart-quotes", "direction", "reserved-id"})
+		})
+	})
+}
+
+func TestSanitizeWrite(t *testing.T) {
+	Convey("Given a diagram with a code fence", t, func() {
+		useTestStateDir(t)
+		src := "```mermaid\ngraph TD\n```"
+		yes, no := true, false
+
+		Convey("It is left alone by default", func() {
+			out, fixes := sanitizeWrite(src, nil)
+			So(out, ShouldEqual, src)
+			So(fixes, ShouldBeNil)
+		})
+
+		Convey("It is sanitized when asked", func() {
+			out, _ := sanitizeWrite(src, &yes)
+			So(out, ShouldEqual, "graph TD")
+		})
+
+		Convey("The preference turns sanitizing on, and the parameter off again", func() {
+			os.WriteFile(filepath.Join(stateDirOverride, "preferences.json"), []byte(`{"sanitize": true}`), 0644)
+			out, _ := sanitizeWrite(src, nil)
+			So(out, ShouldEqual, "graph TD")
+			out, _ = sanitizeWrite(src, &no)
+			So(out, ShouldEqual, src)
+		})
+	})
+}
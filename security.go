@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tokenHeader carries the per-instance secret for non-browser clients. The
+// embedded UI gets the same secret as a cookie when it loads the page.
+const (
+	tokenHeader = "X-Mermaid-Token"
+	tokenCookie = "mermaid_token"
+)
+
+// apiToken is the secret every API request must present. It is regenerated
+// each time an instance starts and written to the state directory.
+var apiToken string
+
+// apiHosts is the set of Host header values the API answers to. Anything else
+// is a DNS rebinding attempt or a misdirected request.
+var apiHosts = map[string]bool{}
+
+func tokenFile() string { return filepath.Join(stateDir(), "token") }
+
+// newToken generates a fresh instance secret.
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeToken stores the instance secret where only the current user can read
+// it. Clients that can read the state directory can talk to the API.
+func writeToken(token string) {
+	os.MkdirAll(stateDir(), 0755)
+	os.WriteFile(tokenFile(), []byte(token), 0600)
+}
+
+// readToken returns the secret of the instance whose state lives in dir.
+func readToken(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "token"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// setAllowedHosts records the names the API may be addressed by: the
+// loopback names, plus the --addr host when it is a specific address.
+func setAllowedHosts(port int) {
+	p := strconv.Itoa(port)
+	apiHosts = map[string]bool{
+		net.JoinHostPort("127.0.0.1", p): true,
+		net.JoinHostPort("localhost", p): true,
+		net.JoinHostPort("::1", p):       true,
+	}
+	if ip := net.ParseIP(cfg.Addr); cfg.Addr != "" && (ip == nil || !ip.IsUnspecified()) {
+		apiHosts[net.JoinHostPort(cfg.Addr, p)] = true
+	}
+}
+
+type socketConnKey struct{}
+
+// markSocketConn tags requests arriving over the Unix socket. Those are
+// already restricted to the current user by file permissions, and their Host
+// header is meaningless.
+func markSocketConn(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.(*net.UnixConn); ok {
+		return context.WithValue(ctx, socketConnKey{}, true)
+	}
+	return ctx
+}
+
+func viaSocket(r *http.Request) bool {
+	v, _ := r.Context().Value(socketConnKey{}).(bool)
+	return v
+}
+
+// guardAPI rejects requests addressed to a Host other than the editor's own
+// (DNS rebinding), state-changing requests whose Origin isn't the editor's,
+// and API requests that don't carry the instance token. Requests for the UI
+// that say they are browser navigations are given the token as a cookie.
+func guardAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("request", "method", r.Method, "path", r.URL.Path, "socket", viaSocket(r))
+		if !viaSocket(r) && !apiHosts[r.Host] {
+			http.Error(w, "invalid Host header", http.StatusForbidden)
+			return
+		}
+		if isStateChanging(r.Method) && !sameOrigin(r) {
+			http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		if needsToken(r.URL.Path) && !hasToken(r) {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		if (r.URL.Path == "/" || r.URL.Path == "/index.html") && browserNavigation(r) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    apiToken,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isStateChanging(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// sameOrigin reports whether a request came from the editor's own page, or
+// from a client that isn't a browser at all (no Origin header).
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return origin == "http://"+r.Host
+}
+
+// browserNavigation reports whether a request is a browser loading the page
+// in a tab, typed or opened by the editor, or followed from its own pages.
+func browserNavigation(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Mode") != "navigate" {
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "none", "same-origin":
+		return true
+	}
+	return false
+}
+
+func needsToken(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/mcp"
+}
+
+func hasToken(r *http.Request) bool {
+	got := r.Header.Get(tokenHeader)
+	if got == "" {
+		if c, err := r.Cookie(tokenCookie); err == nil {
+			got = c.Value
+		}
+	}
+	return apiToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(apiToken)) == 1
+}
+
+// tokenTransport adds the instance token to every request a Client sends.
+type tokenTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(tokenHeader, t.token)
+	}
+	return t.base.RoundTrip(req)
+}
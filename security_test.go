@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGuardAPI(t *testing.T) {
+	Convey("Given the API guard in front of a handler", t, func() {
+		apiToken = "secret"
+		setAllowedHosts(4567)
+		Reset(func() {
+			apiToken = ""
+			apiHosts = map[string]bool{}
+		})
+
+		handler := guardAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		serve := func(req *http.Request) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+		apiRequest := func(method, path string) *http.Request {
+			req := httptest.NewRequest(method, path, nil)
+			req.Host = "127.0.0.1:4567"
+			req.Header.Set(tokenHeader, "secret")
+			return req
+		}
+
+		Convey("A request with the loopback host and token is allowed", func() {
+			So(serve(apiRequest("PUT", "/api/diagram")).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("localhost is accepted as well as 127.0.0.1", func() {
+			req := apiRequest("GET", "/api/diagram")
+			req.Host = "localhost:4567"
+			So(serve(req).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("A rebinding hostname is rejected", func() {
+			req := apiRequest("GET", "/api/diagram")
+			req.Host = "evil.example.com:4567"
+			So(serve(req).Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("The right hostname on the wrong port is rejected", func() {
+			req := apiRequest("GET", "/api/diagram")
+			req.Host = "127.0.0.1:80"
+			So(serve(req).Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("A cross-origin POST is rejected even with a token", func() {
+			req := apiRequest("POST", "/api/quit")
+			req.Header.Set("Origin", "https://evil.example.com")
+			So(serve(req).Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("A cross-site fetch is rejected by Sec-Fetch-Site", func() {
+			req := apiRequest("PUT", "/api/preferences")
+			req.Header.Set("Sec-Fetch-Site", "cross-site")
+			So(serve(req).Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("A same-origin POST from the editor page is allowed", func() {
+			req := apiRequest("POST", "/api/download")
+			req.Header.Set("Origin", "http://127.0.0.1:4567")
+			req.Header.Set("Sec-Fetch-Site", "same-origin")
+			So(serve(req).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("An API request without the token is rejected", func() {
+			req := apiRequest("GET", "/api/diagram")
+			req.Header.Del(tokenHeader)
+			So(serve(req).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("The token cookie is accepted in place of the header", func() {
+			req := apiRequest("GET", "/api/events")
+			req.Header.Del(tokenHeader)
+			req.AddCookie(&http.Cookie{Name: tokenCookie, Value: "secret"})
+			So(serve(req).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("Opening the UI in a browser needs no token and sets the token cookie", func() {
+			req := apiRequest("GET", "/")
+			req.Header.Del(tokenHeader)
+			req.Header.Set("Sec-Fetch-Mode", "navigate")
+			req.Header.Set("Sec-Fetch-Site", "none")
+			w := serve(req)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+
+			cookies := w.Result().Cookies()
+			So(cookies, ShouldHaveLength, 1)
+			So(cookies[0].Value, ShouldEqual, "secret")
+			So(cookies[0].HttpOnly, ShouldBeTrue)
+			So(cookies[0].SameSite, ShouldEqual, http.SameSiteStrictMode)
+		})
+
+		Convey("A bare GET of the UI gets no token", func() {
+			req := apiRequest("GET", "/")
+			req.Header.Del(tokenHeader)
+			w := serve(req)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Result().Cookies(), ShouldBeEmpty)
+		})
+
+		Convey("A navigation from another site gets no token", func() {
+			req := apiRequest("GET", "/")
+			req.Header.Del(tokenHeader)
+			req.Header.Set("Sec-Fetch-Mode", "navigate")
+			req.Header.Set("Sec-Fetch-Site", "cross-site")
+			So(serve(req).Result().Cookies(), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestTokenFile(t *testing.T) {
+	Convey("Given a test state directory", t, func() {
+		tmp := useTestStateDir(t)
+
+		Convey("writeState writes a fresh private token", func() {
+			writeState(1234)
+			So(readToken(tmp), ShouldEqual, apiToken)
+			So(apiToken, ShouldHaveLength, 64)
+
+			info, err := os.Stat(tokenFile())
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("clearState removes the token", func() {
+			writeState(1234)
+			clearState()
+			_, err := os.Stat(tokenFile())
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
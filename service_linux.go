@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// serviceName names the systemd user units installed by `service install`.
+const serviceName = "mermaid-editor"
+
+// defaultServicePort is the fixed port of the service when --port is unset.
+// Socket activation needs a port known before the editor ever runs.
+const defaultServicePort = 4700
+
+func unitDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "systemd", "user"), nil
+}
+
+// runService implements `mermaid-editor service install|uninstall|status`.
+func runService(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: mermaid-editor service install|uninstall|status")
+		os.Exit(2)
+	}
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService()
+	case "uninstall":
+		err = uninstallService()
+	case "status":
+		err = serviceStatus()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown service command %q\n", args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mermaid-editor service %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+// systemdEscape quotes s for use as a single word in a unit file.
+func systemdEscape(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// serviceUnits returns the contents of the socket and service units that run
+// exe on port, with state in stateDir.
+func serviceUnits(exe string, port int, stateDir string) (socket, service string) {
+	socket = fmt.Sprintf(`[Unit]
+Description=MermAId Editor (socket)
+
+[Socket]
+ListenStream=127.0.0.1:%d
+ListenStream=%s
+SocketMode=0600
+Service=%s.service
+
+[Install]
+WantedBy=sockets.target
+`, port, systemdEscape(filepath.Join(stateDir, "sock")), serviceName)
+
+	args := []string{systemdEscape(exe), "--no-browser", "--port", strconv.Itoa(port), "--state-dir", systemdEscape(stateDir)}
+	service = fmt.Sprintf(`[Unit]
+Description=MermAId Editor
+Requires=%s.socket
+After=%s.socket
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`, serviceName, serviceName, strings.Join(args, " "))
+	return socket, service
+}
+
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", append([]string{"--user"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	dir, err := unitDir()
+	if err != nil {
+		return err
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = defaultServicePort
+	}
+	if url := checkExisting(); url != "" && serviceURL(stateDir()) == "" {
+		return fmt.Errorf("an editor is already running at %s; stop it first", url)
+	}
+
+	socket, service := serviceUnits(exe, port, stateDir())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, serviceName+".socket"), []byte(socket), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, serviceName+".service"), []byte(service), 0644); err != nil {
+		return err
+	}
+
+	// Clients discover the service through these before it has ever run.
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return err
+	}
+	if readToken(stateDir()) == "" {
+		writeToken(newToken())
+	}
+	if err := os.WriteFile(serviceFile(), []byte(strconv.Itoa(port)), 0644); err != nil {
+		return err
+	}
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", "--now", serviceName+".socket"); err != nil {
+		return err
+	}
+	fmt.Printf("Installed %s.socket; the editor starts on first use at http://127.0.0.1:%d\n", serviceName, port)
+	return nil
+}
+
+func uninstallService() error {
+	dir, err := unitDir()
+	if err != nil {
+		return err
+	}
+	// Units that are already gone are fine; keep going and clean up files.
+	systemctl("disable", "--now", serviceName+".socket", serviceName+".service")
+	os.Remove(filepath.Join(dir, serviceName+".socket"))
+	os.Remove(filepath.Join(dir, serviceName+".service"))
+	os.Remove(serviceFile())
+	os.Remove(socketFile())
+	os.Remove(tokenFile())
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	fmt.Printf("Uninstalled %s service\n", serviceName)
+	return nil
+}
+
+func serviceStatus() error {
+	dir, err := unitDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, serviceName+".socket")); err != nil {
+		fmt.Println("Service not installed.")
+		return nil
+	}
+	for _, unit := range []string{serviceName + ".socket", serviceName + ".service"} {
+		out, _ := exec.Command("systemctl", "--user", "is-active", unit).Output()
+		fmt.Printf("%-24s %s\n", unit, strings.TrimSpace(string(out)))
+	}
+	if url := serviceURL(stateDir()); url != "" {
+		fmt.Printf("URL: %s\n", url)
+	}
+	return nil
+}
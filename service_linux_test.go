@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServiceUnits(t *testing.T) {
+	Convey("Given serviceUnits()", t, func() {
+		socket, service := serviceUnits("/usr/local/bin/mermaid-editor", 4700, "/home/me/.cache/mermaid-editor")
+
+		Convey("The socket unit listens on the fixed port and a private Unix socket", func() {
+			So(socket, ShouldContainSubstring, "ListenStream=127.0.0.1:4700\n")
+			So(socket, ShouldContainSubstring, "ListenStream=/home/me/.cache/mermaid-editor/sock\n")
+			So(socket, ShouldContainSubstring, "SocketMode=0600\n")
+		})
+
+		Convey("The service runs headless on the same port and state directory", func() {
+			So(service, ShouldContainSubstring,
+				"ExecStart=/usr/local/bin/mermaid-editor --no-browser --port 4700 --state-dir /home/me/.cache/mermaid-editor\n")
+			So(service, ShouldContainSubstring, "Requires=mermaid-editor.socket\n")
+		})
+
+		Convey("Paths with spaces or percent signs are escaped", func() {
+			_, service := serviceUnits("/opt/My Apps/mermaid-editor", 4700, "/tmp/100%")
+			So(service, ShouldContainSubstring, `ExecStart="/opt/My Apps/mermaid-editor"`)
+			So(service, ShouldContainSubstring, "--state-dir /tmp/100%%")
+		})
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runService reports that service mode is Linux-only; it relies on systemd
+// user units.
+func runService(args []string) {
+	fmt.Fprintln(os.Stderr, "mermaid-editor service is only supported on Linux (systemd)")
+	os.Exit(1)
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// listenSocket listens on a Unix socket at path that only the current user
+// can connect to. Any leftover socket file is replaced; callers must have
+// already checked that no live instance owns it.
+func listenSocket(path string) (net.Listener, error) {
+	os.Remove(path)
+
+	// Create the socket in a directory only the current user can enter and
+	// move it into place once it is private, so there is no window in which
+	// another user could connect to it.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".s")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
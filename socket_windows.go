@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// listenSocket is a no-op on Windows; the API is served over TCP only.
+func listenSocket(path string) (net.Listener, error) {
+	return nil, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// saveDelay coalesces bursts of edits into a single write.
+const saveDelay = 500 * time.Millisecond
+
+// documentStore persists the diagram of an instance to its state directory so
+// the editor reopens with the last document of that workspace.
+type documentStore struct {
+	path  string
+	state *DiagramState
+
+	mu    sync.Mutex
+	saved int64
+	timer *time.Timer
+}
+
+func newDocumentStore(path string, state *DiagramState) *documentStore {
+	_, v := state.Get()
+	return &documentStore{path: path, state: state, saved: v}
+}
+
+// loadDocument returns the persisted diagram at path, or "" if there is none.
+func loadDocument(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Watch saves the diagram after every change. It runs for the life of the
+// process.
+func (s *documentStore) Watch() {
+	ch := s.state.Subscribe()
+	defer s.state.Unsubscribe(ch)
+	for range ch {
+		s.schedule()
+	}
+}
+
+func (s *documentStore) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer == nil {
+		s.timer = time.AfterFunc(saveDelay, func() { s.Flush() })
+	}
+}
+
+// Flush writes the current diagram if it changed since the last save.
+func (s *documentStore) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	content, v := s.state.Get()
+	if v == s.saved {
+		return
+	}
+	if err := writeFileAtomic(s.path, []byte(content)); err != nil {
+		log.Printf("Failed to save diagram: %v", err)
+		return
+	}
+	s.saved = v
+}
+
+// writeFileAtomic replaces path via a temp file so a crash never leaves a
+// half-written document behind.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDocumentStore(t *testing.T) {
+	Convey("Given a document store", t, func() {
+		path := filepath.Join(t.TempDir(), "state", "diagram.mmd")
+		ds := NewDiagramState("graph TD")
+		s := newDocumentStore(path, ds)
+
+		Convey("Flush does nothing until the diagram changes", func() {
+			s.Flush()
+			_, err := os.Stat(path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Flush writes the current diagram", func() {
+			ds.Set("graph LR; A-->B", "api")
+			s.Flush()
+			So(loadDocument(path), ShouldEqual, "graph LR; A-->B")
+		})
+
+		Convey("Watch saves changes after a short delay", func() {
+			go s.Watch()
+			time.Sleep(20 * time.Millisecond) // let Watch subscribe
+			ds.Set("saved by watch", "mcp")
+
+			deadline := time.Now().Add(2 * time.Second)
+			for loadDocument(path) != "saved by watch" && time.Now().Before(deadline) {
+				time.Sleep(20 * time.Millisecond)
+			}
+			So(loadDocument(path), ShouldEqual, "saved by watch")
+		})
+
+		Convey("loadDocument returns empty when nothing was saved", func() {
+			So(loadDocument(path), ShouldEqual, "")
+		})
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// workspaceDir is the directory this instance is scoped to, or nil for the
+// global instance shared by every project on the machine. With
+// --workspace=roots it is only set once the MCP client names its roots,
+// from another goroutine than the ones reading it; use workspaceRoot and
+// setWorkspaceRoot.
+var workspaceDir atomic.Pointer[string]
+
+// workspaceRoot returns the directory this instance is scoped to, or "".
+func workspaceRoot() string {
+	if dir := workspaceDir.Load(); dir != nil {
+		return *dir
+	}
+	return ""
+}
+
+// setWorkspaceRoot scopes this instance to dir.
+func setWorkspaceRoot(dir string) {
+	workspaceDir.Store(&dir)
+}
+
+// Special values accepted by --workspace in addition to a directory path.
+const (
+	workspaceGit   = "git"   // the git root of the current directory
+	workspaceRoots = "roots" // the first root advertised by the MCP client
+)
+
+// baseStateDir returns the directory holding the global instance's state and
+// the per-workspace state directories.
+func baseStateDir() string {
+	if stateDirOverride != "" {
+		return stateDirOverride
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "mermaid-editor")
+}
+
+func workspacesDir() string { return filepath.Join(baseStateDir(), "workspaces") }
+
+// workspaceStateDir returns the state directory for the given workspace root.
+func workspaceStateDir(root string) string {
+	if root == "" {
+		return baseStateDir()
+	}
+	return filepath.Join(workspacesDir(), workspaceKey(root))
+}
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// workspaceKey derives a stable directory name for a workspace root. The
+// readable prefix is for humans browsing the cache dir; the hash keeps two
+// repos with the same name apart.
+func workspaceKey(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	name := unsafeKeyChars.ReplaceAllString(filepath.Base(root), "_")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name + "-" + hex.EncodeToString(sum[:6])
+}
+
+// resolveWorkspace turns a --workspace value into an absolute workspace root.
+// An empty value selects the global instance.
+func resolveWorkspace(arg string) (string, error) {
+	switch arg {
+	case "":
+		return "", nil
+	case workspaceGit:
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		root := gitRoot(cwd)
+		if root == "" {
+			return "", fmt.Errorf("%s is not inside a git repository", cwd)
+		}
+		return root, nil
+	}
+	return canonicalDir(arg)
+}
+
+// canonicalDir returns the absolute, symlink-free form of dir so the same
+// workspace always maps to the same state directory.
+func canonicalDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// gitRoot walks up from dir looking for a .git entry (a directory, or a file
+// for worktrees and submodules) and returns the containing directory, or "".
+func gitRoot(dir string) string {
+	dir, err := canonicalDir(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// rootsWorkspace picks a workspace root from the file:// roots advertised by
+// an MCP client. Roots inside a git repository are widened to the repo root.
+func rootsWorkspace(uris []string) string {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "file" {
+			continue
+		}
+		dir, err := canonicalDir(u.Path)
+		if err != nil {
+			continue
+		}
+		if root := gitRoot(dir); root != "" {
+			return root
+		}
+		return dir
+	}
+	return ""
+}
+
+// instance describes a running editor found via its state directory.
+type instance struct {
+	Workspace string
+	URL       string
+}
+
+// listInstances returns every running editor: the global instance first,
+// followed by workspace-scoped instances.
+func listInstances() []instance {
+	var found []instance
+	if url := checkExistingIn(baseStateDir()); url != "" {
+		found = append(found, instance{URL: url})
+	}
+	entries, _ := os.ReadDir(workspacesDir())
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(workspacesDir(), e.Name())
+		url := checkExistingIn(dir)
+		if url == "" {
+			continue
+		}
+		ws, _ := os.ReadFile(filepath.Join(dir, "workspace"))
+		found = append(found, instance{Workspace: strings.TrimSpace(string(ws)), URL: url})
+	}
+	return found
+}
+
+// runList prints the running instances for `mermaid-editor list`.
+func runList() {
+	instances := listInstances()
+	if len(instances) == 0 {
+		fmt.Println("No running instances.")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tWORKSPACE")
+	for _, inst := range instances {
+		ws := inst.Workspace
+		if ws == "" {
+			ws = "(global)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", inst.URL, ws)
+	}
+	tw.Flush()
+}
+
+// runURL prints the URL of the instance the current scope would use, for
+// `mermaid-editor url`. It resolves --workspace, --state-dir and an installed
+// service the way the editor does, so scripts such as mermaid-cli find the
+// same instance. With -json it also prints the state directory, where the
+// token and socket are. A scope with no instance exits with status 1.
+func runURL(args []string) {
+	fs := flag.NewFlagSet("url", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, `print {"url", "state_dir"}`)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mermaid-editor [--workspace=DIR] url [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// A script has no MCP roots; use the fallback an agent without them gets.
+	if cfg.Workspace == workspaceRoots {
+		if cwd, err := os.Getwd(); err == nil {
+			setWorkspaceRoot(gitRoot(cwd))
+		}
+	} else {
+		setupWorkspace()
+	}
+	url := checkExisting()
+	if url == "" {
+		fmt.Fprintln(os.Stderr, "mermaid-editor is not running")
+		os.Exit(1)
+	}
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"url": url, "state_dir": stateDir()})
+		return
+	}
+	fmt.Println(url)
+}
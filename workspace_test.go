@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// useTestWorkspace scopes the instance to root until the enclosing Convey
+// scope finishes.
+func useTestWorkspace(root string) {
+	setWorkspaceRoot(root)
+	Reset(func() { setWorkspaceRoot("") })
+}
+
+func TestWorkspaceKey(t *testing.T) {
+	Convey("Given workspaceKey()", t, func() {
+		Convey("It is stable for the same root", func() {
+			So(workspaceKey("/src/project"), ShouldEqual, workspaceKey("/src/project"))
+		})
+
+		Convey("Repos with the same name get different keys", func() {
+			So(workspaceKey("/a/project"), ShouldNotEqual, workspaceKey("/b/project"))
+		})
+
+		Convey("It starts with a readable, filesystem-safe name", func() {
+			So(workspaceKey("/src/my project"), ShouldStartWith, "my_project-")
+		})
+	})
+}
+
+func TestResolveWorkspace(t *testing.T) {
+	Convey("Given resolveWorkspace()", t, func() {
+		Convey("An empty value selects the global instance", func() {
+			root, err := resolveWorkspace("")
+			So(err, ShouldBeNil)
+			So(root, ShouldEqual, "")
+		})
+
+		Convey("A directory resolves to its absolute path", func() {
+			tmp, _ := filepath.EvalSymlinks(t.TempDir())
+			root, err := resolveWorkspace(tmp)
+			So(err, ShouldBeNil)
+			So(root, ShouldEqual, tmp)
+		})
+
+		Convey("A missing directory is an error", func() {
+			_, err := resolveWorkspace(filepath.Join(t.TempDir(), "missing"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given gitRoot()", t, func() {
+		tmp, _ := filepath.EvalSymlinks(t.TempDir())
+		os.MkdirAll(filepath.Join(tmp, ".git"), 0755)
+		nested := filepath.Join(tmp, "docs", "diagrams")
+		os.MkdirAll(nested, 0755)
+
+		Convey("It finds the repository root from a nested directory", func() {
+			So(gitRoot(nested), ShouldEqual, tmp)
+		})
+
+		Convey("rootsWorkspace widens a file:// root to the repository root", func() {
+			So(rootsWorkspace([]string{"https://example.com", "file://" + nested}), ShouldEqual, tmp)
+		})
+	})
+}
+
+func TestWorkspaceState(t *testing.T) {
+	Convey("Given a test state directory", t, func() {
+		tmp := useTestStateDir(t)
+
+		Convey("The global instance keeps its state at the top level", func() {
+			So(stateDir(), ShouldEqual, tmp)
+		})
+
+		Convey("A workspace instance gets its own state directory", func() {
+			useTestWorkspace("/src/project")
+			So(stateDir(), ShouldEqual, filepath.Join(tmp, "workspaces", workspaceKey("/src/project")))
+		})
+
+		Convey("writeState records the workspace root", func() {
+			useTestWorkspace("/src/project")
+			writeState(1234)
+
+			data, err := os.ReadFile(workspaceFile())
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "/src/project")
+		})
+
+		Convey("listInstances reports running global and workspace instances", func() {
+			writeState(1111)
+			useTestWorkspace("/src/project")
+			writeState(2222)
+
+			stale := workspaceStateDir("/src/stale")
+			os.MkdirAll(stale, 0755)
+			os.WriteFile(filepath.Join(stale, "pid"), []byte("99999999"), 0644)
+			os.WriteFile(filepath.Join(stale, "port"), []byte("3333"), 0644)
+
+			instances := listInstances()
+			So(instances, ShouldHaveLength, 2)
+			So(instances[0], ShouldResemble, instance{URL: "http://127.0.0.1:1111"})
+			So(instances[1], ShouldResemble, instance{Workspace: "/src/project", URL: "http://127.0.0.1:2222"})
+		})
+	})
+}